@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type AdminConfig struct {
+	// The admin UI is only served when both are set (HTTP basic auth).
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+func (c AdminConfig) enabled() bool {
+	return c.Username != "" && c.Password != ""
+}
+
+func withBasicAuth(h http.Handler, cfg AdminConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(cfg.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(cfg.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="telemetry admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+type ruleView struct {
+	Index    int
+	Rule     DeviceTypeRule
+	Prefixes string
+	Keywords string
+	Matches  []Device
+}
+
+type rulesPage struct {
+	Version string
+	Rules   []ruleView
+	Error   string
+	Saved   bool
+}
+
+const rulesHTML = `<!DOCTYPE html>
+<html><head><title>classification rules</title></head><body>
+<h1>Classification rules</h1>
+{{- if .Error}}<p style="color:#c00">{{.Error}}</p>{{end}}
+{{- if .Saved}}<p style="color:#080">Saved; applied from the next scan.</p>{{end}}
+<table border="1" cellpadding="4">
+<tr><th>#</th><th>Rule</th><th>Matching devices</th></tr>
+{{- range .Rules}}
+<tr><td>{{.Index}}</td><td>
+<form method="post">
+<input type="hidden" name="version" value="{{$.Version}}">
+<input type="hidden" name="index" value="{{.Index}}">
+type <input name="type" value="{{.Rule.Type}}"><br>
+MAC prefixes <input name="mac_prefixes" size="40" value="{{.Prefixes}}"><br>
+hostname keywords <input name="hostname_keywords" size="40" value="{{.Keywords}}"><br>
+<label><input type="checkbox" name="infrastructure" value="true"{{if .Rule.Infrastructure}} checked{{end}}> infrastructure</label>
+<button>Save</button>
+</form></td><td>
+{{- range .Matches}}{{.IP}} {{.MAC}} {{.Hostname}}<br>{{else}}none{{end}}
+</td></tr>
+{{- end}}
+<tr><td>new</td><td>
+<form method="post">
+<input type="hidden" name="version" value="{{.Version}}">
+<input type="hidden" name="index" value="-1">
+type <input name="type"><br>
+MAC prefixes <input name="mac_prefixes" size="40" placeholder="aa:bb:cc, dd:ee:ff"><br>
+hostname keywords <input name="hostname_keywords" size="40" placeholder="printer, hp"><br>
+<label><input type="checkbox" name="infrastructure" value="true"> infrastructure</label>
+<button>Add</button>
+</form></td><td></td></tr>
+</table>
+</body></html>
+`
+
+var rulesTmpl = htmltemplate.Must(htmltemplate.New("rules").Parse(rulesHTML))
+
+// adminMu serializes rule edits within this process; the version check
+// covers edits based on a stale page.
+var adminMu sync.Mutex
+
+func renderRules(w http.ResponseWriter, status int, page rulesPage) {
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page.Version = configHash(cfgPath)
+	for i, rule := range cfg.DeviceTypes {
+		page.Rules = append(page.Rules, ruleView{
+			Index:    i,
+			Rule:     rule,
+			Prefixes: strings.Join(rule.MACPrefixes, ", "),
+			Keywords: strings.Join(rule.HostnameKeywords, ", "),
+		})
+	}
+	// The rules edited here are the top-level ones; the devices of every
+	// scanner are matched against them.
+	for _, s := range scanners {
+		scan := s.currentScan()
+		if scan == nil {
+			continue
+		}
+		for _, d := range scan.Devices {
+			if i, _ := matchRule(cfg, d.MAC, d.Hostname, d.DHCP); i >= 0 {
+				page.Rules[i].Matches = append(page.Rules[i].Matches, d)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := rulesTmpl.Execute(w, page); err != nil {
+		errorLog.Printf("Error rendering rules page: %v", err)
+	}
+}
+
+var macPrefixPattern = regexp.MustCompile(`^[0-9a-f]{2}(:[0-9a-f]{2}){0,5}$`)
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func ruleFromForm(form url.Values) (DeviceTypeRule, error) {
+	rule := DeviceTypeRule{
+		Type:             strings.TrimSpace(form.Get("type")),
+		MACPrefixes:      splitList(form.Get("mac_prefixes")),
+		HostnameKeywords: splitList(form.Get("hostname_keywords")),
+		Infrastructure:   form.Get("infrastructure") == "true",
+	}
+	if rule.Type == "" {
+		return rule, fmt.Errorf("type is required")
+	}
+	if len(rule.MACPrefixes) == 0 && len(rule.HostnameKeywords) == 0 {
+		return rule, fmt.Errorf("a rule needs at least one MAC prefix or hostname keyword")
+	}
+	for _, p := range rule.MACPrefixes {
+		if !macPrefixPattern.MatchString(p) {
+			return rule, fmt.Errorf("invalid MAC prefix %q", p)
+		}
+	}
+	return rule, nil
+}
+
+func flowList(items []string) *yaml.Node {
+	n := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Style: yaml.FlowStyle}
+	for _, item := range items {
+		n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: item, Style: yaml.DoubleQuotedStyle})
+	}
+	return n
+}
+
+// setKey replaces the value of key in a mapping node, appending the pair
+// if it is missing. Comments on the key are kept.
+func setKey(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+	mapping.Content = append(mapping.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
+
+// applyRule edits device_types in the YAML document; index -1 appends.
+// Only the lines of the edited rule are rewritten, so comments, blank
+// lines and every other setting survive.
+func applyRule(data []byte, index int, rule DeviceTypeRule) ([]byte, error) {
+	// The rules shown are the merged ones, which need not be those of any
+	// one document.
+	if _, docs, err := mergeConfigDocuments(data); err == nil && docs > 1 {
+		return nil, fmt.Errorf("%s has %d YAML documents; edit its device_types by hand", cfgPath, docs)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s is not a YAML mapping", cfgPath)
+	}
+	root := doc.Content[0]
+	var rules *yaml.Node
+	end := -1 // first line after device_types, 0-based
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if rules != nil && end < 0 {
+			end = root.Content[i].Line - 1
+		}
+		if root.Content[i].Value == "device_types" {
+			rules = root.Content[i+1]
+		}
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if end < 0 {
+		end = len(lines)
+	}
+	if rules == nil || rules.Kind != yaml.SequenceNode || rules.Style&yaml.FlowStyle != 0 || len(rules.Content) == 0 {
+		return nil, fmt.Errorf("device_types must be a non-empty block sequence to edit rules here")
+	}
+
+	var mapping *yaml.Node
+	switch {
+	case index == -1:
+		mapping = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	case index >= 0 && index < len(rules.Content) && rules.Content[index].Kind == yaml.MappingNode:
+		mapping = rules.Content[index]
+	default:
+		return nil, fmt.Errorf("rule %d does not exist", index)
+	}
+	setKey(mapping, "type", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: rule.Type, Style: yaml.DoubleQuotedStyle})
+	setKey(mapping, "mac_prefixes", flowList(rule.MACPrefixes))
+	setKey(mapping, "hostname_keywords", flowList(rule.HostnameKeywords))
+	if rule.Infrastructure || hasKey(mapping, "infrastructure") {
+		setKey(mapping, "infrastructure", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(rule.Infrastructure)})
+	}
+	// The head comment sits above the rule's first line and is kept as is.
+	mapping.HeadComment = ""
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: []*yaml.Node{mapping}}); err != nil {
+		return nil, err
+	}
+	enc.Close()
+	indent := strings.Repeat(" ", rules.Content[0].Column-3)
+	var text []string
+	for _, line := range strings.SplitAfter(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		text = append(text, indent+strings.TrimSuffix(line, "\n")+"\n")
+	}
+
+	// A rule spans from its first line to the next rule, minus trailing
+	// blank lines and comments that belong to what follows.
+	span := func(i int) (int, int) {
+		start, stop := rules.Content[i].Line-1, end
+		if i+1 < len(rules.Content) {
+			stop = rules.Content[i+1].Line - 1
+		}
+		for stop > start {
+			trimmed := strings.TrimSpace(lines[stop-1])
+			lead := len(lines[stop-1]) - len(strings.TrimLeft(lines[stop-1], " "))
+			if trimmed != "" && !(strings.HasPrefix(trimmed, "#") && lead <= len(indent)) {
+				break
+			}
+			stop--
+		}
+		return start, stop
+	}
+	var out []string
+	if index == -1 {
+		_, stop := span(len(rules.Content) - 1)
+		out = append(out, lines[:stop]...)
+		out = append(out, "\n")
+		out = append(out, text...)
+		out = append(out, lines[stop:]...)
+	} else {
+		start, stop := span(index)
+		out = append(out, lines[:start]...)
+		out = append(out, text...)
+		out = append(out, lines[stop:]...)
+	}
+	return []byte(strings.Join(out, "")), nil
+}
+
+func hasKey(mapping *yaml.Node, key string) bool {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return true
+		}
+	}
+	return false
+}
+
+// saveConfig writes a timestamped backup of the current file, then
+// replaces it atomically.
+func saveConfig(old, data []byte) error {
+	backup := fmt.Sprintf("%s.%s.bak", cfgPath, time.Now().Format("20060102-150405.000"))
+	if err := os.WriteFile(backup, old, 0o644); err != nil {
+		return fmt.Errorf("failed to write backup: %v", err)
+	}
+	tmp := cfgPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cfgPath)
+}
+
+// sameOrigin rejects browser requests sent from another site's page;
+// requests without an Origin header (curl, scripts) are allowed.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// rulesHandler serves /admin/rules: GET lists the rules with the devices
+// they match, POST adds or edits one rule.
+func rulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		renderRules(w, http.StatusOK, rulesPage{})
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request rejected", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		renderRules(w, http.StatusBadRequest, rulesPage{Error: err.Error()})
+		return
+	}
+	index, err := strconv.Atoi(r.PostForm.Get("index"))
+	if err != nil {
+		renderRules(w, http.StatusBadRequest, rulesPage{Error: "invalid rule index"})
+		return
+	}
+	rule, err := ruleFromForm(r.PostForm)
+	if err != nil {
+		renderRules(w, http.StatusBadRequest, rulesPage{Error: err.Error()})
+		return
+	}
+
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	old, err := os.ReadFile(cfgPath)
+	if err != nil {
+		renderRules(w, http.StatusInternalServerError, rulesPage{Error: err.Error()})
+		return
+	}
+	if r.PostForm.Get("version") != configHash(cfgPath) {
+		renderRules(w, http.StatusConflict, rulesPage{Error: "the config changed since this page was loaded; review the current rules and retry"})
+		return
+	}
+	data, err := applyRule(old, index, rule)
+	if err == nil {
+		var check Config
+		var merged []byte
+		if merged, _, err = mergeConfigDocuments(data); err == nil {
+			err = yaml.Unmarshal(merged, &check)
+		}
+		if err == nil {
+			// Refuse what would only fail on the next reload.
+			var problems []string
+			for _, verr := range validateConfig(check) {
+				problems = append(problems, verr.Error())
+			}
+			if len(problems) > 0 {
+				err = fmt.Errorf("the config would be invalid: %s", strings.Join(problems, "; "))
+			}
+		}
+	}
+	if err != nil {
+		renderRules(w, http.StatusBadRequest, rulesPage{Error: err.Error()})
+		return
+	}
+	if requestCancelled(r) {
+		// The client was told the request failed; do not save behind it.
+		return
+	}
+	if err := saveConfig(old, data); err != nil {
+		renderRules(w, http.StatusInternalServerError, rulesPage{Error: err.Error()})
+		return
+	}
+	emitEvent("config_rules_changed", map[string]interface{}{"index": index, "rule_type": rule.Type, "config_hash": configHash(cfgPath)})
+	renderRules(w, http.StatusOK, rulesPage{Saved: true})
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// agentReport is what an agent pushes to /api/v1/ingest.
+type agentReport struct {
+	Host string `json:"host"`
+	// Interval is the agent's push interval in seconds, used to tell when
+	// the host went stale.
+	Interval float64        `json:"interval_seconds"`
+	System   SystemSnapshot `json:"system"`
+}
+
+// runAgent implements "-agent -push-to URL": sample the local system
+// metrics and push them to a main instance, without scanning.
+func runAgent(args []string) int {
+	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+	fs.Bool("agent", true, "run as a push agent")
+	pushTo := fs.String("push-to", "", "ingest URL of the main exporter, e.g. http://main:2112/api/v1/ingest")
+	host := fs.String("host", "", "host label to report (default: the hostname)")
+	interval := fs.Duration("interval", 15*time.Second, "push interval")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *pushTo == "" {
+		fmt.Fprintln(os.Stderr, "agent: -push-to is required")
+		return 2
+	}
+	if *host == "" {
+		name, err := os.Hostname()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "agent: cannot determine hostname, pass -host:", err)
+			return 2
+		}
+		*host = strings.Split(name, ".")[0]
+	}
+	// The token comes from the environment so it does not show up in ps.
+	token := os.Getenv("TELEMETRY_INGEST_TOKEN")
+	if token == "" {
+		fmt.Fprintln(os.Stderr, "agent: TELEMETRY_INGEST_TOKEN is not set")
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	client := &http.Client{Timeout: 10 * time.Second}
+	log.Printf("Pushing system metrics for %s to %s every %s", *host, *pushTo, *interval)
+	for {
+		sys, _, _ := sampleSystem()
+		if err := pushReport(ctx, client, *pushTo, token, agentReport{Host: *host, Interval: interval.Seconds(), System: sys}); err != nil {
+			errorLog.Printf("Error pushing to %s: %v", *pushTo, err)
+		}
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-time.After(*interval):
+		}
+	}
+}
+
+func pushReport(ctx context.Context, client *http.Client, url, token string, report agentReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("ingest answered %s", resp.Status)
+	}
+	return nil
+}
+
+type IngestConfig struct {
+	// Token enables POST /api/v1/ingest; agents send it as a bearer token.
+	Token string `yaml:"token"`
+	// MaxHosts caps how many agents are tracked; pushes from further hosts
+	// are rejected (default 16).
+	MaxHosts int `yaml:"max_hosts"`
+	// StaleIntervals drops a host's series once it missed this many of its
+	// push intervals (default 3).
+	StaleIntervals int `yaml:"stale_intervals"`
+}
+
+func (c IngestConfig) withDefaults() IngestConfig {
+	if c.MaxHosts <= 0 {
+		c.MaxHosts = 16
+	}
+	if c.StaleIntervals <= 0 {
+		c.StaleIntervals = 3
+	}
+	return c
+}
+
+var agentHostPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,62}$`)
+
+type agentEntry struct {
+	report   agentReport
+	received time.Time
+}
+
+// agentStore holds the last report per host for agentCollector.
+type agentStore struct {
+	mu    sync.Mutex
+	cfg   IngestConfig
+	hosts map[string]agentEntry
+}
+
+func newAgentStore(cfg IngestConfig) *agentStore {
+	return &agentStore{cfg: cfg.withDefaults(), hosts: make(map[string]agentEntry)}
+}
+
+func (s *agentStore) staleAfter(e agentEntry) time.Duration {
+	interval := time.Duration(e.report.Interval * float64(time.Second))
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	return time.Duration(s.cfg.StaleIntervals) * interval
+}
+
+// prune drops stale hosts. Callers hold s.mu.
+func (s *agentStore) prune(now time.Time) {
+	for host, e := range s.hosts {
+		if now.Sub(e.received) > s.staleAfter(e) {
+			delete(s.hosts, host)
+		}
+	}
+}
+
+func (s *agentStore) put(report agentReport, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(now)
+	if _, ok := s.hosts[report.Host]; !ok && len(s.hosts) >= s.cfg.MaxHosts {
+		return fmt.Errorf("already tracking %d hosts (http.ingest.max_hosts)", s.cfg.MaxHosts)
+	}
+	s.hosts[report.Host] = agentEntry{report: report, received: now}
+	return nil
+}
+
+func (s *agentStore) current(now time.Time) []agentEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(now)
+	out := make([]agentEntry, 0, len(s.hosts))
+	for _, e := range s.hosts {
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].report.Host < out[j].report.Host })
+	return out
+}
+
+// ingestHandler serves POST /api/v1/ingest for agents.
+func ingestHandler(m *Metrics, store *agentStore, cfg IngestConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Token)) != 1 {
+			m.IngestRejected.WithLabelValues("unauthorized").Inc()
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var report agentReport
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&report); err != nil {
+			m.IngestRejected.WithLabelValues("invalid").Inc()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !agentHostPattern.MatchString(report.Host) {
+			m.IngestRejected.WithLabelValues("invalid").Inc()
+			http.Error(w, "invalid host name", http.StatusBadRequest)
+			return
+		}
+		if err := store.put(report, time.Now()); err != nil {
+			m.IngestRejected.WithLabelValues("too_many_hosts").Inc()
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// agentCollector re-exposes the pushed system metrics with a host label.
+type agentCollector struct {
+	store                                    *agentStore
+	cpu, memPercent, memTotal, memUsed, push *prometheus.Desc
+	cpuRatio, memRatio                       *prometheus.Desc
+}
+
+func newAgentCollector(namespace string, store *agentStore) *agentCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, []string{"host"}, nil)
+	}
+	return &agentCollector{
+		store:      store,
+		cpu:        desc("agent_cpu_usage_percent", "CPU usage reported by an agent in percent (0-100); deprecated, use agent_cpu_usage_ratio"),
+		cpuRatio:   desc("agent_cpu_usage_ratio", "CPU usage reported by an agent as a ratio (0-1)"),
+		memPercent: desc("agent_memory_usage_percent", "Memory usage reported by an agent in percent (0-100); deprecated, use agent_memory_usage_ratio"),
+		memRatio:   desc("agent_memory_usage_ratio", "Memory usage reported by an agent as a ratio (0-1)"),
+		memTotal:   desc("agent_memory_total_bytes", "Total memory reported by an agent in bytes"),
+		memUsed:    desc("agent_memory_used_bytes", "Used memory reported by an agent in bytes"),
+		push:       desc("agent_last_push_timestamp_seconds", "Time of the agent's last accepted push since unix epoch in seconds"),
+	}
+}
+
+func (c *agentCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.cpu
+	ch <- c.cpuRatio
+	ch <- c.memPercent
+	ch <- c.memRatio
+	ch <- c.memTotal
+	ch <- c.memUsed
+	ch <- c.push
+}
+
+func (c *agentCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, e := range c.store.current(time.Now()) {
+		host, sys := e.report.Host, e.report.System
+		ch <- prometheus.MustNewConstMetric(c.cpu, prometheus.GaugeValue, sys.CPUPercent, host)
+		ch <- prometheus.MustNewConstMetric(c.cpuRatio, prometheus.GaugeValue, percentToRatio(sys.CPUPercent), host)
+		ch <- prometheus.MustNewConstMetric(c.memPercent, prometheus.GaugeValue, sys.MemoryPercent, host)
+		ch <- prometheus.MustNewConstMetric(c.memRatio, prometheus.GaugeValue, percentToRatio(sys.MemoryPercent), host)
+		ch <- prometheus.MustNewConstMetric(c.memTotal, prometheus.GaugeValue, float64(sys.MemoryTotal), host)
+		ch <- prometheus.MustNewConstMetric(c.memUsed, prometheus.GaugeValue, float64(sys.MemoryUsed), host)
+		ch <- prometheus.MustNewConstMetric(c.push, prometheus.GaugeValue, float64(e.received.Unix()), host)
+	}
+}
+
+func init() {
+	registerFeature("agent_ingest", false)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+type AggregateConfig struct {
+	// MinSamples is how many probed devices a vendor or device type needs
+	// before its aggregates are exported (default 3).
+	MinSamples int `yaml:"min_samples"`
+}
+
+func (c AggregateConfig) minSamples() int {
+	if c.MinSamples <= 0 {
+		return 3
+	}
+	return c.MinSamples
+}
+
+// GroupAggregate summarizes the probe results of one vendor or device type
+// in a scan. RTT quantiles are only set with at least min_samples replies.
+type GroupAggregate struct {
+	Probed     int           `json:"probed"`
+	Lost       int           `json:"lost"`
+	LossRatio  float64       `json:"loss_ratio"`
+	RTTSamples int           `json:"rtt_samples"`
+	RTTMedian  time.Duration `json:"rtt_median,omitempty"`
+	RTTP95     time.Duration `json:"rtt_p95,omitempty"`
+}
+
+func (g GroupAggregate) hasRTT() bool {
+	return g.RTTMedian > 0
+}
+
+type Aggregates struct {
+	ByVendor map[string]GroupAggregate `json:"by_vendor"`
+	ByType   map[string]GroupAggregate `json:"by_type"`
+}
+
+// quantile uses the nearest-rank method on sorted samples.
+func quantile(sorted []time.Duration, q float64) time.Duration {
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	return sorted[max(rank, 0)]
+}
+
+func aggregateBy(cfg AggregateConfig, devices []Device, key func(Device) string) map[string]GroupAggregate {
+	type group struct {
+		probed, lost int
+		rtts         []time.Duration
+	}
+	groups := make(map[string]*group)
+	for _, d := range devices {
+		if !d.Probe.ICMPProbed {
+			continue
+		}
+		k := key(d)
+		g := groups[k]
+		if g == nil {
+			g = &group{}
+			groups[k] = g
+		}
+		g.probed++
+		if !d.Probe.ICMPReplied {
+			g.lost++
+		} else if d.Probe.RTT > 0 {
+			g.rtts = append(g.rtts, d.Probe.RTT)
+		}
+	}
+
+	out := make(map[string]GroupAggregate)
+	for k, g := range groups {
+		if g.probed < cfg.minSamples() {
+			continue
+		}
+		agg := GroupAggregate{
+			Probed:     g.probed,
+			Lost:       g.lost,
+			LossRatio:  float64(g.lost) / float64(g.probed),
+			RTTSamples: len(g.rtts),
+		}
+		if len(g.rtts) >= cfg.minSamples() {
+			sort.Slice(g.rtts, func(i, j int) bool { return g.rtts[i] < g.rtts[j] })
+			agg.RTTMedian = quantile(g.rtts, 0.5)
+			agg.RTTP95 = quantile(g.rtts, 0.95)
+		}
+		out[k] = agg
+	}
+	return out
+}
+
+// buildAggregates computes the per-vendor and per-type aggregates from the
+// same devices the snapshot publishes.
+func buildAggregates(cfg AggregateConfig, devices []Device) Aggregates {
+	return Aggregates{
+		ByVendor: aggregateBy(cfg, devices, func(d Device) string {
+			if d.Vendor == "" {
+				return "unknown"
+			}
+			return d.Vendor
+		}),
+		ByType: aggregateBy(cfg, devices, func(d Device) string { return d.DeviceType }),
+	}
+}
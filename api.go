@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(versioned(v)); err != nil {
+		errorLog.Printf("Error encoding API response: %v", err)
+	}
+}
+
+// devicesHandler serves the devices of the last scan; ?scanner= picks the
+// scanner, like on every per-scanner endpoint.
+func devicesHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := scannerFor(w, r)
+	if !ok {
+		return
+	}
+	devices := []Device{}
+	if scan := s.currentScan(); scan != nil {
+		devices = append(devices, listedDevices(scan.Devices)...)
+	}
+	writeJSON(w, http.StatusOK, devices)
+}
+
+// deviceHandler serves GET /api/v1/devices/{mac}; IP-only devices can be
+// looked up by IP.
+func deviceHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := scannerFor(w, r)
+	if !ok {
+		return
+	}
+	id := strings.ToLower(r.PathValue("mac"))
+	if scan := s.currentScan(); scan != nil {
+		for _, d := range scan.Devices {
+			if strings.ToLower(d.MAC) == id || (d.MAC == unknownMAC && d.IP == id) {
+				writeJSON(w, http.StatusOK, d)
+				return
+			}
+		}
+	}
+	writeJSON(w, http.StatusNotFound, map[string]string{"error": "device not found"})
+}
+
+func scansHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := scannerFor(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.history.recent())
+}
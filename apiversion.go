@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// apiVersion is the version of the JSON shapes served by the API and
+// carried by events. Adding fields keeps it; renaming, removing or
+// retyping a field bumps it.
+const apiVersion = 1
+
+const schemaPath = "/api/v1/schema/"
+
+// apiObjects are the object types that carry api_version and schema, by
+// schema name.
+var apiObjects = map[string]reflect.Type{
+	"device":    reflect.TypeOf(Device{}),
+	"event":     reflect.TypeOf(Event{}),
+	"scan":      reflect.TypeOf(ScanStats{}),
+	"scan_dump": reflect.TypeOf(scanDump{}),
+	"summary":   reflect.TypeOf(networkSummary{}),
+}
+
+func schemaURL(name string) string {
+	return schemaPath + name
+}
+
+// apiHeader is inlined ahead of an object's own fields by its MarshalJSON.
+type apiHeader struct {
+	APIVersion int    `json:"api_version"`
+	Schema     string `json:"schema"`
+}
+
+func apiHeaderFor(name string) apiHeader {
+	return apiHeader{APIVersion: apiVersion, Schema: schemaURL(name)}
+}
+
+func (d Device) MarshalJSON() ([]byte, error) {
+	type plain Device
+	return json.Marshal(struct {
+		apiHeader
+		plain
+	}{apiHeaderFor("device"), plain(d)})
+}
+
+func (e Event) MarshalJSON() ([]byte, error) {
+	type plain Event
+	return json.Marshal(struct {
+		apiHeader
+		plain
+	}{apiHeaderFor("event"), plain(e)})
+}
+
+func (s ScanStats) MarshalJSON() ([]byte, error) {
+	type plain ScanStats
+	return json.Marshal(struct {
+		apiHeader
+		plain
+	}{apiHeaderFor("scan"), plain(s)})
+}
+
+func (d scanDump) MarshalJSON() ([]byte, error) {
+	type plain scanDump
+	return json.Marshal(struct {
+		apiHeader
+		plain
+	}{apiHeaderFor("scan_dump"), plain(d)})
+}
+
+func (s networkSummary) MarshalJSON() ([]byte, error) {
+	type plain networkSummary
+	return json.Marshal(struct {
+		apiHeader
+		plain
+	}{apiHeaderFor("summary"), plain(s)})
+}
+
+// versioned adds api_version to the ad-hoc map responses; the object
+// types above carry it themselves.
+func versioned(v interface{}) interface{} {
+	var out map[string]interface{}
+	switch v := v.(type) {
+	case map[string]string:
+		out = make(map[string]interface{}, len(v)+1)
+		for k, s := range v {
+			out[k] = s
+		}
+	case map[string]interface{}:
+		out = make(map[string]interface{}, len(v)+1)
+		for k, x := range v {
+			out[k] = x
+		}
+	default:
+		return v
+	}
+	out["api_version"] = apiVersion
+	return out
+}
+
+// versionHandler serves GET /api/v1/version.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	schemas := make(map[string]string, len(apiObjects))
+	for name := range apiObjects {
+		schemas[name] = schemaURL(name)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"version": version,
+		"schemas": schemas,
+	})
+}
+
+// schemaHandler serves GET /api/v1/schema/{type}: a JSON Schema derived
+// from the Go type, so it cannot drift from what is served.
+func schemaHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("type")
+	t, ok := apiObjects[name]
+	if !ok {
+		names := make([]string, 0, len(apiObjects))
+		for n := range apiObjects {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown schema (have " + strings.Join(names, ", ") + ")"})
+		return
+	}
+	s := typeSchema(t, "json", map[reflect.Type]bool{})
+	s["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	s["$id"] = schemaURL(name)
+	writeJSON(w, http.StatusOK, s)
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// typeSchema describes how t is encoded by encoding/json (tag "json") or
+// yaml.v3 (tag "yaml"). seen guards against recursive types.
+func typeSchema(t reflect.Type, tag string, seen map[reflect.Type]bool) map[string]interface{} {
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case durationType:
+		if tag == "yaml" {
+			return map[string]interface{}{"type": "string", "description": "Go duration, e.g. 30s or 5m"}
+		}
+		return map[string]interface{}{"type": "integer", "description": "nanoseconds"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeSchema(t.Elem(), tag, seen)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), tag, seen)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), tag, seen)}
+	case reflect.Struct:
+		if seen[t] {
+			return map[string]interface{}{}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		props := make(map[string]interface{})
+		if _, ok := apiObjectName(t); ok && tag == "json" {
+			props["api_version"] = map[string]interface{}{"const": apiVersion}
+			props["schema"] = map[string]interface{}{"type": "string"}
+		}
+		for _, f := range reflect.VisibleFields(t) {
+			// Untagged embedded structs are inlined; their fields are
+			// visited as promoted fields.
+			if !f.IsExported() || (f.Anonymous && f.Tag.Get(tag) == "") {
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get(tag), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+				if tag == "yaml" {
+					name = strings.ToLower(name)
+				}
+			}
+			props[name] = typeSchema(f.Type, tag, seen)
+		}
+		s := map[string]interface{}{"type": "object", "properties": props}
+		if tag == "yaml" {
+			// config validate and doctor reject unknown keys.
+			s["additionalProperties"] = false
+		}
+		return s
+	}
+	return map[string]interface{}{}
+}
+
+func apiObjectName(t reflect.Type) (string, bool) {
+	for name, at := range apiObjects {
+		if at == t {
+			return name, true
+		}
+	}
+	return "", false
+}
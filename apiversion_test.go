@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// fill sets every exported field of v to a value derived from its name,
+// so a renamed, removed or retyped field changes the marshaled JSON.
+func fill(v reflect.Value, name string, depth int) {
+	switch v.Type() {
+	case timeType:
+		v.Set(reflect.ValueOf(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)))
+		return
+	case durationType:
+		v.SetInt(int64(1500 * time.Millisecond))
+		return
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		if depth > 3 {
+			return
+		}
+		v.Set(reflect.New(v.Type().Elem()))
+		fill(v.Elem(), name, depth+1)
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(int64(len(name)))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(uint64(len(name)))
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(float64(len(name)) + 0.5)
+	case reflect.String:
+		v.SetString(name)
+	case reflect.Interface:
+		v.Set(reflect.ValueOf(name))
+	case reflect.Slice:
+		if depth > 3 {
+			return
+		}
+		s := reflect.MakeSlice(v.Type(), 1, 1)
+		fill(s.Index(0), name, depth+1)
+		v.Set(s)
+	case reflect.Map:
+		if depth > 3 {
+			return
+		}
+		m := reflect.MakeMap(v.Type())
+		key, elem := reflect.New(v.Type().Key()).Elem(), reflect.New(v.Type().Elem()).Elem()
+		fill(key, name+"_key", depth+1)
+		fill(elem, name, depth+1)
+		m.SetMapIndex(key, elem)
+		v.Set(m)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Type().Field(i); f.IsExported() {
+				fill(v.Field(i), f.Name, depth)
+			}
+		}
+	}
+}
+
+func sortedObjects() []string {
+	names := make([]string, 0, len(apiObjects))
+	for name := range apiObjects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TestAPIContract marshals every versioned object type with all fields set
+// and compares it with testdata/api/<type>.json.
+func TestAPIContract(t *testing.T) {
+	for _, name := range sortedObjects() {
+		t.Run(name, func(t *testing.T) {
+			v := reflect.New(apiObjects[name]).Elem()
+			fill(v, name, 0)
+			data, err := json.MarshalIndent(v.Interface(), "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var header apiHeader
+			if err := json.Unmarshal(data, &header); err != nil || header != apiHeaderFor(name) {
+				t.Errorf("header %+v (%v), want %+v", header, err, apiHeaderFor(name))
+			}
+			golden(t, "api/"+name+".json", append(data, '\n'))
+		})
+	}
+}
+
+// TestAPISchemas pins the served JSON Schemas, which are derived from the
+// same types.
+func TestAPISchemas(t *testing.T) {
+	for _, name := range sortedObjects() {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", schemaPath+name, nil)
+			r.SetPathValue("type", name)
+			rec := httptest.NewRecorder()
+			schemaHandler(rec, r)
+			if rec.Code != 200 {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			var schema interface{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &schema); err != nil {
+				t.Fatal(err)
+			}
+			data, _ := json.MarshalIndent(schema, "", "  ")
+			golden(t, "api/"+name+".schema.json", append(data, '\n'))
+		})
+	}
+
+	r := httptest.NewRequest("GET", schemaPath+"nope", nil)
+	r.SetPathValue("type", "nope")
+	rec := httptest.NewRecorder()
+	schemaHandler(rec, r)
+	if rec.Code != 404 {
+		t.Errorf("unknown schema: status %d", rec.Code)
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	versionHandler(rec, httptest.NewRequest("GET", "/api/v1/version", nil))
+	var got struct {
+		APIVersion int               `json:"api_version"`
+		Version    string            `json:"version"`
+		Schemas    map[string]string `json:"schemas"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.APIVersion != apiVersion || got.Version != version || len(got.Schemas) != len(apiObjects) {
+		t.Errorf("got %+v", got)
+	}
+	for name, url := range got.Schemas {
+		if url != schemaURL(name) {
+			t.Errorf("schema %s at %q", name, url)
+		}
+	}
+}
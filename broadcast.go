@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Probe strategies (scan.probe).
+const (
+	probeUnicast   = "unicast"
+	probeBroadcast = "broadcast"
+)
+
+const defaultBroadcastSettle = 2 * time.Second
+
+func (c ScanConfig) broadcastSettle() time.Duration {
+	if c.BroadcastSettle > 0 {
+		return c.BroadcastSettle
+	}
+	return defaultBroadcastSettle
+}
+
+func broadcastPingArgs(cfg ScanConfig, bcast, goos string) []string {
+	if goos == "darwin" {
+		// Broadcast is allowed by default; -t bounds the whole run.
+		args := []string{"-c", "2", "-t", "2"}
+		if cfg.Interface != "" {
+			args = append(args, "-b", cfg.Interface)
+		}
+		return append(args, bcast)
+	}
+	args := []string{"-b", "-c", "2", "-w", "2"}
+	if cfg.Interface != "" {
+		args = append(args, "-I", cfg.Interface)
+	}
+	return append(args, bcast)
+}
+
+// sendMulticastQueries sends an mDNS service enumeration query and an SSDP
+// M-SEARCH. Answers are ignored; the point is that every responder ARPs
+// for us and so lands in the neighbor table.
+func (s *scanner) sendMulticastQueries() {
+	name := dnsmessage.MustNewName("_services._dns-sd._udp.local.")
+	query := dnsmessage.Message{Questions: []dnsmessage.Question{{
+		Name:  name,
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET,
+	}}}
+	if packet, err := query.Pack(); err == nil {
+		s.sendUDP(trafficMDNS, "224.0.0.251:5353", packet)
+	}
+	s.sendUDP(trafficSSDP, "239.255.255.250:1900", []byte("M-SEARCH * HTTP/1.1\r\n"+
+		"HOST: 239.255.255.250:1900\r\n"+
+		"MAN: \"ssdp:discover\"\r\n"+
+		"MX: 1\r\n"+
+		"ST: ssdp:all\r\n\r\n"))
+}
+
+// sendUDP sends payload to addr, counting it as traffic of kind.
+func (s *scanner) sendUDP(kind, addr string, payload []byte) {
+	conn, err := net.Dial("udp4", addr)
+	if err != nil {
+		debugf("multicast probe %s: %v", addr, err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write(payload); err != nil {
+		debugf("multicast probe %s: %v", addr, err)
+		return
+	}
+	s.countSent(kind, 1, udpOverhead+len(payload))
+}
+
+// broadcastSweep wakes every network with one broadcast ping per prefix,
+// sent through the network's interface, plus multicast discovery queries,
+// waits for the replies to settle and returns the neighbor table seen
+// afterwards.
+func (s *scanner) broadcastSweep(cfg ScanConfig, networks []scanNetwork) map[string]string {
+	for _, n := range networks {
+		for _, bcast := range n.Range.broadcasts() {
+			if err := s.runner.Run("ping", broadcastPingArgs(n.Scan, bcast, s.runner.GOOS())...); err != nil {
+				debugf("broadcast ping %s: %v", bcast, err)
+			}
+			s.countSent(trafficICMP, 2, 2*pingEchoSize)
+		}
+	}
+	// Multicast goes out from this host, which only helps when it is the
+	// one scanning.
+	if _, ok := s.runner.(localRunner); ok {
+		s.sendMulticastQueries()
+	}
+	time.Sleep(cfg.broadcastSettle())
+	entries, _ := s.getNeighbors()
+	return neighborMACs(entries)
+}
+
+// unicastFallback returns the targets the broadcast phase did not find, or
+// none unless scan.probe_fallback is unicast.
+func unicastFallback(cfg ScanConfig, targets []string, seen map[string]string) []string {
+	if cfg.ProbeFallback != probeUnicast {
+		return nil
+	}
+	var rest []string
+	for _, ip := range targets {
+		if _, ok := seen[ip]; !ok {
+			rest = append(rest, ip)
+		}
+	}
+	return rest
+}
+
+// phaseContributions attributes every final neighbor entry to the phase
+// that first found it.
+func phaseContributions(table, broadcastSeen map[string]string) map[string]int {
+	phases := map[string]int{probeBroadcast: 0, probeUnicast: 0}
+	for ip := range table {
+		if _, ok := broadcastSeen[ip]; ok {
+			phases[probeBroadcast]++
+		} else {
+			phases[probeUnicast]++
+		}
+	}
+	return phases
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func (c DebugConfig) bundleInterval() time.Duration {
+	if c.BundleInterval <= 0 {
+		return time.Minute
+	}
+	return c.BundleInterval
+}
+
+var (
+	bundleMu   sync.Mutex
+	lastBundle time.Time
+)
+
+// allowBundle rate-limits bundle generation to one per interval.
+func allowBundle(interval time.Duration, now time.Time) (time.Duration, bool) {
+	bundleMu.Lock()
+	defer bundleMu.Unlock()
+	if wait := lastBundle.Add(interval).Sub(now); wait > 0 {
+		return wait, false
+	}
+	lastBundle = now
+	return 0, true
+}
+
+type bundleFile struct {
+	name string
+	data []byte
+}
+
+func jsonFile(name string, v interface{}) bundleFile {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		data = []byte(err.Error())
+	}
+	return bundleFile{name, data}
+}
+
+// collectBundle gathers the bundle contents. It only reads published
+// snapshots, so scans are never held up, and stops with ctx's error once
+// ctx is done.
+func collectBundle(ctx context.Context, now time.Time, g prometheus.Gatherer) ([]bundleFile, error) {
+	files := []bundleFile{jsonFile("version.json", map[string]interface{}{
+		"version":     version,
+		"go_version":  runtime.Version(),
+		"os":          runtime.GOOS,
+		"arch":        runtime.GOARCH,
+		"uptime":      now.Sub(startTime).String(),
+		"config_hash": configHash(cfgPath),
+		"features":    featureSet(),
+		"scan_id":     scanID.Load(),
+		"created_at":  now,
+	})}
+
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(g, promhttp.HandlerOpts{}).
+		ServeHTTP(rec, httptest.NewRequestWithContext(ctx, http.MethodGet, "/metrics", nil))
+	files = append(files, bundleFile{"metrics.txt", rec.Body.Bytes()})
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Named scanners get a scan-NAME.json each.
+	for _, s := range scanners {
+		suffix := ""
+		if s.name != "" {
+			suffix = "-" + s.name
+		}
+		if scan := s.currentScan(); scan != nil {
+			files = append(files, jsonFile("scan"+suffix+".json", scan))
+		}
+		if dump := s.lastScanDump.Load(); dump != nil {
+			copied := *dump
+			copied.Config, _ = configAsMap(copied.cfg)
+			files = append(files, jsonFile("scan-dump"+suffix+".json", &copied))
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	events, _ := recentEvents(0)
+	files = append(files, jsonFile("events.json", events))
+	files = append(files, bundleFile{"log.txt", []byte(strings.Join(recentLogs.snapshot(), "\n") + "\n")})
+
+	if cfg, err := loadConfig(cfgPath); err != nil {
+		files = append(files, bundleFile{"config.json", []byte(err.Error())})
+	} else {
+		generic, err := configAsMap(cfg)
+		if err != nil {
+			files = append(files, bundleFile{"config.json", []byte(err.Error())})
+		} else {
+			files = append(files, jsonFile("config.json", generic))
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var stacks bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&stacks, 2)
+	files = append(files, bundleFile{"goroutines.txt", stacks.Bytes()})
+	return files, ctx.Err()
+}
+
+func writeBundle(files []bundleFile, now time.Time, dir string) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		hdr := &tar.Header{Name: dir + "/" + f.name, Mode: 0o644, Size: int64(len(f.data)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// bundleHandler serves POST /api/v1/debug/bundle: a tar.gz with the
+// metrics, scan state, recent logs and events, redacted config and
+// goroutine stacks. With debug.bundle_dir set it is written there instead
+// of returned.
+func bundleHandler(cfg DebugConfig, g prometheus.Gatherer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		if wait, ok := allowBundle(cfg.bundleInterval(), now); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "a bundle was generated recently; retry later"})
+			return
+		}
+		name := "telemetry-bundle-" + now.Format("20060102-150405")
+		files, err := collectBundle(r.Context(), now, g)
+		if err != nil {
+			// Timed out: withTimeout has answered, nothing is written.
+			return
+		}
+		data, err := writeBundle(files, now, name)
+		if err == nil && requestCancelled(r) {
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if cfg.BundleDir == "" {
+			w.Header().Set("Content-Type", "application/gzip")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".tar.gz"))
+			w.Write(data)
+			return
+		}
+		path := filepath.Join(cfg.BundleDir, name+".tar.gz")
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		log.Printf("Wrote debug bundle %s", path)
+		writeJSON(w, http.StatusOK, map[string]string{"path": path})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// guestListLimit caps how many collapsed guest devices the API lists.
+const guestListLimit = 100
+
+// randomizedMAC reports whether mac is locally administered, which is how
+// phones and laptops mark per-network private addresses.
+func randomizedMAC(mac string) bool {
+	if len(mac) < 2 {
+		return false
+	}
+	b, err := strconv.ParseUint(mac[:2], 16, 8)
+	if err != nil {
+		return false
+	}
+	return b&0x02 != 0
+}
+
+// markGuests enforces scan.max_tracked_devices. Devices are ranked known
+// (configured or infrastructure) > named > oldest first, with the MAC as a
+// tie-break so the result is deterministic; unknown randomized-MAC devices
+// that fall outside the limit are flagged as guests and collapsed into a
+// single series by the collector.
+func markGuests(cfg Config, devices []Device) {
+	limit := cfg.Scan.MaxTrackedDevices
+	if limit <= 0 || len(devices) <= limit {
+		return
+	}
+	rank := func(d Device) int {
+		if _, ok := cfg.deviceConfig(d.MAC); ok || d.Infrastructure {
+			return 0
+		}
+		if d.Hostname != "<unknown>" {
+			return 1
+		}
+		return 2
+	}
+	order := make([]int, len(devices))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := devices[order[i]], devices[order[j]]
+		if ra, rb := rank(a), rank(b); ra != rb {
+			return ra < rb
+		}
+		if !a.FirstSeen.Equal(b.FirstSeen) {
+			return a.FirstSeen.Before(b.FirstSeen)
+		}
+		if a.MAC != b.MAC {
+			return a.MAC < b.MAC
+		}
+		return a.IP < b.IP
+	})
+	for pos, i := range order {
+		d := &devices[i]
+		if pos >= limit && rank(*d) > 0 && randomizedMAC(strings.ToLower(d.MAC)) {
+			d.Guest = true
+		}
+	}
+}
+
+// listedDevices returns the devices for the API with collapsed guests
+// capped at guestListLimit.
+func listedDevices(devices []Device) []Device {
+	out := make([]Device, 0, len(devices))
+	guests := 0
+	for _, d := range devices {
+		if d.Guest {
+			if guests >= guestListLimit {
+				continue
+			}
+			guests++
+		}
+		out = append(out, d)
+	}
+	return out
+}
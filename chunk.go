@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// chunkScheduler rotates through the scan range chunk by chunk so large
+// ranges are fully covered over several cycles.
+type chunkScheduler struct {
+	mu         sync.Mutex
+	cursor     int
+	lastProbed map[string]time.Time
+	startedAt  time.Time
+}
+
+func newChunkScheduler() *chunkScheduler {
+	return &chunkScheduler{lastProbed: make(map[string]time.Time), startedAt: time.Now()}
+}
+
+// next returns the addresses to probe this cycle: the next chunk of the
+// range plus every known-active address, which is probed every cycle.
+func (c *chunkScheduler) next(all []string, chunkSize int, known map[string]string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if chunkSize <= 0 || chunkSize >= len(all) {
+		c.cursor = 0
+		return all
+	}
+
+	if c.cursor >= len(all) {
+		c.cursor = 0
+	}
+	end := c.cursor + chunkSize
+	var targets []string
+	if end <= len(all) {
+		targets = append(targets, all[c.cursor:end]...)
+	} else {
+		targets = append(targets, all[c.cursor:]...)
+		targets = append(targets, all[:end-len(all)]...)
+	}
+	c.cursor = end % len(all)
+
+	inChunk := make(map[string]bool, len(targets))
+	for _, ip := range targets {
+		inChunk[ip] = true
+	}
+	for ip := range known {
+		if !inChunk[ip] {
+			targets = append(targets, ip)
+		}
+	}
+	return targets
+}
+
+func (c *chunkScheduler) markProbed(targets []string, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ip := range targets {
+		c.lastProbed[ip] = at
+	}
+}
+
+// coverageAge is the time since the least recently probed address in the
+// range was probed.
+func (c *chunkScheduler) coverageAge(all []string, now time.Time) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	oldest := now
+	for _, ip := range all {
+		t, ok := c.lastProbed[ip]
+		if !ok {
+			return now.Sub(c.startedAt)
+		}
+		if t.Before(oldest) {
+			oldest = t
+		}
+	}
+	return now.Sub(oldest)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Durations between two time.Now() readings use the monotonic clock, so
+// intervals, expiry and retention are unaffected when NTP steps the wall
+// clock; only the wall readings shown to users jump. Times that lost the
+// monotonic reading (Truncate, Round, parsing) must not be used for those
+// decisions.
+
+// clockStepThreshold is how far the wall clock must move against the
+// monotonic clock between scans to count as a step rather than slewing.
+const clockStepThreshold = 2 * time.Second
+
+// wallStep is how far the wall clock was stepped between two readings of
+// time.Now() taken in this process: positive when it moved forward.
+func wallStep(prev, now time.Time) time.Duration {
+	return now.Round(0).Sub(prev.Round(0)) - now.Sub(prev)
+}
+
+// wallTime is t as the wall clock reads at now: now's wall reading minus
+// the monotonic time elapsed since t. A step between t and now therefore
+// shifts t with the clock instead of leaving it in the future. Times
+// without a monotonic reading keep their wall time, clamped to now.
+func wallTime(t, now time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	wall := now.Round(0)
+	if rebased := wall.Add(-now.Sub(t)); rebased.Before(wall) {
+		return rebased
+	}
+	return wall
+}
+
+// noteClockStep warns about a wall-clock step between the starts of two
+// scans. Called by the scan loop.
+func noteClockStep(m *Metrics, prev, now time.Time) {
+	if prev.IsZero() {
+		return
+	}
+	step := wallStep(prev, now)
+	if step.Abs() <= clockStepThreshold {
+		return
+	}
+	m.ClockSteps.Inc()
+	log.Printf("Warning: the wall clock was stepped by %s since the last scan; intervals and expiry are unaffected, displayed times follow the new clock",
+		step.Round(time.Millisecond))
+	emitEvent("clock_step", map[string]interface{}{"step_seconds": step.Seconds()})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// stepped returns tm as time.Now would have read it had the wall clock
+// been stepped by d: the wall reading moves, the monotonic one does not.
+// time.Time has no API for that, so it edits the wall word laid out in
+// time.go (hasMonotonic bit, 33 bits of seconds since 1885, 30 bits of
+// nanoseconds) and skips the test if that layout ever changes.
+func stepped(t *testing.T, tm time.Time, d time.Duration) time.Time {
+	t.Helper()
+	const nsecBits = 30
+	out := tm
+	wall := (*uint64)(unsafe.Pointer(&out))
+	if *wall>>63 != 1 {
+		t.Fatal("stepped needs a time.Now reading")
+	}
+	ns := int64(*wall<<1>>(nsecBits+1))*1e9 + int64(*wall&(1<<nsecBits-1)) + int64(d)
+	*wall = 1<<63 | uint64(ns/1e9)<<nsecBits | uint64(ns%1e9)
+	if !out.Round(0).Equal(tm.Round(0).Add(d)) || out.Sub(tm) != 0 {
+		t.Skip("time.Time layout changed; cannot simulate a clock step")
+	}
+	return out
+}
+
+func TestWallStep(t *testing.T) {
+	prev := time.Now()
+	later := prev.Add(30 * time.Second)
+	for _, step := range []time.Duration{0, time.Hour, -time.Hour, -24 * time.Hour} {
+		if got := wallStep(prev, stepped(t, later, step)); got != step {
+			t.Errorf("step %s measured as %s", step, got)
+		}
+	}
+}
+
+func TestNoteClockStep(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	s := newScanner("", 1)
+	s.m = NewMetrics(reg, "").forScanner(reg, s)
+	prev := time.Now()
+	later := prev.Add(30 * time.Second)
+	for _, tc := range []struct {
+		step  time.Duration
+		count float64
+	}{
+		{0, 0},
+		{clockStepThreshold, 0}, // slewing, not a step
+		{-time.Hour, 1},
+		{time.Hour, 2},
+	} {
+		_, seq := recentEvents(0)
+		noteClockStep(s.m, prev, stepped(t, later, tc.step))
+		if got := testutil.ToFloat64(s.m.ClockSteps); got != tc.count {
+			t.Errorf("step %s: telemetry_clock_steps_total %v, want %v", tc.step, got, tc.count)
+		}
+		events, _ := recentEvents(seq)
+		if emitted := len(events) > 0; emitted != (tc.step.Abs() > clockStepThreshold) {
+			t.Errorf("step %s: events %v", tc.step, events)
+		}
+	}
+	noteClockStep(s.m, time.Time{}, later)
+	if got := testutil.ToFloat64(s.m.ClockSteps); got != 2 {
+		t.Errorf("the first scan counted as a step")
+	}
+}
+
+func TestWallTime(t *testing.T) {
+	seen := time.Now()
+	later := seen.Add(10 * time.Minute)
+	for _, step := range []time.Duration{0, -24 * time.Hour, 24 * time.Hour} {
+		now := stepped(t, later, step)
+		// Ten minutes ago on the clock as it reads now.
+		if got, want := wallTime(seen, now), now.Round(0).Add(-10*time.Minute); !got.Equal(want) {
+			t.Errorf("step %s: shown as %s, want %s", step, got, want)
+		}
+	}
+	now := time.Now()
+	if got := wallTime(now.Round(0).Add(time.Hour), now); !got.Equal(now.Round(0)) {
+		t.Errorf("a future time without monotonic reading is shown as %s, want it clamped to now", got)
+	}
+	if !wallTime(time.Time{}, now).IsZero() {
+		t.Error("the zero time is not kept")
+	}
+}
+
+// TestPresenceExpiryIgnoresClockSteps steps the wall clock a day either
+// way between scans: only the monotonic time since a device was last seen
+// decides its eviction, and the flap window likewise.
+func TestPresenceExpiryIgnoresClockSteps(t *testing.T) {
+	for _, step := range []time.Duration{-24 * time.Hour, 24 * time.Hour} {
+		s, _ := presenceScanner(t)
+		cfg := ScanConfig{OfflineRetention: time.Hour}
+		t0 := time.Now()
+		d := Device{IP: "192.168.1.10", MAC: "aa:bb:cc:00:00:01"}
+		s.updatePresence(cfg, []Device{d}, t0)
+
+		records := s.updatePresence(cfg, nil, stepped(t, t0.Add(time.Minute), step))
+		if len(records) != 1 {
+			t.Fatalf("step %s: evicted a minute after it was seen", step)
+		}
+		if now := stepped(t, t0.Add(time.Minute), step).Round(0); records[0].LastSeen.After(now) {
+			t.Errorf("step %s: last seen %s is after now %s", step, records[0].LastSeen, now)
+		}
+		devices := []Device{d}
+		s.updatePresence(cfg, devices, stepped(t, t0.Add(2*time.Minute), step))
+		if devices[0].Flaps24h != 2 {
+			t.Errorf("step %s: flaps %d, want 2", step, devices[0].Flaps24h)
+		}
+		if records := s.updatePresence(cfg, nil, stepped(t, t0.Add(2*time.Minute+time.Hour+time.Second), step)); len(records) != 0 {
+			t.Errorf("step %s: not evicted after offline_retention", step)
+		}
+	}
+}
+
+func TestTimeseriesRetentionIgnoresClockSteps(t *testing.T) {
+	cfg := TimeseriesConfig{Resolution: time.Minute, Retention: time.Hour}
+	for _, step := range []time.Duration{-24 * time.Hour, 24 * time.Hour} {
+		var c countSeries
+		t0 := time.Now()
+		c.record(cfg, []Device{{State: stateOnline}}, t0)
+		c.record(cfg, []Device{{State: stateOnline}}, stepped(t, t0.Add(5*time.Minute), step))
+		points, _, err := c.series("devices_online", time.Hour, stepped(t, t0.Add(6*time.Minute), step))
+		if err != nil || len(points) != 2 {
+			t.Errorf("step %s: %d points within the hour (%v), want 2", step, len(points), err)
+		}
+		c.record(cfg, nil, stepped(t, t0.Add(61*time.Minute), step))
+		if points, _, _ := c.series("devices_online", time.Hour, stepped(t, t0.Add(61*time.Minute), step)); len(points) != 2 {
+			t.Errorf("step %s: %d points after the first scan aged out, want 2", step, len(points))
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CohortConfig sets the windows of the first-seen cohorts: how many
+// devices joined the network within each window, and how many of those
+// are still online. First-seen times are kept in memory, so cohorts start
+// over on restart unless registry.state_file keeps them.
+type CohortConfig struct {
+	// Windows defaults to 24h, 168h (7d) and 720h (30d).
+	Windows []time.Duration `yaml:"windows"`
+}
+
+func (c CohortConfig) windows() []time.Duration {
+	var out []time.Duration
+	for _, w := range c.Windows {
+		if w > 0 {
+			out = append(out, w)
+		}
+	}
+	if len(out) == 0 {
+		return []time.Duration{24 * time.Hour, 7 * 24 * time.Hour, 30 * 24 * time.Hour}
+	}
+	return out
+}
+
+// windowLabel formats windows of several whole days as "7d" and others
+// as a Go duration without trailing zero units ("24h", "1h30m").
+func windowLabel(w time.Duration) string {
+	const day = 24 * time.Hour
+	if w > day && w%day == 0 {
+		return fmt.Sprintf("%dd", w/day)
+	}
+	s := w.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+type cohortEntry struct {
+	key string
+	at  time.Time
+}
+
+// cohortStats is one window's cohort as of the last scan.
+type cohortStats struct {
+	Window    string `json:"window"`
+	FirstSeen int    `json:"first_seen"`
+	Online    int    `json:"online"`
+	// RetainedRatio is Online/FirstSeen, 0 for an empty cohort.
+	RetainedRatio float64 `json:"retained_ratio"`
+}
+
+// cohortState is a scanner's cohort bookkeeping.
+type cohortState struct {
+	// mu guards the fields below: the scan loop updates them, and a prune
+	// between scans drops devices from them.
+	mu sync.Mutex
+	// joined lists devices in first-seen order, oldest first, back to the
+	// longest window.
+	joined []cohortEntry
+	// windows, online and at are the last scan's, so a prune can recompute
+	// its cohorts.
+	windows []time.Duration
+	online  map[string]bool
+	at      time.Time
+
+	last atomic.Pointer[[]cohortStats]
+}
+
+// noteFirstSeen appends a device seen for the first time. Called by the
+// scan loop as it fills firstSeen, so entries arrive in time order.
+func (c *cohortState) noteFirstSeen(key string, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.joined = append(c.joined, cohortEntry{key, at})
+}
+
+// forgetCohorts drops devices deleted from the inventory from the cohorts
+// and republishes the last scan's cohorts without them.
+func (s *scanner) forgetCohorts(macs map[string]bool) {
+	c := &s.cohorts
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	kept := c.joined[:0]
+	for _, e := range c.joined {
+		if !macs[e.key] {
+			kept = append(kept, e)
+		}
+	}
+	clear(c.joined[len(kept):])
+	c.joined = kept
+	if c.last.Load() != nil {
+		s.publishCohorts()
+	}
+}
+
+// rejoinCohorts puts back pruned devices that came back before their
+// first-seen time was forgotten, in first-seen order.
+func (s *scanner) rejoinCohorts(firstSeen map[string]time.Time) {
+	c := &s.cohorts
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.joined {
+		delete(firstSeen, e.key)
+	}
+	if len(firstSeen) == 0 || len(c.windows) == 0 {
+		return
+	}
+	longest := slices.Max(c.windows)
+	for key, at := range firstSeen {
+		if c.at.Sub(at) > longest {
+			continue
+		}
+		i := sort.Search(len(c.joined), func(i int) bool { return c.joined[i].at.After(at) })
+		c.joined = slices.Insert(c.joined, i, cohortEntry{key, at})
+	}
+	s.publishCohorts()
+}
+
+// updateCohorts recomputes the cohorts after a scan. Since joined is in
+// time order, each window's cohort is a suffix found by binary search;
+// only devices within the longest window are visited, never the whole
+// first-seen map.
+func (s *scanner) updateCohorts(cfg CohortConfig, devices []Device, now time.Time) {
+	c := &s.cohorts
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.windows, c.at = cfg.windows(), now
+	longest := c.windows[0]
+	for _, w := range c.windows {
+		longest = max(longest, w)
+	}
+	if drop := c.since(longest); drop > 0 {
+		c.joined = append([]cohortEntry(nil), c.joined[drop:]...)
+	}
+
+	c.online = make(map[string]bool)
+	for _, d := range devices {
+		if d.State == stateOnline {
+			c.online[d.key()] = true
+		}
+	}
+	s.publishCohorts()
+}
+
+// since returns the index of the first device in joined seen within w of
+// the last scan. The caller holds c.mu.
+func (c *cohortState) since(w time.Duration) int {
+	cutoff := c.at.Add(-w)
+	return sort.Search(len(c.joined), func(i int) bool { return !c.joined[i].at.Before(cutoff) })
+}
+
+// publishCohorts counts the cohorts of the last scan and publishes them.
+// The caller holds s.cohorts.mu.
+func (s *scanner) publishCohorts() {
+	c := &s.cohorts
+	stats := make([]cohortStats, 0, len(c.windows))
+	s.m.CohortFirstSeen.Reset()
+	s.m.CohortRetained.Reset()
+	for _, w := range c.windows {
+		st := cohortStats{Window: windowLabel(w)}
+		for _, e := range c.joined[c.since(w):] {
+			st.FirstSeen++
+			if c.online[e.key] {
+				st.Online++
+			}
+		}
+		if st.FirstSeen > 0 {
+			st.RetainedRatio = float64(st.Online) / float64(st.FirstSeen)
+		}
+		s.m.CohortFirstSeen.WithLabelValues(st.Window).Set(float64(st.FirstSeen))
+		s.m.CohortRetained.WithLabelValues(st.Window).Set(st.RetainedRatio)
+		stats = append(stats, st)
+	}
+	c.last.Store(&stats)
+}
+
+// cohortsHandler serves GET /api/v1/stats/cohorts.
+func cohortsHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := scannerFor(w, r)
+	if !ok {
+		return
+	}
+	stats := s.cohorts.last.Load()
+	if stats == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no scan yet"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"cohorts": *stats})
+}
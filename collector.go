@@ -0,0 +1,324 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// deviceCollector renders the per-device metrics from the published scan
+// snapshot, so a scrape always sees exactly one complete scan.
+type deviceCollector struct {
+	connectedDevices *prometheus.Desc
+	deviceState      *prometheus.Desc
+	infrastructureUp *prometheus.Desc
+	guestDevices     *prometheus.Desc
+	deviceVersion    *prometheus.Desc
+	deviceOS         *prometheus.Desc
+	deviceBootTime   *prometheus.Desc
+	leaseExpiry      *prometheus.Desc
+	vendorRTT        *prometheus.Desc
+	vendorLoss       *prometheus.Desc
+	typeRTT          *prometheus.Desc
+	typeLoss         *prometheus.Desc
+	lastSeen         *prometheus.Desc
+	transitions      *prometheus.Desc
+	groupMembers     *prometheus.Desc
+	groupOnline      *prometheus.Desc
+	groupAnyOnline   *prometheus.Desc
+	groupAvailable   *prometheus.Desc
+
+	s *scanner
+}
+
+func newDeviceCollector(namespace string, s *scanner) *deviceCollector {
+	return &deviceCollector{
+		s: s,
+		connectedDevices: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "wifi_connected_devices"),
+			"Devices on the local network: 1 if seen in the last scan, 0 while absent within scan.offline_retention",
+			[]string{"ip", "mac", "hostname", "device_type", "hostname_stale", "hostname_unstable", "static_in_pool", "proxied", "vlan"}, nil,
+		),
+		lastSeen: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "wifi_device_last_seen_timestamp_seconds"),
+			"When a device was last seen by a scan",
+			[]string{"mac", "ip", "hostname", "device_type"}, nil,
+		),
+		transitions: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "wifi_device_transitions_total"),
+			"Presence transitions of a device into the online or offline state",
+			[]string{"mac", "state"}, nil,
+		),
+		deviceState: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "wifi_device_state"),
+			"Presence state of a device (state-set: 1 for the current state)",
+			[]string{"mac", "state"}, nil,
+		),
+		infrastructureUp: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "network_infrastructure_up"),
+			"Whether an infrastructure device (router, switch, AP) was seen in the last scan",
+			[]string{"mac", "name"}, nil,
+		),
+		guestDevices: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "wifi_guest_devices_total"),
+			"Devices collapsed into one series because scan.max_tracked_devices was exceeded",
+			nil, nil,
+		),
+		deviceVersion: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "wifi_device_version_info"),
+			"Firmware/OS version reported by a device over SSDP or mDNS",
+			[]string{"mac", "version"}, nil,
+		),
+		deviceOS: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "wifi_device_os_info"),
+			"OS and kernel release a managed device reported over SSH (devices[].ssh)",
+			[]string{"mac", "os", "kernel"}, nil,
+		),
+		deviceBootTime: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "wifi_device_boot_time_seconds"),
+			"Last boot time a managed device reported over SSH, in seconds since the epoch",
+			[]string{"mac"}, nil,
+		),
+		leaseExpiry: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "wifi_device_lease_expiry_timestamp_seconds"),
+			"Expiry of the device's DHCP lease (0 for infinite leases)",
+			[]string{"mac"}, nil,
+		),
+		vendorRTT: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "wifi_vendor_rtt_seconds"),
+			"Median and 95th percentile RTT of the devices of one vendor in the last scan",
+			[]string{"vendor", "quantile"}, nil,
+		),
+		vendorLoss: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "wifi_vendor_packet_loss_ratio"),
+			"Share of probed devices of one vendor that did not reply in the last scan",
+			[]string{"vendor"}, nil,
+		),
+		typeRTT: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "wifi_device_type_rtt_seconds"),
+			"Median and 95th percentile RTT of the devices of one type in the last scan",
+			[]string{"device_type", "quantile"}, nil,
+		),
+		typeLoss: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "wifi_device_type_packet_loss_ratio"),
+			"Share of probed devices of one type that did not reply in the last scan",
+			[]string{"device_type"}, nil,
+		),
+		groupMembers: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "wifi_group_devices"),
+			"Known members of a device group, present or not",
+			[]string{"group"}, nil,
+		),
+		groupOnline: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "wifi_group_devices_online"),
+			"Members of a device group seen in the last scan",
+			[]string{"group"}, nil,
+		),
+		groupAnyOnline: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "wifi_group_any_online"),
+			"Whether any member of a device group was seen in the last scan",
+			[]string{"group"}, nil,
+		),
+		groupAvailable: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "wifi_group_availability_ratio"),
+			"Share of a device group's known members seen in the last scan",
+			[]string{"group"}, nil,
+		),
+	}
+}
+
+func (c *deviceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.connectedDevices
+	ch <- c.deviceState
+	ch <- c.infrastructureUp
+	ch <- c.guestDevices
+	ch <- c.deviceVersion
+	ch <- c.deviceOS
+	ch <- c.deviceBootTime
+	ch <- c.leaseExpiry
+	ch <- c.vendorRTT
+	ch <- c.vendorLoss
+	ch <- c.typeRTT
+	ch <- c.typeLoss
+	ch <- c.lastSeen
+	ch <- c.transitions
+	ch <- c.groupMembers
+	ch <- c.groupOnline
+	ch <- c.groupAnyOnline
+	ch <- c.groupAvailable
+}
+
+func (c *deviceCollector) Collect(ch chan<- prometheus.Metric) {
+	scan := c.s.currentScan()
+	if scan == nil {
+		return
+	}
+	seenMAC := make(map[string]bool, len(scan.Devices))
+	guests := 0
+	for _, d := range scan.Devices {
+		if d.Guest {
+			guests++
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.connectedDevices, prometheus.GaugeValue, 1,
+			d.IP, d.MAC, scan.Labels.value(d.HostnameLabel), d.DeviceType, strconv.FormatBool(d.HostnameStale), strconv.FormatBool(d.HostnameUnstable), strconv.FormatBool(d.StaticInPool), strconv.FormatBool(d.Proxied), d.VLAN)
+		if seenMAC[d.MAC] || d.MAC == unknownMAC {
+			continue // one MAC answering for several IPs
+		}
+		seenMAC[d.MAC] = true
+		if scan.VersionMetric && d.Version != nil {
+			ch <- prometheus.MustNewConstMetric(c.deviceVersion, prometheus.GaugeValue, 1, d.MAC, scan.Labels.value(d.Version.Version))
+		}
+		if d.HostInfo != nil {
+			ch <- prometheus.MustNewConstMetric(c.deviceOS, prometheus.GaugeValue, 1, d.MAC, scan.Labels.value(d.HostInfo.OS), scan.Labels.value(d.HostInfo.Kernel))
+			if !d.HostInfo.BootTime.IsZero() {
+				ch <- prometheus.MustNewConstMetric(c.deviceBootTime, prometheus.GaugeValue, float64(d.HostInfo.BootTime.Unix()), d.MAC)
+			}
+		}
+		if d.Lease != nil {
+			expiry := 0.0
+			if !d.Lease.Expiry.IsZero() {
+				expiry = float64(d.Lease.Expiry.Unix())
+			}
+			ch <- prometheus.MustNewConstMetric(c.leaseExpiry, prometheus.GaugeValue, expiry, d.MAC)
+		}
+		for _, st := range deviceStates {
+			value := 0.0
+			if st == d.State {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(c.deviceState, prometheus.GaugeValue, value, d.MAC, st)
+		}
+	}
+	for _, rec := range scan.Presence {
+		d := rec.Device
+		if d.Guest {
+			continue
+		}
+		if !rec.Online {
+			ch <- prometheus.MustNewConstMetric(c.connectedDevices, prometheus.GaugeValue, 0,
+				d.IP, d.MAC, scan.Labels.value(d.HostnameLabel), d.DeviceType, strconv.FormatBool(d.HostnameStale), strconv.FormatBool(d.HostnameUnstable), strconv.FormatBool(d.StaticInPool), strconv.FormatBool(d.Proxied), d.VLAN)
+		}
+		ch <- prometheus.MustNewConstMetric(c.lastSeen, prometheus.GaugeValue, float64(rec.LastSeen.Unix()),
+			d.MAC, d.IP, scan.Labels.value(d.HostnameLabel), d.DeviceType)
+		if d.MAC == unknownMAC || d.Proxied {
+			continue // the MAC label alone does not identify the device
+		}
+		for _, state := range []string{presenceOnline, presenceOffline} {
+			ch <- prometheus.MustNewConstMetric(c.transitions, prometheus.CounterValue, float64(rec.Edges[state]), d.MAC, state)
+		}
+	}
+	for _, infra := range scan.Infrastructure {
+		value := 0.0
+		if infra.Up {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.infrastructureUp, prometheus.GaugeValue, value, infra.MAC, scan.Labels.value(infra.Name))
+	}
+	ch <- prometheus.MustNewConstMetric(c.guestDevices, prometheus.GaugeValue, float64(guests))
+	collectAggregates(ch, c.vendorRTT, c.vendorLoss, scan.Aggregates.ByVendor, scan.Labels.value)
+	collectAggregates(ch, c.typeRTT, c.typeLoss, scan.Aggregates.ByType, func(s string) string { return s })
+	for name, g := range scan.Groups {
+		anyOnline := 0.0
+		if g.AnyOnline {
+			anyOnline = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.groupMembers, prometheus.GaugeValue, float64(g.Members), name)
+		ch <- prometheus.MustNewConstMetric(c.groupOnline, prometheus.GaugeValue, float64(g.Online), name)
+		ch <- prometheus.MustNewConstMetric(c.groupAnyOnline, prometheus.GaugeValue, anyOnline, name)
+		ch <- prometheus.MustNewConstMetric(c.groupAvailable, prometheus.GaugeValue, g.availability(), name)
+	}
+}
+
+func collectAggregates(ch chan<- prometheus.Metric, rtt, loss *prometheus.Desc, groups map[string]GroupAggregate, label func(string) string) {
+	for key, g := range groups {
+		ch <- prometheus.MustNewConstMetric(loss, prometheus.GaugeValue, g.LossRatio, label(key))
+		if g.hasRTT() {
+			ch <- prometheus.MustNewConstMetric(rtt, prometheus.GaugeValue, g.RTTMedian.Seconds(), label(key), "0.5")
+			ch <- prometheus.MustNewConstMetric(rtt, prometheus.GaugeValue, g.RTTP95.Seconds(), label(key), "0.95")
+		}
+	}
+}
+
+// systemCollector renders CPU and memory from the published system
+// snapshot, so the percent and ratio forms always come from one sample.
+type systemCollector struct {
+	// cpuPercent and cpuRatio carry the cluster label, and coreRatio too,
+	// on Apple Silicon only.
+	cpuPercent, cpuRatio       *prometheus.Desc
+	memoryPercent, memoryRatio *prometheus.Desc
+	memoryTotal, memoryUsed    *prometheus.Desc
+	coreRatio                  *prometheus.Desc
+	clusters                   []cpuCluster
+}
+
+func newSystemCollector(namespace string) *systemCollector {
+	clusters := cpuClusters()
+	var cpuLabels []string
+	coreLabels := []string{"core"}
+	if clusters != nil {
+		cpuLabels = []string{"cluster"}
+		coreLabels = append(coreLabels, "cluster")
+	}
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, labels, nil)
+	}
+	return &systemCollector{
+		cpuPercent:    desc("macbook_cpu_usage_percent", "CPU usage on MacBook in percent (0-100); on Apple Silicon cluster=performance|efficiency averages those cores and the whole machine has it empty; deprecated, use macbook_cpu_usage_ratio", cpuLabels...),
+		cpuRatio:      desc("macbook_cpu_usage_ratio", "CPU usage on MacBook as a ratio (0-1); on Apple Silicon cluster=performance|efficiency averages those cores and the whole machine has it empty", cpuLabels...),
+		memoryPercent: desc("macbook_memory_usage_percent", "Memory usage on MacBook in percent (0-100); deprecated, use macbook_memory_usage_ratio"),
+		memoryRatio:   desc("macbook_memory_usage_ratio", "Memory usage on MacBook as a ratio (0-1)"),
+		memoryTotal:   desc("macbook_memory_total_bytes", "Total memory on MacBook in bytes"),
+		memoryUsed:    desc("macbook_memory_used_bytes", "Used memory on MacBook in bytes"),
+		coreRatio:     desc("macbook_cpu_core_usage_ratio", "Usage of one logical CPU on MacBook as a ratio (0-1); cluster is performance or efficiency on Apple Silicon", coreLabels...),
+		clusters:      clusters,
+	}
+}
+
+func (c *systemCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.cpuPercent
+	ch <- c.cpuRatio
+	ch <- c.memoryPercent
+	ch <- c.memoryRatio
+	ch <- c.memoryTotal
+	ch <- c.memoryUsed
+	ch <- c.coreRatio
+}
+
+// collectCPU sends CPU usage in both forms, for the whole machine when
+// cluster is empty.
+func (c *systemCollector) collectCPU(ch chan<- prometheus.Metric, percent float64, cluster string) {
+	var labels []string
+	if c.clusters != nil {
+		labels = []string{cluster}
+	}
+	ch <- prometheus.MustNewConstMetric(c.cpuPercent, prometheus.GaugeValue, percent, labels...)
+	ch <- prometheus.MustNewConstMetric(c.cpuRatio, prometheus.GaugeValue, percentToRatio(percent), labels...)
+}
+
+func (c *systemCollector) Collect(ch chan<- prometheus.Metric) {
+	sys := currentSystem()
+	c.collectCPU(ch, sys.CPUPercent, "")
+	ch <- prometheus.MustNewConstMetric(c.memoryPercent, prometheus.GaugeValue, sys.MemoryPercent)
+	ch <- prometheus.MustNewConstMetric(c.memoryRatio, prometheus.GaugeValue, percentToRatio(sys.MemoryPercent))
+	ch <- prometheus.MustNewConstMetric(c.memoryTotal, prometheus.GaugeValue, float64(sys.MemoryTotal))
+	ch <- prometheus.MustNewConstMetric(c.memoryUsed, prometheus.GaugeValue, float64(sys.MemoryUsed))
+
+	sums, counts := make(map[string]float64), make(map[string]int)
+	for i, percent := range sys.CPUCorePercent {
+		core := strconv.Itoa(i)
+		if c.clusters == nil {
+			ch <- prometheus.MustNewConstMetric(c.coreRatio, prometheus.GaugeValue, percentToRatio(percent), core)
+			continue
+		}
+		cluster := clusterOf(c.clusters, i)
+		ch <- prometheus.MustNewConstMetric(c.coreRatio, prometheus.GaugeValue, percentToRatio(percent), core, cluster)
+		sums[cluster] += percent
+		counts[cluster]++
+	}
+	for cluster, n := range counts {
+		if cluster != "" {
+			c.collectCPU(ch, sums[cluster]/float64(n), cluster)
+		}
+	}
+}
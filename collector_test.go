@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestPercentToRatio(t *testing.T) {
+	for _, tc := range []struct{ percent, want float64 }{
+		{0, 0},
+		{100, 1},
+		{50, 0.5},
+		{12.5, 0.125},
+	} {
+		if got := percentToRatio(tc.percent); got != tc.want {
+			t.Errorf("percentToRatio(%v) = %v, want %v", tc.percent, got, tc.want)
+		}
+	}
+}
+
+// seriesByLabels keys a family's gauge values by their label values.
+func seriesByLabels(mf *dto.MetricFamily) map[string]float64 {
+	out := make(map[string]float64)
+	for _, m := range mf.Metric {
+		var key []string
+		for _, l := range m.Label {
+			key = append(key, l.GetName()+"="+l.GetValue())
+		}
+		out[strings.Join(key, ",")] = m.GetGauge().GetValue()
+	}
+	return out
+}
+
+// TestSystemRatioMatchesPercent scrapes the system collector after every
+// sample: each _ratio series must equal its _percent twin divided by 100.
+func TestSystemRatioMatchesPercent(t *testing.T) {
+	prev := currentSystem()
+	t.Cleanup(func() { publishSystem(prev) })
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(newSystemCollector(""))
+	for _, sys := range []SystemSnapshot{
+		{},
+		{CPUPercent: 100, MemoryPercent: 100, CPUCorePercent: []float64{100, 100}},
+		{CPUPercent: 33.333333333, MemoryPercent: 66.7, CPUCorePercent: []float64{0.1, 99.9, 42}},
+		{CPUPercent: 1e-9, MemoryPercent: 12.345678901234, MemoryTotal: 16 << 30, MemoryUsed: 2 << 30},
+	} {
+		publishSystem(sys)
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		families := make(map[string]*dto.MetricFamily)
+		for _, mf := range mfs {
+			families[mf.GetName()] = mf
+		}
+		for _, pair := range [][2]string{
+			{"macbook_cpu_usage_percent", "macbook_cpu_usage_ratio"},
+			{"macbook_memory_usage_percent", "macbook_memory_usage_ratio"},
+		} {
+			percent, ratio := families[pair[0]], families[pair[1]]
+			if percent == nil || ratio == nil {
+				t.Fatalf("missing %s or %s", pair[0], pair[1])
+			}
+			ratios := seriesByLabels(ratio)
+			for labels, p := range seriesByLabels(percent) {
+				r, ok := ratios[labels]
+				if !ok {
+					t.Errorf("%s{%s} has no %s twin", pair[0], labels, pair[1])
+					continue
+				}
+				if math.Abs(r*100-p) > 1e-9 || r < 0 || r > 1 {
+					t.Errorf("%s{%s} = %v but %s = %v", pair[1], labels, r, pair[0], p)
+				}
+			}
+		}
+		if got := len(families["macbook_cpu_core_usage_ratio"].GetMetric()); got != len(sys.CPUCorePercent) {
+			t.Errorf("%d core series for %d cores", got, len(sys.CPUCorePercent))
+		}
+		if used := families["macbook_memory_used_bytes"].Metric[0].GetGauge().GetValue(); used != float64(sys.MemoryUsed) {
+			t.Errorf("memory used %v, want %d bytes", used, sys.MemoryUsed)
+		}
+	}
+
+	// The help strings name the unit.
+	mfs, _ := reg.Gather()
+	for _, mf := range mfs {
+		var unit string
+		switch {
+		case strings.HasSuffix(mf.GetName(), "_ratio"):
+			unit = "ratio (0-1)"
+		case strings.HasSuffix(mf.GetName(), "_percent"):
+			unit = "percent (0-100)"
+		case strings.HasSuffix(mf.GetName(), "_bytes"):
+			unit = "bytes"
+		}
+		if !strings.Contains(mf.GetHelp(), unit) {
+			t.Errorf("%s help %q does not say %q", mf.GetName(), mf.GetHelp(), unit)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// decodeConfigStrict decodes a config file, rejecting unknown keys. Line
+// numbers in errors about a file of several documents are those of the
+// merged config `config validate` prints.
+func decodeConfigStrict(data []byte) (Config, error) {
+	var cfg Config
+	data, _, err := mergeConfigDocuments(data)
+	if err != nil {
+		return Config{}, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && err.Error() != "EOF" {
+		return Config{}, err
+	}
+	cfg.source = data
+	return cfg, nil
+}
+
+// validateConfig checks the parts of a config that are otherwise only
+// reported at scan time.
+func validateConfig(cfg Config) []error {
+	var errs []error
+	if _, err := cfg.Labels.policy(); err != nil {
+		errs = append(errs, err)
+	}
+	_, viewErrs := compileViews(cfg.Metrics.Namespace, cfg.Views)
+	errs = append(errs, viewErrs...)
+	if err := validateComponents(cfg.Components); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.DHCP.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	_, groupErrs := validGroups(cfg.Groups)
+	errs = append(errs, groupErrs...)
+	errs = append(errs, validateDevices(cfg.Devices)...)
+	errs = append(errs, validateDeviceSSH(cfg.Devices)...)
+	if err := cfg.Uplink.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.Scan.PingCommand.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.EventLog.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.Tracing.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.OTLP.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.PowerSave.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.CPU.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.Metrics.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.Anomaly.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateDHCPSniff(cfg); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseScanNetworks(cfg); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.Remote != nil {
+		if _, err := newSSHRunner(*cfg.Remote); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return append(errs, validateScanners(cfg)...)
+}
+
+// validateDevices rejects devices: entries without or with a repeated MAC,
+// since only the first entry of a MAC would ever apply.
+func validateDevices(devices []DeviceConfig) []error {
+	var errs []error
+	seen := make(map[string]bool)
+	for i, d := range devices {
+		mac := strings.ToLower(d.MAC)
+		switch {
+		case mac == "":
+			errs = append(errs, fmt.Errorf("devices[%d]: mac is required", i))
+		case seen[mac]:
+			errs = append(errs, fmt.Errorf("devices[%d]: duplicate device %s", i, mac))
+		}
+		seen[mac] = true
+	}
+	return append(errs, validateExpectedIPs(devices)...)
+}
+
+// configSchema is a JSON Schema of config.yaml derived from Config.
+func configSchema() map[string]interface{} {
+	s := typeSchema(reflect.TypeOf(Config{}), "yaml", map[reflect.Type]bool{})
+	s["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	s["title"] = "telemetry-test config.yaml"
+	return s
+}
+
+// runConfigCommand implements "config validate [-format text|json]
+// [path]" and "config schema".
+func runConfigCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: config validate [-format text|json] [path] | config schema")
+		return 2
+	}
+	switch args[0] {
+	case "schema":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(configSchema()); err != nil {
+			fmt.Fprintln(os.Stderr, "config schema:", err)
+			return 1
+		}
+		return 0
+	case "validate":
+		return runConfigValidate(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "config: unknown command %q (have validate, schema)\n", args[0])
+	return 2
+}
+
+func runConfigValidate(args []string) int {
+	fs := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	format := fs.String("format", "text", "output format: text or json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *format != "text" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "config validate: -format must be text or json, got %q\n", *format)
+		return 2
+	}
+	path := cfgPath
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+
+	var errs []error
+	// effective is the merged config of a file of several documents.
+	var effective []byte
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var docs int
+		if merged, n, mergeErr := mergeConfigDocuments(data); mergeErr == nil && n > 1 {
+			effective, docs = merged, n
+		}
+		var cfg Config
+		if cfg, err = decodeConfigStrict(data); err == nil {
+			errs = validateConfig(cfg)
+		}
+		if effective != nil && *format == "text" {
+			fmt.Printf("# Effective config of %s (%d documents merged):\n%s\n", path, docs, effective)
+		}
+	}
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if *format == "json" {
+		messages := []string{}
+		for _, err := range errs {
+			messages = append(messages, err.Error())
+		}
+		result := map[string]interface{}{
+			"path":   path,
+			"valid":  len(errs) == 0,
+			"errors": messages,
+		}
+		if effective != nil {
+			var generic interface{}
+			if yaml.Unmarshal(effective, &generic) == nil {
+				result["effective"] = generic
+			}
+		}
+		json.NewEncoder(os.Stdout).Encode(result)
+	} else if len(errs) == 0 {
+		fmt.Printf("%s is valid\n", path)
+	} else {
+		for _, err := range errs {
+			fmt.Printf("%s: %v\n", path, err)
+		}
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	return 0
+}
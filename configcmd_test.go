@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// schemaPaths walks t as yaml.v3 decodes it and calls visit with the
+// dotted path and the schema node of every field.
+func schemaPaths(t *testing.T, typ reflect.Type, schema map[string]interface{}, path string, seen map[reflect.Type]bool, visit func(string, map[string]interface{})) {
+	t.Helper()
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Slice, reflect.Array:
+		items, _ := schema["items"].(map[string]interface{})
+		schemaPaths(t, typ.Elem(), items, strings.TrimSuffix(path, ".")+"[].", seen, visit)
+		return
+	case reflect.Map:
+		elem, _ := schema["additionalProperties"].(map[string]interface{})
+		schemaPaths(t, typ.Elem(), elem, path+"*.", seen, visit)
+		return
+	case reflect.Struct:
+	default:
+		return
+	}
+	if typ == timeType || seen[typ] {
+		return
+	}
+	seen[typ] = true
+	defer delete(seen, typ)
+	props, _ := schema["properties"].(map[string]interface{})
+	for _, f := range reflect.VisibleFields(typ) {
+		if !f.IsExported() || (f.Anonymous && f.Tag.Get("yaml") == "") {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		child, _ := props[name].(map[string]interface{})
+		visit(path+name, child)
+		if child != nil {
+			schemaPaths(t, f.Type, child, path+name+".", seen, visit)
+		}
+	}
+}
+
+func TestConfigSchemaCoversEveryField(t *testing.T) {
+	// Round-trip through JSON as `config schema` prints it.
+	var schema map[string]interface{}
+	data, err := json.Marshal(configSchema())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+	walked := make(map[string]bool)
+	schemaPaths(t, reflect.TypeOf(Config{}), schema, "", map[reflect.Type]bool{}, func(path string, node map[string]interface{}) {
+		walked[path] = true
+		if node == nil {
+			t.Errorf("%s is missing from the schema", path)
+		}
+	})
+	for _, path := range []string{"network.cidrs", "scan.interface", "devices[].mac", "metrics.namespace", "http.websocket.allowed_origins"} {
+		if !walked[path] {
+			t.Errorf("%s was not walked (%d fields)", path, len(walked))
+		}
+	}
+	if schema["additionalProperties"] != false {
+		t.Error("unknown top-level keys are allowed by the schema")
+	}
+}
+
+// captureStdout runs f and returns what it printed.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	done := make(chan []byte)
+	go func() {
+		out, _ := io.ReadAll(r)
+		done <- out
+	}()
+	defer func() { os.Stdout = saved }()
+	f()
+	w.Close()
+	return string(<-done)
+}
+
+func TestConfigValidate(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name   string
+		config string
+		code   int
+		errors []string
+	}{
+		{"valid", "network:\n  cidrs: [\"192.168.1.0/24\"]\n", 0, nil},
+		{"unknown key", "network:\n  cidr: [\"192.168.1.0/24\"]\n", 1, []string{"field cidr not found"}},
+		{"bad cidr and regex", "network:\n  cidrs: [\"192.168.1.0\"]\nlabels:\n  allowed: \"[\"\n", 1, []string{"labels.allowed", "network.cidrs"}},
+		{"duplicate device", "devices:\n  - mac: aa:bb:cc:dd:ee:01\n  - mac: AA:BB:CC:DD:EE:01\n", 1, []string{"devices[1]: duplicate device aa:bb:cc:dd:ee:01"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.ReplaceAll(tc.name, " ", "_")+".yaml")
+			if err := os.WriteFile(path, []byte(tc.config), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			var code int
+			out := captureStdout(t, func() { code = runConfigCommand([]string{"validate", "-format", "json", path}) })
+			var result struct {
+				Path   string   `json:"path"`
+				Valid  bool     `json:"valid"`
+				Errors []string `json:"errors"`
+			}
+			if err := json.Unmarshal([]byte(out), &result); err != nil {
+				t.Fatalf("%v: %q", err, out)
+			}
+			if code != tc.code || result.Valid != (tc.code == 0) || result.Path != path {
+				t.Errorf("exit %d, %+v; want exit %d", code, result, tc.code)
+			}
+			joined := strings.Join(result.Errors, "\n")
+			for _, want := range tc.errors {
+				if !strings.Contains(joined, want) {
+					t.Errorf("errors %q do not mention %q", result.Errors, want)
+				}
+			}
+			if len(tc.errors) == 0 && len(result.Errors) != 0 {
+				t.Errorf("unexpected errors %q", result.Errors)
+			}
+		})
+	}
+
+	if code := runConfigCommand([]string{"validate", "-format", "xml"}); code != 2 {
+		t.Errorf("bad -format: exit %d", code)
+	}
+	if code := runConfigCommand([]string{"frobnicate"}); code != 2 {
+		t.Errorf("unknown command: exit %d", code)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// mergeConfigDocuments returns the effective config of a config file made
+// of one or more YAML documents separated by ---, and how many documents
+// it had. A file with a single document is returned unchanged.
+//
+// Later documents are merged over earlier ones, so a shared base can be
+// followed by per-site overlays:
+//   - mappings merge key by key, recursively;
+//   - anything else, lists included, replaces the earlier value;
+//   - a key ending in + (e.g. `devices+:`) appends its list to the earlier
+//     one instead of replacing it.
+func mergeConfigDocuments(data []byte) ([]byte, int, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	n := 0
+	for ; ; n++ {
+		var doc yaml.Node
+		err := dec.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, n, err
+		}
+		if len(doc.Content) == 0 {
+			continue
+		}
+		root := doc.Content[0]
+		if root.Kind == yaml.ScalarNode && root.Tag == "!!null" {
+			continue
+		}
+		if root.Kind != yaml.MappingNode {
+			return nil, n, fmt.Errorf("config document %d is not a YAML mapping", n+1)
+		}
+		// Anchors only reach within their document and may be replaced by
+		// a later one, so aliases are expanded before merging.
+		expandAliases(root)
+		if err := mergeMapping(merged, root, ""); err != nil {
+			return nil, n, fmt.Errorf("config document %d: %w", n+1, err)
+		}
+	}
+	if n <= 1 {
+		return data, n, nil
+	}
+	out, err := yaml.Marshal(merged)
+	return out, n, err
+}
+
+// mergeMapping merges the mapping src into dst as mergeConfigDocuments
+// describes; path is the key path of dst, for errors.
+func mergeMapping(dst, src *yaml.Node, path string) error {
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		keyNode, value := src.Content[i], src.Content[i+1]
+		key := keyNode.Value
+		appending := strings.HasSuffix(key, "+")
+		if appending {
+			key = strings.TrimSuffix(key, "+")
+			if value.Kind != yaml.SequenceNode {
+				return fmt.Errorf("%s%s+ must be a list", path, key)
+			}
+		}
+		if value.Kind == yaml.MappingNode {
+			// Resolves + keys nested in a mapping that replaces or adds.
+			fresh := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Style: value.Style}
+			if err := mergeMapping(fresh, value, path+key+"."); err != nil {
+				return err
+			}
+			value = fresh
+		}
+
+		j := mappingIndex(dst, key)
+		switch {
+		case j < 0:
+			k := *keyNode
+			k.Value = key
+			dst.Content = append(dst.Content, &k, value)
+		case appending:
+			prev := dst.Content[j+1]
+			if prev.Kind == yaml.ScalarNode && prev.Tag == "!!null" {
+				dst.Content[j+1] = value
+			} else if prev.Kind != yaml.SequenceNode {
+				return fmt.Errorf("%s%s+: cannot append to %s, which is not a list", path, key, path+key)
+			} else {
+				if len(prev.Content) == 0 {
+					// Keep `devices: []` from turning the appended list into flow style.
+					prev.Style = value.Style
+				}
+				prev.Content = append(prev.Content, value.Content...)
+			}
+		case dst.Content[j+1].Kind == yaml.MappingNode && value.Kind == yaml.MappingNode:
+			if err := mergeMapping(dst.Content[j+1], value, path+key+"."); err != nil {
+				return err
+			}
+		default:
+			dst.Content[j+1] = value
+		}
+	}
+	return nil
+}
+
+func mappingIndex(mapping *yaml.Node, key string) int {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// expandAliases replaces every alias under n with a copy of what it
+// points at.
+func expandAliases(n *yaml.Node) {
+	n.Anchor = ""
+	for i, c := range n.Content {
+		if c.Kind == yaml.AliasNode && c.Alias != nil {
+			c = copyNode(c.Alias)
+			n.Content[i] = c
+		}
+		expandAliases(c)
+	}
+}
+
+func copyNode(n *yaml.Node) *yaml.Node {
+	cp := *n
+	cp.Content = make([]*yaml.Node, len(n.Content))
+	for i, c := range n.Content {
+		cp.Content[i] = copyNode(c)
+	}
+	return &cp
+}
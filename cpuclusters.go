@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// cpuCluster is a range of logical CPUs of one core type.
+type cpuCluster struct {
+	Name  string // "performance" or "efficiency"
+	First int
+	Count int
+}
+
+var (
+	cpuClustersOnce sync.Once
+	cpuClusterList  []cpuCluster
+)
+
+// perfLevelKeys are the sysctls describing the core types of Apple
+// Silicon; no chip has more than two yet.
+var perfLevelKeys = []string{
+	"hw.perflevel0.name", "hw.perflevel0.logicalcpu",
+	"hw.perflevel1.name", "hw.perflevel1.logicalcpu",
+}
+
+// cpuClusters returns the core clusters of this host, read once. It is nil
+// except on Apple Silicon, so the cluster label is left out elsewhere.
+func cpuClusters() []cpuCluster {
+	cpuClustersOnce.Do(func() {
+		if runtime.GOOS != "darwin" || runtime.GOARCH != "arm64" {
+			return
+		}
+		out, err := outputAccounted("sysctl", perfLevelKeys...)
+		if err != nil {
+			errorLog.Printf("Error reading the CPU clusters (sysctl hw.perflevel*): %v", err)
+			return
+		}
+		cpuClusterList = parsePerfLevels(string(out))
+		for _, c := range cpuClusterList {
+			log.Printf("CPUs %d-%d are %s cores", c.First, c.First+c.Count-1, c.Name)
+		}
+	})
+	return cpuClusterList
+}
+
+// parsePerfLevels parses `sysctl hw.perflevel0.name ...`, e.g. on an M1:
+//
+//	hw.perflevel0.name: Performance
+//	hw.perflevel0.logicalcpu: 4
+//	hw.perflevel1.name: Efficiency
+//	hw.perflevel1.logicalcpu: 4
+//
+// (M1 Pro: 8 and 2, M2: 4 and 4, M3 Pro: 6 and 6). perflevel0 is the
+// fastest type, but the kernel numbers CPUs from the slowest up, so the
+// efficiency cores come first.
+func parsePerfLevels(out string) []cpuCluster {
+	values := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			values[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	var levels []cpuCluster
+	for i := 0; ; i++ {
+		name := values[fmt.Sprintf("hw.perflevel%d.name", i)]
+		n, err := strconv.Atoi(values[fmt.Sprintf("hw.perflevel%d.logicalcpu", i)])
+		if name == "" || err != nil || n <= 0 {
+			break
+		}
+		levels = append(levels, cpuCluster{Name: strings.ToLower(name), Count: n})
+	}
+	if len(levels) < 2 {
+		return nil
+	}
+	clusters := make([]cpuCluster, 0, len(levels))
+	first := 0
+	for i := len(levels) - 1; i >= 0; i-- {
+		c := levels[i]
+		c.First = first
+		first += c.Count
+		clusters = append(clusters, c)
+	}
+	return clusters
+}
+
+// clusterOf returns the cluster of a logical CPU, or "" if unknown.
+func clusterOf(clusters []cpuCluster, cpu int) string {
+	for _, c := range clusters {
+		if cpu >= c.First && cpu < c.First+c.Count {
+			return c.Name
+		}
+	}
+	return ""
+}
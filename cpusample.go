@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+)
+
+// CPUConfig sets how CPU usage is measured.
+type CPUConfig struct {
+	// SampleWindow, when set, measures CPU usage over a window of this
+	// length on every sample instead of since the previous sample. The
+	// system loop blocks for the window, so it must be shorter than the
+	// 5s sampling period.
+	SampleWindow time.Duration `yaml:"sample_window"`
+}
+
+func (c CPUConfig) validate() error {
+	if c.SampleWindow < 0 || c.SampleWindow >= systemInterval {
+		return fmt.Errorf("cpu.sample_window must be between 0 and %s, got %s", systemInterval, c.SampleWindow)
+	}
+	return nil
+}
+
+// cpuSampler measures CPU usage from the kernel's cumulative CPU times.
+//
+// gopsutil's cpu.Percent(0, ...) does the same, but keeps its baseline in
+// a package global shared by every caller: its first call compares against
+// boot and returns the average since then, and two callers interleaving
+// (say the system loop and a second sampler) each get the other's interval.
+// cpuSampler keeps its own baseline behind a mutex instead, and reports
+// nothing on the first sample rather than the since-boot average.
+type cpuSampler struct {
+	mu     sync.Mutex
+	times  func(percpu bool) ([]cpu.TimesStat, error)
+	window time.Duration
+	total  []cpu.TimesStat
+	cores  []cpu.TimesStat
+}
+
+// systemCPU is the one sampler everything reading CPU usage goes through.
+var systemCPU = &cpuSampler{times: cpu.Times}
+
+func (s *cpuSampler) setWindow(window time.Duration) {
+	s.mu.Lock()
+	s.window = window
+	s.mu.Unlock()
+}
+
+// sample returns the total and per-core CPU usage in percent. ok is false
+// when there is no usable total: the times could not be read, or this is
+// the first sample and there is nothing to compare against yet. cores is
+// nil in the same cases for the per-core times.
+func (s *cpuSampler) sample() (total float64, cores []float64, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.window > 0 {
+		// Take a fresh baseline so the result covers exactly the window.
+		s.read()
+		time.Sleep(s.window)
+	}
+	prevTotal, prevCores := s.total, s.cores
+	s.read()
+	if usage := cpuUsage(prevTotal, s.total); len(usage) == 1 {
+		total, ok = usage[0], true
+	}
+	return total, cpuUsage(prevCores, s.cores), ok
+}
+
+// read replaces the baseline with the current times, keeping the old one
+// when they cannot be read.
+func (s *cpuSampler) read() {
+	if t, err := s.times(false); err == nil && len(t) > 0 {
+		s.total = t
+	} else if err != nil {
+		debugf("Error reading CPU times: %v", err)
+	}
+	if t, err := s.times(true); err == nil && len(t) > 0 {
+		s.cores = t
+	}
+}
+
+// cpuUsage returns the busy percentage of each CPU between two readings,
+// or nil when they cannot be compared (no previous reading, or CPUs came
+// or went in between).
+func cpuUsage(prev, cur []cpu.TimesStat) []float64 {
+	if len(prev) == 0 || len(prev) != len(cur) {
+		return nil
+	}
+	usage := make([]float64, len(cur))
+	for i := range cur {
+		busy0, all0 := cpuBusy(prev[i])
+		busy1, all1 := cpuBusy(cur[i])
+		switch {
+		case busy1 <= busy0, all1 <= all0:
+			usage[i] = 0
+		default:
+			usage[i] = min(100*(busy1-busy0)/(all1-all0), 100)
+		}
+	}
+	return usage
+}
+
+// cpuBusy returns the busy and total seconds of a reading. Guest time is
+// left out: Linux already counts it in user time.
+func cpuBusy(t cpu.TimesStat) (busy, all float64) {
+	all = t.User + t.System + t.Idle + t.Nice + t.Iowait + t.Irq + t.Softirq + t.Steal
+	return all - t.Idle - t.Iowait, all
+}
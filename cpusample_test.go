@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+)
+
+// fakeCPUTimes serves scripted readings, one per sample: the total and
+// the per-core times. A nil total fails the read.
+type fakeCPUTimes struct {
+	readings [][]cpu.TimesStat // total followed by cores
+	reads    int
+}
+
+func (f *fakeCPUTimes) times(percpu bool) ([]cpu.TimesStat, error) {
+	r := f.readings[min(f.reads, len(f.readings)-1)]
+	if percpu {
+		f.reads++
+		if r == nil {
+			return nil, errors.New("no /proc/stat")
+		}
+		return r[1:], nil
+	}
+	if r == nil {
+		return nil, errors.New("no /proc/stat")
+	}
+	return r[:1], nil
+}
+
+// busyIdle is a reading with the given user and idle seconds.
+func busyIdle(user, idle float64) cpu.TimesStat {
+	return cpu.TimesStat{User: user, Idle: idle}
+}
+
+func TestCPUSampler(t *testing.T) {
+	fake := &fakeCPUTimes{readings: [][]cpu.TimesStat{
+		// Since boot: 90% busy, which must not be reported.
+		{busyIdle(900, 100), busyIdle(450, 50), busyIdle(450, 50)},
+		{busyIdle(930, 170), busyIdle(460, 90), busyIdle(470, 80)},
+		nil,
+		{busyIdle(990, 210), busyIdle(490, 110), busyIdle(500, 100)},
+		// A counter going backwards, and a core going offline.
+		{busyIdle(980, 200), busyIdle(495, 115)},
+	}}
+	s := &cpuSampler{times: fake.times}
+	for _, tc := range []struct {
+		name  string
+		total float64
+		cores []float64
+		ok    bool
+	}{
+		{"first sample", 0, nil, false},
+		{"delta", 30, []float64{20, 40}, true},
+		// The baseline is kept, so the failed read reports no activity...
+		{"failed read", 0, []float64{0, 0}, true},
+		// ...and the next one covers both periods.
+		{"after a failed read", 60, []float64{60, 60}, true},
+		{"counters reset", 0, nil, true},
+	} {
+		total, cores, ok := s.sample()
+		if total != tc.total || ok != tc.ok || !reflect.DeepEqual(cores, tc.cores) {
+			t.Errorf("%s: got %v %v %v, want %v %v %v", tc.name, total, cores, ok, tc.total, tc.cores, tc.ok)
+		}
+	}
+}
+
+func TestCPUSamplerWindow(t *testing.T) {
+	fake := &fakeCPUTimes{readings: [][]cpu.TimesStat{
+		{busyIdle(900, 100), busyIdle(900, 100)},
+		{busyIdle(910, 190), busyIdle(910, 190)},
+	}}
+	s := &cpuSampler{times: fake.times}
+	s.setWindow(10 * time.Millisecond)
+	start := time.Now()
+	// The window takes its own baseline, so even the first sample counts.
+	total, _, ok := s.sample()
+	if !ok || total != 10 {
+		t.Errorf("got %v %v, want 10%% over the window", total, ok)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("sampled in %s, shorter than the window", elapsed)
+	}
+}
+
+// TestCPUSamplerConcurrent samples from several goroutines at once. Every
+// reading adds 1s busy and 3s idle, so each sample must be exactly 25%:
+// interleaved reads would pair one caller's baseline with another's.
+func TestCPUSamplerConcurrent(t *testing.T) {
+	var busy, idle float64
+	s := &cpuSampler{times: func(percpu bool) ([]cpu.TimesStat, error) {
+		if percpu {
+			return []cpu.TimesStat{busyIdle(busy, idle)}, nil
+		}
+		busy, idle = busy+1, idle+3
+		return []cpu.TimesStat{busyIdle(busy, idle)}, nil
+	}}
+	s.sample()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var bad []float64
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				if total, _, ok := s.sample(); !ok || total != 25 {
+					mu.Lock()
+					bad = append(bad, total)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(bad) > 0 {
+		t.Errorf("%d samples off 25%%: %v", len(bad), bad[:min(len(bad), 5)])
+	}
+}
+
+func TestCPUBusy(t *testing.T) {
+	// Guest time is already part of user time on Linux.
+	busy, all := cpuBusy(cpu.TimesStat{User: 10, System: 5, Idle: 80, Nice: 1, Iowait: 2, Irq: 1, Softirq: 1, Steal: 0, Guest: 4})
+	if busy != 18 || all != 100 {
+		t.Errorf("busy %v of %v, want 18 of 100", busy, all)
+	}
+}
+
+func TestCPUConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		window time.Duration
+		ok     bool
+	}{
+		{0, true},
+		{time.Second, true},
+		{-time.Second, false},
+		{systemInterval, false},
+	} {
+		if err := (CPUConfig{SampleWindow: tc.window}).validate(); (err == nil) != tc.ok {
+			t.Errorf("sample_window %s: %v", tc.window, err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type DebugConfig struct {
+	// RetainScanDetails keeps the raw inputs and decisions of the last scan
+	// for GET /api/v1/debug/scan-dump.
+	RetainScanDetails bool `yaml:"retain_scan_details"`
+	// BundleDir receives debug bundles from POST /api/v1/debug/bundle;
+	// empty returns them in the response. BundleInterval rate-limits
+	// generation (default 1m).
+	BundleDir      string        `yaml:"bundle_dir"`
+	BundleInterval time.Duration `yaml:"bundle_interval"`
+}
+
+type scanDump struct {
+	TakenAt    time.Time         `json:"taken_at"`
+	ARPOutput  string            `json:"arp_output"`
+	ARPEntries map[string]string `json:"arp_entries"`
+	Devices    []deviceDump      `json:"devices"`
+	Config     interface{}       `json:"config"`
+
+	cfg Config // effective config of the scan, rendered into Config on request
+}
+
+type deviceDump struct {
+	IP             string             `json:"ip"`
+	MAC            string             `json:"mac"`
+	Probe          ProbeResult        `json:"probe"`
+	ProbeError     string             `json:"probe_error,omitempty"`
+	Names          map[string]string  `json:"names"`
+	NameErrors     map[string]string  `json:"name_errors,omitempty"`
+	Hostname       string             `json:"hostname"`
+	Classification classificationDump `json:"classification"`
+}
+
+type classificationDump struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func errStrings(errs map[string]error) map[string]string {
+	out := make(map[string]string, len(errs))
+	for k, err := range errs {
+		out[k] = err.Error()
+	}
+	return out
+}
+
+func redactedIfSet(s string) string {
+	if s == "" {
+		return s
+	}
+	return "<redacted>"
+}
+
+// redactedHeaders returns a copy of headers with every value replaced;
+// they are mostly credentials such as Authorization.
+func redactedHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	out := make(map[string]string, len(headers))
+	for k, v := range headers {
+		out[k] = redactedIfSet(v)
+	}
+	return out
+}
+
+// redacted returns cfg with its secrets replaced.
+func (cfg Config) redacted() Config {
+	if cfg.Admin.Password != "" {
+		cfg.Admin.Password = "<redacted>"
+	}
+	if cfg.HTTP.Ingest.Token != "" {
+		cfg.HTTP.Ingest.Token = "<redacted>"
+	}
+	if cfg.Uplink.Token != "" {
+		cfg.Uplink.Token = "<redacted>"
+	}
+	cfg.OTLP.Headers = redactedHeaders(cfg.OTLP.Headers)
+	cfg.Tracing.Headers = redactedHeaders(cfg.Tracing.Headers)
+	// SSH users and key paths of managed devices.
+	devices := make([]DeviceConfig, len(cfg.Devices))
+	for i, d := range cfg.Devices {
+		if d.SSH != nil {
+			ssh := *d.SSH
+			ssh.User, ssh.KeyFile, ssh.KnownHostsFile = redactedIfSet(ssh.User), redactedIfSet(ssh.KeyFile), redactedIfSet(ssh.KnownHostsFile)
+			d.SSH = &ssh
+		}
+		devices[i] = d
+	}
+	cfg.Devices = devices
+	if cfg.Scanners != nil {
+		scanners := make([]ScannerConfig, len(cfg.Scanners))
+		for i, s := range cfg.Scanners {
+			scanners[i] = s.redacted()
+		}
+		cfg.Scanners = scanners
+	}
+	return cfg
+}
+
+// configAsMap converts cfg to a generic value keyed like config.yaml, with
+// secrets redacted.
+func configAsMap(cfg Config) (interface{}, error) {
+	var generic interface{}
+	data, err := yaml.Marshal(cfg.redacted())
+	if err == nil {
+		err = yaml.Unmarshal(data, &generic)
+	}
+	return generic, err
+}
+
+var macPattern = regexp.MustCompile(`(?i)\b[0-9a-f]{1,2}(:[0-9a-f]{1,2}){5}\b`)
+
+func anonymize(s string) string {
+	if s == "" || s == "<unknown>" || s == unknownMAC {
+		return s
+	}
+	sum := sha256.Sum256([]byte(strings.ToLower(s)))
+	return "anon-" + hex.EncodeToString(sum[:6])
+}
+
+// anonymized returns a copy of d with MACs and hostnames hashed, so the
+// same device still correlates across sections of the dump.
+func (d *scanDump) anonymized() *scanDump {
+	out := *d
+	out.ARPOutput = macPattern.ReplaceAllStringFunc(d.ARPOutput, anonymize)
+	out.ARPEntries = make(map[string]string, len(d.ARPEntries))
+	for ip, mac := range d.ARPEntries {
+		out.ARPEntries[ip] = anonymize(mac)
+	}
+	out.cfg.Devices = make([]DeviceConfig, len(d.cfg.Devices))
+	for i, dc := range d.cfg.Devices {
+		dc.MAC = anonymize(dc.MAC)
+		dc.Name = anonymize(dc.Name)
+		dc.Owner = anonymize(dc.Owner)
+		out.cfg.Devices[i] = dc
+	}
+	out.Devices = make([]deviceDump, len(d.Devices))
+	for i, dev := range d.Devices {
+		dev.MAC = anonymize(dev.MAC)
+		dev.Hostname = anonymize(dev.Hostname)
+		names := make(map[string]string, len(dev.Names))
+		for source, name := range dev.Names {
+			names[source] = anonymize(name)
+		}
+		dev.Names = names
+		out.Devices[i] = dev
+	}
+	return &out
+}
+
+// scanDumpHandler serves GET /api/v1/debug/scan-dump from the details kept
+// by the last scan of the scanner ?scanner= names; ?anonymize=true hashes
+// MACs and hostnames.
+func scanDumpHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := scannerFor(w, r)
+	if !ok {
+		return
+	}
+	dump := s.lastScanDump.Load()
+	if dump == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{
+			"error": "no scan details retained; set debug.retain_scan_details: true and wait for a scan",
+		})
+		return
+	}
+	if r.URL.Query().Get("anonymize") == "true" {
+		dump = dump.anonymized()
+	} else {
+		copied := *dump
+		dump = &copied
+	}
+	var err error
+	if dump.Config, err = configAsMap(dump.cfg); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if requestCancelled(r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, dump)
+}
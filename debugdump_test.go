@@ -0,0 +1,283 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// secretConfig sets every secret redacted() knows about; each value is
+// unique so a leak can be found in any response.
+const secretConfig = `
+admin:
+  username: admin
+  password: secret-admin-password
+http:
+  ingest:
+    token: secret-ingest-token
+uplink:
+  token: secret-uplink-token
+otlp:
+  endpoint: https://collector.example/v1/metrics
+  headers:
+    Authorization: Bearer secret-otlp-token
+    X-Empty: ""
+tracing:
+  headers:
+    api-key: secret-tracing-key
+devices:
+  - mac: aa:bb:cc:dd:ee:01
+    name: nas
+    ssh:
+      host: nas.lan
+      user: secret-ssh-user
+      key_file: /home/secret-key-file
+      known_hosts_file: /home/secret-known-hosts
+  - mac: aa:bb:cc:dd:ee:02
+    name: tv
+`
+
+var configSecrets = []string{
+	"secret-admin-password", "secret-ingest-token", "secret-uplink-token", "secret-otlp-token",
+	"secret-tracing-key", "secret-ssh-user", "secret-key-file", "secret-known-hosts",
+}
+
+func TestRedacted(t *testing.T) {
+	cfg, err := loadConfigData(t, secretConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := cfg.redacted()
+	for _, tc := range []struct {
+		field     string
+		got, want string
+	}{
+		{"admin.password", r.Admin.Password, "<redacted>"},
+		{"admin.username", r.Admin.Username, "admin"},
+		{"http.ingest.token", r.HTTP.Ingest.Token, "<redacted>"},
+		{"uplink.token", r.Uplink.Token, "<redacted>"},
+		{"otlp.endpoint", r.OTLP.Endpoint, "https://collector.example/v1/metrics"},
+		{"otlp.headers.Authorization", r.OTLP.Headers["Authorization"], "<redacted>"},
+		{"otlp.headers.X-Empty", r.OTLP.Headers["X-Empty"], ""},
+		{"tracing.headers.api-key", r.Tracing.Headers["api-key"], "<redacted>"},
+		{"devices[0].ssh.host", r.Devices[0].SSH.Host, "nas.lan"},
+		{"devices[0].ssh.user", r.Devices[0].SSH.User, "<redacted>"},
+		{"devices[0].ssh.key_file", r.Devices[0].SSH.KeyFile, "<redacted>"},
+		{"devices[0].ssh.known_hosts_file", r.Devices[0].SSH.KnownHostsFile, "<redacted>"},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s = %q, want %q", tc.field, tc.got, tc.want)
+		}
+	}
+	if r.Devices[1].SSH != nil {
+		t.Error("a device without ssh got one")
+	}
+
+	// The original is left alone: maps, slices and pointers are copied.
+	if cfg.Admin.Password != "secret-admin-password" || cfg.OTLP.Headers["Authorization"] != "Bearer secret-otlp-token" ||
+		cfg.Tracing.Headers["api-key"] != "secret-tracing-key" || cfg.Devices[0].SSH.User != "secret-ssh-user" {
+		t.Errorf("redacted() modified the config it was called on: %+v", cfg)
+	}
+}
+
+func TestRedactedEmpty(t *testing.T) {
+	var cfg Config
+	if r := cfg.redacted(); !reflect.DeepEqual(r, Config{Devices: []DeviceConfig{}}) {
+		t.Errorf("unset secrets became %+v", r)
+	}
+}
+
+func loadConfigData(t *testing.T, data string) (Config, error) {
+	t.Helper()
+	p := path.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return loadConfig(p)
+}
+
+// inSecretConfigDir runs the test from a directory whose config.yaml is
+// secretConfig, and returns that config redacted as the handlers serve it.
+func inSecretConfigDir(t *testing.T) (Config, interface{}) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile(cfgPath, []byte(secretConfig), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generic, err := configAsMap(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg, jsonRoundTrip(t, generic)
+}
+
+// withScanner installs a single unnamed scanner for the handlers to serve.
+func withScanner(t *testing.T) *scanner {
+	t.Helper()
+	prev := scanners
+	s := newScanner("", 1)
+	scanners = []*scanner{s}
+	t.Cleanup(func() { scanners = prev })
+	return s
+}
+
+func jsonRoundTrip(t *testing.T, v interface{}) interface{} {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func checkNoSecrets(t *testing.T, where string, body []byte) {
+	t.Helper()
+	for _, s := range configSecrets {
+		if bytes.Contains(body, []byte(s)) {
+			t.Errorf("%s leaks %s", where, s)
+		}
+	}
+}
+
+// checkRedactedConfig compares a served config with want and spot checks
+// that the secrets in it are redacted.
+func checkRedactedConfig(t *testing.T, where string, got, want interface{}) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s config = %v, want %v", where, got, want)
+	}
+	m, _ := got.(map[string]interface{})
+	admin, _ := m["admin"].(map[string]interface{})
+	otlp, _ := m["otlp"].(map[string]interface{})
+	headers, _ := otlp["headers"].(map[string]interface{})
+	if admin["password"] != "<redacted>" || headers["Authorization"] != "<redacted>" {
+		t.Errorf("%s config is not redacted: admin %v, otlp headers %v", where, admin, headers)
+	}
+}
+
+func TestConfigHandlerRedacts(t *testing.T) {
+	_, want := inSecretConfigDir(t)
+	rec := httptest.NewRecorder()
+	configHandler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/config", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+	checkNoSecrets(t, "/api/v1/config", rec.Body.Bytes())
+	var resp struct {
+		Config interface{} `json:"config"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	checkRedactedConfig(t, "/api/v1/config", resp.Config, want)
+}
+
+func TestScanDumpHandlerRedacts(t *testing.T) {
+	cfg, want := inSecretConfigDir(t)
+	dump := &scanDump{TakenAt: time.Now(), ARPEntries: map[string]string{}, cfg: cfg}
+	s := withScanner(t)
+	s.lastScanDump.Store(dump)
+	anonymized, err := configAsMap(dump.anonymized().cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for query, want := range map[string]interface{}{"": want, "?anonymize=true": jsonRoundTrip(t, anonymized)} {
+		rec := httptest.NewRecorder()
+		scanDumpHandler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/debug/scan-dump"+query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: got %d: %s", query, rec.Code, rec.Body)
+		}
+		checkNoSecrets(t, "/api/v1/debug/scan-dump"+query, rec.Body.Bytes())
+		var resp struct {
+			Config interface{} `json:"config"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		checkRedactedConfig(t, "/api/v1/debug/scan-dump"+query, resp.Config, want)
+	}
+	if s.lastScanDump.Load().Config != nil {
+		t.Error("the handler rendered the config into the retained dump")
+	}
+}
+
+func TestBundleHandlerRedacts(t *testing.T) {
+	cfg, want := inSecretConfigDir(t)
+	withScanner(t).lastScanDump.Store(&scanDump{TakenAt: time.Now(), ARPEntries: map[string]string{}, cfg: cfg})
+	bundleMu.Lock()
+	lastBundle = time.Time{}
+	bundleMu.Unlock()
+
+	rec := httptest.NewRecorder()
+	bundleHandler(DebugConfig{}, prometheus.NewRegistry())(rec, httptest.NewRequest(http.MethodPost, "/api/v1/debug/bundle", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	found := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := path.Base(hdr.Name)
+		found[name] = true
+		checkNoSecrets(t, "bundle "+name, data)
+		switch name {
+		case "config.json":
+			var got interface{}
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			checkRedactedConfig(t, "bundle config.json", got, want)
+		case "scan-dump.json":
+			var got struct {
+				Config interface{} `json:"config"`
+			}
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			checkRedactedConfig(t, "bundle scan-dump.json", got.Config, want)
+		}
+	}
+	for _, name := range []string{"config.json", "scan-dump.json"} {
+		if !found[name] {
+			t.Errorf("bundle has no %s", name)
+		}
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Disposition"), "attachment; ") {
+		t.Errorf("Content-Disposition %q", rec.Header().Get("Content-Disposition"))
+	}
+}
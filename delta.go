@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+type AnomalyConfig struct {
+	// DeviceDeltaThreshold fires a device_count_jump event when the device
+	// count changes by at least this much in one scan; 0 disables it.
+	DeviceDeltaThreshold int `yaml:"device_delta_threshold"`
+	// ShrinkPercent holds back a scan whose device count is more than this
+	// far below the recent average until the next scan confirms it
+	// (default 50; 100 disables it).
+	ShrinkPercent float64 `yaml:"shrink_percent"`
+}
+
+func (c AnomalyConfig) shrinkPercent() float64 {
+	if c.ShrinkPercent <= 0 {
+		return 50
+	}
+	return c.ShrinkPercent
+}
+
+func (c AnomalyConfig) validate() error {
+	if c.ShrinkPercent < 0 || c.ShrinkPercent > 100 {
+		return fmt.Errorf("anomaly.shrink_percent must be between 0 and 100, got %g", c.ShrinkPercent)
+	}
+	return nil
+}
+
+// rateSmoothing is the weight of the newest sample in the smoothed rate.
+const rateSmoothing = 0.2
+
+// deviceTrendState tracks the device count of the last trustworthy scan.
+type deviceTrendState struct {
+	count  int
+	at     time.Time
+	rate   float64 // devices per hour, exponentially smoothed
+	primed bool
+}
+
+// trackDeviceDelta updates wifi_devices_delta and wifi_devices_rate_per_hour.
+// The first scan after startup only sets the baseline, and degraded scans
+// (neighbor table unreadable or replaced by the ping fallback) are skipped
+// so they neither produce a delta nor become the next baseline.
+func (s *scanner) trackDeviceDelta(cfg AnomalyConfig, count int, degraded bool, now time.Time) {
+	if degraded {
+		return
+	}
+	if !s.deviceTrend.primed {
+		s.deviceTrend.count, s.deviceTrend.at, s.deviceTrend.primed = count, now, true
+		return
+	}
+	delta := count - s.deviceTrend.count
+	if hours := now.Sub(s.deviceTrend.at).Hours(); hours > 0 {
+		s.deviceTrend.rate = rateSmoothing*(float64(delta)/hours) + (1-rateSmoothing)*s.deviceTrend.rate
+	}
+	s.m.DevicesDelta.Set(float64(delta))
+	s.m.DevicesRate.Set(s.deviceTrend.rate)
+
+	if cfg.DeviceDeltaThreshold > 0 && math.Abs(float64(delta)) >= float64(cfg.DeviceDeltaThreshold) {
+		s.emitEvent("device_count_jump", map[string]interface{}{
+			"delta":    delta,
+			"devices":  count,
+			"previous": s.deviceTrend.count,
+		})
+	}
+	s.deviceTrend.count, s.deviceTrend.at = count, now
+}
+
+// shrinkWindow is how many accepted scans the shrink check averages.
+const shrinkWindow = 10
+
+// scanShrinkState is the state of the shrink check.
+type scanShrinkState struct {
+	counts  []int // device counts of the last accepted scans
+	pending bool  // the last scan was held back
+	network string
+}
+
+// shrinkSignals are what the scan saw that could explain a drop.
+type shrinkSignals struct {
+	NeighborErr   error
+	ProbeFailures int // probe errors other than timeouts
+	// Network is the gateway and our address on each scanned network;
+	// a change means the host moved or switched interfaces.
+	Network string
+}
+
+// suspectedCause picks the likeliest explanation for a drop.
+func (s shrinkSignals) suspectedCause(networkChanged bool) string {
+	switch {
+	case errors.Is(s.NeighborErr, ErrParse):
+		return "parse_errors"
+	case networkChanged:
+		return "interface_change"
+	case s.ProbeFailures > 0:
+		return "probe_failures"
+	}
+	return "unknown"
+}
+
+// scanNetworkSignature identifies where this scan ran from, for
+// shrinkSignals.Network.
+func scanNetworkSignature(networks []scanNetwork, gateway string) string {
+	parts := []string{gateway}
+	for _, n := range networks {
+		ip, mac, _ := localAddress(n.Scan, n.Range)
+		parts = append(parts, ip+"@"+mac)
+	}
+	return strings.Join(parts, ",")
+}
+
+// checkScanShrink compares a scan's device count with the average of the
+// last accepted scans and reports whether to hold the scan back: when it
+// dropped by more than shrink_percent, the previous scan stays exported
+// and only the next scan dropping as well confirms the new count, so a
+// single bad sweep (often a parser regression) does not wipe the device
+// metrics. Degraded scans are already known to be incomplete and are not
+// checked or averaged.
+func (s *scanner) checkScanShrink(cfg AnomalyConfig, count int, degraded bool, sig shrinkSignals) bool {
+	networkChanged := s.scanShrink.network != "" && sig.Network != s.scanShrink.network
+	s.scanShrink.network = sig.Network
+	if degraded {
+		return false
+	}
+	avg := 0.0
+	for _, n := range s.scanShrink.counts {
+		avg += float64(n)
+	}
+	if len(s.scanShrink.counts) > 0 {
+		avg /= float64(len(s.scanShrink.counts))
+	}
+	limit := avg * (1 - cfg.shrinkPercent()/100)
+	if float64(count) >= limit || avg == 0 {
+		if s.scanShrink.pending {
+			s.printf("Device count back to %d (average %.1f): the held scan was a one-off", count, avg)
+			s.scanShrink.pending = false
+		}
+		s.m.ScanResultAnomaly.Set(0)
+		s.acceptScanCount(count)
+		return false
+	}
+
+	s.m.ScanResultAnomaly.Set(1)
+	fields := map[string]interface{}{
+		"devices":         count,
+		"average":         math.Round(avg*10) / 10,
+		"drop_percent":    math.Round(1000*(1-float64(count)/avg)) / 10,
+		"suspected_cause": sig.suspectedCause(networkChanged),
+		"probe_failures":  sig.ProbeFailures,
+	}
+	if sig.NeighborErr != nil {
+		fields["neighbor_error"] = sig.NeighborErr.Error()
+	}
+	if !s.scanShrink.pending {
+		s.scanShrink.pending = true
+		fields["confirmed"] = false
+		s.logf("Scan found %d devices against an average of %.1f (suspected cause: %s); keeping the previous scan until the next one confirms the drop",
+			count, avg, fields["suspected_cause"])
+		s.emitEvent("scan_result_shrunk", fields)
+		return true
+	}
+	// The drop is real: start the average over from the new count.
+	s.scanShrink.pending = false
+	s.scanShrink.counts = []int{count}
+	fields["confirmed"] = true
+	s.logf("Second scan in a row found %d devices against an average of %.1f; publishing it", count, avg)
+	s.emitEvent("scan_result_shrunk", fields)
+	return false
+}
+
+func (s *scanner) acceptScanCount(count int) {
+	s.scanShrink.counts = append(s.scanShrink.counts, count)
+	if len(s.scanShrink.counts) > shrinkWindow {
+		s.scanShrink.counts = s.scanShrink.counts[1:]
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"time"
+)
+
+const errorHistorySize = 5
+
+// Error categories recorded per device.
+const (
+	errProbe          = "probe"
+	errResolution     = "resolution"
+	errClassification = "classification"
+)
+
+type ErrorRecord struct {
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// errorRing keeps the last errorHistorySize errors in a fixed array.
+type errorRing struct {
+	entries [errorHistorySize]ErrorRecord
+	next    int
+	count   int
+}
+
+func (r *errorRing) add(rec ErrorRecord) {
+	r.entries[r.next] = rec
+	r.next = (r.next + 1) % errorHistorySize
+	if r.count < errorHistorySize {
+		r.count++
+	}
+}
+
+// list returns the errors newest first.
+func (r *errorRing) list() []ErrorRecord {
+	out := make([]ErrorRecord, 0, r.count)
+	for i := 1; i <= r.count; i++ {
+		out = append(out, r.entries[(r.next-i+errorHistorySize)%errorHistorySize])
+	}
+	return out
+}
+
+// recordDeviceResult stores err for the category, or clears the category
+// when the operation succeeded.
+func (s *scanner) recordDeviceResult(key, category string, err error, now time.Time) {
+	if err == nil {
+		if cats := s.deviceErrorLog[key]; cats != nil {
+			delete(cats, category)
+			if len(cats) == 0 {
+				delete(s.deviceErrorLog, key)
+			}
+		}
+		return
+	}
+	cats := s.deviceErrorLog[key]
+	if cats == nil {
+		cats = make(map[string]*errorRing)
+		s.deviceErrorLog[key] = cats
+	}
+	ring := cats[category]
+	if ring == nil {
+		ring = &errorRing{}
+		cats[category] = ring
+	}
+	ring.add(ErrorRecord{Message: err.Error(), Time: now})
+}
+
+func (s *scanner) deviceErrorHistory(key string) map[string][]ErrorRecord {
+	cats := s.deviceErrorLog[key]
+	if len(cats) == 0 {
+		return nil
+	}
+	out := make(map[string][]ErrorRecord, len(cats))
+	for cat, ring := range cats {
+		out[cat] = ring.list()
+	}
+	return out
+}
+
+// forgetDeviceErrors drops the history of devices no longer tracked.
+func (s *scanner) forgetDeviceErrors(keep map[string]bool) {
+	for key := range s.deviceErrorLog {
+		if !keep[key] {
+			delete(s.deviceErrorLog, key)
+		}
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxInventorySize bounds an uploaded inventory file.
+const maxInventorySize = 8 << 20
+
+// inventoryColumns are the CSV columns of an inventory file, in the order
+// they are written to devices:. Only mac is required; tags are separated
+// by ";".
+var inventoryColumns = []string{"mac", "name", "owner", "location", "tags", "infrastructure", "expected_ip"}
+
+// inventoryRow is one device of an inventory file and the line it is on.
+type inventoryRow struct {
+	Line   int
+	Device DeviceConfig
+}
+
+// inventoryResult is the outcome of an import, one entry per row.
+type inventoryResult struct {
+	Line   int    `json:"line"`
+	MAC    string `json:"mac"`
+	Action string `json:"action"` // created, updated or skipped
+}
+
+// normalizeMAC accepts the usual notations (aa:bb:.., AA-BB-.., aabb.ccdd..)
+// and returns the lowercase colon form used everywhere else.
+func normalizeMAC(s string) (string, error) {
+	hw, err := net.ParseMAC(strings.TrimSpace(s))
+	if err != nil || len(hw) != 6 {
+		return "", fmt.Errorf("invalid MAC %q", s)
+	}
+	return hw.String(), nil
+}
+
+// parseInventory reads a CSV inventory, or YAML when name ends in .yaml or
+// .yml. Every invalid row is reported, prefixed with name and its line.
+func parseInventory(name string, data []byte) ([]inventoryRow, []error) {
+	var rows []inventoryRow
+	var errs []error
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		rows, errs = parseInventoryYAML(name, data)
+	default:
+		rows, errs = parseInventoryCSV(name, data)
+	}
+	seen := make(map[string]int)
+	for i := range rows {
+		row := &rows[i]
+		mac, err := normalizeMAC(row.Device.MAC)
+		switch {
+		case row.Device.MAC == "":
+			errs = append(errs, fmt.Errorf("%s:%d: mac is required", name, row.Line))
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%s:%d: %v", name, row.Line, err))
+		case seen[mac] != 0:
+			errs = append(errs, fmt.Errorf("%s:%d: duplicate device %s (first on line %d)", name, row.Line, mac, seen[mac]))
+		default:
+			seen[mac] = row.Line
+		}
+		row.Device.MAC = mac
+		if ip := row.Device.ExpectedIP; ip != "" && net.ParseIP(ip) == nil {
+			errs = append(errs, fmt.Errorf("%s:%d: invalid expected_ip %q", name, row.Line, ip))
+		}
+	}
+	if len(rows) == 0 && len(errs) == 0 {
+		errs = append(errs, fmt.Errorf("%s: no devices", name))
+	}
+	return rows, errs
+}
+
+func parseInventoryCSV(name string, data []byte) ([]inventoryRow, []error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.TrimLeadingSpace = true
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, []error{fmt.Errorf("%s: reading header: %v", name, err)}
+	}
+	columns := make(map[string]int)
+	for i, col := range header {
+		col = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(col, "\ufeff")))
+		known := false
+		for _, c := range inventoryColumns {
+			known = known || c == col
+		}
+		if !known {
+			return nil, []error{fmt.Errorf("%s:1: unknown column %q (have %s)", name, col, strings.Join(inventoryColumns, ", "))}
+		}
+		columns[col] = i
+	}
+	if _, ok := columns["mac"]; !ok {
+		return nil, []error{fmt.Errorf("%s:1: missing mac column", name)}
+	}
+
+	var rows []inventoryRow
+	var errs []error
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// A malformed quote leaves the rest of the file unreadable.
+			return rows, append(errs, fmt.Errorf("%s: %v", name, err))
+		}
+		line, _ := r.FieldPos(0)
+		if len(record) > len(header) {
+			errs = append(errs, fmt.Errorf("%s:%d: %d fields, the header has %d", name, line, len(record), len(header)))
+			continue
+		}
+		field := func(col string) string {
+			if i, ok := columns[col]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		d := DeviceConfig{
+			MAC:        field("mac"),
+			Name:       field("name"),
+			Owner:      field("owner"),
+			Location:   field("location"),
+			ExpectedIP: field("expected_ip"),
+		}
+		for _, tag := range strings.Split(field("tags"), ";") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				d.Tags = append(d.Tags, tag)
+			}
+		}
+		if s := field("infrastructure"); s != "" {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s:%d: infrastructure must be true or false, got %q", name, line, s))
+				continue
+			}
+			d.Infrastructure = &b
+		}
+		rows = append(rows, inventoryRow{Line: line, Device: d})
+	}
+	return rows, errs
+}
+
+// parseInventoryYAML reads a list of devices: entries, either at the top
+// level or under a devices: key as in config.yaml.
+func parseInventoryYAML(name string, data []byte) ([]inventoryRow, []error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, []error{fmt.Errorf("%s: %v", name, err)}
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	list := doc.Content[0]
+	if list.Kind == yaml.MappingNode {
+		list = nil
+		for i := 0; i+1 < len(doc.Content[0].Content); i += 2 {
+			if doc.Content[0].Content[i].Value == "devices" {
+				list = doc.Content[0].Content[i+1]
+			}
+		}
+	}
+	if list == nil || list.Kind != yaml.SequenceNode {
+		return nil, []error{fmt.Errorf("%s: expected a list of devices or a devices: key", name)}
+	}
+
+	known := typeSchema(reflect.TypeOf(DeviceConfig{}), "yaml", map[reflect.Type]bool{})["properties"].(map[string]interface{})
+	var rows []inventoryRow
+	var errs []error
+	for _, item := range list.Content {
+		if item.Kind != yaml.MappingNode {
+			errs = append(errs, fmt.Errorf("%s:%d: expected a device mapping", name, item.Line))
+			continue
+		}
+		var unknown error
+		for i := 0; i+1 < len(item.Content); i += 2 {
+			if _, ok := known[item.Content[i].Value]; !ok && unknown == nil {
+				unknown = fmt.Errorf("%s:%d: unknown field %q", name, item.Content[i].Line, item.Content[i].Value)
+			}
+		}
+		if unknown != nil {
+			errs = append(errs, unknown)
+			continue
+		}
+		var d DeviceConfig
+		if err := item.Decode(&d); err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %v", name, item.Line, err))
+			continue
+		}
+		rows = append(rows, inventoryRow{Line: item.Line, Device: d})
+	}
+	return rows, errs
+}
+
+func quoted(s string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: s, Style: yaml.DoubleQuotedStyle}
+}
+
+// applyInventoryRow sets the fields of row on a devices: entry and reports
+// whether anything changed. Empty fields leave the entry's value alone, so
+// an inventory only needs the columns it manages.
+func applyInventoryRow(mapping *yaml.Node, current DeviceConfig, d DeviceConfig) bool {
+	changed := false
+	set := func(key, cur, val string) {
+		if val != "" && val != cur {
+			setKey(mapping, key, quoted(val))
+			changed = true
+		}
+	}
+	if current.MAC == "" {
+		setKey(mapping, "mac", quoted(d.MAC))
+		changed = true
+	}
+	set("name", current.Name, d.Name)
+	set("owner", current.Owner, d.Owner)
+	set("location", current.Location, d.Location)
+	if len(d.Tags) > 0 && !reflect.DeepEqual(current.Tags, d.Tags) {
+		setKey(mapping, "tags", flowList(d.Tags))
+		changed = true
+	}
+	if d.Infrastructure != nil && (current.Infrastructure == nil || *current.Infrastructure != *d.Infrastructure) {
+		setKey(mapping, "infrastructure", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(*d.Infrastructure)})
+		changed = true
+	}
+	set("expected_ip", current.ExpectedIP, d.ExpectedIP)
+	return changed
+}
+
+// mergeInventory adds or updates the devices: entries of rows in the YAML
+// document, keyed by MAC. Like applyRule, only the lines of the devices:
+// section are rewritten; the data is returned unchanged if no row changes
+// anything.
+func mergeInventory(data []byte, rows []inventoryRow) ([]byte, []inventoryResult, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("%s is not a YAML mapping", cfgPath)
+	}
+	root := doc.Content[0]
+	var key, devices *yaml.Node
+	end := -1 // first line after devices:, 0-based
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if devices != nil && end < 0 {
+			end = root.Content[i].Line - 1
+		}
+		if root.Content[i].Value == "devices" {
+			key, devices = root.Content[i], root.Content[i+1]
+		}
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if end < 0 {
+		end = len(lines)
+	}
+	if devices == nil {
+		key = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "devices"}
+		devices = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	}
+	if devices.Kind != yaml.SequenceNode && !(devices.Kind == yaml.ScalarNode && devices.Tag == "!!null") {
+		return nil, nil, fmt.Errorf("devices must be a list to import into it")
+	}
+	devices.Kind, devices.Tag = yaml.SequenceNode, "!!seq"
+
+	results := make([]inventoryResult, 0, len(rows))
+	changed := false
+	for _, row := range rows {
+		res := inventoryResult{Line: row.Line, MAC: row.Device.MAC, Action: "skipped"}
+		var entry *yaml.Node
+		var current DeviceConfig
+		for _, item := range devices.Content {
+			var d DeviceConfig
+			if item.Kind == yaml.MappingNode && item.Decode(&d) == nil && strings.EqualFold(d.MAC, row.Device.MAC) {
+				entry, current = item, d
+				break
+			}
+		}
+		if entry == nil {
+			entry = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			devices.Content = append(devices.Content, entry)
+			res.Action = "created"
+			applyInventoryRow(entry, current, row.Device)
+		} else if applyInventoryRow(entry, current, row.Device) {
+			res.Action = "updated"
+		}
+		changed = changed || res.Action != "skipped"
+		results = append(results, res)
+	}
+	if !changed {
+		return data, results, nil
+	}
+
+	// The section is re-encoded in block style; comments above devices:
+	// and after its last entry stay where they are in the file.
+	devices.Style = 0
+	section := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{
+		{Kind: yaml.ScalarNode, Tag: "!!str", Value: key.Value, LineComment: key.LineComment}, devices,
+	}}
+	devices.FootComment = ""
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(section); err != nil {
+		return nil, nil, err
+	}
+	enc.Close()
+
+	var out []string
+	if key.Line == 0 {
+		out = append(out, lines...)
+		if len(lines) > 0 && !strings.HasSuffix(lines[len(lines)-1], "\n") {
+			out = append(out, "\n")
+		}
+		out = append(out, "\n", buf.String())
+		return []byte(strings.Join(out, "")), results, nil
+	}
+	start, stop := key.Line-1, end
+	for stop > start+1 {
+		trimmed := strings.TrimSpace(lines[stop-1])
+		if trimmed != "" && !(strings.HasPrefix(trimmed, "#") && !strings.HasPrefix(lines[stop-1], " ")) {
+			break
+		}
+		stop--
+	}
+	out = append(out, lines[:start]...)
+	out = append(out, buf.String())
+	out = append(out, lines[stop:]...)
+	return []byte(strings.Join(out, "")), results, nil
+}
+
+// importInventory parses an inventory and merges it into the config file,
+// writing nothing when any row is invalid, the merged devices: section would
+// not validate, dryRun is set or ctx is done. It holds adminMu while it
+// edits.
+func importInventory(ctx context.Context, name string, inventory []byte, dryRun bool) ([]inventoryResult, []error) {
+	rows, errs := parseInventory(name, inventory)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	old, err := os.ReadFile(cfgPath)
+	if err != nil {
+		return nil, []error{err}
+	}
+	data, results, err := mergeInventory(old, rows)
+	if err != nil {
+		return nil, []error{err}
+	}
+	cfg, err := decodeConfigStrict(data)
+	if err != nil {
+		return nil, []error{fmt.Errorf("merged config does not parse: %v", err)}
+	}
+	if errs := validateDevices(cfg.Devices); len(errs) > 0 {
+		return nil, errs
+	}
+	if dryRun || bytes.Equal(old, data) {
+		return results, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, []error{err}
+	}
+	if err := saveConfig(old, data); err != nil {
+		return nil, []error{err}
+	}
+	return results, nil
+}
+
+func countResults(results []inventoryResult) map[string]int {
+	counts := map[string]int{"created": 0, "updated": 0, "skipped": 0}
+	for _, res := range results {
+		counts[res.Action]++
+	}
+	return counts
+}
+
+// runDevicesCommand implements "devices import [-dry-run] <file>".
+func runDevicesCommand(args []string) int {
+	if len(args) > 0 && args[0] == "prune" {
+		return runDevicesPrune(args[1:])
+	}
+	if len(args) == 0 || args[0] != "import" {
+		fmt.Fprintln(os.Stderr, "usage: devices import [-dry-run] <inventory.csv|inventory.yaml>")
+		fmt.Fprintln(os.Stderr, "       devices prune [-dry-run] [-last-seen-before DATE] [-type TYPE] [-scanner NAME]")
+		return 2
+	}
+	fs := flag.NewFlagSet("devices import", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "report what would change without writing "+cfgPath)
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: devices import [-dry-run] <inventory.csv|inventory.yaml>")
+		return 2
+	}
+	path := fs.Arg(0)
+	inventory, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "devices import:", err)
+		return 1
+	}
+	results, errs := importInventory(context.Background(), path, inventory, *dryRun)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		fmt.Fprintf(os.Stderr, "%s not changed\n", cfgPath)
+		return 1
+	}
+	for _, res := range results {
+		fmt.Printf("%-8s %s (line %d)\n", res.Action, res.MAC, res.Line)
+	}
+	counts := countResults(results)
+	verb := "updated"
+	if *dryRun {
+		verb = "would be updated (dry run)"
+	} else if counts["created"]+counts["updated"] == 0 {
+		verb = "not changed"
+	}
+	fmt.Printf("%d created, %d updated, %d skipped; %s %s\n", counts["created"], counts["updated"], counts["skipped"], cfgPath, verb)
+	return 0
+}
+
+// devicesImportHandler serves POST /admin/devices/import: the inventory is
+// the multipart field "file", and dry_run=true reports without writing.
+func devicesImportHandler(w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request rejected", http.StatusForbidden)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxInventorySize)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "expected a multipart upload with the inventory in field \"file\": " + err.Error()})
+		return
+	}
+	defer file.Close()
+	inventory, err := io.ReadAll(file)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.FormValue("dry_run"))
+	results, errs := importInventory(r.Context(), header.Filename, inventory, dryRun)
+	if len(errs) > 0 {
+		messages := make([]string, len(errs))
+		for i, err := range errs {
+			messages[i] = err.Error()
+		}
+		status := http.StatusBadRequest
+		var pathErr *os.PathError
+		if errors.As(errs[0], &pathErr) {
+			status = http.StatusInternalServerError
+		}
+		writeJSON(w, status, map[string]interface{}{"errors": messages})
+		return
+	}
+	counts := countResults(results)
+	if !dryRun && counts["created"]+counts["updated"] > 0 {
+		emitEvent("config_devices_imported", map[string]interface{}{
+			"created":     counts["created"],
+			"updated":     counts["updated"],
+			"config_hash": configHash(cfgPath),
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"dry_run": dryRun,
+		"created": counts["created"],
+		"updated": counts["updated"],
+		"skipped": counts["skipped"],
+		"devices": results,
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// pruneFilter selects inventory devices to delete; a device must match
+// every field that is set.
+type pruneFilter struct {
+	// LastSeenBefore matches devices last seen before this time.
+	LastSeenBefore time.Time
+	// Type matches devices of this device type, e.g. "unknown".
+	Type string
+}
+
+// parsePruneFilter parses last_seen_before, as a date (local midnight) or
+// an RFC 3339 time, and type. At least one of them is required, so a
+// prune never empties the inventory by accident.
+func parsePruneFilter(lastSeenBefore, deviceType string) (pruneFilter, error) {
+	f := pruneFilter{Type: deviceType}
+	if lastSeenBefore != "" {
+		t, err := time.ParseInLocation("2006-01-02", lastSeenBefore, time.Local)
+		if err != nil {
+			if t, err = time.Parse(time.RFC3339, lastSeenBefore); err != nil {
+				return f, fmt.Errorf("last_seen_before %q is neither a date (2006-01-02) nor an RFC 3339 time", lastSeenBefore)
+			}
+		}
+		f.LastSeenBefore = t
+	}
+	if f.LastSeenBefore.IsZero() && f.Type == "" {
+		return f, errors.New("set last_seen_before, type or both")
+	}
+	return f, nil
+}
+
+func (f pruneFilter) matches(d KnownDevice) bool {
+	if !f.LastSeenBefore.IsZero() && !d.LastSeen.Before(f.LastSeenBefore) {
+		return false
+	}
+	return f.Type == "" || d.DeviceType == f.Type
+}
+
+// prunedDevices returns the devices f matches, sorted by MAC.
+func prunedDevices(devices []KnownDevice, f pruneFilter) []KnownDevice {
+	matched := []KnownDevice{}
+	for _, d := range devices {
+		if f.matches(d) {
+			matched = append(matched, d)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].MAC < matched[j].MAC })
+	return matched
+}
+
+// prune deletes the devices f matches from the inventory, the state file
+// and the cohorts, or with dryRun only returns them. It holds the registry
+// lock for a pass over the inventory and a state file write, so a scan
+// waits on it for a moment at most. Devices still on the network come back
+// with the next scan, keeping their first-seen time and cohort.
+func (s *scanner) prune(f pruneFilter, dryRun bool) []KnownDevice {
+	r := &s.registry
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	all := make([]KnownDevice, 0, len(r.devices))
+	for _, k := range r.devices {
+		all = append(all, *k)
+	}
+	matched := prunedDevices(all, f)
+	if dryRun || len(matched) == 0 {
+		return matched
+	}
+	for _, d := range matched {
+		delete(r.devices, d.MAC)
+		r.pruned = append(r.pruned, d.MAC)
+	}
+	online := make(map[string]bool)
+	if list := r.last.Load(); list != nil {
+		for _, d := range *list {
+			online[d.MAC] = d.Online
+		}
+	}
+	r.publish(r.cfg, online)
+	gone := make(map[string]bool, len(matched))
+	for _, d := range matched {
+		if !online[d.MAC] {
+			gone[d.MAC] = true
+		}
+	}
+	s.forgetCohorts(gone)
+	return matched
+}
+
+// devicesPruneHandler serves DELETE /api/v1/devices: last_seen_before and
+// type select the inventory devices to delete, and dry_run=true only
+// reports them. scanner picks the inventory with several scanners.
+func devicesPruneHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := scannerFor(w, r)
+		if !ok {
+			return
+		}
+		q := r.URL.Query()
+		f, err := parsePruneFilter(q.Get("last_seen_before"), q.Get("type"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		dryRun, _ := strconv.ParseBool(q.Get("dry_run"))
+		if requestCancelled(r) {
+			return
+		}
+		matched := s.prune(f, dryRun)
+		if !dryRun && len(matched) > 0 {
+			s.emitEvent("devices_pruned", map[string]interface{}{"removed": len(matched)})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"dry_run": dryRun,
+			"removed": len(matched),
+			"devices": matched,
+		})
+	}
+}
+
+// runDevicesPrune is `devices prune`: the same prune on registry.state_file
+// while the exporter is stopped; a running exporter would write its own
+// inventory back with its next scan.
+func runDevicesPrune(args []string) int {
+	fs := flag.NewFlagSet("devices prune", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "report what would be deleted without writing the state file")
+	lastSeenBefore := fs.String("last-seen-before", "", "delete devices last seen before this date (2006-01-02) or RFC 3339 time")
+	deviceType := fs.String("type", "", "delete devices of this device type")
+	scannerName := fs.String("scanner", "", "prune this scanner's inventory (required with scanners:)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	f, err := parsePruneFilter(*lastSeenBefore, *deviceType)
+	if err != nil || fs.NArg() != 0 {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "devices prune:", err)
+		}
+		fmt.Fprintln(os.Stderr, "usage: devices prune [-dry-run] [-last-seen-before DATE] [-type TYPE] [-scanner NAME]")
+		return 2
+	}
+	cfg, err := loadScannerConfig(*scannerName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "devices prune:", err)
+		return 1
+	}
+	path := cfg.Registry.StateFile
+	if path == "" {
+		fmt.Fprintf(os.Stderr, "devices prune: registry.state_file is not set in %s\n", cfgPath)
+		return 1
+	}
+	state, from, err := readRegistryState(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "devices prune:", err)
+		return 1
+	}
+	matched := prunedDevices(state.Devices, f)
+	for _, d := range matched {
+		fmt.Printf("%s %-15s %-10s last seen %s\n", d.MAC, d.IP, d.DeviceType, d.LastSeen.Format(time.RFC3339))
+	}
+	if *dryRun {
+		fmt.Printf("%d devices would be deleted (dry run); %s not changed\n", len(matched), path)
+		return 0
+	}
+	if len(matched) == 0 {
+		fmt.Printf("0 devices deleted; %s not changed\n", path)
+		return 0
+	}
+	remove := make(map[string]bool, len(matched))
+	for _, d := range matched {
+		remove[d.MAC] = true
+	}
+	kept := make([]KnownDevice, 0, len(state.Devices)-len(matched))
+	for _, d := range state.Devices {
+		if !remove[d.MAC] {
+			kept = append(kept, d)
+		}
+	}
+	if from < registryStateVersion {
+		backup, err := backupRegistryState(path, from)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "devices prune:", err)
+			return 1
+		}
+		fmt.Printf("%s migrated from version %d to %d; the old file is %s\n", path, from, registryStateVersion, backup)
+	}
+	if err := saveRegistry(path, kept); err != nil {
+		fmt.Fprintln(os.Stderr, "devices prune:", err)
+		return 1
+	}
+	fmt.Printf("%d devices deleted from %s\n", len(matched), path)
+	return 0
+}
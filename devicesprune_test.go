@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func cohortCounts(s *scanner) []cohortStats {
+	if stats := s.cohorts.last.Load(); stats != nil {
+		return *stats
+	}
+	return nil
+}
+
+// TestPruneForgetsCohorts prunes devices between scans: those offline
+// leave the cohorts at once, those still online keep theirs.
+func TestPruneForgetsCohorts(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	s := newScanner("", 1)
+	s.m = NewMetrics(reg, "").forScanner(reg, s)
+	cohorts := CohortConfig{Windows: []time.Duration{24 * time.Hour}}
+	t0 := time.Now()
+	scan := func(at time.Time, devices ...Device) {
+		for _, d := range devices {
+			if _, ok := s.firstSeen[d.key()]; !ok {
+				s.firstSeen[d.key()] = at
+				s.cohorts.noteFirstSeen(d.key(), at)
+			}
+		}
+		s.updateCohorts(cohorts, devices, at)
+		s.updateRegistry(RegistryConfig{}, devices, at)
+	}
+	tv := Device{MAC: "aa:bb:cc:00:00:01", IP: "192.168.1.10", DeviceType: "tv", State: stateOnline, FirstSeen: t0}
+	phone := Device{MAC: "aa:bb:cc:00:00:02", IP: "192.168.1.11", DeviceType: "phone", State: stateOnline, FirstSeen: t0}
+	guest := Device{MAC: "aa:bb:cc:00:00:03", IP: "192.168.1.12", DeviceType: "unknown", State: stateOnline, FirstSeen: t0}
+	scan(t0, tv, phone, guest)
+	scan(t0.Add(time.Hour), tv)
+
+	if got, want := cohortCounts(s), []cohortStats{{Window: "24h", FirstSeen: 3, Online: 1, RetainedRatio: 1.0 / 3}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("before the prune: %+v, want %+v", got, want)
+	}
+	if matched := s.prune(pruneFilter{LastSeenBefore: t0.Add(time.Minute)}, true); len(matched) != 2 || len(cohortCounts(s)) != 1 || cohortCounts(s)[0].FirstSeen != 3 {
+		t.Errorf("dry run removed devices: %v, cohorts %+v", matched, cohortCounts(s))
+	}
+
+	// The tv is online: pruned, it comes back with the next scan.
+	if matched := s.prune(pruneFilter{Type: "tv"}, false); len(matched) != 1 {
+		t.Fatalf("pruned %v, want the tv", matched)
+	}
+	if got := cohortCounts(s)[0]; got.FirstSeen != 3 || got.Online != 1 {
+		t.Errorf("pruning an online device changed its cohort: %+v", got)
+	}
+	if matched := s.prune(pruneFilter{LastSeenBefore: t0.Add(time.Minute)}, false); len(matched) != 2 {
+		t.Fatalf("pruned %v, want the phone and the guest", matched)
+	}
+	want := []cohortStats{{Window: "24h", FirstSeen: 1, Online: 1, RetainedRatio: 1}}
+	if got := cohortCounts(s); !reflect.DeepEqual(got, want) {
+		t.Errorf("after the prune: %+v, want %+v", got, want)
+	}
+	if got := testutil.ToFloat64(s.m.CohortFirstSeen.WithLabelValues("24h")); got != 1 {
+		t.Errorf("first-seen gauge %v after the prune, want 1", got)
+	}
+
+	// The phone comes back before the scan loop forgot its first-seen
+	// time, so it rejoins its cohort, and the guest stays gone.
+	scan(t0.Add(2*time.Hour), tv, phone)
+	want = []cohortStats{{Window: "24h", FirstSeen: 2, Online: 2, RetainedRatio: 1}}
+	if got := cohortCounts(s); !reflect.DeepEqual(got, want) {
+		t.Errorf("after the next scan: %+v, want %+v", got, want)
+	}
+	if len(s.registry.pruned) != 0 {
+		t.Errorf("pruned MACs left after the scan: %v", s.registry.pruned)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type DHCPConfig struct {
+	// LeasesFile is a dnsmasq-format leases file
+	// ("<expiry> <mac> <ip> <hostname> <client-id>" per line).
+	LeasesFile string `yaml:"leases_file"`
+	// PoolStart and PoolEnd bound the dynamic range; devices seen inside it
+	// without a lease are flagged static_in_pool.
+	PoolStart string `yaml:"pool_start"`
+	PoolEnd   string `yaml:"pool_end"`
+	// Sniff listens for DHCP DISCOVER and REQUEST broadcasts on UDP 67, so
+	// joining devices are reported within seconds instead of at the next
+	// scan, and their DHCP fingerprint feeds classification. It needs
+	// root or CAP_NET_BIND_SERVICE, cannot share the port with a DHCP
+	// server on the same host and only takes effect on restart.
+	Sniff bool `yaml:"sniff"`
+}
+
+type Lease struct {
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname,omitempty"`
+	// Expiry is zero for infinite leases.
+	Expiry time.Time `json:"expiry"`
+}
+
+func parseLeases(data []byte) map[string]Lease {
+	leases := make(map[string]Lease)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		epoch, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		lease := Lease{IP: fields[2]}
+		if epoch > 0 {
+			lease.Expiry = time.Unix(epoch, 0)
+		}
+		if len(fields) > 3 && fields[3] != "*" {
+			lease.Hostname = fields[3]
+		}
+		leases[strings.ToLower(fields[1])] = lease
+	}
+	return leases
+}
+
+func readLeases(path string) (map[string]Lease, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseLeases(data), nil
+}
+
+func (c DHCPConfig) inPool(ip string) bool {
+	start, end, addr := net.ParseIP(c.PoolStart).To4(), net.ParseIP(c.PoolEnd).To4(), net.ParseIP(ip).To4()
+	if start == nil || end == nil || addr == nil {
+		return false
+	}
+	return bytes.Compare(addr, start) >= 0 && bytes.Compare(addr, end) <= 0
+}
+
+func (c DHCPConfig) validate() error {
+	if c.PoolStart == "" && c.PoolEnd == "" {
+		return nil
+	}
+	start, end := net.ParseIP(c.PoolStart).To4(), net.ParseIP(c.PoolEnd).To4()
+	if start == nil || end == nil {
+		return fmt.Errorf("dhcp.pool_start and dhcp.pool_end must both be IPv4 addresses")
+	}
+	if bytes.Compare(start, end) > 0 {
+		return fmt.Errorf("dhcp.pool_start %s is after dhcp.pool_end %s", c.PoolStart, c.PoolEnd)
+	}
+	return nil
+}
+
+// applyLeases merges the lease file into this scan's devices by MAC. It
+// runs in the scan loop on the devices being built, so the published
+// snapshot already carries the lease data.
+func (s *scanner) applyLeases(cfg DHCPConfig, devices []Device) error {
+	if cfg.LeasesFile == "" {
+		return nil
+	}
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	leases, err := readLeases(cfg.LeasesFile)
+	if err != nil {
+		return err
+	}
+	flagged := make(map[string]bool)
+	for i := range devices {
+		d := &devices[i]
+		if d.MAC == unknownMAC {
+			continue
+		}
+		mac := strings.ToLower(d.MAC)
+		if lease, ok := leases[mac]; ok {
+			d.Lease = &lease
+			continue
+		}
+		if !cfg.inPool(d.IP) {
+			continue
+		}
+		d.StaticInPool = true
+		flagged[mac] = true
+		if !s.staticInPool[mac] {
+			s.emitEvent("static_ip_in_pool", map[string]interface{}{
+				"device":     *d,
+				"pool_start": cfg.PoolStart,
+				"pool_end":   cfg.PoolEnd,
+			})
+		}
+	}
+	s.staticInPool = flagged
+	return nil
+}
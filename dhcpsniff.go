@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dhcpServerPort is where clients broadcast DISCOVER and REQUEST.
+const dhcpServerPort = 67
+
+// dhcpProbeDelay leaves a joining device time to get its ACK and answer
+// ARP before the targeted scan probes it.
+const dhcpProbeDelay = 3 * time.Second
+
+// dhcpFingerprintTTL is how long a sniffed fingerprint is kept for a MAC
+// that does not send DHCP again.
+const dhcpFingerprintTTL = 7 * 24 * time.Hour
+
+// DHCP message types (option 53) the sniffer acts on.
+const (
+	dhcpDiscover = 1
+	dhcpRequest  = 3
+)
+
+// DHCPFingerprint is what a device revealed in its last DISCOVER or
+// REQUEST.
+type DHCPFingerprint struct {
+	Hostname string `json:"hostname,omitempty"`
+	// Params is the parameter request list (option 55) as comma-separated
+	// option codes, e.g. "1,3,6,15,119,252"; it identifies the DHCP client
+	// and so the OS, and is matched by device_types.dhcp_fingerprints.
+	Params      string    `json:"params"`
+	VendorClass string    `json:"vendor_class,omitempty"`
+	SeenAt      time.Time `json:"seen_at"`
+}
+
+// dhcpPacket is the part of a client message the sniffer uses.
+type dhcpPacket struct {
+	MessageType byte
+	MAC         string
+	// RequestedIP is option 50, or ciaddr when renewing.
+	RequestedIP string
+	Fingerprint DHCPFingerprint
+}
+
+// parseDHCPClientPacket decodes a BOOTREQUEST from an Ethernet client.
+func parseDHCPClientPacket(b []byte) (dhcpPacket, error) {
+	var p dhcpPacket
+	if len(b) < 240 {
+		return p, fmt.Errorf("short packet (%d bytes)", len(b))
+	}
+	if b[0] != 1 || b[1] != 1 || b[2] != 6 {
+		return p, fmt.Errorf("not an Ethernet BOOTREQUEST")
+	}
+	if binary.BigEndian.Uint32(b[236:240]) != 0x63825363 {
+		return p, fmt.Errorf("missing DHCP magic cookie")
+	}
+	p.MAC = net.HardwareAddr(b[28:34]).String()
+	if ciaddr := net.IP(b[12:16]); !ciaddr.IsUnspecified() {
+		p.RequestedIP = ciaddr.String()
+	}
+	for opts := b[240:]; len(opts) > 0; {
+		code := opts[0]
+		if code == 255 {
+			break
+		}
+		if code == 0 {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return p, fmt.Errorf("truncated option %d", code)
+		}
+		value := opts[2 : 2+int(opts[1])]
+		opts = opts[2+int(opts[1]):]
+		switch code {
+		case 12:
+			p.Fingerprint.Hostname = string(value)
+		case 50:
+			if len(value) == 4 {
+				p.RequestedIP = net.IP(value).String()
+			}
+		case 53:
+			if len(value) == 1 {
+				p.MessageType = value[0]
+			}
+		case 55:
+			codes := make([]string, len(value))
+			for i, c := range value {
+				codes[i] = strconv.Itoa(int(c))
+			}
+			p.Fingerprint.Params = strings.Join(codes, ",")
+		case 60:
+			p.Fingerprint.VendorClass = string(value)
+		}
+	}
+	if p.MessageType == 0 {
+		return p, fmt.Errorf("no DHCP message type")
+	}
+	return p, nil
+}
+
+// dhcpJoins holds the sniffed fingerprints, which the scan loop reads for
+// classification, and the addresses waiting for a targeted probe.
+type dhcpJoins struct {
+	mu           sync.Mutex
+	fingerprints map[string]DHCPFingerprint // by lowercase MAC
+	pending      map[string]bool            // requested IPs
+}
+
+func newDHCPJoins() *dhcpJoins {
+	return &dhcpJoins{fingerprints: make(map[string]DHCPFingerprint), pending: make(map[string]bool)}
+}
+
+// observe records a client packet and reports whether it starts a join:
+// the MAC sent nothing within the last two scan intervals, so a DISCOVER
+// and the REQUEST after it count once.
+func (j *dhcpJoins) observe(p dhcpPacket) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for mac, fp := range j.fingerprints {
+		if p.Fingerprint.SeenAt.Sub(fp.SeenAt) > dhcpFingerprintTTL {
+			delete(j.fingerprints, mac)
+		}
+	}
+	prev, ok := j.fingerprints[p.MAC]
+	j.fingerprints[p.MAC] = p.Fingerprint
+	return !ok || p.Fingerprint.SeenAt.Sub(prev.SeenAt) > 2*scanInterval
+}
+
+// fingerprint returns the last fingerprint seen from mac, or nil.
+func (j *dhcpJoins) fingerprint(mac string) *DHCPFingerprint {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if fp, ok := j.fingerprints[strings.ToLower(mac)]; ok {
+		return &fp
+	}
+	return nil
+}
+
+// queueProbe marks ip for the next targeted scan.
+func (j *dhcpJoins) queueProbe(ip string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.pending[ip] = true
+}
+
+// takeTargets hands the pending addresses within r to a targeted scan.
+func (j *dhcpJoins) takeTargets(r scanRange) []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var targets []string
+	for ip := range j.pending {
+		if r.contains(net.ParseIP(ip)) {
+			targets = append(targets, ip)
+		}
+	}
+	j.pending = make(map[string]bool)
+	sort.Strings(targets)
+	return targets
+}
+
+// validateDHCPSniff rejects dhcp.sniff with remote probing: the listener
+// only hears broadcasts on this host's segments.
+func validateDHCPSniff(cfg Config) error {
+	if cfg.DHCP.Sniff && cfg.Remote != nil {
+		return fmt.Errorf("dhcp.sniff listens on this host and cannot be combined with remote")
+	}
+	return nil
+}
+
+// dhcpSniffLoop listens for client broadcasts until ctx is done. A device
+// missing from the last scan is reported as device_joining right away, and
+// its REQUEST schedules a scan of just the requested address.
+func (s *scanner) dhcpSniffLoop(ctx context.Context) error {
+	conn, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", dhcpServerPort))
+	if err != nil {
+		return fmt.Errorf("dhcp sniffer: %v", err)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	s.printf("Listening for DHCP broadcasts on :%d", dhcpServerPort)
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("dhcp sniffer: %v", err)
+		}
+		p, err := parseDHCPClientPacket(buf[:n])
+		if err != nil {
+			s.m.DHCPPackets.WithLabelValues("invalid").Inc()
+			debugf("ignoring DHCP packet: %v", err)
+			continue
+		}
+		switch p.MessageType {
+		case dhcpDiscover:
+			s.m.DHCPPackets.WithLabelValues("discover").Inc()
+		case dhcpRequest:
+			s.m.DHCPPackets.WithLabelValues("request").Inc()
+		default:
+			s.m.DHCPPackets.WithLabelValues("other").Inc()
+			continue
+		}
+		p.Fingerprint.SeenAt = time.Now()
+		starts := s.joins.observe(p)
+		if s.knownMAC(p.MAC) {
+			continue
+		}
+		if starts {
+			s.emitEvent("device_joining", map[string]interface{}{
+				"mac":          p.MAC,
+				"requested_ip": p.RequestedIP,
+				"dhcp":         p.Fingerprint,
+			})
+		}
+		if p.MessageType == dhcpRequest && p.RequestedIP != "" {
+			s.joins.queueProbe(p.RequestedIP)
+			time.AfterFunc(dhcpProbeDelay, func() { s.requestScan(scanCauseDHCP) })
+		}
+	}
+}
+
+// knownMAC reports whether mac was in the last published scan.
+func (s *scanner) knownMAC(mac string) bool {
+	if scan := s.currentScan(); scan != nil {
+		for _, d := range scan.Devices {
+			if strings.EqualFold(d.MAC, mac) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func init() {
+	registerFeature("dhcp_sniff", false)
+}
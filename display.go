@@ -0,0 +1,61 @@
+package main
+
+// DisplayConfig tells UIs how to render devices of a type.
+type DisplayConfig struct {
+	// Icon is one of displayIcons.
+	Icon string `yaml:"icon" json:"icon"`
+	// Category is one of mobile, computer, iot, infra, other.
+	Category string `yaml:"category" json:"category"`
+	Color    string `yaml:"color" json:"color"`
+}
+
+var displayIcons = map[string]bool{
+	"phone": true, "tablet": true, "laptop": true, "desktop": true,
+	"tv": true, "speaker": true, "printer": true, "camera": true,
+	"plug": true, "router": true, "switch": true, "access-point": true,
+	"console": true, "generic": true,
+}
+
+var genericDisplay = DisplayConfig{Icon: "generic", Category: "other", Color: "#9e9e9e"}
+
+// defaultDisplays covers the common types so minimal configs still render
+// nicely.
+var defaultDisplays = map[string]DisplayConfig{
+	"apple":   {Icon: "laptop", Category: "computer", Color: "#a2aaad"},
+	"mobile":  {Icon: "phone", Category: "mobile", Color: "#3ddc84"},
+	"windows": {Icon: "desktop", Category: "computer", Color: "#0078d4"},
+	"iot":     {Icon: "plug", Category: "iot", Color: "#ff9800"},
+	"printer": {Icon: "printer", Category: "iot", Color: "#795548"},
+	"tv":      {Icon: "tv", Category: "iot", Color: "#673ab7"},
+	"router":  {Icon: "router", Category: "infra", Color: "#607d8b"},
+}
+
+// displayFor merges the rule's display section over the defaults for the
+// type. Unknown icons fall back to the generic one.
+func displayFor(cfg Config, deviceType string, infrastructure bool) DisplayConfig {
+	d, ok := defaultDisplays[deviceType]
+	if !ok {
+		d = genericDisplay
+		if infrastructure {
+			d = defaultDisplays["router"]
+		}
+	}
+	for _, rule := range cfg.DeviceTypes {
+		if rule.Type != deviceType || rule.Display == nil {
+			continue
+		}
+		if rule.Display.Icon != "" {
+			d.Icon = rule.Display.Icon
+		}
+		if rule.Display.Category != "" {
+			d.Category = rule.Display.Category
+		}
+		if rule.Display.Color != "" {
+			d.Color = rule.Display.Color
+		}
+	}
+	if !displayIcons[d.Icon] {
+		d.Icon = genericDisplay.Icon
+	}
+	return d
+}
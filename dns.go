@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const resolvConfPath = "/etc/resolv.conf"
+
+type DNSConfig struct {
+	// Servers overrides the nameservers read from /etc/resolv.conf.
+	Servers []string `yaml:"servers"`
+	// ProbeName is queried for its A record; empty queries the root's NS
+	// records, which needs nothing but a working server.
+	ProbeName string        `yaml:"probe_name"`
+	Timeout   time.Duration `yaml:"timeout"`
+	// Interval between health checks (default 1m). They run on their own,
+	// so a server that does not answer never holds up a scan.
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (c DNSConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return 2 * time.Second
+	}
+	return c.Timeout
+}
+
+func (c DNSConfig) interval() time.Duration {
+	if c.Interval <= 0 {
+		return time.Minute
+	}
+	return c.Interval
+}
+
+func init() {
+	registerFeature("dns_health", true)
+}
+
+func systemNameservers(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+// dnsRcodeError is an answer from a DNS server that is neither a result
+// nor NXDOMAIN, such as SERVFAIL or REFUSED.
+type dnsRcodeError dnsmessage.RCode
+
+func (e dnsRcodeError) Error() string {
+	return "server answered " + dnsmessage.RCode(e).String()
+}
+
+// queryDNSServer sends one query straight to server and waits for its
+// answer; unlike net.Resolver it never answers from /etc/hosts. The query
+// is for name's A record, or for the root's NS records when name is empty,
+// which every recursive server can answer. NXDOMAIN counts as an answer
+// from a healthy server. Cancelling ctx abandons the query.
+func queryDNSServer(ctx context.Context, server, name string, timeout time.Duration) (time.Duration, error) {
+	addr := server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		addr = net.JoinHostPort(server, "53")
+	}
+	question := dnsmessage.Question{Name: dnsmessage.MustNewName("."), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET}
+	if name != "" {
+		qname, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+		if err != nil {
+			return 0, err
+		}
+		question.Name, question.Type = qname, dnsmessage.TypeA
+	}
+	id := uint16(rand.Intn(1 << 16))
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{question},
+	}
+	packet, err := query.Pack()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(start.Add(timeout))
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+	if _, err := conn.Write(packet); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return time.Since(start), err
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(buf[:n])
+		if err != nil || h.ID != id || !h.Response {
+			// Not our answer; keep waiting until the deadline.
+			continue
+		}
+		elapsed := time.Since(start)
+		if h.RCode != dnsmessage.RCodeSuccess && h.RCode != dnsmessage.RCodeNameError {
+			return elapsed, dnsRcodeError(h.RCode)
+		}
+		return elapsed, nil
+	}
+}
+
+// checkDNSServers probes every configured (or system) nameserver once, in
+// parallel, so it takes one timeout at most. It only records health;
+// hostname resolution keeps working independently.
+func checkDNSServers(ctx context.Context, m *Metrics, cfg DNSConfig) {
+	servers := cfg.Servers
+	if len(servers) == 0 {
+		servers = systemNameservers(resolvConfPath)
+	}
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			elapsed, err := queryDNSServer(ctx, server, cfg.ProbeName, cfg.timeout())
+			if ctx.Err() != nil {
+				return
+			}
+
+			var rcodeErr dnsRcodeError
+			var netErr net.Error
+			switch {
+			case err == nil:
+				m.DNSServerUp.WithLabelValues(server).Set(1)
+				m.DNSResponseTime.WithLabelValues(server).Observe(elapsed.Seconds())
+			case errors.As(err, &netErr) && netErr.Timeout():
+				m.DNSServerUp.WithLabelValues(server).Set(0)
+				m.DNSTimeouts.WithLabelValues(server).Inc()
+			default:
+				if errors.As(err, &rcodeErr) && dnsmessage.RCode(rcodeErr) == dnsmessage.RCodeServerFailure {
+					m.DNSServfails.WithLabelValues(server).Inc()
+				}
+				m.DNSServerUp.WithLabelValues(server).Set(0)
+				errorLog.Printf("DNS server %s health query failed: %v", server, err)
+			}
+		}(server)
+	}
+	wg.Wait()
+}
+
+// dnsHealthLoop runs the DNS health checks every dns.interval, picking up
+// config changes as the scans do, until ctx is cancelled.
+func (s *scanner) dnsHealthLoop(ctx context.Context, cfg DNSConfig) error {
+	for {
+		checkDNSServers(ctx, s.m, cfg)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(cfg.interval()):
+		}
+		// A config that fails to load is logged by the scan loop; the
+		// checks carry on with the last good one.
+		if loaded, err := s.loadConfig(); err == nil {
+			cfg = loaded.DNS
+		}
+	}
+}
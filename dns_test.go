@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func dnsScanner(t *testing.T) *scanner {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	s := newScanner("", 1)
+	s.m = NewMetrics(reg, "").forScanner(reg, s)
+	return s
+}
+
+func TestCheckDNSServers(t *testing.T) {
+	captureErrorLog(t)
+	s := dnsScanner(t)
+	up, silent, alsoSilent := fakeDNSServer(t, false), fakeDNSServer(t, true), fakeDNSServer(t, true)
+	start := time.Now()
+	checkDNSServers(context.Background(), s.m, DNSConfig{Servers: []string{up, silent, alsoSilent}, Timeout: 200 * time.Millisecond})
+	// The servers are queried in parallel: one timeout, not one per server.
+	if elapsed := time.Since(start); elapsed > 390*time.Millisecond {
+		t.Errorf("took %s for two silent servers with a 200ms timeout", elapsed)
+	}
+	for _, tc := range []struct {
+		server   string
+		up       float64
+		timeouts float64
+	}{
+		{up, 1, 0},
+		{silent, 0, 1},
+		{alsoSilent, 0, 1},
+	} {
+		if got := testutil.ToFloat64(s.m.DNSServerUp.WithLabelValues(tc.server)); got != tc.up {
+			t.Errorf("%s: up %v, want %v", tc.server, got, tc.up)
+		}
+		if got := testutil.ToFloat64(s.m.DNSTimeouts.WithLabelValues(tc.server)); got != tc.timeouts {
+			t.Errorf("%s: timeouts %v, want %v", tc.server, got, tc.timeouts)
+		}
+	}
+}
+
+func TestCheckDNSServersCancelled(t *testing.T) {
+	s := dnsScanner(t)
+	silent := fakeDNSServer(t, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	checkDNSServers(ctx, s.m, DNSConfig{Servers: []string{silent}, Timeout: time.Minute})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %s after the context was cancelled", elapsed)
+	}
+	// An abandoned query says nothing about the server.
+	if n := testutil.CollectAndCount(s.m.DNSTimeouts); n != 0 {
+		t.Errorf("%d timeouts recorded for an abandoned check", n)
+	}
+}
+
+func TestDNSHealthLoop(t *testing.T) {
+	t.Chdir(t.TempDir()) // no config.yaml: the loop keeps its config
+	captureErrorLog(t)
+	s := dnsScanner(t)
+	up, silent := fakeDNSServer(t, false), fakeDNSServer(t, true)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.dnsHealthLoop(ctx, DNSConfig{Servers: []string{up, silent}, Timeout: time.Minute, Interval: 10 * time.Millisecond})
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(s.m.DNSServerUp.WithLabelValues(up)) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the loop never checked the servers")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// The silent server holds the check for its minute-long timeout;
+	// stopping does not wait for it.
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("loop returned %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the loop did not stop with its context")
+	}
+}
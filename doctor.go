@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type doctorStatus int
+
+const (
+	doctorPass doctorStatus = iota
+	doctorWarn
+	doctorFail
+)
+
+func (s doctorStatus) String() string {
+	return [...]string{"PASS", "WARN", "FAIL"}[s]
+}
+
+func (s doctorStatus) color() string {
+	return [...]string{"\033[32m", "\033[33m", "\033[31m"}[s]
+}
+
+type doctorResult struct {
+	Status doctorStatus
+	Detail string
+	// Hint tells the user how to fix a warning or failure.
+	Hint string
+}
+
+func passed(format string, args ...interface{}) doctorResult {
+	return doctorResult{Status: doctorPass, Detail: fmt.Sprintf(format, args...)}
+}
+
+// doctorCheck is one diagnostic. Checks must not depend on each other so
+// the list can grow freely. A per-scanner check runs once for every
+// scanner, with its runner and effective config.
+type doctorCheck struct {
+	Name       string
+	Run        func(s *scanner, cfg Config) doctorResult
+	PerScanner bool
+}
+
+var doctorChecks = []doctorCheck{
+	{"config", checkConfigFile, false},
+	{"commands", checkCommands, true},
+	{"probe", checkProbeCapability, true},
+	{"neighbor table", checkNeighborRead, true},
+	{"interface", checkInterfaceSubnet, true},
+	{"listen port", checkListenPort, false},
+	{"dhcp sniff", checkDHCPSniff, true},
+	{"dns", checkDNSReachability, true},
+	{"mdns", checkMDNSReachability, false},
+}
+
+// checkConfigFile parses config.yaml strictly so typos in keys are caught,
+// then validates the parts that are otherwise only reported at scan time.
+func checkConfigFile(*scanner, Config) doctorResult {
+	data, err := os.ReadFile(cfgPath)
+	if err != nil {
+		return doctorResult{doctorFail, err.Error(), "create " + cfgPath + " next to the binary (see the README)"}
+	}
+	cfg, err := decodeConfigStrict(data)
+	if err != nil {
+		return doctorResult{doctorFail, err.Error(), "fix the YAML syntax or the misspelled key"}
+	}
+	var problems []string
+	for _, err := range validateConfig(cfg) {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		return doctorResult{doctorFail, strings.Join(problems, "; "), "correct the listed settings in " + cfgPath}
+	}
+	return passed("%s is valid", cfgPath)
+}
+
+// requiredCommands are the external tools a scan shells out to: none when
+// probing locally on Linux, arp elsewhere, and ping too on a remote host
+// unless scan.ping_command replaces it.
+func requiredCommands(cfg Config) []string {
+	var names []string
+	if cfg.Remote != nil && !cfg.Scan.PingCommand.enabled() {
+		names = append(names, "ping")
+	}
+	if cfg.Remote != nil || runtime.GOOS != "linux" {
+		names = append(names, "arp")
+	}
+	return names
+}
+
+func checkCommands(s *scanner, cfg Config) doctorResult {
+	names := requiredCommands(cfg)
+	if len(names) == 0 {
+		return passed("no external commands needed")
+	}
+	var missing []string
+	for _, name := range names {
+		if cfg.Remote != nil {
+			if s.runner.Run("sh", "-c", "command -v "+name) != nil {
+				missing = append(missing, name)
+			}
+		} else if _, err := exec.LookPath(name); err != nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return doctorResult{doctorFail, "not found: " + strings.Join(missing, ", "),
+			"install iputils-ping and net-tools (Debian/Ubuntu) or the equivalent packages"}
+	}
+	return passed("%s available", strings.Join(names, " and "))
+}
+
+func checkProbeCapability(s *scanner, cfg Config) doctorResult {
+	if pc := cfg.Scan.PingCommand; pc.enabled() {
+		if err := checkPingCommand(s.runner, pc, cfg.Network.timeout()); err != nil {
+			return doctorResult{doctorFail, err.Error(), "fix scan.ping_command.path, args or alive_exit_codes"}
+		}
+		return passed("%s answered for 127.0.0.1", pc.Path)
+	}
+	if cfg.Remote == nil {
+		switch detectProbeMode() {
+		case probeModeICMP:
+			return passed("native ICMP echo over a raw socket")
+		case probeModeICMPUnprivilege:
+			return passed("native ICMP echo over an unprivileged ping socket")
+		}
+		return doctorResult{doctorWarn, "no ICMP socket allowed; probing with TCP connects, which miss hosts that drop them",
+			"run as root, setcap cap_net_raw+ep on the binary or widen net.ipv4.ping_group_range"}
+	}
+	if _, err := s.runner.Output("ping", "-c", "1", "-W", "1", "127.0.0.1"); err != nil {
+		switch {
+		case errors.Is(err, ErrUnavailable):
+			return doctorResult{doctorFail, "ping 127.0.0.1 failed: " + err.Error(),
+				"check that " + cfg.Remote.Host + " is reachable over ssh and has ping installed"}
+		case errors.Is(err, ErrPermission):
+			return doctorResult{doctorFail, "ping is not allowed to open a raw socket",
+				"run setcap cap_net_raw+ep $(which ping) or widen net.ipv4.ping_group_range"}
+		}
+		return doctorResult{doctorFail, "ping 127.0.0.1 failed: " + err.Error(), "check that ping works for this user"}
+	}
+	return passed("ping 127.0.0.1 answered")
+}
+
+func checkNeighborRead(s *scanner, cfg Config) doctorResult {
+	table, _, err := s.readNeighbors()
+	if err != nil {
+		hint := "make sure " + procNetARP + " (Linux) or arp -an can be read by this user"
+		switch {
+		case errors.Is(err, ErrUnavailable):
+			hint = "install net-tools (arp) or check the remote host is reachable"
+		case errors.Is(err, ErrParse):
+			hint = "the neighbor table has an unknown format; attach a debug bundle (POST /api/v1/debug/bundle) to a bug report"
+		}
+		return doctorResult{doctorFail, "reading the neighbor table failed: " + err.Error(), hint}
+	}
+	if len(table) == 0 {
+		return doctorResult{doctorWarn, "the neighbor table is empty",
+			"in containers grant CAP_NET_ADMIN / host networking; otherwise wait for traffic on the network"}
+	}
+	return passed("%d neighbor entries", len(table))
+}
+
+func checkInterfaceSubnet(_ *scanner, cfg Config) doctorResult {
+	if cfg.Remote != nil {
+		return passed("probing remotely on %s; local interfaces not checked", cfg.Remote.Host)
+	}
+	networks := cfg.scanNetworks()
+	if err := validateScanNetworks(networks); err != nil {
+		return doctorResult{doctorFail, err.Error(), "fix scan.interface / scan.source_ip / scan.interfaces"}
+	}
+	var ips []string
+	for _, n := range networks {
+		ip, _, err := localAddress(n.Scan, n.Range)
+		if err != nil {
+			return doctorResult{doctorFail, err.Error(), "connect to the " + n.Range.String() + " network or adjust network.cidrs"}
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 1 {
+		return passed("local address %s is in the scan range", ips[0])
+	}
+	return passed("local addresses %s are in the scan ranges", strings.Join(ips, ", "))
+}
+
+func checkListenPort(*scanner, Config) doctorResult {
+	ln, err := net.Listen("tcp", ":2112")
+	if err != nil {
+		return doctorResult{doctorFail, err.Error(), "stop the other exporter instance or whatever is bound to :2112"}
+	}
+	ln.Close()
+	return passed(":2112 is free")
+}
+
+func checkDHCPSniff(_ *scanner, cfg Config) doctorResult {
+	if !cfg.DHCP.Sniff {
+		return passed("dhcp.sniff is off")
+	}
+	if err := validateDHCPSniff(cfg); err != nil {
+		return doctorResult{doctorFail, err.Error(), "turn off dhcp.sniff or run the exporter on the scanned network"}
+	}
+	conn, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", dhcpServerPort))
+	if err != nil {
+		return doctorResult{doctorFail, err.Error(),
+			"run as root or setcap cap_net_bind_service+ep on the binary; a DHCP server on this host holds the port itself"}
+	}
+	conn.Close()
+	return passed("UDP %d can be bound", dhcpServerPort)
+}
+
+func checkDNSReachability(_ *scanner, cfg Config) doctorResult {
+	servers := cfg.DNS.Servers
+	if len(servers) == 0 {
+		servers = systemNameservers(resolvConfPath)
+	}
+	if len(servers) == 0 {
+		return doctorResult{doctorWarn, "no nameservers configured", "set dns.servers or fix " + resolvConfPath}
+	}
+	var down []string
+	for _, server := range servers {
+		if _, err := queryDNSServer(context.Background(), server, cfg.DNS.ProbeName, 2*time.Second); err != nil {
+			down = append(down, server)
+		}
+	}
+	if len(down) > 0 {
+		return doctorResult{doctorWarn, "not answering: " + strings.Join(down, ", "),
+			"hostnames from reverse DNS will be missing; check the nameservers"}
+	}
+	return passed("%d nameservers answering", len(servers))
+}
+
+// checkMDNSReachability sends a service enumeration query to the mDNS
+// group and waits for any answer.
+func checkMDNSReachability(*scanner, Config) doctorResult {
+	hint := "mDNS names will be missing; allow UDP 5353 and multicast on this host"
+	query := dnsmessage.Message{Questions: []dnsmessage.Question{{
+		Name:  dnsmessage.MustNewName("_services._dns-sd._udp.local."),
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET,
+	}}}
+	packet, err := query.Pack()
+	if err != nil {
+		return doctorResult{doctorWarn, err.Error(), hint}
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return doctorResult{doctorWarn, err.Error(), hint}
+	}
+	defer conn.Close()
+	if _, err := conn.WriteTo(packet, &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}); err != nil {
+		return doctorResult{doctorWarn, err.Error(), hint}
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	if _, from, err := conn.ReadFrom(buf); err == nil {
+		return passed("answer from %s", from)
+	}
+	return doctorResult{doctorWarn, "no mDNS responder answered", hint}
+}
+
+// runDoctor runs every check, prints the report and returns the exit code:
+// 1 if any check failed.
+func runDoctor() int {
+	cfg, _ := loadConfig(cfgPath)
+	var (
+		checked []*scanner
+		cfgs    []Config
+	)
+	for _, name := range cfg.scannerNames() {
+		s := newScanner(name, 1)
+		eff, err := cfg.scannerConfig(name, parseConfig)
+		if err != nil {
+			eff = cfg
+		}
+		if eff.Remote != nil {
+			if r, err := newSSHRunner(*eff.Remote); err == nil {
+				s.runner = r
+			}
+		}
+		checked, cfgs = append(checked, s), append(cfgs, eff)
+	}
+	colored := false
+	if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		colored = true
+	}
+
+	code := 0
+	for _, check := range doctorChecks {
+		for i, s := range checked {
+			if i > 0 && !check.PerScanner {
+				break
+			}
+			res := check.Run(s, cfgs[i])
+			status := res.Status.String()
+			if colored {
+				status = res.Status.color() + status + "\033[0m"
+			}
+			name := check.Name
+			if check.PerScanner && s.name != "" {
+				name += " (" + s.name + ")"
+			}
+			fmt.Printf("[%s] %-15s %s\n", status, name, res.Detail)
+			if res.Status != doctorPass && res.Hint != "" {
+				fmt.Printf("       %-15s -> %s\n", "", res.Hint)
+			}
+			if res.Status == doctorFail {
+				code = 1
+			}
+		}
+	}
+	return code
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNSServer answers every query on a local UDP port, or drops them
+// all when silent, and returns its address.
+func fakeDNSServer(t *testing.T, silent bool) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if silent || query.Unpack(buf[:n]) != nil {
+				continue
+			}
+			query.Header.Response = true
+			if answer, err := query.Pack(); err == nil {
+				conn.WriteTo(answer, from)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestCheckConfigFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for _, tc := range []struct {
+		name   string
+		data   string
+		status doctorStatus
+		detail string
+	}{
+		{"missing", "", doctorFail, "no such file"},
+		{"typo", "network:\n  cidr: [\"192.168.1.0/24\"]\n", doctorFail, "cidr"},
+		{"invalid", "network:\n  cidrs: [\"192.168.1.0\"]\n", doctorFail, "network.cidrs"},
+		{"valid", "network:\n  cidrs: [\"192.168.1.0/24\"]\n", doctorPass, "is valid"},
+	} {
+		os.Remove(cfgPath)
+		if tc.data != "" {
+			if err := os.WriteFile(cfgPath, []byte(tc.data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		res := checkConfigFile(nil, Config{})
+		if res.Status != tc.status || !strings.Contains(res.Detail, tc.detail) {
+			t.Errorf("%s: got %v %q, want %v containing %q", tc.name, res.Status, res.Detail, tc.status, tc.detail)
+		}
+		if res.Status != doctorPass && res.Hint == "" {
+			t.Errorf("%s: no hint", tc.name)
+		}
+	}
+}
+
+func TestRequiredCommands(t *testing.T) {
+	local := []string(nil)
+	if runtime.GOOS != "linux" {
+		local = []string{"arp"}
+	}
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+		want []string
+	}{
+		{"local", Config{}, local},
+		{"remote", Config{Remote: &RemoteConfig{Host: "pi"}}, []string{"ping", "arp"}},
+		{"remote with ping_command", Config{Remote: &RemoteConfig{Host: "pi"}, Scan: ScanConfig{PingCommand: PingCommandConfig{Path: "fping"}}}, []string{"arp"}},
+	} {
+		if got := requiredCommands(tc.cfg); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCheckCommandsRemote(t *testing.T) {
+	cfg := Config{Remote: &RemoteConfig{Host: "pi"}}
+	s := newScanner("", 1)
+	s.runner = fakeRunner{"sh -c command -v ping": "/bin/ping\n", "sh -c command -v arp": "/usr/sbin/arp\n"}
+	if res := checkCommands(s, cfg); res.Status != doctorPass {
+		t.Errorf("both installed: %v %q", res.Status, res.Detail)
+	}
+	s.runner = fakeRunner{"sh -c command -v ping": "/bin/ping\n"}
+	if res := checkCommands(s, cfg); res.Status != doctorFail || res.Detail != "not found: arp" {
+		t.Errorf("arp missing: %v %q", res.Status, res.Detail)
+	}
+}
+
+func TestCheckProbeCapabilityRemote(t *testing.T) {
+	cfg := Config{Remote: &RemoteConfig{Host: "pi"}}
+	s := newScanner("", 1)
+	s.runner = fakeRunner{"ping -c 1 -W 1 127.0.0.1": "1 packets transmitted, 1 received\n"}
+	if res := checkProbeCapability(s, cfg); res.Status != doctorPass {
+		t.Errorf("ping answering: %v %q", res.Status, res.Detail)
+	}
+	s.runner = fakeRunner{}
+	if res := checkProbeCapability(s, cfg); res.Status != doctorFail || !strings.Contains(res.Hint, "cap_net_raw") {
+		t.Errorf("ping without permission: %v %q -> %q", res.Status, res.Detail, res.Hint)
+	}
+}
+
+func TestCheckNeighborRead(t *testing.T) {
+	const header = "IP address       HW type     Flags       HW address            Mask     Device\n"
+	for _, tc := range []struct {
+		name   string
+		runner fakeRunner
+		status doctorStatus
+		hint   string
+	}{
+		{"entries", fakeRunner{"cat " + procNetARP: header + "192.168.1.5      0x1         0x2         aa:bb:cc:dd:ee:ff     *        wlan0\n"}, doctorPass, ""},
+		{"empty", fakeRunner{"cat " + procNetARP: header}, doctorWarn, "CAP_NET_ADMIN"},
+		{"unknown format", fakeRunner{"cat " + procNetARP: "garbage\n"}, doctorFail, "debug bundle"},
+		{"unreadable", fakeRunner{}, doctorFail, procNetARP},
+	} {
+		s := newScanner("", 1)
+		s.runner = tc.runner
+		res := checkNeighborRead(s, Config{})
+		if res.Status != tc.status || !strings.Contains(res.Hint, tc.hint) {
+			t.Errorf("%s: got %v %q -> %q, want %v with a hint about %q", tc.name, res.Status, res.Detail, res.Hint, tc.status, tc.hint)
+		}
+	}
+}
+
+func TestCheckInterfaceSubnet(t *testing.T) {
+	if res := checkInterfaceSubnet(nil, Config{Remote: &RemoteConfig{Host: "pi"}}); res.Status != doctorPass {
+		t.Errorf("remote: %v %q", res.Status, res.Detail)
+	}
+	cfg := Config{Network: NetworkConfig{CIDRs: []string{"127.0.0.0/24"}}}
+	if res := checkInterfaceSubnet(nil, cfg); res.Status != doctorPass || !strings.Contains(res.Detail, "127.0.0.1") {
+		t.Errorf("loopback range: %v %q", res.Status, res.Detail)
+	}
+	cfg.Network.CIDRs = []string{"198.51.100.0/24"}
+	if res := checkInterfaceSubnet(nil, cfg); res.Status != doctorFail || !strings.Contains(res.Hint, "198.51.100.0/24") {
+		t.Errorf("range off this host: %v %q -> %q", res.Status, res.Detail, res.Hint)
+	}
+}
+
+func TestCheckListenPort(t *testing.T) {
+	ln, err := net.Listen("tcp", ":2112")
+	if err != nil {
+		t.Skipf("port 2112 is in use: %v", err)
+	}
+	res := checkListenPort(nil, Config{})
+	ln.Close()
+	if res.Status != doctorFail || res.Hint == "" {
+		t.Errorf("bound port: %v %q", res.Status, res.Detail)
+	}
+	if res := checkListenPort(nil, Config{}); res.Status != doctorPass {
+		t.Errorf("free port: %v %q", res.Status, res.Detail)
+	}
+}
+
+func TestCheckDHCPSniffOff(t *testing.T) {
+	if res := checkDHCPSniff(nil, Config{}); res.Status != doctorPass {
+		t.Errorf("got %v %q", res.Status, res.Detail)
+	}
+}
+
+func TestCheckDNSReachability(t *testing.T) {
+	up, down := fakeDNSServer(t, false), fakeDNSServer(t, true)
+	if res := checkDNSReachability(nil, Config{DNS: DNSConfig{Servers: []string{up}}}); res.Status != doctorPass {
+		t.Errorf("answering server: %v %q", res.Status, res.Detail)
+	}
+	res := checkDNSReachability(nil, Config{DNS: DNSConfig{Servers: []string{up, down}}})
+	if res.Status != doctorWarn || res.Detail != "not answering: "+down {
+		t.Errorf("silent server: %v %q", res.Status, res.Detail)
+	}
+}
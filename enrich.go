@@ -0,0 +1,440 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// EnrichmentConfig moves the slow per-device lookups (the netbios and
+// versions resolution stages, and SSH enrichment of devices with an ssh
+// entry) out of the scan into a background scheduler, so every device is
+// not asked everything on every scan.
+// Enabling or disabling it takes a restart; the enricher settings are
+// re-read every scan.
+type EnrichmentConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Workers is the size of the pool working the queue (default 2).
+	Workers int `yaml:"workers"`
+	// Enrichers tunes each enricher by stage name.
+	Enrichers map[string]EnricherConfig `yaml:"enrichers"`
+}
+
+type EnricherConfig struct {
+	// MinInterval is the rate limit: the least time between two runs of
+	// this enricher, across all devices (default 250ms).
+	MinInterval time.Duration `yaml:"min_interval"`
+	// Cooldown is how long a device is left alone after it was enriched
+	// (default 6h).
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// enricherNames are the resolution stages the scheduler takes over, and
+// ssh, which only it runs.
+var enricherNames = []string{sourceNetBIOS, stageVersions, sourceSSH}
+
+func (c EnrichmentConfig) workers() int {
+	if c.Workers <= 0 {
+		return 2
+	}
+	return c.Workers
+}
+
+func (c EnrichmentConfig) minInterval(enricher string) time.Duration {
+	if d := c.Enrichers[enricher].MinInterval; d > 0 {
+		return d
+	}
+	return 250 * time.Millisecond
+}
+
+func (c EnrichmentConfig) cooldown(enricher string) time.Duration {
+	if d := c.Enrichers[enricher].Cooldown; d > 0 {
+		return d
+	}
+	return 6 * time.Hour
+}
+
+// Job priorities; lower runs first among jobs due at the same time.
+const (
+	enrichPriorityNew = iota
+	enrichPriorityKnown
+)
+
+type enrichJob struct {
+	key       string // device key
+	enricher  string
+	notBefore time.Time
+	priority  int
+	index     int
+}
+
+type enrichQueue []*enrichJob
+
+func (q enrichQueue) Len() int { return len(q) }
+func (q enrichQueue) Less(i, j int) bool {
+	if !q[i].notBefore.Equal(q[j].notBefore) {
+		return q[i].notBefore.Before(q[j].notBefore)
+	}
+	return q[i].priority < q[j].priority
+}
+func (q enrichQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+func (q *enrichQueue) Push(x interface{}) {
+	job := x.(*enrichJob)
+	job.index = len(*q)
+	*q = append(*q, job)
+}
+func (q *enrichQueue) Pop() interface{} {
+	old := *q
+	job := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return job
+}
+
+// enrichTarget is what a worker needs to enrich a device, as of the last
+// scan that saw it.
+type enrichTarget struct {
+	ip       string
+	mdnsName string
+	ssh      *RemoteConfig
+}
+
+// enrichResult is merged into deviceNames and deviceVersions by the scan
+// loop, which owns them.
+type enrichResult struct {
+	key      string
+	enricher string
+	name     string
+	version  VersionRecord
+	hostInfo HostInfo
+	// err is set for failed ssh lookups, which go into the device's error
+	// history.
+	err error
+}
+
+type enrichJobKey struct{ key, enricher string }
+
+// enrichScheduler holds one job per device and enricher. The scan loop
+// feeds it with observe and takes results with drain; workers only run
+// while no scan is in progress.
+type enrichScheduler struct {
+	m       *Metrics
+	scanner *scanner
+
+	mu      sync.Mutex
+	cfg     EnrichmentConfig
+	res     ResolutionConfig
+	queue   enrichQueue
+	queued  map[enrichJobKey]*enrichJob
+	targets map[string]enrichTarget
+	last    map[enrichJobKey]time.Time
+	fails   map[enrichJobKey]int // failed runs in a row, for the backoff
+	next    map[string]time.Time // per enricher, for the rate limit
+	paused  bool
+	held    bool // power_save, see hold
+	results []enrichResult
+	wake    chan struct{} // closed and replaced whenever workers should look again
+}
+
+func newEnrichScheduler(sc *scanner, cfg EnrichmentConfig) *enrichScheduler {
+	return &enrichScheduler{
+		m:       sc.m,
+		scanner: sc,
+		cfg:     cfg,
+		queued:  make(map[enrichJobKey]*enrichJob),
+		targets: make(map[string]enrichTarget),
+		last:    make(map[enrichJobKey]time.Time),
+		fails:   make(map[enrichJobKey]int),
+		next:    make(map[string]time.Time),
+		wake:    make(chan struct{}),
+	}
+}
+
+// deferred reports whether the scan should leave stage to the scheduler.
+func (s *enrichScheduler) deferred(stage string) bool {
+	if s == nil {
+		return false
+	}
+	for _, name := range enricherNames {
+		if name == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// staleAfter extends ttl by the cooldown for names an enricher refreshes,
+// which are only looked up again once the cooldown has passed.
+func (s *enrichScheduler) staleAfter(source string, ttl time.Duration) time.Duration {
+	if !s.deferred(source) {
+		return ttl
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return ttl + s.cfg.cooldown(source)
+}
+
+// notifyLocked wakes every waiting worker. Callers hold s.mu.
+func (s *enrichScheduler) notifyLocked() {
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+// wants reports whether enricher applies to a target: ssh to devices with
+// an ssh entry, the others while their resolution stage is enabled.
+func (s *enrichScheduler) wants(target enrichTarget, enricher string) bool {
+	if enricher == sourceSSH {
+		return target.ssh != nil
+	}
+	return s.res.stageEnabled(enricher)
+}
+
+// pause stops workers from starting jobs while a scan runs; jobs already
+// running finish.
+func (s *enrichScheduler) pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = true
+}
+
+// hold keeps workers from starting jobs while on, across scans, e.g. to
+// save battery. Safe on a nil scheduler.
+func (s *enrichScheduler) hold(on bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.held && !on {
+		s.notifyLocked()
+	}
+	s.held = on
+}
+
+// observe updates the targets from a finished scan and resumes the
+// workers. Devices never enriched are queued to run now; the others keep
+// their job, due a cooldown after their last run. Devices missing from
+// the scan are dropped along with their jobs.
+func (s *enrichScheduler) observe(cfg Config, devices []Device, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg.Enrichers = cfg.Enrichment.Enrichers
+	s.res = cfg.Resolution
+	s.targets = make(map[string]enrichTarget, len(devices))
+	for _, d := range devices {
+		target := enrichTarget{ip: d.IP, mdnsName: d.Names[sourceMDNS].Name}
+		if dc, ok := cfg.deviceConfig(d.MAC); ok && dc.SSH != nil && !d.Proxied {
+			target.ssh = dc.SSH
+		}
+		s.targets[d.key()] = target
+	}
+	for jk, job := range s.queued {
+		if target, ok := s.targets[jk.key]; !ok || !s.wants(target, jk.enricher) {
+			heap.Remove(&s.queue, job.index)
+			delete(s.queued, jk)
+		}
+	}
+	for jk := range s.last {
+		if _, ok := s.targets[jk.key]; !ok {
+			delete(s.last, jk)
+			delete(s.fails, jk)
+		}
+	}
+	for key, target := range s.targets {
+		for _, enricher := range enricherNames {
+			jk := enrichJobKey{key, enricher}
+			if _, ok := s.queued[jk]; ok || !s.wants(target, enricher) {
+				continue
+			}
+			job := &enrichJob{key: key, enricher: enricher, notBefore: now, priority: enrichPriorityNew}
+			if last, ok := s.last[jk]; ok {
+				job.notBefore, job.priority = last.Add(s.cfg.cooldown(enricher)), enrichPriorityKnown
+			}
+			heap.Push(&s.queue, job)
+			s.queued[jk] = job
+		}
+	}
+	s.paused = false
+	s.m.EnrichmentQueueDepth.Set(float64(len(s.queue)))
+	s.notifyLocked()
+}
+
+// drain hands the results gathered since the last call to the scan loop.
+func (s *enrichScheduler) drain() []enrichResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := s.results
+	s.results = nil
+	return out
+}
+
+// take pops the next job that is due and allowed by its enricher's rate
+// limit. Otherwise it returns how long to wait and the channel that is
+// closed when the queue changes.
+func (s *enrichScheduler) take(now time.Time) (*enrichJob, enrichTarget, time.Duration, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.paused && !s.held && len(s.queue) > 0 {
+		job := s.queue[0]
+		if wait := job.notBefore.Sub(now); wait > 0 {
+			return nil, enrichTarget{}, wait, s.wake
+		}
+		if next := s.next[job.enricher]; next.After(now) {
+			// Rate limited: push back behind the limit and look again.
+			job.notBefore = next
+			heap.Fix(&s.queue, job.index)
+			continue
+		}
+		heap.Pop(&s.queue)
+		delete(s.queued, enrichJobKey{job.key, job.enricher})
+		s.next[job.enricher] = now.Add(s.cfg.minInterval(job.enricher))
+		s.m.EnrichmentQueueDepth.Set(float64(len(s.queue)))
+		return job, s.targets[job.key], 0, nil
+	}
+	return nil, enrichTarget{}, time.Hour, s.wake
+}
+
+// finish records a job's result and requeues the device after the
+// enricher's cooldown, or after enrichBackoff when it returned an error.
+func (s *enrichScheduler) finish(job *enrichJob, res *enrichResult, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jk := enrichJobKey{job.key, job.enricher}
+	if res != nil {
+		s.results = append(s.results, *res)
+	}
+	if _, ok := s.targets[job.key]; !ok {
+		return
+	}
+	s.last[jk] = now
+	wait := s.cfg.cooldown(job.enricher)
+	if res != nil && res.err != nil {
+		s.fails[jk]++
+		wait = enrichBackoff(s.fails[jk])
+	} else {
+		delete(s.fails, jk)
+	}
+	job.notBefore, job.priority = now.Add(wait), enrichPriorityKnown
+	heap.Push(&s.queue, job)
+	s.queued[jk] = job
+	s.m.EnrichmentQueueDepth.Set(float64(len(s.queue)))
+}
+
+func (s *enrichScheduler) run(job *enrichJob, target enrichTarget) *enrichResult {
+	s.mu.Lock()
+	timeout := s.res.timeout()
+	s.mu.Unlock()
+
+	start := time.Now()
+	res := &enrichResult{key: job.key, enricher: job.enricher}
+	var err error
+	switch job.enricher {
+	case sourceNetBIOS:
+		res.name, err = s.scanner.lookupNetBIOS(target.ip, timeout)
+	case stageVersions:
+		names := map[string]string{}
+		if target.mdnsName != "" {
+			names[sourceMDNS] = target.mdnsName
+		}
+		var ok bool
+		if res.version, ok = s.scanner.lookupVersion(target.ip, names, timeout); !ok {
+			res = nil
+		}
+	case sourceSSH:
+		res.hostInfo, err = lookupHostInfo(target.ip, *target.ssh, time.Now())
+	}
+	s.m.EnrichmentDuration.WithLabelValues(job.enricher).Observe(time.Since(start).Seconds())
+	if err != nil || res == nil {
+		if err != nil {
+			debugf("enriching %s with %s: %v", target.ip, job.enricher, err)
+		}
+		s.m.EnrichmentFailures.WithLabelValues(job.enricher).Inc()
+		if job.enricher == sourceSSH {
+			res.err = err
+			return res
+		}
+		return nil
+	}
+	return res
+}
+
+func (s *enrichScheduler) worker(ctx context.Context) {
+	for {
+		job, target, wait, changed := s.take(time.Now())
+		if job != nil {
+			s.finish(job, s.run(job, target), time.Now())
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// enrichmentLoop runs the worker pool until ctx is done. Running lookups
+// are bounded by resolution.timeout and allowed to finish; the pending
+// queue is abandoned, as it is rebuilt from the first scan after a
+// restart.
+func enrichmentLoop(ctx context.Context, s *enrichScheduler) error {
+	var wg sync.WaitGroup
+	for i := 0; i < s.cfg.workers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.worker(ctx)
+		}()
+	}
+	wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := len(s.queue); n > 0 {
+		log.Printf("Abandoning %d queued enrichment jobs", n)
+	}
+	return nil
+}
+
+// mergeEnrichment stores results from the scheduler the way resolution
+// results are stored. Only called by the scan loop.
+func (s *scanner) mergeEnrichment(results []enrichResult) {
+	for _, res := range results {
+		switch res.enricher {
+		case sourceNetBIOS:
+			records := s.deviceNames[res.key]
+			if records == nil {
+				records = make(map[string]NameRecord)
+				s.deviceNames[res.key] = records
+			}
+			records[sourceNetBIOS] = NameRecord{Name: res.name, ResolvedAt: time.Now()}
+		case stageVersions:
+			s.deviceVersions[res.key] = res.version
+		case sourceSSH:
+			s.recordDeviceResult(res.key, errSSH, res.err, time.Now())
+			if res.err != nil {
+				continue
+			}
+			s.deviceHostInfo[res.key] = res.hostInfo
+			if res.hostInfo.Hostname != "" {
+				records := s.deviceNames[res.key]
+				if records == nil {
+					records = make(map[string]NameRecord)
+					s.deviceNames[res.key] = records
+				}
+				records[sourceSSH] = NameRecord{Name: res.hostInfo.Hostname, ResolvedAt: res.hostInfo.CheckedAt}
+			}
+		}
+	}
+}
+
+func init() {
+	registerFeature("enrichment", false)
+}
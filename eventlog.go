@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// EventLogConfig appends every numbered event to a local JSONL file, one
+// envelope per line exactly as served by /api/v1/events, for setups with
+// nowhere to send them. It is off unless path is set and takes effect on
+// restart.
+type EventLogConfig struct {
+	Path string `yaml:"path"`
+	// MaxSizeBytes rotates the file to <path>.1 once it would grow past
+	// this size (default 10 MiB).
+	MaxSizeBytes int64 `yaml:"max_size_bytes"`
+	// Keep is how many rotated files are kept (default 5).
+	Keep int `yaml:"keep"`
+	// Fsync is "always" (after every write), "interval" (once a second,
+	// the default) or "never" (left to the OS).
+	Fsync string `yaml:"fsync"`
+	// QueueSize bounds the events waiting to be written (default 1024);
+	// when it is full the oldest is dropped.
+	QueueSize int `yaml:"queue_size"`
+}
+
+const (
+	fsyncAlways   = "always"
+	fsyncInterval = "interval"
+	fsyncNever    = "never"
+)
+
+func (c EventLogConfig) enabled() bool {
+	return c.Path != ""
+}
+
+func (c EventLogConfig) maxSizeBytes() int64 {
+	if c.MaxSizeBytes <= 0 {
+		return 10 << 20
+	}
+	return c.MaxSizeBytes
+}
+
+func (c EventLogConfig) keep() int {
+	if c.Keep <= 0 {
+		return 5
+	}
+	return c.Keep
+}
+
+func (c EventLogConfig) fsync() string {
+	if c.Fsync == "" {
+		return fsyncInterval
+	}
+	return c.Fsync
+}
+
+func (c EventLogConfig) queueSize() int {
+	if c.QueueSize <= 0 {
+		return 1024
+	}
+	return c.QueueSize
+}
+
+func (c EventLogConfig) validate() error {
+	switch c.fsync() {
+	case fsyncAlways, fsyncInterval, fsyncNever:
+	default:
+		return fmt.Errorf("event_log.fsync must be %q, %q or %q, got %q", fsyncAlways, fsyncInterval, fsyncNever, c.Fsync)
+	}
+	return nil
+}
+
+// eventLogRetry is how long the writer waits before opening the file
+// again, e.g. while its directory is missing.
+const eventLogRetry = time.Second
+
+// eventLogWriter decouples emitEvent from the disk: enqueue never blocks,
+// and a single goroutine writes, rotates and syncs.
+type eventLogWriter struct {
+	cfg EventLogConfig
+	m   *Metrics
+
+	mu     sync.Mutex
+	queue  [][]byte
+	notify chan struct{}
+
+	// Only touched by the writer goroutine.
+	file     *os.File
+	size     int64
+	dirty    bool
+	lastSync time.Time
+}
+
+// eventLog is nil unless event_log.path was set at startup.
+var eventLog *eventLogWriter
+
+func newEventLogWriter(m *Metrics, cfg EventLogConfig) *eventLogWriter {
+	return &eventLogWriter{cfg: cfg, m: m, notify: make(chan struct{}, 1)}
+}
+
+// enqueue adds an event, dropping the oldest if the queue is full. It is
+// called by broadcastEvent, so lines are queued in Seq order.
+func (w *eventLogWriter) enqueue(ev Event) {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		errorLog.Printf("Error encoding %s event for the event log: %v", ev.Type, err)
+		return
+	}
+	w.mu.Lock()
+	if len(w.queue) >= w.cfg.queueSize() {
+		w.queue = w.queue[1:]
+		w.m.EventLogDropped.Inc()
+	}
+	w.queue = append(w.queue, append(line, '\n'))
+	w.mu.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (w *eventLogWriter) take() [][]byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	lines := w.queue
+	w.queue = nil
+	return lines
+}
+
+// requeue puts lines that could not be written back ahead of newer ones,
+// still bounded by the queue size.
+func (w *eventLogWriter) requeue(lines [][]byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.queue = append(lines, w.queue...)
+	if over := len(w.queue) - w.cfg.queueSize(); over > 0 {
+		w.queue = w.queue[over:]
+		w.m.EventLogDropped.Add(float64(over))
+	}
+}
+
+// open (re)opens the file if it is not open, or if the path no longer
+// points at it because it was moved, deleted or its directory unmounted.
+func (w *eventLogWriter) open() error {
+	if w.file != nil {
+		onDisk, err := os.Stat(w.cfg.Path)
+		open, ferr := w.file.Stat()
+		if err == nil && ferr == nil && os.SameFile(onDisk, open) {
+			return nil
+		}
+		w.close()
+	}
+	f, err := os.OpenFile(w.cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file, w.size = f, info.Size()
+	return nil
+}
+
+func (w *eventLogWriter) close() {
+	if w.file == nil {
+		return
+	}
+	if w.dirty {
+		w.file.Sync()
+		w.dirty = false
+	}
+	w.file.Close()
+	w.file = nil
+}
+
+// rotate shifts <path>.N to <path>.N+1, dropping the oldest, and moves
+// the current file to <path>.1.
+func (w *eventLogWriter) rotate() error {
+	w.close()
+	keep := w.cfg.keep()
+	os.Remove(fmt.Sprintf("%s.%d", w.cfg.Path, keep))
+	for i := keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", w.cfg.Path, i), fmt.Sprintf("%s.%d", w.cfg.Path, i+1))
+	}
+	if err := os.Rename(w.cfg.Path, w.cfg.Path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return w.open()
+}
+
+// write appends lines, rotating before a line that would pass the size
+// limit. It returns the lines it could not write.
+func (w *eventLogWriter) write(lines [][]byte) ([][]byte, error) {
+	if err := w.open(); err != nil {
+		return lines, err
+	}
+	for i, line := range lines {
+		if w.size > 0 && w.size+int64(len(line)) > w.cfg.maxSizeBytes() {
+			if err := w.rotate(); err != nil {
+				return lines[i:], err
+			}
+		}
+		n, err := w.file.Write(line)
+		w.size += int64(n)
+		w.dirty = w.dirty || n > 0
+		if err != nil {
+			w.close()
+			if n == 0 {
+				return lines[i:], err
+			}
+			// The line is partly on disk; writing it again would not fix it.
+			return lines[i+1:], err
+		}
+	}
+	return nil, nil
+}
+
+func (w *eventLogWriter) sync(now time.Time) {
+	if w.file == nil || !w.dirty {
+		return
+	}
+	switch w.cfg.fsync() {
+	case fsyncNever:
+		return
+	case fsyncInterval:
+		if now.Sub(w.lastSync) < time.Second {
+			return
+		}
+	}
+	if err := w.file.Sync(); err != nil {
+		w.m.EventLogErrors.Inc()
+		errorLog.Printf("Error syncing event log %s: %v", w.cfg.Path, err)
+	}
+	w.dirty, w.lastSync = false, now
+}
+
+func (w *eventLogWriter) flush() {
+	if lines := w.take(); len(lines) > 0 {
+		rest, err := w.write(lines)
+		if err != nil {
+			w.m.EventLogErrors.Inc()
+			errorLog.Printf("Error writing event log %s, retrying: %v", w.cfg.Path, err)
+			w.requeue(rest)
+		}
+	}
+	w.sync(time.Now())
+}
+
+// eventLogLoop writes queued events until ctx is done, then writes what is
+// left and closes the file. Write errors keep events queued and are
+// retried every eventLogRetry.
+func eventLogLoop(ctx context.Context, w *eventLogWriter) error {
+	ticker := time.NewTicker(eventLogRetry)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			w.flush()
+			w.close()
+			return nil
+		case <-w.notify:
+		case <-ticker.C:
+		}
+		w.flush()
+	}
+}
+
+func init() {
+	registerFeature("event_log", false)
+}
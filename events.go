@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// Event is the envelope for lifecycle and device events. Events are written
+// to the log as one JSON object per line and fanned out to stream
+// subscribers. Seq increases by one per broadcast event so clients can
+// resume; events synthesized for a single client carry no Seq. ScanID is
+// the scan in progress (or the last one) when the event was emitted.
+type Event struct {
+	Seq    uint64                 `json:"seq,omitempty"`
+	ScanID uint64                 `json:"scan_id,omitempty"`
+	Type   string                 `json:"type"`
+	Time   time.Time              `json:"time"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+func emitEvent(eventType string, fields map[string]interface{}) {
+	logEvent(Event{Type: eventType, Time: time.Now(), Fields: fields})
+}
+
+// logEvent broadcasts ev and writes it to the log.
+func logEvent(ev Event) {
+	ev = broadcastEvent(ev)
+	data, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("Error encoding %s event: %v", ev.Type, err)
+		return
+	}
+	log.Println("event " + string(data))
+}
+
+// subscriber receives events on a buffered channel. A subscriber that does
+// not keep up has its channel closed instead of blocking the publisher.
+type subscriber struct {
+	ch chan Event
+}
+
+type EventsConfig struct {
+	// Buffer is how many recent events are kept for clients resuming with
+	// Last-Event-ID or ?after_seq=.
+	Buffer int `yaml:"buffer"`
+}
+
+// subscribersMu also guards the sequence counter and the replay ring, so
+// a subscriber registered with a replay sees every event exactly once.
+var (
+	subscribersMu sync.Mutex
+	subscribers   = make(map[*subscriber]struct{})
+	eventSeq      uint64
+	eventRing     []Event
+	eventRingSize = defaultEventBuffer
+)
+
+const defaultEventBuffer = 256
+
+func configureEventBuffer(cfg EventsConfig) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	if cfg.Buffer > 0 {
+		eventRingSize = cfg.Buffer
+	}
+}
+
+// resyncEvent tells a client that events after its cursor were already
+// dropped from the buffer and it has to refetch the snapshot.
+func resyncEvent(after, oldest uint64) Event {
+	return Event{Type: "resync_required", Time: time.Now(), Fields: map[string]interface{}{
+		"after_seq":  after,
+		"oldest_seq": oldest,
+	}}
+}
+
+// eventsAfter returns the buffered events with Seq > after, preceded by a
+// resync_required event if some of them were already dropped or the cursor
+// is from before a restart. Callers hold subscribersMu.
+func eventsAfter(after uint64) []Event {
+	var out []Event
+	if after > eventSeq {
+		return append(out, resyncEvent(after, eventSeq+1))
+	}
+	if len(eventRing) > 0 && eventRing[0].Seq > after+1 {
+		out = append(out, resyncEvent(after, eventRing[0].Seq))
+	} else if len(eventRing) == 0 && eventSeq > after {
+		out = append(out, resyncEvent(after, eventSeq+1))
+	}
+	for _, ev := range eventRing {
+		if ev.Seq > after {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+func recentEvents(after uint64) ([]Event, uint64) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	return eventsAfter(after), eventSeq
+}
+
+func subscribe(buffer int) (<-chan Event, func()) {
+	ch, _, cancel := subscribeAfter(buffer, nil)
+	return ch, cancel
+}
+
+// subscribeAfter registers a subscriber; with a cursor it also returns the
+// buffered events after it, atomically with the registration.
+func subscribeAfter(buffer int, after *uint64) (<-chan Event, []Event, func()) {
+	sub := &subscriber{ch: make(chan Event, buffer)}
+	subscribersMu.Lock()
+	var replay []Event
+	if after != nil {
+		replay = eventsAfter(*after)
+	}
+	subscribers[sub] = struct{}{}
+	subscribersMu.Unlock()
+
+	cancel := func() {
+		subscribersMu.Lock()
+		defer subscribersMu.Unlock()
+		if _, ok := subscribers[sub]; ok {
+			delete(subscribers, sub)
+			close(sub.ch)
+		}
+	}
+	return sub.ch, replay, cancel
+}
+
+// broadcastEvent numbers ev, buffers it for resuming clients and delivers
+// it to every subscriber without logging it.
+func broadcastEvent(ev Event) Event {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	eventSeq++
+	ev.Seq = eventSeq
+	if ev.ScanID == 0 {
+		ev.ScanID = scanID.Load()
+	}
+	eventRing = append(eventRing, ev)
+	if len(eventRing) > eventRingSize {
+		eventRing = eventRing[len(eventRing)-eventRingSize:]
+	}
+	if eventLog != nil {
+		eventLog.enqueue(ev)
+	}
+	for sub := range subscribers {
+		select {
+		case sub.ch <- ev:
+		default:
+			delete(subscribers, sub)
+			close(sub.ch)
+		}
+	}
+	return ev
+}
+
+// emitDeviceEvents diffs two scans by device key and emits device_joined,
+// device_left, device_changed and device_version_changed, followed by
+// scan_completed.
+func (s *scanner) emitDeviceEvents(prev, cur *ScanSnapshot) {
+	before := make(map[string]Device)
+	if prev != nil {
+		for _, d := range prev.Devices {
+			if _, ok := before[d.key()]; !ok {
+				before[d.key()] = d
+			}
+		}
+	}
+	after := make(map[string]Device)
+	for _, d := range cur.Devices {
+		if _, ok := after[d.key()]; !ok {
+			after[d.key()] = d
+		}
+	}
+
+	// The first scan after startup only establishes the baseline.
+	if prev != nil {
+		for key, d := range after {
+			old, ok := before[key]
+			switch {
+			case !ok:
+				s.emitEvent("device_joined", map[string]interface{}{"device": d})
+			case old.IP != d.IP || old.Hostname != d.Hostname || old.DeviceType != d.DeviceType:
+				s.emitEvent("device_changed", map[string]interface{}{"device": d, "previous": old})
+			}
+			if ok && old.Version != nil && d.Version != nil && old.Version.Version != d.Version.Version {
+				s.emitEvent("device_version_changed", map[string]interface{}{
+					"device":   d,
+					"previous": old.Version.Version,
+					"version":  d.Version.Version,
+				})
+			}
+		}
+		for key, d := range before {
+			if _, ok := after[key]; !ok {
+				s.emitEvent("device_left", map[string]interface{}{"device": d})
+			}
+		}
+	}
+	s.emitScanCompleted(cur)
+}
+
+func (s *scanner) emitScanCompleted(cur *ScanSnapshot) {
+	ev := Event{Type: "scan_completed", Time: cur.TakenAt, ScanID: cur.Stats.ID, Fields: map[string]interface{}{
+		"devices":    len(cur.Devices),
+		"duration":   cur.Stats.Duration.Seconds(),
+		"conditions": cur.Stats.Conditions,
+	}}
+	if cur.Stats.TraceID != "" {
+		ev.Fields["trace_id"] = cur.Stats.TraceID
+	}
+	if s.name != "" {
+		ev.Fields["scanner"] = s.name
+	}
+	broadcastEvent(ev)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// validateExpectedIPs checks the expected_ip of every devices: entry.
+func validateExpectedIPs(devices []DeviceConfig) []error {
+	var errs []error
+	for _, d := range devices {
+		if d.ExpectedIP != "" && net.ParseIP(d.ExpectedIP) == nil {
+			errs = append(errs, fmt.Errorf("devices %s: expected_ip %q is not an IP address", d.MAC, d.ExpectedIP))
+		}
+	}
+	return errs
+}
+
+func sameFamily(a, b net.IP) bool {
+	return (a.To4() == nil) == (b.To4() == nil)
+}
+
+// checkExpectedIPs compares the devices that have an expected_ip with the
+// addresses they were seen at. A device that is not in the scan, or only
+// seen with addresses of the other family, keeps its state: a violation
+// lasts until the device shows up at the expected address again or the
+// setting changes.
+func (s *scanner) checkExpectedIPs(cfg Config, devices []Device) {
+	seen := make(map[string][]net.IP)
+	for _, d := range devices {
+		if ip := net.ParseIP(d.IP); ip != nil {
+			mac := strings.ToLower(d.MAC)
+			seen[mac] = append(seen[mac], ip)
+		}
+	}
+
+	pinned := make(map[string]string)
+	for _, dc := range cfg.Devices {
+		expected := net.ParseIP(dc.ExpectedIP)
+		if expected == nil {
+			continue
+		}
+		mac := strings.ToLower(dc.MAC)
+		pinned[mac] = expected.String()
+		if s.pinnedDevices[mac] != pinned[mac] {
+			// Newly pinned or changed: start over.
+			s.m.IPViolation.WithLabelValues(mac).Set(0)
+			delete(s.ipViolations, mac)
+		}
+
+		var observed []string
+		ok := false
+		for _, ip := range seen[mac] {
+			if !sameFamily(ip, expected) {
+				continue
+			}
+			if ip.Equal(expected) {
+				ok = true
+			}
+			observed = append(observed, ip.String())
+		}
+		switch {
+		case len(observed) == 0:
+			// Offline or only seen with the other address family.
+		case ok:
+			s.m.IPViolation.WithLabelValues(mac).Set(0)
+			if prev, ok := s.ipViolations[mac]; ok {
+				delete(s.ipViolations, mac)
+				s.emitEvent("expected_ip_restored", map[string]interface{}{
+					"mac":      mac,
+					"name":     dc.Name,
+					"expected": dc.ExpectedIP,
+					"previous": prev,
+				})
+			}
+		default:
+			s.m.IPViolation.WithLabelValues(mac).Set(1)
+			at := strings.Join(observed, ",")
+			if s.ipViolations[mac] != at {
+				s.ipViolations[mac] = at
+				s.emitEvent("expected_ip_violation", map[string]interface{}{
+					"mac":      mac,
+					"name":     dc.Name,
+					"expected": dc.ExpectedIP,
+					"observed": observed,
+				})
+			}
+		}
+	}
+
+	for mac := range s.pinnedDevices {
+		if _, ok := pinned[mac]; !ok {
+			s.m.IPViolation.DeleteLabelValues(mac)
+			delete(s.ipViolations, mac)
+		}
+	}
+	s.pinnedDevices = pinned
+}
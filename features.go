@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Optional modules call registerFeature from their init so the binary can
+// report what it was built with. Modules compiled out via build tags
+// register themselves as disabled from their stub file.
+var (
+	featuresMu sync.Mutex
+	features   = make(map[string]bool)
+)
+
+func registerFeature(name string, enabled bool) {
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+	features[name] = enabled
+}
+
+func featureSet() map[string]bool {
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+	out := make(map[string]bool, len(features))
+	for k, v := range features {
+		out[k] = v
+	}
+	return out
+}
+
+func enabledFeatures() []string {
+	names := []string{}
+	for name, enabled := range featureSet() {
+		if enabled {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func disabledFeatures() []string {
+	names := []string{}
+	for name, enabled := range featureSet() {
+		if !enabled {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// registerFeaturesInfo exposes telemetry_features_info with one label per
+// feature. It must run after every init has registered its feature and
+// after main has registered the ones the config enables.
+func registerFeaturesInfo(reg prometheus.Registerer, namespace string) {
+	set := featureSet()
+	labels := make(prometheus.Labels, len(set))
+	for name, enabled := range set {
+		labels[name] = strconv.FormatBool(enabled)
+	}
+	info := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "telemetry_features_info",
+		Help:        "Features compiled into and enabled in this binary",
+		ConstLabels: labels,
+	})
+	info.Set(1)
+	reg.MustRegister(info)
+}
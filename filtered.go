@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// labelMatcher is one matcher of a series selector, e.g. job=~"home|lab".
+type labelMatcher struct {
+	name  string
+	op    string // =, !=, =~ or !~
+	value string
+	re    *regexp.Regexp // anchored, for =~ and !~
+}
+
+func (m labelMatcher) matches(v string) bool {
+	switch m.op {
+	case "=":
+		return v == m.value
+	case "!=":
+		return v != m.value
+	case "=~":
+		return m.re.MatchString(v)
+	}
+	return !m.re.MatchString(v)
+}
+
+// seriesSelector is a parsed Prometheus series selector; a series matches
+// when every matcher does.
+type seriesSelector []labelMatcher
+
+// parseSelector parses a series selector the way Prometheus does for
+// match[]: an optional metric name followed by optional label matchers,
+//
+//	wifi_device_state{state="online", mac=~"aa:.*"}
+//	{__name__=~"macbook_.*_ratio"}
+//
+// with values in double, single or back quotes. Like Prometheus, it
+// rejects selectors in which every matcher matches the empty string,
+// since those would select every series.
+func parseSelector(s string) (seriesSelector, error) {
+	p := &selectorParser{s: s}
+	var sel seriesSelector
+	p.skipSpace()
+	if name := p.ident(true); name != "" {
+		sel = append(sel, labelMatcher{name: "__name__", op: "=", value: name})
+	}
+	p.skipSpace()
+	if p.peek() == '{' {
+		p.pos++
+		for {
+			p.skipSpace()
+			if p.peek() == '}' {
+				p.pos++
+				break
+			}
+			m, err := p.matcher()
+			if err != nil {
+				return nil, err
+			}
+			sel = append(sel, m)
+			p.skipSpace()
+			switch p.peek() {
+			case ',':
+				p.pos++
+			case '}':
+			default:
+				return nil, p.errorf("expected , or }")
+			}
+		}
+	}
+	p.skipSpace()
+	if p.pos < len(p.s) {
+		return nil, p.errorf("unexpected %q", p.s[p.pos:])
+	}
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("empty selector")
+	}
+	for _, m := range sel {
+		if !m.matches("") {
+			return sel, nil
+		}
+	}
+	return nil, fmt.Errorf("selector must contain at least one matcher that does not match the empty string")
+}
+
+type selectorParser struct {
+	s   string
+	pos int
+}
+
+func (p *selectorParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at position %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *selectorParser) peek() byte {
+	if p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+func (p *selectorParser) skipSpace() {
+	for p.pos < len(p.s) && strings.IndexByte(" \t\n\r", p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+// ident reads a label name, or with colons a metric name.
+func (p *selectorParser) ident(colons bool) string {
+	start := p.pos
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		letter := c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || (colons && c == ':')
+		if !letter && (p.pos == start || c < '0' || c > '9') {
+			break
+		}
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+func (p *selectorParser) matcher() (labelMatcher, error) {
+	m := labelMatcher{name: p.ident(false)}
+	if m.name == "" {
+		return m, p.errorf("expected a label name")
+	}
+	p.skipSpace()
+	for _, op := range []string{"=~", "!~", "!=", "="} {
+		if strings.HasPrefix(p.s[p.pos:], op) {
+			m.op = op
+			p.pos += len(op)
+			break
+		}
+	}
+	if m.op == "" {
+		return m, p.errorf("expected =, !=, =~ or !~ after %s", m.name)
+	}
+	p.skipSpace()
+	value, err := p.quoted()
+	if err != nil {
+		return m, err
+	}
+	m.value = value
+	if m.op == "=~" || m.op == "!~" {
+		if m.re, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+			return m, fmt.Errorf("%s%s%q: %v", m.name, m.op, value, err)
+		}
+	}
+	return m, nil
+}
+
+// quoted reads a string in double or single quotes, with backslash
+// escapes, or in back quotes, without.
+func (p *selectorParser) quoted() (string, error) {
+	quote := p.peek()
+	if quote != '"' && quote != '\'' && quote != '`' {
+		return "", p.errorf("expected a quoted string")
+	}
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		p.pos++
+		switch {
+		case c == quote:
+			return b.String(), nil
+		case c == '\\' && quote != '`':
+			if p.pos == len(p.s) {
+				return "", p.errorf("unterminated string")
+			}
+			e := p.s[p.pos]
+			p.pos++
+			switch e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '\\', '"', '\'':
+				b.WriteByte(e)
+			default:
+				// Kept for regexes such as "\d+".
+				b.WriteByte('\\')
+				b.WriteByte(e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// seriesNames are the names a metric of the family is scraped under:
+// histograms and summaries are also name_sum, name_count and, for
+// histograms, name_bucket.
+func seriesNames(mf *dto.MetricFamily) []string {
+	name := mf.GetName()
+	switch mf.GetType() {
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		return []string{name, name + "_bucket", name + "_sum", name + "_count"}
+	case dto.MetricType_SUMMARY:
+		return []string{name, name + "_sum", name + "_count"}
+	}
+	return []string{name}
+}
+
+// matchesMetric reports whether a metric of mf matches. A histogram or
+// summary is kept or dropped whole: it matches when any of its series
+// names does, and its le and quantile labels are not seen.
+func (sel seriesSelector) matchesMetric(names []string, m *dto.Metric) bool {
+	labels := make(map[string]string, len(m.GetLabel()))
+	for _, l := range m.GetLabel() {
+		labels[l.GetName()] = l.GetValue()
+	}
+	for _, name := range names {
+		labels["__name__"] = name
+		ok := true
+		for _, lm := range sel {
+			if !lm.matches(labels[lm.name]) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filterFamilies wraps g, keeping only the metrics that match any of sels.
+// Families left without metrics are dropped, so each remaining one keeps
+// its HELP and TYPE.
+func filterFamilies(g prometheus.Gatherer, sels []seriesSelector) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+		out := mfs[:0]
+		for _, mf := range mfs {
+			names := seriesNames(mf)
+			var kept []*dto.Metric
+			for _, m := range mf.GetMetric() {
+				for _, sel := range sels {
+					if sel.matchesMetric(names, m) {
+						kept = append(kept, m)
+						break
+					}
+				}
+			}
+			if len(kept) > 0 {
+				mf.Metric = kept
+				out = append(out, mf)
+			}
+		}
+		return out, err
+	})
+}
+
+// filteredMetricsHandler serves GET /metrics/filtered?match[]=<selector>:
+// the series of g matching any of the selectors, for a remote Prometheus
+// that only needs a few of them. g is the gatherer /metrics serves.
+func filteredMetricsHandler(g prometheus.Gatherer, opts promhttp.HandlerOpts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw := r.URL.Query()["match[]"]
+		if len(raw) == 0 {
+			http.Error(w, "at least one match[] selector is required", http.StatusBadRequest)
+			return
+		}
+		sels := make([]seriesSelector, 0, len(raw))
+		for _, s := range raw {
+			sel, err := parseSelector(s)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("match[]=%s: %v", s, err), http.StatusBadRequest)
+				return
+			}
+			sels = append(sels, sel)
+		}
+		promhttp.HandlerFor(filterFamilies(g, sels), opts).ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestParseSelector(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []labelMatcher // re is not compared
+	}{
+		{`wifi_device_state`, []labelMatcher{{name: "__name__", op: "=", value: "wifi_device_state"}}},
+		{`job:rate5m`, []labelMatcher{{name: "__name__", op: "=", value: "job:rate5m"}}},
+		{` wifi_device_state{state="online", mac=~"aa:.*"} `, []labelMatcher{
+			{name: "__name__", op: "=", value: "wifi_device_state"},
+			{name: "state", op: "=", value: "online"},
+			{name: "mac", op: "=~", value: "aa:.*"},
+		}},
+		{`{__name__=~"macbook_.*_ratio"}`, []labelMatcher{{name: "__name__", op: "=~", value: "macbook_.*_ratio"}}},
+		{`up{job!="a",}`, []labelMatcher{{name: "__name__", op: "=", value: "up"}, {name: "job", op: "!=", value: "a"}}},
+		{`up{job!~'a|b'}`, []labelMatcher{{name: "__name__", op: "=", value: "up"}, {name: "job", op: "!~", value: "a|b"}}},
+		{"{ip=`1\\.2`}", []labelMatcher{{name: "ip", op: "=", value: `1\.2`}}},
+		{`{hostname="a\"b\n"}`, []labelMatcher{{name: "hostname", op: "=", value: "a\"b\n"}}},
+		{`{hostname=~"\d+"}`, []labelMatcher{{name: "hostname", op: "=~", value: `\d+`}}},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			sel, err := parseSelector(tc.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]labelMatcher, len(sel))
+			for i, m := range sel {
+				m.re = nil
+				got[i] = m
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{``, "empty selector"},
+		{`{}`, "empty selector"},
+		{`{job=""}`, "does not match the empty string"},
+		{`{job=~".*"}`, "does not match the empty string"},
+		{`up{job}`, "expected =, !=, =~ or !~ after job"},
+		{`up{="a"}`, "expected a label name"},
+		{`up{job=a}`, "expected a quoted string"},
+		{`up{job="a"`, "expected , or }"},
+		{`up{job="a}`, "unterminated string"},
+		{`up{job=~"("}`, "missing closing )"},
+		{`up extra`, "unexpected \"extra\""},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			_, err := parseSelector(tc.in)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestFilterFamilies(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	state := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "wifi_device_state", Help: "h"}, []string{"mac", "state"})
+	state.WithLabelValues("aa:00", "online").Set(1)
+	state.WithLabelValues("bb:00", "offline").Set(1)
+	rtt := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "wifi_rtt_seconds", Help: "h", Buckets: []float64{0.1}}, []string{"mac"})
+	rtt.WithLabelValues("aa:00").Observe(0.05)
+	reg.MustRegister(state, rtt)
+
+	for _, tc := range []struct {
+		selectors []string
+		want      map[string]int // metrics kept per family
+	}{
+		{[]string{`wifi_device_state{state="online"}`}, map[string]int{"wifi_device_state": 1}},
+		{[]string{`{mac=~"aa:.*"}`}, map[string]int{"wifi_device_state": 1, "wifi_rtt_seconds": 1}},
+		// A histogram is kept whole when one of its series names matches,
+		// and le is not seen.
+		{[]string{`wifi_rtt_seconds_bucket`}, map[string]int{"wifi_rtt_seconds": 1}},
+		{[]string{`wifi_rtt_seconds_bucket{le="0.1"}`}, map[string]int{}},
+		{[]string{`wifi_device_state{state="offline"}`, `wifi_rtt_seconds_count`}, map[string]int{"wifi_device_state": 1, "wifi_rtt_seconds": 1}},
+		{[]string{`missing`}, map[string]int{}},
+	} {
+		t.Run(strings.Join(tc.selectors, " "), func(t *testing.T) {
+			var sels []seriesSelector
+			for _, s := range tc.selectors {
+				sel, err := parseSelector(s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sels = append(sels, sel)
+			}
+			mfs, err := filterFamilies(reg, sels).Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]int)
+			for _, mf := range mfs {
+				got[mf.GetName()] = len(mf.GetMetric())
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSeriesNames(t *testing.T) {
+	for _, tc := range []struct {
+		typ  dto.MetricType
+		want []string
+	}{
+		{dto.MetricType_GAUGE, []string{"m"}},
+		{dto.MetricType_COUNTER, []string{"m"}},
+		{dto.MetricType_HISTOGRAM, []string{"m", "m_bucket", "m_sum", "m_count"}},
+		{dto.MetricType_SUMMARY, []string{"m", "m_sum", "m_count"}},
+	} {
+		name := "m"
+		mf := &dto.MetricFamily{Name: &name, Type: tc.typ.Enum()}
+		if got := seriesNames(mf); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: got %v, want %v", tc.typ, got, tc.want)
+		}
+	}
+}
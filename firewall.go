@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// socketfilterfw answers the --get* queries without root.
+const socketfilterfw = "/usr/libexec/ApplicationFirewall/socketfilterfw"
+
+// firewallInterval is how often the firewall settings are read; they only
+// change when someone edits them.
+const firewallInterval = time.Minute
+
+// FirewallSnapshot is the macOS application firewall configuration. A nil
+// field could not be read (e.g. the query was denied) and its metric is
+// left out.
+type FirewallSnapshot struct {
+	// State is socketfilterfw's global state: 0 off, 1 on, 2 blocking
+	// all but essential services.
+	State       *int
+	Stealth     *bool
+	BlockAll    *bool
+	AllowSigned *bool
+	TakenAt     time.Time
+}
+
+var lastFirewall atomic.Pointer[FirewallSnapshot]
+
+var firewallStateRe = regexp.MustCompile(`\(state = (\d+)\)`)
+
+// parseFirewallState reads `socketfilterfw --getglobalstate`:
+//
+//	Firewall is enabled. (State = 1)
+//	Firewall is set to block all non-essential incoming connections
+func parseFirewallState(out string) (int, bool) {
+	out = strings.ToLower(out)
+	if m := firewallStateRe.FindStringSubmatch(out); m != nil {
+		n, err := strconv.Atoi(m[1])
+		return n, err == nil
+	}
+	if strings.Contains(out, "block all non-essential") {
+		return 2, true
+	}
+	if on, ok := parseFirewallSwitch(out); ok {
+		if on {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// parseFirewallSwitch reads the answer to one of the on/off queries, in
+// the format up to macOS 13 or the one after:
+//
+//	Stealth mode enabled
+//	Firewall stealth mode is on
+//	Block all DISABLED!
+//	Firewall has block all state set to disabled.
+//	Automatically allow signed built-in software ENABLED
+//
+// The last on/off word decides.
+func parseFirewallSwitch(out string) (on, ok bool) {
+	for _, word := range strings.FieldsFunc(strings.ToLower(out), func(r rune) bool {
+		return !('a' <= r && r <= 'z')
+	}) {
+		switch word {
+		case "enabled", "on":
+			on, ok = true, true
+		case "disabled", "off":
+			on, ok = false, true
+		}
+	}
+	return on, ok
+}
+
+func firewallSwitch(flag string) *bool {
+	out, err := outputAccounted(socketfilterfw, flag)
+	if err != nil {
+		debugf("socketfilterfw %s: %v", flag, err)
+		return nil
+	}
+	on, ok := parseFirewallSwitch(string(out))
+	if !ok {
+		debugf("socketfilterfw %s: unrecognized answer %q", flag, out)
+		return nil
+	}
+	return &on
+}
+
+func sampleFirewall(now time.Time) FirewallSnapshot {
+	snap := FirewallSnapshot{TakenAt: now}
+	if out, err := outputAccounted(socketfilterfw, "--getglobalstate"); err != nil {
+		debugf("socketfilterfw --getglobalstate: %v", err)
+	} else if state, ok := parseFirewallState(string(out)); ok {
+		snap.State = &state
+	}
+	snap.Stealth = firewallSwitch("--getstealthmode")
+	snap.BlockAll = firewallSwitch("--getblockall")
+	snap.AllowSigned = firewallSwitch("--getallowsigned")
+	return snap
+}
+
+// firewallLoop reads the firewall settings every firewallInterval until
+// ctx is done.
+func firewallLoop(ctx context.Context) error {
+	for {
+		snap := sampleFirewall(time.Now())
+		lastFirewall.Store(&snap)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(firewallInterval):
+		}
+	}
+}
+
+type firewallCollector struct {
+	enabled, stealth, info *prometheus.Desc
+}
+
+func newFirewallCollector(namespace string) *firewallCollector {
+	return &firewallCollector{
+		enabled: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "macbook_firewall_enabled"),
+			"1 if the macOS application firewall is on", nil, nil),
+		stealth: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "macbook_stealth_mode_enabled"),
+			"1 if firewall stealth mode is on, so pings and probes of closed ports from other hosts go unanswered", nil, nil),
+		info: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "macbook_firewall_info"),
+			"Application firewall state (off, on, essential_only) and settings; unknown where they could not be read", []string{"state", "block_all", "allow_signed"}, nil),
+	}
+}
+
+func (c *firewallCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.enabled
+	ch <- c.stealth
+	ch <- c.info
+}
+
+func optionalBool(b *bool) string {
+	if b == nil {
+		return "unknown"
+	}
+	return strconv.FormatBool(*b)
+}
+
+func (c *firewallCollector) Collect(ch chan<- prometheus.Metric) {
+	snap := lastFirewall.Load()
+	if snap == nil {
+		return
+	}
+	state := "unknown"
+	if snap.State != nil {
+		enabled := 0.0
+		if *snap.State > 0 {
+			enabled = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.enabled, prometheus.GaugeValue, enabled)
+		state = [...]string{"off", "on", "essential_only"}[min(max(*snap.State, 0), 2)]
+	}
+	if snap.Stealth != nil {
+		stealth := 0.0
+		if *snap.Stealth {
+			stealth = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.stealth, prometheus.GaugeValue, stealth)
+	}
+	if snap.State == nil && snap.BlockAll == nil && snap.AllowSigned == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.info, prometheus.GaugeValue, 1, state, optionalBool(snap.BlockAll), optionalBool(snap.AllowSigned))
+}
+
+func init() {
+	registerFeature("firewall", false)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Dashboard rows, in order, with the metric name prefixes (after the
+// namespace) they collect.
+var dashboardRows = []struct {
+	title    string
+	prefixes []string
+}{
+	{"System", []string{"macbook_", "agent_"}},
+	{"Network", []string{"network_", "dns_"}},
+	{"Devices", []string{"wifi_"}},
+	{"Scan health", []string{"telemetry_"}},
+}
+
+type grafanaDashboard struct {
+	UID           string                 `json:"uid"`
+	Title         string                 `json:"title"`
+	Tags          []string               `json:"tags"`
+	SchemaVersion int                    `json:"schemaVersion"`
+	Refresh       string                 `json:"refresh"`
+	Time          map[string]string      `json:"time"`
+	Templating    map[string]interface{} `json:"templating"`
+	Panels        []grafanaPanel         `json:"panels"`
+}
+
+type grafanaPanel struct {
+	ID          int                    `json:"id"`
+	Type        string                 `json:"type"`
+	Title       string                 `json:"title"`
+	Description string                 `json:"description,omitempty"`
+	GridPos     grafanaGridPos         `json:"gridPos"`
+	Datasource  map[string]string      `json:"datasource,omitempty"`
+	Targets     []grafanaTarget        `json:"targets,omitempty"`
+	FieldConfig map[string]interface{} `json:"fieldConfig,omitempty"`
+	Collapsed   *bool                  `json:"collapsed,omitempty"`
+}
+
+type grafanaGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type grafanaTarget struct {
+	RefID        string `json:"refId"`
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat,omitempty"`
+	Instant      bool   `json:"instant,omitempty"`
+	Format       string `json:"format,omitempty"`
+}
+
+type metricFamilyInfo struct {
+	name, help, kind string
+	labels           []string
+}
+
+// panelID derives a panel ID from what the panel shows, so it stays the
+// same when other metrics come and go.
+func panelID(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32()&0x7fffffff) | 1
+}
+
+func panelUnit(name string) string {
+	switch {
+	case strings.HasSuffix(name, "_timestamp_seconds"):
+		return "dateTimeAsIso"
+	case strings.HasSuffix(name, "_seconds"):
+		return "s"
+	case strings.HasSuffix(name, "_bytes"):
+		return "bytes"
+	case strings.HasSuffix(name, "_ratio"):
+		return "percentunit"
+	case strings.HasSuffix(name, "_total"):
+		return "ops"
+	}
+	return "short"
+}
+
+func metricTarget(f metricFamilyInfo) grafanaTarget {
+	var legend []string
+	for _, l := range f.labels {
+		legend = append(legend, "{{"+l+"}}")
+	}
+	t := grafanaTarget{RefID: "A", Expr: f.name, LegendFormat: strings.Join(legend, " ")}
+	switch f.kind {
+	case "COUNTER":
+		t.Expr = "rate(" + f.name + "[$__rate_interval])"
+	case "HISTOGRAM":
+		by := append([]string{"le"}, f.labels...)
+		t.Expr = "histogram_quantile(0.95, sum by (" + strings.Join(by, ", ") + ") (rate(" + f.name + "_bucket[$__rate_interval])))"
+		t.LegendFormat = strings.TrimSpace("p95 " + t.LegendFormat)
+	case "SUMMARY":
+		t.LegendFormat = strings.TrimSpace("{{quantile}} " + t.LegendFormat)
+	}
+	return t
+}
+
+// registeredFamilies lists the families the gatherer currently exposes.
+// Vectors without children yet are absent until their first sample.
+// Deprecated *_percent gauges are left out when their *_ratio form exists.
+func registeredFamilies(g prometheus.Gatherer) ([]metricFamilyInfo, error) {
+	mfs, err := g.Gather()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(mfs))
+	for _, mf := range mfs {
+		names[mf.GetName()] = true
+	}
+	var out []metricFamilyInfo
+	for _, mf := range mfs {
+		name := mf.GetName()
+		if strings.HasSuffix(name, "_percent") && names[strings.TrimSuffix(name, "_percent")+"_ratio"] {
+			continue
+		}
+		labelSet := make(map[string]bool)
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if n := lp.GetName(); n != "le" && n != "quantile" {
+					labelSet[n] = true
+				}
+			}
+		}
+		info := metricFamilyInfo{name: name, help: mf.GetHelp(), kind: mf.GetType().String()}
+		for l := range labelSet {
+			info.labels = append(info.labels, l)
+		}
+		sort.Strings(info.labels)
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out, nil
+}
+
+// buildDashboard lays out one row per dashboardRows entry with a time
+// series panel per family, plus a device table. The same metric set
+// always yields the same JSON.
+func buildDashboard(namespace string, families []metricFamilyInfo) grafanaDashboard {
+	prefix := ""
+	if namespace != "" {
+		prefix = namespace + "_"
+	}
+	ds := map[string]string{"type": "prometheus", "uid": "${datasource}"}
+	uid := "telemetry"
+	if namespace != "" {
+		uid += "-" + namespace
+	}
+	d := grafanaDashboard{
+		UID:           uid,
+		Title:         "Telemetry exporter",
+		Tags:          []string{"telemetry"},
+		SchemaVersion: 39,
+		Refresh:       "30s",
+		Time:          map[string]string{"from": "now-6h", "to": "now"},
+		Templating: map[string]interface{}{"list": []map[string]interface{}{{
+			"name":  "datasource",
+			"label": "Data source",
+			"type":  "datasource",
+			"query": "prometheus",
+		}}},
+		Panels: []grafanaPanel{},
+	}
+
+	y := 0
+	for _, row := range dashboardRows {
+		var members []metricFamilyInfo
+		for _, f := range families {
+			short := strings.TrimPrefix(f.name, prefix)
+			if prefix != "" && short == f.name {
+				continue
+			}
+			for _, p := range row.prefixes {
+				if strings.HasPrefix(short, p) {
+					members = append(members, f)
+					break
+				}
+			}
+		}
+		if len(members) == 0 {
+			continue
+		}
+		collapsed := false
+		d.Panels = append(d.Panels, grafanaPanel{
+			ID: panelID("row:" + row.title), Type: "row", Title: row.title, Collapsed: &collapsed,
+			GridPos: grafanaGridPos{H: 1, W: 24, Y: y},
+		})
+		y++
+
+		col := 0
+		if row.title == "Devices" {
+			for _, f := range members {
+				if f.name != prefix+"wifi_connected_devices" {
+					continue
+				}
+				d.Panels = append(d.Panels, grafanaPanel{
+					ID: panelID("table:" + f.name), Type: "table", Title: "Devices", Description: f.help,
+					GridPos:    grafanaGridPos{H: 10, W: 24, Y: y},
+					Datasource: ds,
+					Targets:    []grafanaTarget{{RefID: "A", Expr: f.name, Instant: true, Format: "table"}},
+				})
+				y += 10
+			}
+		}
+		for _, f := range members {
+			d.Panels = append(d.Panels, grafanaPanel{
+				ID: panelID("timeseries:" + f.name), Type: "timeseries", Title: strings.TrimPrefix(f.name, prefix), Description: f.help,
+				GridPos:     grafanaGridPos{H: 8, W: 12, X: col * 12, Y: y},
+				Datasource:  ds,
+				Targets:     []grafanaTarget{metricTarget(f)},
+				FieldConfig: map[string]interface{}{"defaults": map[string]interface{}{"unit": panelUnit(f.name)}},
+			})
+			if col = 1 - col; col == 0 {
+				y += 8
+			}
+		}
+		if col == 1 {
+			y += 8
+		}
+	}
+	return d
+}
+
+// grafanaDashboardHandler serves GET /api/v1/grafana/dashboard: a dashboard
+// JSON model for the metrics currently registered, ready to import.
+func grafanaDashboardHandler(namespace string, g prometheus.Gatherer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		families, err := registeredFamilies(g)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if requestCancelled(r) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(buildDashboard(namespace, families))
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// golden compares got with testdata/name, or rewrites it with -update.
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.MkdirAll("testdata", 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s changed; run go test -update if that is intended\ngot:\n%s", path, got)
+	}
+}
+
+// defaultRegistry registers the metrics of the default config, one
+// unnamed scanner, after a scan that found one device.
+func defaultRegistry(t *testing.T, namespace string) *prometheus.Registry {
+	t.Helper()
+	prevSystem := currentSystem()
+	publishSystem(SystemSnapshot{})
+	subprocessStats.mu.Lock()
+	prevUsage := subprocessStats.usage
+	subprocessStats.usage = make(map[string]*subprocessUsage)
+	subprocessStats.mu.Unlock()
+	t.Cleanup(func() {
+		publishSystem(prevSystem)
+		subprocessStats.mu.Lock()
+		subprocessStats.usage = prevUsage
+		subprocessStats.mu.Unlock()
+	})
+
+	reg := prometheus.NewPedanticRegistry()
+	s := newScanner("", 1)
+	s.m = NewMetrics(reg, namespace).forScanner(reg, s)
+	s.publishScan(&ScanSnapshot{Devices: []Device{{IP: "192.168.1.10", MAC: "aa:bb:cc:00:00:01", DeviceType: "unknown", State: deviceStates[0]}}})
+	return reg
+}
+
+func TestGrafanaDashboardGolden(t *testing.T) {
+	if cpuClusters() != nil {
+		t.Skip("the golden dashboard is for hosts without CPU clusters")
+	}
+	rec := httptest.NewRecorder()
+	grafanaDashboardHandler("", defaultRegistry(t, ""))(rec, httptest.NewRequest("GET", "/api/v1/grafana/dashboard", nil))
+	if rec.Code != 200 {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	golden(t, "grafana_dashboard.json", rec.Body.Bytes())
+}
+
+func TestBuildDashboardIsStable(t *testing.T) {
+	families, err := registeredFamilies(defaultRegistry(t, "lab"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := buildDashboard("lab", families)
+	if d.UID != "telemetry-lab" {
+		t.Errorf("uid %q", d.UID)
+	}
+	ids := make(map[int]string)
+	for _, p := range d.Panels {
+		if other, ok := ids[p.ID]; ok {
+			t.Errorf("panels %q and %q share ID %d", other, p.Title, p.ID)
+		}
+		ids[p.ID] = p.Title
+		for _, target := range p.Targets {
+			if !strings.Contains(target.Expr, "lab_") {
+				t.Errorf("panel %q queries %q outside the namespace", p.Title, target.Expr)
+			}
+		}
+	}
+
+	// Another metric only adds its own panel; the rest keep their IDs.
+	more := append([]metricFamilyInfo{{name: "lab_network_extra_seconds", kind: "GAUGE"}}, families...)
+	again := buildDashboard("lab", more)
+	kept := make(map[int]bool)
+	for _, p := range again.Panels {
+		kept[p.ID] = true
+	}
+	for id, title := range ids {
+		if !kept[id] {
+			t.Errorf("panel %q lost ID %d when a metric was added", title, id)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// GroupConfig names a set of devices. A device belongs to the group when it
+// matches any of the selectors.
+type GroupConfig struct {
+	Name  string   `yaml:"name"`
+	MACs  []string `yaml:"macs"`
+	Types []string `yaml:"types"`
+	// Tags match the tags of devices: entries.
+	Tags []string `yaml:"tags"`
+	// Vendor matches OUI vendors containing it, ignoring case.
+	Vendor string `yaml:"vendor"`
+}
+
+// GroupStatus is a group's presence in one scan. Explicitly listed MACs are
+// members even while absent; selector matches only once they are seen.
+// Dormant devices count as online: they still hold a fresh ARP entry.
+type GroupStatus struct {
+	Members   int      `json:"members"`
+	Online    int      `json:"online"`
+	AnyOnline bool     `json:"any_online"`
+	Absent    []string `json:"absent,omitempty"`
+}
+
+func (g GroupStatus) availability() float64 {
+	if g.Members == 0 {
+		return 0
+	}
+	return float64(g.Online) / float64(g.Members)
+}
+
+// validGroups returns the groups that can be evaluated and an error for
+// each one that cannot.
+func validGroups(groups []GroupConfig) ([]GroupConfig, []error) {
+	var valid []GroupConfig
+	var errs []error
+	seen := make(map[string]bool)
+	for i, g := range groups {
+		switch {
+		case g.Name == "":
+			errs = append(errs, fmt.Errorf("groups[%d]: name is required", i))
+		case seen[g.Name]:
+			errs = append(errs, fmt.Errorf("groups[%d]: duplicate group %q", i, g.Name))
+		case len(g.MACs) == 0 && len(g.Types) == 0 && len(g.Tags) == 0 && g.Vendor == "":
+			errs = append(errs, fmt.Errorf("group %s: no selectors (macs, types, tags, vendor)", g.Name))
+		default:
+			valid = append(valid, g)
+		}
+		seen[g.Name] = true
+	}
+	return valid, errs
+}
+
+func (g GroupConfig) matches(d Device, tags []string) bool {
+	for _, mac := range g.MACs {
+		if strings.EqualFold(mac, d.MAC) {
+			return true
+		}
+	}
+	for _, t := range g.Types {
+		if t == d.DeviceType {
+			return true
+		}
+	}
+	for _, want := range g.Tags {
+		for _, tag := range tags {
+			if tag == want {
+				return true
+			}
+		}
+	}
+	return g.Vendor != "" && strings.Contains(strings.ToLower(d.Vendor), strings.ToLower(g.Vendor))
+}
+
+// applyGroups sets the tags and group memberships of this scan's devices
+// and returns the status of every valid group. Invalid groups are logged
+// and skipped so one typo does not drop the rest.
+func applyGroups(cfg Config, devices []Device) map[string]GroupStatus {
+	groups, errs := validGroups(cfg.Groups)
+	for _, err := range errs {
+		errorLog.Printf("Skipping device group: %v", err)
+	}
+
+	status := make(map[string]GroupStatus, len(groups))
+	members := make(map[string]map[string]bool, len(groups))
+	for _, g := range groups {
+		members[g.Name] = make(map[string]bool)
+	}
+	for i := range devices {
+		d := &devices[i]
+		dc, _ := cfg.deviceConfig(d.MAC)
+		d.Tags, d.Owner, d.Location = dc.Tags, dc.Owner, dc.Location
+		key := d.key()
+		for _, g := range groups {
+			if members[g.Name][key] || !g.matches(*d, dc.Tags) {
+				continue
+			}
+			members[g.Name][key] = true
+			d.Groups = append(d.Groups, g.Name)
+			st := status[g.Name]
+			st.Members++
+			st.Online++
+			st.AnyOnline = true
+			status[g.Name] = st
+		}
+	}
+	for _, g := range groups {
+		st := status[g.Name]
+		for _, mac := range g.MACs {
+			mac = strings.ToLower(mac)
+			if !members[g.Name][mac] {
+				members[g.Name][mac] = true
+				st.Members++
+				st.Absent = append(st.Absent, mac)
+			}
+		}
+		sort.Strings(st.Absent)
+		status[g.Name] = st
+	}
+	return status
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGroupMatches(t *testing.T) {
+	tv := Device{MAC: "aa:bb:cc:dd:ee:01", DeviceType: "apple", Vendor: "Apple, Inc."}
+	for _, tc := range []struct {
+		name  string
+		group GroupConfig
+		tags  []string
+		want  bool
+	}{
+		{"mac ignores case", GroupConfig{MACs: []string{"AA:BB:CC:DD:EE:01"}}, nil, true},
+		{"other mac", GroupConfig{MACs: []string{"aa:bb:cc:dd:ee:02"}}, nil, false},
+		{"type", GroupConfig{Types: []string{"android", "apple"}}, nil, true},
+		{"other type", GroupConfig{Types: []string{"android"}}, nil, false},
+		{"tag", GroupConfig{Tags: []string{"living-room"}}, []string{"media", "living-room"}, true},
+		{"other tag", GroupConfig{Tags: []string{"office"}}, []string{"media"}, false},
+		{"vendor substring", GroupConfig{Vendor: "apple"}, nil, true},
+		{"other vendor", GroupConfig{Vendor: "Samsung"}, nil, false},
+		{"any selector", GroupConfig{Types: []string{"android"}, Vendor: "APPLE"}, nil, true},
+		{"none", GroupConfig{}, nil, false},
+	} {
+		if got := tc.group.matches(tv, tc.tags); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestValidGroups(t *testing.T) {
+	valid, errs := validGroups([]GroupConfig{
+		{Name: "tvs", Types: []string{"apple"}},
+		{Types: []string{"android"}},
+		{Name: "tvs", Vendor: "LG"},
+		{Name: "empty"},
+		{Name: "nas", MACs: []string{"aa:bb:cc:dd:ee:03"}},
+	})
+	if len(valid) != 2 || valid[0].Name != "tvs" || valid[1].Name != "nas" {
+		t.Errorf("valid groups %+v, want tvs and nas", valid)
+	}
+	want := []string{"groups[1]: name is required", `groups[2]: duplicate group "tvs"`, "group empty: no selectors"}
+	if len(errs) != len(want) {
+		t.Fatalf("errors %v, want %d", errs, len(want))
+	}
+	for i, w := range want {
+		if !strings.Contains(errs[i].Error(), w) {
+			t.Errorf("error %d = %v, want %q", i, errs[i], w)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+func (c LabelConfig) hostnameConfirmScans() int {
+	if c.HostnameConfirmScans <= 0 {
+		return 2
+	}
+	return c.HostnameConfirmScans
+}
+
+func (c LabelConfig) hostnameMaxChangesPerHour() int {
+	if c.HostnameMaxChangesPerHour <= 0 {
+		return 6
+	}
+	return c.HostnameMaxChangesPerHour
+}
+
+// normalizeHostname folds the variations resolvers report for the same
+// name (case, surrounding space, a trailing dot).
+func normalizeHostname(s string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(s), "."))
+}
+
+type hostnameLabelState struct {
+	label     string // exported hostname label
+	raw       string // last name as resolved
+	candidate string // normalized name waiting to be confirmed
+	seen      int    // consecutive scans candidate was seen
+
+	first   string      // first label, kept while frozen
+	changes []time.Time // resolved name changes within the last hour
+	frozen  bool
+}
+
+// trackChange records a change of the resolved name and freezes a device
+// changing it more than max times an hour, e.g. a TV making up a new mDNS
+// name per session, so it cannot churn series without bound. It thaws
+// once an hour passes without a change.
+func (st *hostnameLabelState) trackChange(key string, changed bool, max int, now time.Time) {
+	recent := st.changes[:0]
+	for _, t := range st.changes {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	if changed {
+		recent = append(recent, now)
+	}
+	st.changes = recent
+	switch {
+	case !st.frozen && len(recent) > max:
+		st.frozen = true
+		log.Printf("Device %s changed its hostname %d times within an hour; freezing its hostname label at %q (hostname_unstable)",
+			key, len(recent), st.first)
+	case st.frozen && len(recent) == 0:
+		st.frozen = false
+		log.Printf("Device %s kept its hostname for an hour; the hostname label follows it again", key)
+	}
+}
+
+// hostnameLabel returns the hostname label for a device and whether it is
+// frozen for changing names too often (see trackChange). A new name only
+// replaces the label once it was seen for labels.hostname_confirm_scans
+// scans in a row, so a name flapping between resolvers does not churn
+// series; the first real name of a device is taken right away.
+func (s *scanner) hostnameLabel(cfg LabelConfig, key, hostname string, now time.Time) (string, bool) {
+	name := normalizeHostname(hostname)
+	st, ok := s.hostnameLabels[key]
+	if !ok {
+		s.hostnameLabels[key] = &hostnameLabelState{label: name, raw: hostname, first: name}
+		return name, false
+	}
+	prev := normalizeHostname(st.raw)
+	st.trackChange(key, name != prev && prev != "<unknown>" && name != "<unknown>", cfg.hostnameMaxChangesPerHour(), now)
+	label := st.nextLabel(s.m, cfg, name, hostname)
+	if st.frozen {
+		if label != st.first {
+			s.m.HostnameLabelSuppressed.WithLabelValues("unstable").Inc()
+		}
+		return st.first, true
+	}
+	return label, false
+}
+
+func (st *hostnameLabelState) nextLabel(m *Metrics, cfg LabelConfig, name, hostname string) string {
+	defer func() { st.raw = hostname }()
+	switch {
+	case name == st.label:
+		st.candidate, st.seen = "", 0
+		if hostname != st.raw && normalizeHostname(st.raw) == name {
+			m.HostnameLabelSuppressed.WithLabelValues("normalized").Inc()
+		}
+		return st.label
+	case st.label == "<unknown>":
+		st.label, st.candidate, st.seen = name, "", 0
+		if st.first == "<unknown>" {
+			st.first = name
+		}
+		return name
+	}
+	if name != st.candidate {
+		st.candidate, st.seen = name, 0
+	}
+	st.seen++
+	if st.seen >= cfg.hostnameConfirmScans() {
+		st.label, st.candidate, st.seen = name, "", 0
+		return name
+	}
+	m.HostnameLabelSuppressed.WithLabelValues("unconfirmed").Inc()
+	return st.label
+}
+
+// forgetHostnameLabels drops the label state of devices no longer in the
+// presence registry and counts the frozen ones left.
+func (s *scanner) forgetHostnameLabels(records []PresenceRecord) {
+	keep := make(map[string]bool, len(records))
+	for _, rec := range records {
+		keep[rec.Device.key()] = true
+	}
+	frozen := 0
+	for key, st := range s.hostnameLabels {
+		if !keep[key] {
+			delete(s.hostnameLabels, key)
+		} else if st.frozen {
+			frozen++
+		}
+	}
+	s.m.HostnameUnstableDevices.Set(float64(frozen))
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	stdnet "net"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/host"
+	"github.com/shirou/gopsutil/v3/net"
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// HostMetricsConfig turns on host collectors beyond CPU and memory, each
+// on its own, so one dashboard can cover the whole machine without a
+// node_exporter next to this one. They sample every interval from one
+// loop; a collector that fails keeps its previous values. It only takes
+// effect on restart.
+type HostMetricsConfig struct {
+	// Interval between samples (default 30s).
+	Interval time.Duration `yaml:"interval"`
+	// Process exports the top N process names by CPU, all processes of a
+	// name summed; the rest are summed into name="other".
+	Process ProcessMetricsConfig `yaml:"process"`
+	// Disk exports usage per mounted physical filesystem and I/O per disk.
+	Disk HostCollectorConfig `yaml:"disk"`
+	// Net exports traffic per network interface, loopback left out.
+	Net HostCollectorConfig `yaml:"net"`
+	// Thermal exports the temperature sensors (Linux hwmon/thermal zones;
+	// macOS builds with cgo only).
+	Thermal HostCollectorConfig `yaml:"thermal"`
+	// Battery exports charge, cycle count and health, on hosts with one.
+	Battery HostCollectorConfig `yaml:"battery"`
+}
+
+type HostCollectorConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+type ProcessMetricsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// TopN defaults to 10.
+	TopN int `yaml:"top_n"`
+}
+
+func (c HostMetricsConfig) interval() time.Duration {
+	if c.Interval <= 0 {
+		return 30 * time.Second
+	}
+	return c.Interval
+}
+
+func (c HostMetricsConfig) topN() int {
+	if c.Process.TopN <= 0 {
+		return 10
+	}
+	return c.Process.TopN
+}
+
+// hostSource is one host collector: the series it exports and how to read
+// them. read is only called by the host metrics loop.
+type hostSource struct {
+	name  string
+	descs []*prometheus.Desc
+	read  func() ([]prometheus.Metric, error)
+	last  atomic.Pointer[[]prometheus.Metric]
+}
+
+// hostSources returns the enabled host collectors.
+func (c HostMetricsConfig) hostSources(namespace string) []*hostSource {
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, labels, nil)
+	}
+	var sources []*hostSource
+	if c.Process.Enabled {
+		sources = append(sources, newProcessSource(desc, c.topN()))
+	}
+	if c.Disk.Enabled {
+		sources = append(sources, newDiskSource(desc))
+	}
+	if c.Net.Enabled {
+		sources = append(sources, newNetSource(desc))
+	}
+	if c.Thermal.Enabled {
+		sources = append(sources, newThermalSource(desc))
+	}
+	if c.Battery.Enabled {
+		sources = append(sources, newBatterySource(desc))
+	}
+	return sources
+}
+
+type descFunc func(name, help string, labels ...string) *prometheus.Desc
+
+const otherProcesses = "other"
+
+type processUsage struct {
+	name        string
+	cpuPercent  float64 // -1 on the first sample
+	memoryBytes uint64
+}
+
+// newProcessSource reads CPU and memory per process name. Like the
+// per-user breakdown it keeps the previous CPU time of every process, so
+// CPU is the share of the whole machine over the interval.
+func newProcessSource(desc descFunc, topN int) *hostSource {
+	cpuDesc := desc("macbook_process_cpu_percent", "CPU used by the processes of a name over the last interval, in percent of the whole machine (0-100)", "name")
+	memDesc := desc("macbook_process_memory_bytes", "Resident memory of the processes of a name", "name")
+	prevCPU := make(map[int32]float64)
+	var prevAt time.Time
+	ncpu := runtime.NumCPU()
+	return &hostSource{name: "process", descs: []*prometheus.Desc{cpuDesc, memDesc}, read: func() ([]prometheus.Metric, error) {
+		procs, err := process.Processes()
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		cpuSeconds := make(map[string]float64)
+		memory := make(map[string]uint64)
+		curCPU := make(map[int32]float64, len(procs))
+		for _, p := range procs {
+			name, nerr := p.Name()
+			times, terr := p.Times()
+			mem, merr := p.MemoryInfo()
+			if nerr != nil || terr != nil || merr != nil || name == "" {
+				continue
+			}
+			memory[name] += mem.RSS
+			cpu := times.User + times.System
+			curCPU[p.Pid] = cpu
+			prev, ok := prevCPU[p.Pid]
+			if !ok || prev > cpu {
+				prev = 0
+			}
+			cpuSeconds[name] += cpu - prev
+		}
+		elapsed := now.Sub(prevAt).Seconds()
+		withCPU := !prevAt.IsZero() && elapsed > 0
+		prevCPU, prevAt = curCPU, now
+
+		usage := make([]processUsage, 0, len(memory))
+		for name, rss := range memory {
+			u := processUsage{name: name, cpuPercent: -1, memoryBytes: rss}
+			if withCPU {
+				u.cpuPercent = 100 * cpuSeconds[name] / (elapsed * float64(ncpu))
+			}
+			usage = append(usage, u)
+		}
+		var out []prometheus.Metric
+		for _, u := range topProcesses(usage, topN) {
+			if u.cpuPercent >= 0 {
+				out = append(out, prometheus.MustNewConstMetric(cpuDesc, prometheus.GaugeValue, u.cpuPercent, u.name))
+			}
+			out = append(out, prometheus.MustNewConstMetric(memDesc, prometheus.GaugeValue, float64(u.memoryBytes), u.name))
+		}
+		return out, nil
+	}}
+}
+
+// topProcesses keeps the n names using the most CPU (memory on the first
+// sample) and sums the others into name="other", as topUsers does.
+func topProcesses(usage []processUsage, n int) []processUsage {
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].cpuPercent != usage[j].cpuPercent {
+			return usage[i].cpuPercent > usage[j].cpuPercent
+		}
+		if usage[i].memoryBytes != usage[j].memoryBytes {
+			return usage[i].memoryBytes > usage[j].memoryBytes
+		}
+		return usage[i].name < usage[j].name
+	})
+	if len(usage) <= n {
+		return usage
+	}
+	other := processUsage{name: otherProcesses, cpuPercent: min(usage[n].cpuPercent, 0)}
+	for _, u := range usage[n:] {
+		other.memoryBytes += u.memoryBytes
+		if u.cpuPercent > 0 {
+			other.cpuPercent += u.cpuPercent
+		}
+	}
+	return append(usage[:n:n], other)
+}
+
+// newDiskSource reads the usage of every mounted physical filesystem and
+// the I/O counters of every disk. Snap and other squashfs images are left
+// out: they are always full.
+func newDiskSource(desc descFunc) *hostSource {
+	used := desc("macbook_disk_used_bytes", "Used space of a mounted filesystem", "mountpoint", "fstype")
+	total := desc("macbook_disk_total_bytes", "Size of a mounted filesystem", "mountpoint", "fstype")
+	read := desc("macbook_disk_read_bytes_total", "Bytes read from a disk", "device")
+	written := desc("macbook_disk_written_bytes_total", "Bytes written to a disk", "device")
+	return &hostSource{name: "disk", descs: []*prometheus.Desc{used, total, read, written}, read: func() ([]prometheus.Metric, error) {
+		parts, err := disk.Partitions(false)
+		if err != nil {
+			return nil, err
+		}
+		var out []prometheus.Metric
+		seen := make(map[string]bool)
+		for _, p := range parts {
+			if p.Fstype == "squashfs" || seen[p.Mountpoint] {
+				continue
+			}
+			seen[p.Mountpoint] = true
+			u, err := disk.Usage(p.Mountpoint)
+			if err != nil {
+				debugf("disk usage %s: %v", p.Mountpoint, err)
+				continue
+			}
+			out = append(out,
+				prometheus.MustNewConstMetric(used, prometheus.GaugeValue, float64(u.Used), p.Mountpoint, p.Fstype),
+				prometheus.MustNewConstMetric(total, prometheus.GaugeValue, float64(u.Total), p.Mountpoint, p.Fstype))
+		}
+		// Disk I/O needs cgo on macOS; usage is still worth exporting
+		// without it.
+		counters, err := disk.IOCounters()
+		if err != nil {
+			debugf("disk I/O counters: %v", err)
+		}
+		for name, c := range counters {
+			out = append(out,
+				prometheus.MustNewConstMetric(read, prometheus.CounterValue, float64(c.ReadBytes), name),
+				prometheus.MustNewConstMetric(written, prometheus.CounterValue, float64(c.WriteBytes), name))
+		}
+		return out, nil
+	}}
+}
+
+// Directions of the macbook_net_* counters.
+const (
+	directionReceive  = "receive"
+	directionTransmit = "transmit"
+)
+
+// newNetSource reads the traffic counters of every interface but loopback.
+func newNetSource(desc descFunc) *hostSource {
+	bytes := desc("macbook_net_bytes_total", "Bytes received or transmitted on a network interface", "interface", "direction")
+	packets := desc("macbook_net_packets_total", "Packets received or transmitted on a network interface", "interface", "direction")
+	errs := desc("macbook_net_errors_total", "Receive or transmit errors on a network interface", "interface", "direction")
+	return &hostSource{name: "net", descs: []*prometheus.Desc{bytes, packets, errs}, read: func() ([]prometheus.Metric, error) {
+		counters, err := net.IOCounters(true)
+		if err != nil {
+			return nil, err
+		}
+		var out []prometheus.Metric
+		for _, c := range counters {
+			if ifi, err := stdnet.InterfaceByName(c.Name); err == nil && ifi.Flags&stdnet.FlagLoopback != 0 {
+				continue
+			}
+			out = append(out,
+				prometheus.MustNewConstMetric(bytes, prometheus.CounterValue, float64(c.BytesRecv), c.Name, directionReceive),
+				prometheus.MustNewConstMetric(bytes, prometheus.CounterValue, float64(c.BytesSent), c.Name, directionTransmit),
+				prometheus.MustNewConstMetric(packets, prometheus.CounterValue, float64(c.PacketsRecv), c.Name, directionReceive),
+				prometheus.MustNewConstMetric(packets, prometheus.CounterValue, float64(c.PacketsSent), c.Name, directionTransmit),
+				prometheus.MustNewConstMetric(errs, prometheus.CounterValue, float64(c.Errin), c.Name, directionReceive),
+				prometheus.MustNewConstMetric(errs, prometheus.CounterValue, float64(c.Errout), c.Name, directionTransmit))
+		}
+		return out, nil
+	}}
+}
+
+// newThermalSource reads the temperature sensors. On Linux some sensors
+// failing still returns the others, with an error listing the failures.
+func newThermalSource(desc descFunc) *hostSource {
+	temp := desc("macbook_temperature_celsius", "Temperature of a hardware sensor", "sensor")
+	return &hostSource{name: "thermal", descs: []*prometheus.Desc{temp}, read: func() ([]prometheus.Metric, error) {
+		temps, err := host.SensorsTemperatures()
+		if len(temps) == 0 {
+			if err == nil {
+				err = fmt.Errorf("no temperature sensors found")
+			}
+			return nil, err
+		}
+		if err != nil {
+			debugf("temperature sensors: %v", err)
+		}
+		var out []prometheus.Metric
+		seen := make(map[string]bool)
+		for _, t := range temps {
+			if seen[t.SensorKey] {
+				continue
+			}
+			seen[t.SensorKey] = true
+			out = append(out, prometheus.MustNewConstMetric(temp, prometheus.GaugeValue, t.Temperature, t.SensorKey))
+		}
+		return out, nil
+	}}
+}
+
+// batteryInfo is the battery's state; -1 where unknown.
+type batteryInfo struct {
+	ChargeRatio float64
+	Cycles      float64
+	// HealthRatio is the full charge capacity over the design capacity.
+	HealthRatio float64
+}
+
+// newBatterySource reads the battery: ioreg on macOS,
+// /sys/class/power_supply on Linux. Hosts without one export nothing.
+func newBatterySource(desc descFunc) *hostSource {
+	charge := desc("macbook_battery_charge_ratio", "Battery charge as a ratio (0-1)")
+	cycles := desc("macbook_battery_cycles", "Charge cycles the battery has gone through")
+	health := desc("macbook_battery_health_ratio", "Full charge capacity of the battery over its design capacity (0-1)")
+	return &hostSource{name: "battery", descs: []*prometheus.Desc{charge, cycles, health}, read: func() ([]prometheus.Metric, error) {
+		b, ok, err := readBattery()
+		if err != nil || !ok {
+			return nil, err
+		}
+		var out []prometheus.Metric
+		for _, v := range []struct {
+			desc  *prometheus.Desc
+			value float64
+		}{{charge, b.ChargeRatio}, {cycles, b.Cycles}, {health, b.HealthRatio}} {
+			if v.value >= 0 {
+				out = append(out, prometheus.MustNewConstMetric(v.desc, prometheus.GaugeValue, v.value))
+			}
+		}
+		return out, nil
+	}}
+}
+
+func readBattery() (batteryInfo, bool, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		out, err := outputAccounted("ioreg", "-rn", "AppleSmartBattery")
+		if err != nil {
+			return batteryInfo{}, false, err
+		}
+		b, ok := parseIoregBattery(string(out))
+		return b, ok, nil
+	case "linux":
+		b, ok := readSysfsBattery("/sys/class/power_supply")
+		return b, ok, nil
+	}
+	return batteryInfo{}, false, nil
+}
+
+var ioregInt = regexp.MustCompile(`"(\w+)" = (\d+)\n`)
+
+// parseIoregBattery parses `ioreg -rn AppleSmartBattery`, e.g.
+//
+//	"CurrentCapacity" = 87
+//	"MaxCapacity" = 100
+//	"CycleCount" = 312
+//	"AppleRawMaxCapacity" = 4381
+//	"DesignCapacity" = 4563
+//
+// Apple Silicon reports Current/MaxCapacity in percent and the mAh in
+// AppleRawMaxCapacity; Intel Macs have mAh in MaxCapacity.
+func parseIoregBattery(out string) (batteryInfo, bool) {
+	v := make(map[string]float64)
+	for _, m := range ioregInt.FindAllStringSubmatch(out+"\n", -1) {
+		if _, ok := v[m[1]]; !ok {
+			v[m[1]], _ = strconv.ParseFloat(m[2], 64)
+		}
+	}
+	if _, ok := v["CurrentCapacity"]; !ok {
+		return batteryInfo{}, false
+	}
+	b := batteryInfo{ChargeRatio: -1, Cycles: -1, HealthRatio: -1}
+	if v["MaxCapacity"] > 0 {
+		b.ChargeRatio = min(v["CurrentCapacity"]/v["MaxCapacity"], 1)
+	}
+	if c, ok := v["CycleCount"]; ok {
+		b.Cycles = c
+	}
+	full := v["AppleRawMaxCapacity"]
+	if full == 0 {
+		full = v["MaxCapacity"]
+	}
+	if d := v["DesignCapacity"]; d > 0 && full > 100 {
+		b.HealthRatio = full / d
+	}
+	return b, true
+}
+
+// readSysfsBattery reads the first battery under root. Batteries report
+// either energy (µWh) or charge (µAh) files, depending on the driver.
+func readSysfsBattery(root string) (batteryInfo, bool) {
+	dirs, _ := filepath.Glob(filepath.Join(root, "*"))
+	for _, dir := range dirs {
+		if readSysfs(dir, "type") != "Battery" || readSysfs(dir, "present") == "0" {
+			continue
+		}
+		num := func(name string) float64 {
+			f, err := strconv.ParseFloat(readSysfs(dir, name), 64)
+			if err != nil {
+				return -1
+			}
+			return f
+		}
+		b := batteryInfo{ChargeRatio: -1, Cycles: num("cycle_count"), HealthRatio: -1}
+		if c := num("capacity"); c >= 0 {
+			b.ChargeRatio = c / 100
+		}
+		for _, kind := range []string{"energy", "charge"} {
+			if full, design := num(kind+"_full"), num(kind+"_full_design"); full > 0 && design > 0 {
+				b.HealthRatio = full / design
+				break
+			}
+		}
+		// Some drivers report 0 cycles when they do not count them.
+		if b.Cycles == 0 {
+			b.Cycles = -1
+		}
+		return b, true
+	}
+	return batteryInfo{}, false
+}
+
+// hostMetricsLoop samples every source every interval until ctx is done.
+func hostMetricsLoop(ctx context.Context, sources []*hostSource, interval time.Duration) error {
+	for {
+		for _, s := range sources {
+			if metrics, err := s.read(); err != nil {
+				errorLog.Printf("Error reading %s metrics: %v", s.name, err)
+			} else {
+				s.last.Store(&metrics)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// hostCollector exports the last sample of every source.
+type hostCollector struct {
+	sources []*hostSource
+}
+
+func (c hostCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, s := range c.sources {
+		for _, d := range s.descs {
+			ch <- d
+		}
+	}
+}
+
+func (c hostCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range c.sources {
+		if metrics := s.last.Load(); metrics != nil {
+			for _, m := range *metrics {
+				ch <- m
+			}
+		}
+	}
+}
+
+func hostSourceNames(sources []*hostSource) string {
+	names := make([]string, len(sources))
+	for i, s := range sources {
+		names[i] = s.name
+	}
+	return strings.Join(names, ", ")
+}
+
+func init() {
+	registerFeature("host_metrics", false)
+}
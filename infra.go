@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strings"
+)
+
+// DeviceConfig holds per-device overrides keyed by MAC.
+type DeviceConfig struct {
+	MAC            string `yaml:"mac"`
+	Name           string `yaml:"name"`
+	Infrastructure *bool  `yaml:"infrastructure"`
+	// Owner and Location are free-form inventory fields, shown with the
+	// device in the API (see devices import).
+	Owner    string `yaml:"owner"`
+	Location string `yaml:"location"`
+	// RTTSLOMs is the round-trip objective for this device, overriding
+	// the one of its device type.
+	RTTSLOMs float64 `yaml:"rtt_slo_ms"`
+	// Tags are free-form labels for selecting the device in groups:.
+	Tags []string `yaml:"tags"`
+	// ProxyARP forces (true) or prevents (false) tracking the IPs behind
+	// this MAC as separate devices, regardless of proxy_arp_threshold.
+	ProxyARP *bool `yaml:"proxy_arp"`
+	// ExpectedIP pins the device to one address (e.g. a DHCP
+	// reservation); wifi_device_ip_violation is 1 while it is seen at
+	// another one of the same family.
+	ExpectedIP string `yaml:"expected_ip"`
+	// SSH opts the device into SSH enrichment: its hostname, OS, kernel
+	// and boot time are read by logging into it, which needs
+	// enrichment.enabled. host defaults to the device's IP; os is ignored.
+	SSH *RemoteConfig `yaml:"ssh"`
+}
+
+type InfrastructureStatus struct {
+	MAC  string `json:"mac"`
+	Name string `json:"name"`
+	Up   bool   `json:"up"`
+}
+
+func (c Config) deviceConfig(mac string) (DeviceConfig, bool) {
+	for _, d := range c.Devices {
+		if strings.EqualFold(d.MAC, mac) {
+			return d, true
+		}
+	}
+	return DeviceConfig{}, false
+}
+
+// isInfrastructure applies, in order: the per-device flag, the gateway
+// check and the flag on the matched device type rule.
+func isInfrastructure(cfg Config, mac, ip, deviceType, gateway string) bool {
+	if d, ok := cfg.deviceConfig(mac); ok && d.Infrastructure != nil {
+		return *d.Infrastructure
+	}
+	if gateway != "" && ip == gateway {
+		return true
+	}
+	for _, rule := range cfg.DeviceTypes {
+		if rule.Type == deviceType && rule.Infrastructure {
+			return true
+		}
+	}
+	return false
+}
+
+// infrastructureStatus lists every known infrastructure device with its
+// current reachability.
+func (s *scanner) infrastructureStatus(cfg Config, devices []Device) []InfrastructureStatus {
+	up := make(map[string]bool)
+	for _, d := range devices {
+		if d.Infrastructure {
+			s.knownInfrastructure[d.MAC] = d.Name
+			up[d.MAC] = true
+		}
+	}
+	for _, d := range cfg.Devices {
+		if d.Infrastructure != nil && *d.Infrastructure {
+			mac := strings.ToLower(d.MAC)
+			if _, ok := s.knownInfrastructure[mac]; !ok {
+				s.knownInfrastructure[mac] = d.Name
+			}
+		}
+	}
+
+	var out []InfrastructureStatus
+	for mac, name := range s.knownInfrastructure {
+		out = append(out, InfrastructureStatus{MAC: mac, Name: name, Up: up[mac]})
+	}
+	return out
+}
+
+func parseLinuxDefaultGateway(routes string) string {
+	for _, line := range strings.Split(routes, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(ip, binary.BigEndian.Uint32(raw))
+		return ip.String()
+	}
+	return ""
+}
+
+func parseDarwinDefaultGateway(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "gateway:" {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// defaultGateway returns the IPv4 default gateway of the host the probes
+// run on, or "" if it cannot be determined.
+func (s *scanner) defaultGateway() string {
+	if s.runner.GOOS() == "darwin" {
+		out, err := s.runner.Output("route", "-n", "get", "default")
+		if err != nil {
+			return ""
+		}
+		return parseDarwinDefaultGateway(string(out))
+	}
+	out, err := s.runner.Output("cat", "/proc/net/route")
+	if err != nil {
+		return ""
+	}
+	return parseLinuxDefaultGateway(string(out))
+}
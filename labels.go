@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+type LabelConfig struct {
+	// Allowed is a regex matched against every character of free-form
+	// label values (hostname, name, version); characters it does
+	// not match become Replacement. Empty allows every printable character.
+	Allowed     string `yaml:"allowed"`
+	Replacement string `yaml:"replacement"`
+	// HostnameConfirmScans is how many consecutive scans a changed hostname
+	// must be seen before the hostname label follows it (default 2). The
+	// API always shows the latest name.
+	HostnameConfirmScans int `yaml:"hostname_confirm_scans"`
+	// HostnameMaxChangesPerHour is how often a device may change its
+	// resolved name within an hour before its hostname label is frozen to
+	// the first name it had (default 6).
+	HostnameMaxChangesPerHour int `yaml:"hostname_max_changes_per_hour"`
+}
+
+// labelPolicy sanitizes free-form label values. Control characters and
+// invalid UTF-8 are always replaced: the client library rejects invalid
+// UTF-8 and control characters break line-oriented relabeling.
+type labelPolicy struct {
+	allowed     *regexp.Regexp
+	replacement string
+}
+
+func (c LabelConfig) policy() (labelPolicy, error) {
+	p := labelPolicy{replacement: c.Replacement}
+	if p.replacement == "" {
+		p.replacement = "_"
+	}
+	if c.Allowed != "" {
+		re, err := regexp.Compile(c.Allowed)
+		if err != nil {
+			return labelPolicy{replacement: p.replacement}, fmt.Errorf("labels.allowed: %v", err)
+		}
+		p.allowed = re
+	}
+	return p, nil
+}
+
+func (p labelPolicy) value(s string) string {
+	repl := p.replacement
+	if repl == "" {
+		repl = "_"
+	}
+	s = strings.ToValidUTF8(s, repl)
+	var b strings.Builder
+	for _, r := range s {
+		if !unicode.IsPrint(r) || (p.allowed != nil && !p.allowed.MatchString(string(r))) {
+			b.WriteString(repl)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestLabelPolicyValue(t *testing.T) {
+	strict, err := LabelConfig{Allowed: `[a-zA-Z0-9.-]`, Replacement: "-"}.policy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		p    labelPolicy
+		in   string
+		want string
+	}{
+		{"plain", labelPolicy{}, "living-room.lan", "living-room.lan"},
+		{"quotes and backslashes are kept", labelPolicy{}, `tv "den" \ lan`, `tv "den" \ lan`},
+		{"newline", labelPolicy{}, "evil\nfake_metric 1", "evil_fake_metric 1"},
+		{"carriage return and tab", labelPolicy{}, "a\rb\tc", "a_b_c"},
+		{"nul and escape", labelPolicy{}, "a\x00b\x1b[31m", "a_b_[31m"},
+		{"bidi override", labelPolicy{}, "abc\u202edcba", "abc_dcba"},
+		{"zero width space", labelPolicy{}, "a\u200bb", "a_b"},
+		{"invalid utf-8", labelPolicy{}, "a\xffb", "a_b"},
+		{"unicode letters are printable", labelPolicy{}, "Küche", "Küche"},
+		{"allowed characters", strict, "Jane's iPhone (2)", "Jane-s-iPhone--2-"},
+		{"replacement default", labelPolicy{allowed: strict.allowed}, "a b", "a_b"},
+	} {
+		if got := tc.p.value(tc.in); got != tc.want {
+			t.Errorf("%s: value(%q) = %q, want %q", tc.name, tc.in, got, tc.want)
+		}
+	}
+	if _, err := (LabelConfig{Allowed: "["}).policy(); err == nil || !strings.Contains(err.Error(), "labels.allowed") {
+		t.Errorf("bad regex: %v", err)
+	}
+}
+
+// TestExpositionConformance renders devices with hostile hostnames through
+// the device collector and parses the text exposition back: every sample
+// must survive with the sanitized value, on its own line.
+func TestExpositionConformance(t *testing.T) {
+	hostnames := []string{
+		`quote " here`,
+		`back\slash`,
+		"new\nline_total 1",
+		"ctrl\x01\x7f",
+		"bidi\u202e\u2066over",
+		"tab\there",
+		"bad\xc3\x28utf8",
+		`trailing\`,
+	}
+	s := newScanner("", 1)
+	snap := &ScanSnapshot{Labels: labelPolicy{}}
+	for i, h := range hostnames {
+		mac := "aa:bb:cc:dd:ee:0" + string(rune('0'+i))
+		snap.Devices = append(snap.Devices, Device{IP: "192.168.1." + string(rune('1'+i)), MAC: mac, HostnameLabel: h, DeviceType: "unknown"})
+	}
+	s.publishScan(snap)
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(newDeviceCollector("", s))
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var parser expfmt.TextParser
+	parsed, err := parser.TextToMetricFamilies(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("exposition does not parse: %v\n%s", err, buf.String())
+	}
+	mf, ok := parsed["wifi_connected_devices"]
+	if !ok || len(mf.Metric) != len(hostnames) {
+		t.Fatalf("parsed %d wifi_connected_devices samples, want %d:\n%s", len(mf.GetMetric()), len(hostnames), buf.String())
+	}
+	got := make(map[string]string)
+	for _, m := range mf.Metric {
+		var mac, hostname string
+		for _, l := range m.Label {
+			switch l.GetName() {
+			case "mac":
+				mac = l.GetValue()
+			case "hostname":
+				hostname = l.GetValue()
+			}
+		}
+		got[mac] = hostname
+	}
+	for i, h := range hostnames {
+		mac := "aa:bb:cc:dd:ee:0" + string(rune('0'+i))
+		want := snap.Labels.value(h)
+		if got[mac] != want {
+			t.Errorf("%q came back as %q, want %q", h, got[mac], want)
+		}
+		if !utf8.ValidString(got[mac]) || strings.IndexFunc(got[mac], func(r rune) bool { return !unicode.IsPrint(r) }) >= 0 {
+			t.Errorf("%q came back with unprintable characters: %q", h, got[mac])
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// legacyMetrics pairs each metric kept for old dashboards with the one
+// replacing it. Both are rendered by the same collector from one sample;
+// /metrics serves only the replacements and /metrics/legacy only the old
+// names, so the two endpoints never disagree about a snapshot.
+var legacyMetrics = []struct{ legacy, current string }{
+	{"macbook_cpu_usage_percent", "macbook_cpu_usage_ratio"},
+	{"macbook_memory_usage_percent", "macbook_memory_usage_ratio"},
+	{"agent_cpu_usage_percent", "agent_cpu_usage_ratio"},
+	{"agent_memory_usage_percent", "agent_memory_usage_ratio"},
+}
+
+// withoutFamilies wraps g, leaving out the named families.
+func withoutFamilies(g prometheus.Gatherer, names map[string]bool) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+		out := mfs[:0]
+		for _, mf := range mfs {
+			if !names[mf.GetName()] {
+				out = append(out, mf)
+			}
+		}
+		return out, err
+	})
+}
+
+// legacyNames returns the legacy and the current names of legacyMetrics
+// in namespace.
+func legacyNames(namespace string) (legacy, current map[string]bool) {
+	legacy, current = make(map[string]bool), make(map[string]bool)
+	for _, p := range legacyMetrics {
+		legacy[prometheus.BuildFQName(namespace, "", p.legacy)] = true
+		current[prometheus.BuildFQName(namespace, "", p.current)] = true
+	}
+	return legacy, current
+}
+
+// legacyMetricsHandler serves GET /metrics/legacy for scrape jobs still on
+// the old names during a migration; telemetry_legacy_endpoint_scrapes_total
+// shows when nothing uses it anymore.
+func legacyMetricsHandler(m *Metrics, g prometheus.Gatherer, opts promhttp.HandlerOpts) http.Handler {
+	_, current := legacyNames(m.namespace)
+	h := promhttp.HandlerFor(withoutFamilies(g, current), opts)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.LegacyScrapes.Inc()
+		h.ServeHTTP(w, r)
+	})
+}
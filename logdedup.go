@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type LogConfig struct {
+	// Level "debug" additionally prints per-device error detail.
+	Level string `yaml:"level"`
+	// DedupWindow collapses identical error lines seen within the window.
+	DedupWindow time.Duration `yaml:"dedup_window"`
+}
+
+type dedupEntry struct {
+	first   time.Time
+	repeats int
+}
+
+// logDeduper prints a message the first time it is seen and swallows exact
+// repeats within the window; once the window is over the number of
+// swallowed repeats is reported in a single line.
+type logDeduper struct {
+	mu     sync.Mutex
+	window time.Duration
+	now    func() time.Time
+	out    func(string)
+	seen   map[string]*dedupEntry
+}
+
+func newLogDeduper(window time.Duration, out func(string)) *logDeduper {
+	return &logDeduper{
+		window: window,
+		now:    time.Now,
+		out:    out,
+		seen:   make(map[string]*dedupEntry),
+	}
+}
+
+func (d *logDeduper) Printf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	d.flushExpired(now)
+
+	if e, ok := d.seen[msg]; ok {
+		e.repeats++
+		return
+	}
+	d.seen[msg] = &dedupEntry{first: now}
+	d.out(msg)
+}
+
+// Flush reports the repeats of every message whose window has ended.
+func (d *logDeduper) Flush() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.flushExpired(d.now())
+}
+
+func (d *logDeduper) flushExpired(now time.Time) {
+	for msg, e := range d.seen {
+		if now.Sub(e.first) < d.window {
+			continue
+		}
+		if e.repeats > 0 {
+			d.out(fmt.Sprintf("%s (repeated %d times)", msg, e.repeats))
+		}
+		delete(d.seen, msg)
+	}
+}
+
+var (
+	errorLog     = newLogDeduper(5*time.Minute, func(s string) { log.Println(s) })
+	debugEnabled bool
+)
+
+func configureLogging(cfg LogConfig) {
+	debugEnabled = cfg.Level == "debug"
+	if cfg.DedupWindow > 0 {
+		errorLog.mu.Lock()
+		errorLog.window = cfg.DedupWindow
+		errorLog.mu.Unlock()
+	}
+}
+
+func debugf(format string, args ...interface{}) {
+	if debugEnabled {
+		log.Printf("debug: "+format, args...)
+	}
+}
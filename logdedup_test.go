@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLogDeduper(t *testing.T) {
+	// Each step either logs msg (flush unset) or flushes at offset at.
+	type step struct {
+		at    time.Duration
+		msg   string
+		flush bool
+	}
+	for _, tc := range []struct {
+		name  string
+		steps []step
+		want  []string
+	}{
+		{"first line is printed", []step{{0, "a", false}}, []string{"a"}},
+		{"repeats inside the window are swallowed", []step{
+			{0, "a", false}, {time.Second, "a", false}, {59 * time.Second, "a", false},
+		}, []string{"a"}},
+		{"different lines are not deduplicated", []step{
+			{0, "a", false}, {time.Second, "b", false},
+		}, []string{"a", "b"}},
+		{"first line after the window reports the repeats", []step{
+			{0, "a", false}, {time.Second, "a", false}, {2 * time.Second, "a", false}, {time.Minute, "a", false},
+		}, []string{"a", "a (repeated 2 times)", "a"}},
+		{"the window is measured from the first line", []step{
+			{0, "a", false}, {59 * time.Second, "a", false}, {61 * time.Second, "a", false},
+		}, []string{"a", "a (repeated 1 times)", "a"}},
+		{"a line without repeats expires silently", []step{
+			{0, "a", false}, {2 * time.Minute, "a", false},
+		}, []string{"a", "a"}},
+		{"flush reports the repeats of an ended window", []step{
+			{0, "a", false}, {time.Second, "a", false}, {time.Minute, "", true},
+		}, []string{"a", "a (repeated 1 times)"}},
+		{"flush keeps an open window", []step{
+			{0, "a", false}, {time.Second, "a", false}, {30 * time.Second, "", true}, {40 * time.Second, "a", false},
+		}, []string{"a"}},
+		{"flush reports once", []step{
+			{0, "a", false}, {time.Second, "a", false}, {time.Minute, "", true}, {2 * time.Minute, "", true},
+		}, []string{"a", "a (repeated 1 times)"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			start := time.Unix(1000, 0)
+			now := start
+			d := newLogDeduper(time.Minute, func(s string) { got = append(got, s) })
+			d.now = func() time.Time { return now }
+			for _, s := range tc.steps {
+				now = start.Add(s.at)
+				if s.flush {
+					d.Flush()
+				} else {
+					d.Printf("%s", s.msg)
+				}
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+const (
+	logRingSize    = 1000
+	logRingLineMax = 4096
+)
+
+// logRing keeps the most recent log lines for debug bundles. It is always
+// installed next to stderr.
+type logRing struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+var recentLogs = &logRing{}
+
+func (r *logRing) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		if len(line) > logRingLineMax {
+			line = line[:logRingLineMax] + "...(truncated)"
+		}
+		r.lines = append(r.lines, line)
+	}
+	if len(r.lines) > logRingSize {
+		r.lines = append([]string(nil), r.lines[len(r.lines)-logRingSize:]...)
+	}
+	return len(p), nil
+}
+
+func (r *logRing) snapshot() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.lines...)
+}
@@ -1,128 +1,162 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/shirou/gopsutil/v3/cpu"
 	"github.com/shirou/gopsutil/v3/mem"
 	"gopkg.in/yaml.v3"
 )
 
-const subnet = "192.168.1."
 const cfgPath = "config.yaml"
 
+// version is set at build time via -ldflags "-X main.version=...".
+var version = "dev"
+
 type DeviceTypeRule struct {
 	Type             string   `yaml:"type"`
 	MACPrefixes      []string `yaml:"mac_prefixes"`
 	HostnameKeywords []string `yaml:"hostname_keywords"`
+	// Infrastructure marks routers, switches and APs rather than clients.
+	Infrastructure bool `yaml:"infrastructure"`
+	// Display is optional rendering info for UIs (icon, category, color).
+	Display *DisplayConfig `yaml:"display"`
+	// RTTSLOMs is the round-trip objective for devices of this type.
+	RTTSLOMs float64 `yaml:"rtt_slo_ms"`
+	// DHCPFingerprints match the parameter request list a device sent
+	// (dhcp.sniff), e.g. "1,121,3,6,15,119,252,95,44,46".
+	DHCPFingerprints []string `yaml:"dhcp_fingerprints"`
 }
 
 type Config struct {
 	DeviceTypes []DeviceTypeRule `yaml:"device_types"`
-}
-
-var (
-	cpuUsage = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "macbook_cpu_usage_percent",
-		Help: "CPU usage percentage on MacBook",
-	})
-
-	memoryUsage = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "macbook_memory_usage_percent",
-		Help: "Memory usage percentage on MacBook",
-	})
-
-	totalMemory = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "macbook_memory_total_bytes",
-		Help: "Total memory on MacBook in bytes",
-	})
-
-	usedMemory = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "macbook_memory_used_bytes",
-		Help: "Used memory on MacBook in bytes",
-	})
-
-	deviceDetails = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "wifi_connected_devices",
-			Help: "Connected devices on the local network",
-		},
-		[]string{"ip", "mac", "hostname", "device_type"},
-	)
-)
+	DNS         DNSConfig        `yaml:"dns"`
+	Scan        ScanConfig       `yaml:"scan"`
+	Resolution  ResolutionConfig `yaml:"resolution"`
+	HTTP        HTTPConfig       `yaml:"http"`
+	Log         LogConfig        `yaml:"log"`
+	Labels      LabelConfig      `yaml:"labels"`
+	Metrics     MetricsConfig    `yaml:"metrics"`
+	Views       []ViewConfig     `yaml:"views"`
+	SelfTest    SelfTestConfig   `yaml:"selftest"`
+	RTTSLO      RTTSLOConfig     `yaml:"rtt_slo"`
+	Anomaly     AnomalyConfig    `yaml:"anomaly"`
+	Admin       AdminConfig      `yaml:"admin"`
+	DHCP        DHCPConfig       `yaml:"dhcp"`
+	Aggregates  AggregateConfig  `yaml:"aggregates"`
+	Network     NetworkConfig    `yaml:"network"`
+	// Components sets the restart policy of server, scanner and system.
+	Components map[string]RestartPolicy `yaml:"components"`
+	Debug      DebugConfig              `yaml:"debug"`
+	Remote     *RemoteConfig            `yaml:"remote"`
+	Devices    []DeviceConfig           `yaml:"devices"`
+	Groups     []GroupConfig            `yaml:"groups"`
+	Uplink     UplinkConfig             `yaml:"uplink"`
+	Enrichment EnrichmentConfig         `yaml:"enrichment"`
+	Timeseries TimeseriesConfig         `yaml:"timeseries"`
+	Cohorts    CohortConfig             `yaml:"cohorts"`
+	Registry   RegistryConfig           `yaml:"registry"`
+	EventLog   EventLogConfig           `yaml:"event_log"`
+	// UserMetrics adds the per-user macbook_user_* breakdown.
+	UserMetrics UserMetricsConfig `yaml:"user_metrics"`
+	HostMetrics HostMetricsConfig `yaml:"host_metrics"`
+	Tracing     TracingConfig     `yaml:"tracing"`
+	OTLP        OTLPConfig        `yaml:"otlp"`
+	PowerSave   PowerSaveConfig   `yaml:"power_save"`
+	CPU         CPUConfig         `yaml:"cpu"`
+	// Scanners run one scan pipeline each, configured by the rest of the
+	// file with the entry's keys merged over it.
+	Scanners []ScannerConfig `yaml:"scanners"`
 
-func init() {
-	prometheus.MustRegister(cpuUsage)
-	prometheus.MustRegister(memoryUsage)
-	prometheus.MustRegister(totalMemory)
-	prometheus.MustRegister(usedMemory)
-	prometheus.MustRegister(deviceDetails)
+	// source is the merged YAML the config was decoded from, which the
+	// scanners' configs are derived from.
+	source []byte
 }
 
-func ping(ip string, wg *sync.WaitGroup) {
-	defer wg.Done()
-	_ = exec.Command("ping", "-c", "1", "-W", "1", ip).Run()
+func loadConfig(configPath string) (Config, error) {
+	var cfg Config
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return cfg, err
+	}
+	return parseConfig(data)
 }
 
-func getARPTable() map[string]string {
-	out, err := exec.Command("arp", "-a").Output()
+// parseConfig decodes a config file, leniently like loadConfig.
+func parseConfig(data []byte) (Config, error) {
+	var cfg Config
+	data, _, err := mergeConfigDocuments(data)
 	if err != nil {
-		log.Println("Error getting ARP table:", err)
-		return nil
+		return cfg, err
 	}
-
-	lines := strings.Split(string(out), "\n")
-	result := make(map[string]string)
-	for _, line := range lines {
-		parts := strings.Fields(line)
-		if len(parts) >= 4 {
-			ip := strings.Trim(parts[1], "()")
-			mac := parts[3]
-			result[ip] = mac
-		}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return cfg, err
 	}
-	return result
+	cfg.source = data
+	return cfg, nil
 }
 
-func resolveHostname(ip string) (string, error) {
-	// Run `arp -a`
-	cmd := exec.Command("arp", "-a")
-	var out bytes.Buffer
-	cmd.Stdout = &out
-
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("failed to run arp: %v", err)
-	}
+func init() {
+	registerFeature("system_metrics", true)
+	registerFeature("device_scan", true)
+}
 
-	lines := strings.Split(out.String(), "\n")
-	for _, line := range lines {
-		if strings.Contains(line, ip) {
-			// Example line: ? (192.168.1.5) at 8:xx:xx:xx:xx on en0 ifscope [ethernet]
-			parts := strings.Fields(line)
-			if len(parts) > 0 {
-				if parts[0] != "?" {
-					return parts[0], nil // parts[0] is the hostname
-				} else {
-					return "<unknown>", nil
-				}
-			}
+// ping probes ip with the system ping, or scan.ping_command if set, and
+// returns the round-trip time, or 0 when the output carries none.
+func (s *scanner) ping(ip string, cfg Config) (time.Duration, error) {
+	pc := cfg.Scan.PingCommand
+	if !pc.enabled() {
+		out, err := s.runner.Output("ping", pingArgs(ip, cfg.Scan, s.runner.GOOS())...)
+		s.countSent(trafficICMP, 1, pingEchoSize)
+		if err != nil {
+			return 0, pingError(err, s.runner.GOOS())
 		}
+		return parsePingRTT(string(out)), nil
+	}
+	out, err := s.runner.Output(pc.Path, pc.expand(ip, cfg.Network.timeout())...)
+	s.countSent(trafficICMP, pc.count(), pc.count()*pingEchoSize)
+	if err := pc.exitResult(err); err != nil {
+		return 0, err
 	}
+	return parsePingRTT(string(out)), nil
+}
 
-	return "", fmt.Errorf("IP not found in ARP table")
+// resolveHostname names ip the way `arp -a` does: the address must be in
+// the neighbor table, and its name is the system resolver's reverse
+// lookup, here bounded by timeout. A neighbor without a name is
+// "<unknown>".
+func (s *scanner) resolveHostname(ip string, timeout time.Duration) (string, error) {
+	entries, _, err := s.readNeighbors()
+	if err != nil {
+		return "", fmt.Errorf("failed to read the neighbor table: %v", err)
+	}
+	if _, ok := neighborMACs(entries)[ip]; !ok {
+		return "", fmt.Errorf("IP not found in ARP table")
+	}
+	name, err := s.lookupDNS(ip, timeout)
+	if err != nil {
+		return "<unknown>", nil
+	}
+	return name, nil
 }
 
-func detectDeviceType(mac, hostname, configPath string) (string, error) {
+func (s *scanner) detectDeviceType(mac, hostname string, fp *DHCPFingerprint) (string, error) {
 	// Basic MAC OUI checks
 	/* if strings.HasPrefix(mac, "fc:fb:fb") || strings.HasPrefix(mac, "ac:bc:32") {
 		return "apple"
@@ -144,91 +178,839 @@ func detectDeviceType(mac, hostname, configPath string) (string, error) {
 	default:
 		return "unknown"
 	} */
-	data, err := os.ReadFile(configPath)
+	cfg, err := s.loadConfig()
 	if err != nil {
 		return "unknown", err
 	}
-	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return "unknown", err
+	deviceType, _ := classifyDevice(cfg, mac, hostname, fp)
+	return deviceType, nil
+}
+
+// classifyDevice applies the device_types rules in order and also reports
+// which rule matched. fp is the device's sniffed DHCP fingerprint, if any.
+func classifyDevice(cfg Config, mac, hostname string, fp *DHCPFingerprint) (deviceType, reason string) {
+	i, reason := matchRule(cfg, mac, hostname, fp)
+	if i < 0 {
+		return "unknown", reason
 	}
+	return cfg.DeviceTypes[i].Type, reason
+}
+
+// matchRule returns the index of the first matching device_types rule, or
+// -1.
+func matchRule(cfg Config, mac, hostname string, fp *DHCPFingerprint) (int, string) {
 	mac = strings.ToLower(mac)
 	hostname = strings.ToLower(hostname)
-	for _, rule := range cfg.DeviceTypes {
+	var params string
+	if fp != nil {
+		params = fp.Params
+	}
+	for i, rule := range cfg.DeviceTypes {
 		for _, prefix := range rule.MACPrefixes {
 			if strings.HasPrefix(mac, prefix) {
-				return rule.Type, nil
+				return i, "mac prefix " + prefix
 			}
 		}
 		for _, keyword := range rule.HostnameKeywords {
 			if strings.Contains(hostname, keyword) {
-				return rule.Type, nil
+				return i, "hostname keyword " + keyword
+			}
+		}
+		for _, fp := range rule.DHCPFingerprints {
+			if params != "" && params == fp {
+				return i, "dhcp fingerprint " + fp
 			}
 		}
 	}
-	return "unknown", nil
+	return -1, "no rule matched"
 }
 
-func scanAndUpdateMetrics() {
-	deviceDetails.Reset()
+func (s *scanner) scanAndUpdateMetrics(cause string) {
+	if !s.running.TryLock() {
+		s.m.ScansSkipped.WithLabelValues(cause).Inc()
+		s.logf("Skipping %s scan: the previous scan is still running", cause)
+		return
+	}
+	defer s.running.Unlock()
+	started := time.Now()
+	stats := ScanStats{ID: nextScanID(), StartedAt: started, Cause: cause, Scanner: s.name, trace: startScanTrace(started)}
+	s.scanID.Store(stats.ID)
+	stats.TraceID = stats.trace.ID()
+	s.schedule.record(s.m, cause, started)
+	sentBefore := s.sent.snapshot()
+
+	cfg, err := s.loadConfig()
+	if err != nil {
+		s.logf("Error loading config: %v", err)
+	}
 
-	var wg sync.WaitGroup
-	for i := 1; i <= 254; i++ {
-		ip := fmt.Sprintf("%s%d", subnet, i)
+	updatePowerSave(s.m, cfg.PowerSave)
+	if s.enrichment != nil {
+		s.enrichment.pause()
+		s.mergeEnrichment(s.enrichment.drain())
+	}
+
+	gateway := s.defaultGateway()
+	networks := s.checkSubnets(cfg, cfg.scanNetworks(), gateway)
+	scanR := combinedRange(networks)
+	all := scanR.addresses()
+	var targets []string
+	if cause == scanCauseDHCP {
+		targets = s.joins.takeTargets(scanR)
+	} else {
+		targets = s.chunks.next(all, cfg.Scan.ChunkSize, s.lastARPTable)
+	}
+
+	stageStart := time.Now()
+	var broadcastSeen map[string]string
+	if cfg.Scan.Probe == probeBroadcast && cause != scanCauseDHCP {
+		broadcastSeen = s.broadcastSweep(cfg.Scan, networks)
+		s.chunks.markProbed(all, time.Now())
+		targets = unicastFallback(cfg.Scan, targets, broadcastSeen)
+	}
+	stats.Probed = len(targets)
+	// With a packet budget, every probe reserves what it may cost before it
+	// is sent, on top of what the broadcast sweep already sent, so the
+	// workers in flight cannot overshoot it.
+	budget := int64(cfg.Scan.MaxPacketsPerCycle)
+	var spent atomic.Int64
+	if budget > 0 {
+		spent.Store(int64(s.packetsSince(sentBefore)))
+		targets = knownFirst(targets, s.lastARPTable)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		replied   = make(map[string]bool, len(targets))
+		rtts      = make(map[string]time.Duration)
+		probeErrs = make(map[string]error)
+		unprobed  = make(map[string]bool)
+		queue     = make(chan string)
+		sources   = make([]string, len(networks))
+		probeCfgs = make([]Config, len(networks))
+	)
+	for i, n := range networks {
+		sources[i] = probeSource(n.Scan, n.Range)
+		probeCfgs[i] = cfg
+		probeCfgs[i].Scan = n.Scan
+	}
+	for i := 0; i < min(s.workers, len(targets)); i++ {
 		wg.Add(1)
-		go ping(ip, &wg)
+		go func() {
+			defer wg.Done()
+			for ip := range queue {
+				n := max(networkFor(networks, ip, ""), 0)
+				if budget > 0 && spent.Add(int64(s.probeCost(ip, probeCfgs[n], s.lastARPTable))) > budget {
+					mu.Lock()
+					unprobed[ip] = true
+					mu.Unlock()
+					continue
+				}
+				probeStart := time.Now()
+				rtt, err := s.probeHost(ip, sources[n], probeCfgs[n])
+				stats.trace.device(stageProbe, ip, probeStart, err)
+				s.countARP(ip, s.lastARPTable, err == nil)
+				mu.Lock()
+				replied[ip] = err == nil
+				if rtt > 0 {
+					rtts[ip] = rtt
+				}
+				if err != nil {
+					probeErrs[ip] = fmt.Errorf("probe %s: %w", ip, err)
+					countScanError(s.m, err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, ip := range targets {
+		queue <- ip
 	}
+	close(queue)
 	wg.Wait()
-	time.Sleep(1 * time.Second)
+	if len(unprobed) > 0 {
+		// Left unmarked, the skipped addresses keep aging in
+		// telemetry_scan_coverage_age_seconds.
+		probed := make([]string, 0, len(targets)-len(unprobed))
+		for _, ip := range targets {
+			if !unprobed[ip] {
+				probed = append(probed, ip)
+			}
+		}
+		s.logf("Scan packet budget of %d used up: %d of %d addresses not probed", cfg.Scan.MaxPacketsPerCycle, len(unprobed), len(targets))
+		targets = probed
+		stats.Probed = len(probed)
+		stats.Unprobed = len(unprobed)
+		stats.BudgetExhausted = true
+	}
+	s.chunks.markProbed(targets, time.Now())
+	s.m.ScanCoverageAge.Set(s.chunks.coverageAge(all, time.Now()).Seconds())
+	if len(targets) > 0 {
+		time.Sleep(1 * time.Second)
+	}
+	stats.recordStage(s.m, stageProbe, stageStart, len(targets), len(probeErrs))
+
+	stageStart = time.Now()
+	neighbors, arpOutput, neighborErr := s.readNeighbors()
+	if neighborErr != nil {
+		s.logf("Error reading neighbor table: %v", neighborErr)
+		countScanError(s.m, neighborErr)
+	}
+	s.trackNeighborChurn(neighbors)
+	rawTable := neighborMACs(neighbors)
+	arpTable := s.checkNeighborTable(rawTable, replied)
+	s.lastARPTable = arpTable
+	// Our own address is tracked on the first network only.
+	s.checkSelfAddress(networks[0].Scan, networks[0].Range, arpTable)
+	vlans := neighborVLANs(networks, neighbors)
+	stats.recordStage(s.m, stageNeighborRead, stageStart, len(arpTable), 0)
+	stats.Phases = phaseContributions(arpTable, broadcastSeen)
+	for phase, n := range stats.Phases {
+		s.m.ScanPhaseDevices.WithLabelValues(phase).Set(float64(n))
+	}
 
-	arpTable := getARPTable()
+	stageStart = time.Now()
+	resolved := s.resolveAll(arpTable, cfg.Resolution)
+	resolutionFailures := 0
+	for _, res := range resolved {
+		if res.err != nil {
+			resolutionFailures++
+		}
+	}
+	stats.recordStage(s.m, stageResolution, stageStart, len(resolved), resolutionFailures)
+
+	stageStart = time.Now()
+	var devices []Device
+	var dump *scanDump
+	if cfg.Debug.RetainScanDetails {
+		dump = &scanDump{ARPOutput: arpOutput, ARPEntries: rawTable, cfg: cfg}
+	}
+	classificationErrors := 0
+	proxied := s.proxiedMACs(cfg, arpTable)
 	for ip, mac := range arpTable {
-		hostname, err := resolveHostname(ip)
-		if err != nil {
-			fmt.Printf("Error: %v\n", err)
+		key := deviceKey(ip, mac)
+		if proxied[mac] {
+			key = proxiedKey(ip, mac)
 		}
-		deviceType, err := detectDeviceType(mac, hostname, cfgPath)
+		hostname, stale, err := s.hostnameFor(key, resolved[ip], cfg.Resolution, time.Now())
+		s.recordDeviceResult(key, errResolution, err, time.Now())
 		if err != nil {
-			fmt.Printf("Error: %v\n", err)
+			debugf("resolving %s (%s): %v", ip, mac, err)
+		}
+		deviceType, classErr := s.detectDeviceType(mac, hostname, s.joins.fingerprint(mac))
+		s.recordDeviceResult(key, errClassification, classErr, time.Now())
+		if classErr != nil {
+			classificationErrors++
+			s.logf("Error detecting device type: %v", classErr)
 		}
-		//fmt.Println("ip : ", ip, "mac : ",mac,"hostname : ", hostname, "deviceType : ",deviceType)
-		deviceDetails.WithLabelValues(ip, mac, hostname, deviceType).Set(1)
+		debugf("ip: %s mac: %s hostname: %s deviceType: %s", ip, mac, hostname, deviceType)
+		_, probed := replied[ip]
+		if probed {
+			s.recordDeviceResult(key, errProbe, probeErrs[ip], time.Now())
+		}
+		var version *VersionRecord
+		if v := s.versionFor(key, resolved[ip]); v.Version != "" {
+			version = &v
+		}
+		var hostInfo *HostInfo
+		if h, ok := s.deviceHostInfo[key]; ok {
+			hostInfo = &h
+		}
+		probe := ProbeResult{ARPSeen: true, ICMPProbed: probed, ICMPReplied: replied[ip], RTT: rtts[ip]}
+		state := deviceState(probe)
+
+		if dump != nil {
+			_, reason := classifyDevice(cfg, mac, hostname, s.joins.fingerprint(mac))
+			dump.Devices = append(dump.Devices, deviceDump{
+				IP:         ip,
+				MAC:        mac,
+				Probe:      probe,
+				ProbeError: errString(probeErrs[ip]),
+				Names:      resolved[ip].names,
+				NameErrors: errStrings(resolved[ip].errs),
+				Hostname:   hostname,
+				Classification: classificationDump{
+					Type:   deviceType,
+					Reason: reason,
+					Error:  errString(classErr),
+				},
+			})
+		}
+
+		infra := isInfrastructure(cfg, mac, ip, deviceType, gateway)
+		name := hostname
+		if d, ok := cfg.deviceConfig(mac); ok && d.Name != "" {
+			name = d.Name
+		}
+
+		if _, ok := s.firstSeen[key]; !ok {
+			s.firstSeen[key] = time.Now()
+			s.cohorts.noteFirstSeen(key, s.firstSeen[key])
+			s.m.DevicesDiscovered.Inc()
+		}
+		label, unstable := s.hostnameLabel(cfg.Labels, key, hostname, started)
+		devices = append(devices, Device{
+			IP:               ip,
+			MAC:              mac,
+			Hostname:         hostname,
+			Name:             name,
+			Vendor:           ouiDB.lookup(mac),
+			DeviceType:       deviceType,
+			Infrastructure:   infra,
+			Display:          displayFor(cfg, deviceType, infra),
+			HostnameStale:    stale,
+			HostnameLabel:    label,
+			HostnameUnstable: unstable,
+			Names:            s.deviceNameSet(key),
+			Version:          version,
+			HostInfo:         hostInfo,
+			State:            state,
+			Probe:            probe,
+			FirstSeen:        wallTime(s.firstSeen[key], time.Now()),
+			Errors:           s.deviceErrorHistory(key),
+			ObservedInScan:   stats.ID,
+			Proxied:          proxied[mac],
+			VLAN:             vlans[ip],
+			DHCP:             s.joins.fingerprint(mac),
+		})
+	}
+
+	markGuests(cfg, devices)
+	if err := s.applyLeases(cfg.DHCP, devices); err != nil {
+		s.logf("Error reading DHCP leases: %v", err)
+	}
+	groups := applyGroups(cfg, devices)
+	stats.recordStage(s.m, stageClassification, stageStart, len(devices), classificationErrors)
+
+	stageStart = time.Now()
+	stats.Conditions = s.checkNetworkConditions(cfg.Network)
+	softened := cfg.Network.SoftenOnVPN && stats.Conditions.VPNActive
+	degraded := rawTable == nil || (len(rawTable) == 0 && len(arpTable) > 0) || softened
+	signals := shrinkSignals{NeighborErr: neighborErr, Network: scanNetworkSignature(networks, gateway)}
+	for _, err := range probeErrs {
+		if errorClass(err) != errClassTimeout {
+			signals.ProbeFailures++
+		}
+	}
+	held := s.checkScanShrink(cfg.Anomaly, len(devices), degraded, signals)
+	s.trackDeviceDelta(cfg.Anomaly, len(devices), degraded || held, time.Now())
+	if held {
+		// The previous scan stays exported, and presence and events are
+		// left alone, until the next scan confirms the drop.
+		stats.Duration = time.Since(started)
+		stats.Traffic = s.trafficSince(sentBefore)
+		stats.trace.finish(stats, len(devices))
+		s.history.record(stats)
+		errorLog.Flush()
+		return
+	}
+	presenceRecords := s.updatePresence(cfg.Scan, devices, time.Now())
+	tracked := make(map[string]bool, len(devices))
+	for _, d := range devices {
+		tracked[d.key()] = true
+	}
+	s.forgetDeviceErrors(tracked)
+	s.forgetHostnameLabels(presenceRecords)
+	infraStatus := s.infrastructureStatus(cfg, devices)
+	runSelfTest(s.m, cfg.SelfTest, devices)
+	s.checkRTTSLOs(cfg, devices)
+	s.checkExpectedIPs(cfg, devices)
+	labels, err := cfg.Labels.policy()
+	if err != nil {
+		s.logf("Invalid label policy, using the default: %v", err)
+	}
+	views, viewErrs := compileViews(s.m.namespace, cfg.Views)
+	for _, err := range viewErrs {
+		s.logf("Skipping metric view: %v", err)
+	}
+	if s.enrichment != nil {
+		s.enrichment.observe(cfg, devices, time.Now())
+	}
+	stats.recordStage(s.m, stagePublish, stageStart, len(devices), 0)
+	stats.Duration = time.Since(started)
+	stats.Traffic = s.trafficSince(sentBefore)
+	if stats.TraceID != "" {
+		s.m.ScanDuration.(prometheus.ExemplarObserver).ObserveWithExemplar(stats.Duration.Seconds(), prometheus.Labels{"trace_id": stats.TraceID})
+	} else {
+		s.m.ScanDuration.Observe(stats.Duration.Seconds())
+	}
+	stats.trace.finish(stats, len(devices))
+
+	snap := &ScanSnapshot{
+		Devices:        devices,
+		Infrastructure: infraStatus,
+		Stats:          stats,
+		Aggregates:     buildAggregates(cfg.Aggregates, devices),
+		Groups:         groups,
+		Presence:       presenceRecords,
+		Gateway:        gateway,
+		TakenAt:        time.Now(),
+		VersionMetric:  cfg.Resolution.VersionMetric,
+		Labels:         labels,
+		Views:          views,
+	}
+	s.publishScan(snap)
+	s.m.LastScanID.Set(float64(stats.ID))
+	s.m.LastScanTimestamp.Set(float64(snap.TakenAt.UnixNano()) / 1e9)
+	if dump != nil {
+		dump.TakenAt = snap.TakenAt
+		s.lastScanDump.Store(dump)
+	} else {
+		s.lastScanDump.Store(nil)
+	}
+	s.history.record(stats)
+	s.timeseries.record(cfg.Timeseries, devices, snap.TakenAt)
+	s.updateCohorts(cfg.Cohorts, devices, snap.TakenAt)
+	s.updateRegistry(cfg.Registry, devices, snap.TakenAt)
+	if softened {
+		// Diff the next normal scan against the last one before the VPN.
+		s.emitScanCompleted(snap)
+	} else {
+		s.emitDeviceEvents(s.eventBaseline, snap)
+		s.eventBaseline = snap
+	}
+
+	if resolutionFailures > 0 {
+		s.logf("resolution failed for %d devices", resolutionFailures)
 	}
+	errorLog.Flush()
 }
 
-func recordMetrics() {
-	go func() {
-		for {
-			// CPU
-			percent, err := cpu.Percent(0, false)
-			if err == nil && len(percent) > 0 {
-				cpuUsage.Set(percent[0])
-			}
+// sampleSystem reads CPU and memory usage; fields stay zero when their
+// source fails.
+func sampleSystem() (sys SystemSnapshot, cpuOK, memOK bool) {
+	sys.TakenAt = time.Now()
 
-			// Memory
-			v, err := mem.VirtualMemory()
-			if err == nil {
-				memoryUsage.Set(v.UsedPercent)
-				totalMemory.Set(float64(v.Total))
-				usedMemory.Set(float64(v.Used))
-			}
+	// CPU
+	sys.CPUPercent, sys.CPUCorePercent, cpuOK = systemCPU.sample()
+
+	// Memory
+	v, err := mem.VirtualMemory()
+	if err == nil {
+		sys.MemoryPercent = v.UsedPercent
+		sys.MemoryTotal = v.Total
+		sys.MemoryUsed = v.Used
+		memOK = true
+	}
+	return sys, cpuOK, memOK
+}
 
-			time.Sleep(5 * time.Second)
+// percentToRatio converts a 0-100 percentage into a 0-1 ratio, the unit
+// Prometheus conventions prefer.
+func percentToRatio(percent float64) float64 {
+	return percent / 100
+}
+
+// systemInterval is how often systemLoop samples CPU and memory.
+const systemInterval = 5 * time.Second
+
+// systemLoop samples CPU and memory every systemInterval. A failed source
+// keeps its previous values.
+func systemLoop(ctx context.Context) error {
+	for {
+		sys, cpuOK, memOK := sampleSystem()
+		prev := currentSystem()
+		if !cpuOK {
+			sys.CPUPercent = prev.CPUPercent
 		}
-	}()
+		if sys.CPUCorePercent == nil {
+			sys.CPUCorePercent = prev.CPUCorePercent
+		}
+		if !memOK {
+			sys.MemoryPercent, sys.MemoryTotal, sys.MemoryUsed = prev.MemoryPercent, prev.MemoryTotal, prev.MemoryUsed
+		}
+		publishSystem(sys)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(systemInterval):
+		}
+	}
+}
+
+func configHash(configPath string) string {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// configHandler serves the effective config (keyed like config.yaml) and
+// the feature set of this binary.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	generic, err := configAsMap(cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"config": generic,
+		"features": map[string][]string{
+			"enabled":  enabledFeatures(),
+			"disabled": disabledFeatures(),
+		},
+	})
 }
 
 func main() {
-	recordMetrics()
-	go func() {
-		for {
-			scanAndUpdateMetrics()
-			time.Sleep(30 * time.Second) // Re-scan every 30 seconds
+	log.SetOutput(io.MultiWriter(os.Stderr, recentLogs))
+	if len(os.Args) > 2 && os.Args[1] == "oui" && os.Args[2] == "update" {
+		if err := runOUIUpdate(os.Args[3:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfigCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "devices" {
+		os.Exit(runDevicesCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "store" {
+		os.Exit(runStoreCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Exit(runDoctor())
+	}
+	if len(os.Args) > 1 && strings.TrimLeft(os.Args[1], "-") == "agent" {
+		os.Exit(runAgent(os.Args[1:]))
+	}
+	// A one-off scan shares the whole startup below, up to the metrics.
+	var once *scanOnceOptions
+	if len(os.Args) > 1 && (os.Args[1] == "scan" || strings.TrimLeft(os.Args[1], "-") == "once") {
+		opts, err := parseScanOnceArgs(os.Args[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		once = &opts
+	}
+
+	loadOUICache()
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		log.Println("Error loading config:", err)
+	}
+	configureLogging(cfg.Log)
+	configureEventBuffer(cfg.HTTP.Events)
+	if errs := validateScanners(cfg); len(errs) > 0 {
+		log.Fatal("Invalid config: ", errs[0])
+	}
+	// Every scanner gets an even share of network.concurrency, so the
+	// probe goroutines and subprocesses of all of them stay within it.
+	names := cfg.scannerNames()
+	scanCfgs := make([]Config, len(names))
+	for i, name := range names {
+		s := newScanner(name, scannerShare(cfg.Network.concurrency(), len(names)))
+		if scanCfgs[i], err = cfg.scannerConfig(name, parseConfig); err != nil {
+			log.Fatal("Invalid config: ", err)
+		}
+		if err := s.setup(scanCfgs[i]); err != nil {
+			log.Fatal("Invalid config: ", s.prefix(err.Error()))
 		}
+		scanners = append(scanners, s)
+	}
+
+	if err := validateComponents(cfg.Components); err != nil {
+		log.Fatal("Invalid config: ", err)
+	}
+	if err := cfg.Uplink.validate(); err != nil {
+		log.Fatal("Invalid config: ", err)
+	}
+	if err := cfg.EventLog.validate(); err != nil {
+		log.Fatal("Invalid config: ", err)
+	}
+	if err := cfg.Tracing.validate(); err != nil {
+		log.Fatal("Invalid config: ", err)
+	}
+	if err := cfg.OTLP.validate(); err != nil {
+		log.Fatal("Invalid config: ", err)
+	}
+	if err := cfg.PowerSave.validate(); err != nil {
+		log.Fatal("Invalid config: ", err)
+	}
+	if err := cfg.CPU.validate(); err != nil {
+		log.Fatal("Invalid config: ", err)
+	}
+	if err := cfg.Metrics.validate(); err != nil {
+		log.Fatal("Invalid config: ", err)
+	}
+	systemCPU.setWindow(cfg.CPU.SampleWindow)
+	for i, s := range scanners {
+		if err := s.loadRegistry(scanCfgs[i].Registry); err != nil {
+			// Starting empty would overwrite the file with the first scan.
+			log.Fatalf("Error reading the device registry: %v (move registry.state_file away to start over)", s.prefix(err.Error()))
+		}
+	}
+
+	// Everything is served from this registry, with the Go runtime and
+	// process metrics the default one would have. With a site, the
+	// exporter's own metrics carry it as a label so several sites can
+	// share one Prometheus.
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	var reg prometheus.Registerer = registry
+	var siteLabels prometheus.Labels
+	if cfg.Uplink.Site != "" {
+		siteLabels = prometheus.Labels{"site": cfg.Uplink.Site}
+		reg = prometheus.WrapRegistererWith(siteLabels, reg)
+	}
+	metrics := NewMetrics(reg, cfg.Metrics.Namespace)
+	metrics.ProcessStartTime.SetToCurrentTime()
+	for _, s := range scanners {
+		s.m = metrics.forScanner(reg, s)
+	}
+	if once != nil {
+		os.Exit(runScanOnce(*once))
+	}
+	if cfg.EventLog.enabled() {
+		// Created before the first event so exporter_started is written.
+		eventLog = newEventLogWriter(metrics, cfg.EventLog)
+		registerFeature("event_log", true)
+	}
+	if cfg.Tracing.enabled() {
+		tracer = newTraceExporter(metrics, cfg.Tracing)
+		registerFeature("tracing", true)
+		log.Printf("Exporting scan traces to %s", cfg.Tracing.Endpoint)
+	}
+	registerFeature("otlp", cfg.OTLP.enabled())
+
+	metricsOpts := promhttp.HandlerOpts{
+		Timeout: cfg.HTTP.requestTimeout(),
+		// Exemplars are only exposed in OpenMetrics; without tracing
+		// there are none, and the classic format is kept.
+		EnableOpenMetrics: cfg.Tracing.enabled(),
+	}
+	legacy, _ := legacyNames(metrics.namespace)
+	http.Handle("/metrics", promhttp.InstrumentMetricHandler(
+		registry,
+		staleMetricsHandler(promhttp.HandlerFor(withoutFamilies(registry, legacy), metricsOpts),
+			metrics.namespace, siteLabels, cfg.HTTP.MetricsCache),
+	))
+	http.Handle("GET /metrics/legacy", legacyMetricsHandler(metrics, registry, metricsOpts))
+	http.Handle("GET /metrics/filtered", filteredMetricsHandler(withoutFamilies(registry, legacy), metricsOpts))
+	var pusher *metricsPusher
+	if cfg.OTLP.enabled() {
+		if pusher, err = newMetricsPusher(metrics, cfg.OTLP, withoutFamilies(registry, legacy)); err != nil {
+			log.Fatal("Invalid config: ", err)
+		}
+		log.Printf("Pushing metrics to %s every %s", cfg.OTLP.Endpoint, cfg.OTLP.interval())
+	}
+	http.Handle("/status", withTimeout(http.HandlerFunc(statusHandler), cfg.HTTP))
+	http.Handle("/api/v1/config", withTimeout(http.HandlerFunc(configHandler), cfg.HTTP))
+	http.Handle("/api/v1/devices", withTimeout(http.HandlerFunc(devicesHandler), cfg.HTTP))
+	http.Handle("GET /api/v1/devices/{mac}", withTimeout(http.HandlerFunc(deviceHandler), cfg.HTTP))
+	http.Handle("GET /api/v1/inventory", withTimeout(http.HandlerFunc(inventoryHandler), cfg.HTTP))
+	http.Handle("GET /api/v1/debug/scan-dump", withTimeout(http.HandlerFunc(scanDumpHandler), cfg.HTTP))
+	http.Handle("POST /api/v1/debug/bundle", withTimeout(bundleHandler(cfg.Debug, registry), cfg.HTTP))
+	http.Handle("GET /api/v1/grafana/dashboard", withTimeout(grafanaDashboardHandler(metrics.namespace, registry), cfg.HTTP))
+	http.Handle("GET /api/v1/version", withTimeout(http.HandlerFunc(versionHandler), cfg.HTTP))
+	http.Handle("GET /api/v1/schema/{type}", withTimeout(http.HandlerFunc(schemaHandler), cfg.HTTP))
+	http.Handle("GET /api/v1/summary", withTimeout(http.HandlerFunc(summaryHandler), cfg.HTTP))
+	http.Handle("GET /api/v1/stats/timeseries", withTimeout(http.HandlerFunc(timeseriesHandler), cfg.HTTP))
+	http.Handle("GET /api/v1/stats/cohorts", withTimeout(http.HandlerFunc(cohortsHandler), cfg.HTTP))
+	http.Handle("GET /api/v1/scans", withTimeout(http.HandlerFunc(scansHandler), cfg.HTTP))
+	http.Handle("GET /api/v1/scanners", withTimeout(http.HandlerFunc(scannersHandler), cfg.HTTP))
+	http.Handle("GET /api/v1/scans/latest/full", withTimeout(http.HandlerFunc(scanResultHandler), cfg.HTTP))
+	http.Handle("GET /api/v1/events", withTimeout(http.HandlerFunc(eventsHandler), cfg.HTTP))
+	if cfg.HTTP.Ingest.Token != "" {
+		store := newAgentStore(cfg.HTTP.Ingest)
+		reg.MustRegister(newAgentCollector(metrics.namespace, store))
+		registerFeature("agent_ingest", true)
+		http.Handle("POST /api/v1/ingest", withTimeout(ingestHandler(metrics, store, cfg.HTTP.Ingest), cfg.HTTP))
+	}
+	if cfg.Admin.enabled() {
+		http.Handle("/admin/rules", withBasicAuth(withTimeout(http.HandlerFunc(rulesHandler), cfg.HTTP), cfg.Admin))
+		http.Handle("POST /admin/devices/import", withBasicAuth(withTimeout(http.HandlerFunc(devicesImportHandler), cfg.HTTP), cfg.Admin))
+		http.Handle("DELETE /api/v1/devices", withBasicAuth(withTimeout(devicesPruneHandler(), cfg.HTTP), cfg.Admin))
+	}
+	// Long-lived streams, not wrapped in the request timeout.
+	http.Handle("GET /api/v1/ws", websocketHandler(cfg.HTTP.WebSocket))
+	http.Handle("GET /api/v1/events/stream", eventStreamHandler(cfg.HTTP.WebSocket))
+
+	ctx, stop := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		emitEvent("exporter_stopping", map[string]interface{}{"reason": sig.String()})
+		stop()
 	}()
 
-	http.Handle("/metrics", promhttp.Handler())
+	// The server waits for the first scan of every scanner.
+	firstScan := make(chan struct{})
+	var firstScans sync.WaitGroup
+	firstScans.Add(len(scanners))
+	go func() {
+		firstScans.Wait()
+		close(firstScan)
+	}()
+	components := []component{
+		{"server", func(ctx context.Context) error {
+			if cfg.Scan.BlockStartup {
+				awaitFirstScan(ctx, firstScan, cfg.Scan.startupTimeout())
+			} else {
+				log.Println("Serving before the first scan finished (scan.block_startup: false)")
+			}
+			return serve(ctx, &http.Server{Addr: ":2112"})
+		}},
+		{"system", func(ctx context.Context) error { return systemLoop(ctx) }},
+	}
+	for i, s := range scanners {
+		scanCfg := scanCfgs[i]
+		var first sync.Once
+		components = append(components, component{s.component("scanner"), func(ctx context.Context) error {
+			return s.scanLoop(ctx, func() { first.Do(firstScans.Done) })
+		}})
+		sshDevices := 0
+		for _, d := range scanCfg.Devices {
+			if d.SSH != nil {
+				sshDevices++
+			}
+		}
+		if sshDevices > 0 && !scanCfg.Enrichment.Enabled {
+			s.logf("Ignoring the ssh entries of %d devices: SSH enrichment needs enrichment.enabled", sshDevices)
+		}
+		if scanCfg.Enrichment.Enabled {
+			s.enrichment = newEnrichScheduler(s, scanCfg.Enrichment)
+			registerFeature("enrichment", true)
+			if sshDevices > 0 {
+				registerFeature("ssh_enrichment", true)
+			}
+			components = append(components, component{s.component("enrichment"), func(ctx context.Context) error {
+				return enrichmentLoop(ctx, s.enrichment)
+			}})
+		}
+		components = append(components, component{s.component("dns"), func(ctx context.Context) error {
+			return s.dnsHealthLoop(ctx, scanCfg.DNS)
+		}})
+		if scanCfg.DHCP.Sniff {
+			registerFeature("dhcp_sniff", true)
+			components = append(components, component{s.component("dhcp"), func(ctx context.Context) error {
+				return s.dhcpSniffLoop(ctx)
+			}})
+		}
+	}
+	if cfg.Uplink.enabled() {
+		registerFeature("uplink", true)
+		log.Printf("Reporting site %s to %s every %s", cfg.Uplink.Site, cfg.Uplink.URL, cfg.Uplink.interval())
+		components = append(components, component{"uplink", func(ctx context.Context) error {
+			return uplinkLoop(ctx, metrics, cfg.Uplink)
+		}})
+	}
+	if cfg.UserMetrics.Enabled {
+		registerFeature("user_metrics", true)
+		reg.MustRegister(newUserCollector(metrics.namespace))
+		components = append(components, component{"user_metrics", func(ctx context.Context) error {
+			return userMetricsLoop(ctx, cfg.UserMetrics)
+		}})
+	}
+	if sources := cfg.HostMetrics.hostSources(metrics.namespace); len(sources) > 0 {
+		registerFeature("host_metrics", true)
+		reg.MustRegister(hostCollector{sources})
+		log.Printf("Collecting host metrics: %s", hostSourceNames(sources))
+		components = append(components, component{"host_metrics", func(ctx context.Context) error {
+			return hostMetricsLoop(ctx, sources, cfg.HostMetrics.interval())
+		}})
+	}
+	// The firewall is read on this host even with a remote runner: peers
+	// probing this machine are what stealth mode gets in the way of.
+	if runtime.GOOS == "darwin" {
+		registerFeature("firewall", true)
+		reg.MustRegister(newFirewallCollector(metrics.namespace))
+		components = append(components, component{"firewall", firewallLoop})
+	}
+	if eventLog != nil {
+		components = append(components, component{"event_log", func(ctx context.Context) error {
+			return eventLogLoop(ctx, eventLog)
+		}})
+	}
+	if tracer != nil {
+		components = append(components, component{"tracing", func(ctx context.Context) error {
+			return traceExportLoop(ctx, tracer)
+		}})
+	}
+	if pusher != nil {
+		components = append(components, component{"otlp", func(ctx context.Context) error {
+			return otlpPushLoop(ctx, pusher)
+		}})
+	}
+	// Every feature main enables is registered by now.
+	registerFeaturesInfo(reg, metrics.namespace)
+	emitEvent("exporter_started", map[string]interface{}{
+		"version":     version,
+		"config_hash": configHash(cfgPath),
+		"features":    enabledFeatures(),
+	})
+	err = runComponents(ctx, metrics, cfg.Components, components)
+	if err != nil {
+		emitEvent("exporter_stopping", map[string]interface{}{"reason": "component_failed", "error": err.Error()})
+		log.Fatal(err)
+	}
+}
+
+// scanLoop re-scans every 30 seconds (longer in power save), or sooner when a scan is requested,
+// and calls scanned after every scan; the caller makes a restarted scanner
+// count its first scan only once.
+func (s *scanner) scanLoop(ctx context.Context, scanned func()) error {
+	cause := scanCausePeriodic
+	for {
+		s.scanAndUpdateMetrics(cause)
+		scanned()
+		timer := time.NewTimer(currentScanPause())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+			cause = scanCausePeriodic
+		case cause = <-s.requests:
+			timer.Stop()
+		}
+	}
+}
 
-	log.Println("Starting metrics server at :2112/metrics")
-	log.Fatal(http.ListenAndServe(":2112", nil))
+// awaitFirstScan waits for the first scan, but never longer than timeout,
+// so a broken network cannot keep the exporter from serving.
+func awaitFirstScan(ctx context.Context, firstScan <-chan struct{}, timeout time.Duration) {
+	log.Printf("Waiting up to %s for the first scan before serving (scan.block_startup: true)", timeout)
+	start := time.Now()
+	select {
+	case <-firstScan:
+		log.Printf("First scan finished after %s", time.Since(start).Truncate(time.Millisecond))
+	case <-time.After(timeout):
+		log.Printf("First scan did not finish within %s; serving anyway", timeout)
+	case <-ctx.Done():
+	}
+}
+
+// serve runs the HTTP server until ctx is cancelled, then shuts it down
+// gracefully.
+func serve(ctx context.Context, server *http.Server) error {
+	errs := make(chan error, 1)
+	go func() {
+		log.Println("Starting metrics server at :2112/metrics")
+		errs <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println("Error shutting down metrics server:", err)
+	}
+	return nil
 }
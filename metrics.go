@@ -0,0 +1,553 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsConfig sets how the exporter's metrics are named.
+type MetricsConfig struct {
+	// Namespace is prepended to every metric name, e.g. "home" exports
+	// home_wifi_connected_devices, for several exporters sharing one
+	// Prometheus. The Go runtime and process metrics keep their names.
+	Namespace string `yaml:"namespace"`
+}
+
+var namespacePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func (c MetricsConfig) validate() error {
+	if c.Namespace != "" && !namespacePattern.MatchString(c.Namespace) {
+		return fmt.Errorf("metrics.namespace %q is not a valid metric name prefix", c.Namespace)
+	}
+	return nil
+}
+
+// Metrics holds every metric the exporter updates directly: the
+// process-wide ones, and the scan metrics of one scanner. NewMetrics
+// registers the process-wide metrics on the given registry, and
+// forScanner a set of scan metrics per scanner, so tests can build an
+// independent set per case.
+type Metrics struct {
+	namespace string
+
+	*processMetrics
+	*scanMetrics
+}
+
+// processMetrics are shared by every scanner.
+type processMetrics struct {
+	ProcessStartTime      prometheus.Gauge
+	TracesDropped         prometheus.Counter
+	LegacyScrapes         prometheus.Counter
+	EventLogDropped       prometheus.Counter
+	EventLogErrors        prometheus.Counter
+	ScanEffectiveInterval prometheus.Gauge
+	PowerSource           *prometheus.GaugeVec
+	BatteryPercent        prometheus.Gauge
+	PowerSave             prometheus.Gauge
+	ComponentRestarts     *prometheus.CounterVec
+	IngestRejected        *prometheus.CounterVec
+	UplinkReports         *prometheus.CounterVec
+	OTLPExports           *prometheus.CounterVec
+	UplinkLastSuccess     prometheus.Gauge
+}
+
+// scanMetrics are kept per scanner, with its name as the scanner label.
+type scanMetrics struct {
+	LastScanID               prometheus.Gauge
+	LastScanTimestamp        prometheus.Gauge
+	ScanDuration             prometheus.Histogram
+	ScanInterval             prometheus.Summary
+	ScanIntervalHistogram    prometheus.Histogram
+	ScansTriggered           *prometheus.CounterVec
+	ScansSkipped             *prometheus.CounterVec
+	ScanErrors               *prometheus.CounterVec
+	ClockSteps               prometheus.Counter
+	ScanCoverageAge          prometheus.Gauge
+	ScanStageDuration        *prometheus.HistogramVec
+	ScanPhaseDevices         *prometheus.GaugeVec
+	NeighborTableUnavailable prometheus.Gauge
+	NeighborChurn            *prometheus.CounterVec
+	SightingGap              prometheus.Histogram
+	HostnameOrigins          *prometheus.CounterVec
+	SelfIPConflict           prometheus.Gauge
+	SubnetMismatch           *prometheus.GaugeVec
+	SelfIPChanges            prometheus.Counter
+	SelfTestOK               *prometheus.GaugeVec
+	RTTSLOBreaches           *prometheus.CounterVec
+	RTTSLOBreach             *prometheus.GaugeVec
+	IPViolation              *prometheus.GaugeVec
+	DHCPPackets              *prometheus.CounterVec
+	CohortFirstSeen          *prometheus.GaugeVec
+	CohortRetained           *prometheus.GaugeVec
+	DevicesDiscovered        prometheus.Counter
+	DevicesDelta             prometheus.Gauge
+	DevicesRate              prometheus.Gauge
+	ScanResultAnomaly        prometheus.Gauge
+	EnrichmentQueueDepth     prometheus.Gauge
+	EnrichmentDuration       *prometheus.HistogramVec
+	EnrichmentFailures       *prometheus.CounterVec
+	HostnameLabelSuppressed  *prometheus.CounterVec
+	HostnameUnstableDevices  prometheus.Gauge
+	VPNActive                prometheus.Gauge
+	CaptivePortal            prometheus.Gauge
+	DNSServerUp              *prometheus.GaugeVec
+	DNSResponseTime          *prometheus.HistogramVec
+	DNSServfails             *prometheus.CounterVec
+	DNSTimeouts              *prometheus.CounterVec
+}
+
+func NewMetrics(reg prometheus.Registerer, namespace string) *Metrics {
+	m := &Metrics{namespace: namespace, processMetrics: &processMetrics{
+		ProcessStartTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "telemetry_process_start_time_seconds",
+			Help:      "Start time of the exporter process since unix epoch in seconds",
+		}),
+		TracesDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "telemetry_traces_dropped_total",
+			Help:      "Scan traces not exported because the queue was full or the collector failed",
+		}),
+		LegacyScrapes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "telemetry_legacy_endpoint_scrapes_total",
+			Help:      "Scrapes of /metrics/legacy, which serves the deprecated metric names",
+		}),
+		EventLogDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "telemetry_event_log_dropped_total",
+			Help:      "Events dropped from a full event_log queue, oldest first",
+		}),
+		EventLogErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "telemetry_event_log_errors_total",
+			Help:      "Failed opens, writes, rotations and syncs of the event_log file",
+		}),
+		ScanEffectiveInterval: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "telemetry_scan_effective_interval_seconds",
+			Help:      "Pause before the next periodic scan: 30s, stretched by power_save.interval_factor while saving battery",
+		}),
+		PowerSource: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "telemetry_power_source",
+				Help:      "1 for the power source this host currently runs on (ac, battery or unknown), 0 for the others",
+			},
+			[]string{"source"},
+		),
+		BatteryPercent: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "telemetry_power_battery_percent",
+			Help:      "Battery charge of this host (0-100), -1 without a battery",
+		}),
+		PowerSave: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "telemetry_power_save_active",
+			Help:      "1 while scanning is backed off and enrichment held because of a low battery (power_save)",
+		}),
+		ComponentRestarts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "telemetry_component_restarts_total",
+				Help:      "Restarts of a failed component (components.<name>.restart: always)",
+			},
+			[]string{"component"},
+		),
+		IngestRejected: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "telemetry_ingest_rejected_total",
+				Help:      "Agent pushes rejected by /api/v1/ingest, by reason",
+			},
+			[]string{"reason"},
+		),
+		UplinkReports: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "telemetry_uplink_reports_total",
+				Help:      "Site summaries for the uplink by result (ok, error, oversize)",
+			},
+			[]string{"result"},
+		),
+		OTLPExports: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "telemetry_otlp_exports_total",
+				Help:      "Metric pushes to the OTLP collector by result (ok, error)",
+			},
+			[]string{"result"},
+		),
+		UplinkLastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "telemetry_uplink_last_success_timestamp_seconds",
+			Help:      "Time the uplink last accepted a site summary since unix epoch in seconds",
+		}),
+	}}
+
+	reg.MustRegister(
+		m.ProcessStartTime,
+		m.TracesDropped,
+		m.LegacyScrapes,
+		m.EventLogDropped,
+		m.EventLogErrors,
+		m.ScanEffectiveInterval,
+		m.PowerSource,
+		m.BatteryPercent,
+		m.PowerSave,
+		m.ComponentRestarts,
+		m.IngestRejected,
+		m.UplinkReports,
+		m.OTLPExports,
+		m.UplinkLastSuccess,
+		newSystemCollector(namespace),
+		newSubprocessCollector(namespace),
+	)
+	return m
+}
+
+// forScanner returns the metrics of s: the process-wide metrics of m and
+// a set of scan metrics of its own, registered on reg with a scanner
+// label unless s is the single unnamed scanner.
+func (m *Metrics) forScanner(reg prometheus.Registerer, s *scanner) *Metrics {
+	if s.name != "" {
+		reg = prometheus.WrapRegistererWith(prometheus.Labels{"scanner": s.name}, reg)
+	}
+	namespace := m.namespace
+	sm := &Metrics{namespace: namespace, processMetrics: m.processMetrics, scanMetrics: &scanMetrics{
+		LastScanID: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "telemetry_last_scan_id",
+			Help:      "ID of the scan the current device metrics come from (scan_id in the API and events)",
+		}),
+		LastScanTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "telemetry_last_scan_timestamp_seconds",
+			Help:      "Time the last scan was published since unix epoch in seconds",
+		}),
+		ScanDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "telemetry_scan_duration_seconds",
+			Help:      "Duration of whole scans in seconds; with tracing, exemplars carry the scan's trace_id",
+			Buckets:   prometheus.ExponentialBuckets(0.5, 2, 8),
+		}),
+		ScanInterval: prometheus.NewSummary(prometheus.SummaryOpts{
+			Namespace: namespace,
+			Name:      "telemetry_scan_interval_seconds",
+			Help:      "Time between consecutive scan starts over the last hour; quantile 0 and 1 are the minimum and maximum",
+			// Quantiles 0 and 1 are exact; the sum and count give the
+			// average.
+			Objectives: map[float64]float64{0: 0, 0.5: 0.05, 0.9: 0.01, 0.99: 0.001, 1: 0},
+			MaxAge:     time.Hour,
+		}),
+		ScanIntervalHistogram: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "telemetry_scan_start_interval_seconds",
+			Help:      "Time between consecutive scan starts",
+			Buckets:   []float64{15, 30, 35, 45, 60, 90, 120, 300, 600},
+		}),
+		ScansTriggered: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "telemetry_scans_total",
+				Help:      "Scans started, by what triggered them",
+			},
+			[]string{"cause"},
+		),
+		ScansSkipped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "telemetry_scans_skipped_total",
+				Help:      "Scans not started because the previous one was still running, by cause",
+			},
+			[]string{"cause"},
+		),
+		ScanErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "telemetry_scan_errors_total",
+				Help:      "Failed probes and neighbor table reads, by class (permission, timeout, unavailable, parse, other); timeouts include every address nobody answers on",
+			},
+			[]string{"class"},
+		),
+		ClockSteps: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "telemetry_clock_steps_total",
+			Help:      "Wall-clock steps (e.g. NTP corrections) of more than 2s seen between scans",
+		}),
+		ScanCoverageAge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "telemetry_scan_coverage_age_seconds",
+			Help:      "Seconds since every address in the scan range was last probed",
+		}),
+		ScanStageDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "telemetry_scan_stage_duration_seconds",
+				Help:      "Duration of each scan pipeline stage in seconds",
+				Buckets:   []float64{.001, .01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+			},
+			[]string{"stage"},
+		),
+		ScanPhaseDevices: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "telemetry_scan_phase_devices",
+				Help:      "Devices found first by each probe phase (broadcast, unicast) in the last scan",
+			},
+			[]string{"phase"},
+		),
+		NeighborTableUnavailable: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "telemetry_neighbor_table_unavailable",
+			Help:      "1 if probes were answered but the neighbor table came back empty",
+		}),
+		NeighborChurn: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "network_neighbor_table_churn_total",
+				Help:      "Neighbor table entries added, removed or changed to another MAC between consecutive scans",
+			},
+			[]string{"interface", "change"},
+		),
+		SightingGap: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "wifi_device_sighting_gap_seconds",
+			Help:      "Time between consecutive sightings of the same device",
+			Buckets:   []float64{30, 60, 120, 300, 900, 1800, 3600, 4 * 3600, 12 * 3600, 24 * 3600},
+		}),
+		HostnameOrigins: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "telemetry_hostname_resolutions_total",
+				Help:      "Hostnames resolved, by origin (resolver = our own chain, os = the arp tool)",
+			},
+			[]string{"origin"},
+		),
+		SelfIPConflict: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "network_self_ip_conflict",
+			Help:      "1 if another device answers ARP for this host's own address",
+		}),
+		SubnetMismatch: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "telemetry_config_subnet_mismatch",
+				Help:      "1 if the configured scan range overlaps none of the subnets of its interface (actual), 0 if it matches",
+			},
+			[]string{"configured", "actual"},
+		),
+		SelfIPChanges: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "network_self_ip_changes_total",
+			Help:      "Changes of this host's address on the scanned network",
+		}),
+		SelfTestOK: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "telemetry_selftest_ok",
+				Help:      "1 if the sentinel device passed every expectation in the last scan; reason names the failed one",
+			},
+			[]string{"sentinel", "reason"},
+		),
+		RTTSLOBreaches: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "wifi_device_rtt_slo_breaches_total",
+				Help:      "Scans in which the device's round-trip time exceeded its rtt_slo_ms",
+			},
+			[]string{"mac"},
+		),
+		RTTSLOBreach: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "wifi_device_rtt_slo_breach",
+				Help:      "1 if the device's last round-trip time exceeded its rtt_slo_ms",
+			},
+			[]string{"mac"},
+		),
+		IPViolation: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "wifi_device_ip_violation",
+				Help:      "1 while a device with an expected_ip was last seen at a different address",
+			},
+			[]string{"mac"},
+		),
+		DHCPPackets: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "telemetry_dhcp_packets_total",
+				Help:      "DHCP client broadcasts heard by dhcp.sniff, by type (discover, request, other, invalid)",
+			},
+			[]string{"type"},
+		),
+		CohortFirstSeen: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "wifi_devices_first_seen",
+				Help:      "Devices first seen within the window",
+			},
+			[]string{"window"},
+		),
+		CohortRetained: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "wifi_devices_first_seen_retained_ratio",
+				Help:      "Share of the devices first seen within the window that were online in the last scan",
+			},
+			[]string{"window"},
+		),
+		DevicesDiscovered: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "wifi_devices_discovered_total",
+			Help:      "Devices seen for the first time; with registry.state_file, first ever rather than since startup",
+		}),
+		DevicesDelta: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "wifi_devices_delta",
+			Help:      "Change in the device count since the previous trustworthy scan",
+		}),
+		DevicesRate: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "wifi_devices_rate_per_hour",
+			Help:      "Exponentially smoothed rate of change of the device count per hour",
+		}),
+		ScanResultAnomaly: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "telemetry_scan_result_anomaly",
+			Help:      "1 if the last scan found far fewer devices than the recent average (anomaly.shrink_percent)",
+		}),
+		EnrichmentQueueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "telemetry_enrichment_queue_depth",
+			Help:      "Device enrichment jobs waiting in the scheduler queue",
+		}),
+		EnrichmentDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "telemetry_enrichment_duration_seconds",
+				Help:      "Duration of device enrichment lookups by enricher",
+				Buckets:   []float64{.001, .01, .05, .1, .25, .5, 1, 2.5, 5},
+			},
+			[]string{"enricher"},
+		),
+		EnrichmentFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "telemetry_enrichment_failures_total",
+				Help:      "Device enrichment lookups that failed or found nothing, by enricher",
+			},
+			[]string{"enricher"},
+		),
+		HostnameLabelSuppressed: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "telemetry_hostname_label_changes_suppressed_total",
+				Help:      "Hostname changes kept out of the hostname label, by reason (normalized, unconfirmed, unstable)",
+			},
+			[]string{"reason"},
+		),
+		HostnameUnstableDevices: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "telemetry_hostname_unstable_devices",
+			Help:      "Devices whose hostname label is frozen for changing names more than labels.hostname_max_changes_per_hour times an hour",
+		}),
+		VPNActive: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "network_vpn_active",
+			Help:      "1 if the default route goes through a VPN interface (network.vpn_interfaces)",
+		}),
+		CaptivePortal: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "network_captive_portal_detected",
+			Help:      "1 if network.captive_portal_url did not answer 204",
+		}),
+		DNSServerUp: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "network_dns_server_up",
+				Help:      "Whether the DNS server answered the last health query (1 = up, 0 = down)",
+			},
+			[]string{"server"},
+		),
+		DNSResponseTime: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "network_dns_response_seconds",
+				Help:      "Response time of DNS health queries in seconds",
+				Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+			},
+			[]string{"server"},
+		),
+		DNSServfails: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "network_dns_servfail_total",
+				Help:      "DNS health queries answered with SERVFAIL",
+			},
+			[]string{"server"},
+		),
+		DNSTimeouts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "network_dns_timeouts_total",
+				Help:      "DNS health queries that timed out",
+			},
+			[]string{"server"},
+		),
+	}}
+
+	reg.MustRegister(
+		sm.LastScanID,
+		sm.LastScanTimestamp,
+		sm.ScanDuration,
+		sm.ScanInterval,
+		sm.ScanIntervalHistogram,
+		sm.ScansTriggered,
+		sm.ScansSkipped,
+		sm.ScanErrors,
+		sm.ClockSteps,
+		sm.ScanCoverageAge,
+		sm.ScanStageDuration,
+		sm.ScanPhaseDevices,
+		sm.NeighborTableUnavailable,
+		sm.NeighborChurn,
+		sm.SightingGap,
+		sm.HostnameOrigins,
+		sm.SelfIPConflict,
+		sm.SubnetMismatch,
+		sm.SelfIPChanges,
+		sm.SelfTestOK,
+		sm.RTTSLOBreaches,
+		sm.RTTSLOBreach,
+		sm.IPViolation,
+		sm.DHCPPackets,
+		sm.CohortFirstSeen,
+		sm.CohortRetained,
+		sm.DevicesDiscovered,
+		sm.DevicesDelta,
+		sm.DevicesRate,
+		sm.ScanResultAnomaly,
+		sm.EnrichmentQueueDepth,
+		sm.EnrichmentDuration,
+		sm.EnrichmentFailures,
+		sm.HostnameLabelSuppressed,
+		sm.HostnameUnstableDevices,
+		sm.VPNActive,
+		sm.CaptivePortal,
+		sm.DNSServerUp,
+		sm.DNSResponseTime,
+		sm.DNSServfails,
+		sm.DNSTimeouts,
+		newDeviceCollector(namespace, s),
+		viewCollector{s},
+		newTrafficCollector(namespace, s),
+		newSummaryCollector(namespace, s),
+	)
+	return sm
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetricsPedanticRegistry(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		namespace string
+		scanners  []string
+	}{
+		{"single unnamed scanner", "", []string{""}},
+		{"two scanners", "", []string{"home", "lab"}},
+		{"namespaced", "lab", []string{"home", "lab"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			m := NewMetrics(reg, tc.namespace)
+			for _, name := range tc.scanners {
+				s := newScanner(name, 1)
+				s.m = m.forScanner(reg, s)
+				// Give the vectors a child each so they are gathered too.
+				s.m.ScanErrors.WithLabelValues(errClassTimeout).Inc()
+				s.m.DNSServerUp.WithLabelValues("192.168.1.1").Set(1)
+				s.publishScan(&ScanSnapshot{Devices: []Device{{IP: "192.168.1.2", MAC: "aa:bb:cc:dd:ee:01", DeviceType: "unknown"}}})
+			}
+			mfs, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("gather: %v", err)
+			}
+
+			want := prometheus.BuildFQName(tc.namespace, "", "telemetry_last_scan_id")
+			for _, mf := range mfs {
+				if mf.GetName() != want {
+					continue
+				}
+				if len(mf.Metric) != len(tc.scanners) {
+					t.Fatalf("%s has %d series, want one per scanner", want, len(mf.Metric))
+				}
+				for i, metric := range mf.Metric {
+					got := ""
+					for _, l := range metric.Label {
+						if l.GetName() == "scanner" {
+							got = l.GetValue()
+						}
+					}
+					if got != tc.scanners[i] {
+						t.Errorf("%s series %d has scanner %q, want %q", want, i, got, tc.scanners[i])
+					}
+				}
+				return
+			}
+			t.Errorf("no %s gathered", want)
+		})
+	}
+}
+
+func TestNewMetricsIsIndependent(t *testing.T) {
+	// Without registration in init, two sets register on their own
+	// registries side by side.
+	for range 2 {
+		reg := prometheus.NewPedanticRegistry()
+		NewMetrics(reg, "")
+		if _, err := reg.Gather(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
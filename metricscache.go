@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type MetricsCacheConfig struct {
+	// ServeStale answers a failed gather with the last good exposition
+	// instead of a 500. Off by default, so failures show up as target down.
+	ServeStale bool `yaml:"serve_stale"`
+	// MaxBytes bounds the cached exposition (default 8 MiB); larger ones
+	// are not cached.
+	MaxBytes int `yaml:"max_bytes"`
+	// MaxAge is how old the cached exposition may get before failures are
+	// passed through again (default 10m).
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+func (c MetricsCacheConfig) maxBytes() int {
+	if c.MaxBytes <= 0 {
+		return 8 << 20
+	}
+	return c.MaxBytes
+}
+
+func (c MetricsCacheConfig) maxAge() time.Duration {
+	if c.MaxAge <= 0 {
+		return 10 * time.Minute
+	}
+	return c.MaxAge
+}
+
+// metricsCache holds the last exposition gathered without error.
+type metricsCache struct {
+	mu          sync.Mutex
+	body        []byte
+	contentType string
+	takenAt     time.Time
+}
+
+// staleMetricsHandler wraps the /metrics handler with http.metrics_cache.
+// Responses are rendered in the text format without compression so the
+// cached body can be replayed to any scraper, with
+// telemetry_serving_stale_metrics appended as 0 or 1. constLabels are the
+// labels the registry wraps the exporter's own metrics with, such as site.
+func staleMetricsHandler(h http.Handler, namespace string, constLabels prometheus.Labels, cfg MetricsCacheConfig) http.Handler {
+	if !cfg.ServeStale {
+		return h
+	}
+	cache := &metricsCache{}
+	labels := exposedLabels(constLabels)
+	staleName := prometheus.BuildFQName(namespace, "", "telemetry_serving_stale_metrics")
+	takenName := prometheus.BuildFQName(namespace, "", "telemetry_stale_metrics_timestamp_seconds")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inner := r.Clone(r.Context())
+		inner.Header.Del("Accept")
+		inner.Header.Del("Accept-Encoding")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, inner)
+
+		now := time.Now()
+		if rec.Code == http.StatusOK {
+			cache.mu.Lock()
+			if rec.Body.Len() <= cfg.maxBytes() {
+				cache.body = append([]byte(nil), rec.Body.Bytes()...)
+				cache.contentType = rec.Header().Get("Content-Type")
+				cache.takenAt = now
+			} else {
+				// Logged on every skip, so serve_stale is never a silent
+				// no-op; the size is left out so the deduper collapses it.
+				errorLog.Printf("Metrics exposition exceeds http.metrics_cache.max_bytes (%d); not cached, so a failed gather cannot be served stale", cfg.maxBytes())
+				debugf("metrics exposition of %d bytes not cached", rec.Body.Len())
+				cache.body = nil
+			}
+			cache.mu.Unlock()
+			w.Header().Set("Content-Type", rec.Header().Get("Content-Type"))
+			w.Write(rec.Body.Bytes())
+			fmt.Fprintf(w, "# HELP %s Whether this response replays a cached exposition because gathering failed\n# TYPE %s gauge\n%s%s 0\n",
+				staleName, staleName, staleName, labels)
+			return
+		}
+
+		cause := strings.Join(strings.Fields(rec.Body.String()), " ")
+		cache.mu.Lock()
+		body, contentType, takenAt := cache.body, cache.contentType, cache.takenAt
+		cache.mu.Unlock()
+		if body == nil || now.Sub(takenAt) > cfg.maxAge() {
+			errorLog.Printf("Gathering metrics failed and no recent exposition is cached: %s", cause)
+			for k, v := range rec.Header() {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(rec.Code)
+			w.Write(rec.Body.Bytes())
+			return
+		}
+		errorLog.Printf("Gathering metrics failed, serving the exposition from %s: %s", takenAt.Format(time.RFC3339), cause)
+		w.Header().Set("Content-Type", contentType)
+		w.Write(body)
+		fmt.Fprintf(w, "# HELP %s Whether this response replays a cached exposition because gathering failed\n# TYPE %s gauge\n%s%s 1\n",
+			staleName, staleName, staleName, labels)
+		fmt.Fprintf(w, "# HELP %s When the replayed exposition was gathered\n# TYPE %s gauge\n%s%s %d\n",
+			takenName, takenName, takenName, labels, takenAt.Unix())
+	})
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// exposedLabels renders labels as the text format writes them after a
+// metric name, sorted by name: {site="lab"}, or nothing without labels.
+func exposedLabels(labels prometheus.Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, name+`="`+labelValueEscaper.Replace(value)+`"`)
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// flakyGatherer gathers reg until failing is set.
+type flakyGatherer struct {
+	reg     *prometheus.Registry
+	mu      sync.Mutex
+	failing bool
+}
+
+func (g *flakyGatherer) fail(failing bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.failing = failing
+}
+
+func (g *flakyGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.failing {
+		return nil, errors.New("collector broke")
+	}
+	return g.reg.Gather()
+}
+
+func newFlakyGatherer(t *testing.T) *flakyGatherer {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "wifi_test_devices", Help: "test"})
+	g.Set(3)
+	reg.MustRegister(g)
+	return &flakyGatherer{reg: reg}
+}
+
+// captureErrorLog replaces errorLog for the test and returns what it printed.
+func captureErrorLog(t *testing.T) func() []string {
+	t.Helper()
+	var mu sync.Mutex
+	var lines []string
+	saved := errorLog
+	errorLog = newLogDeduper(time.Hour, func(s string) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, s)
+	})
+	t.Cleanup(func() { errorLog = saved })
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), lines...)
+	}
+}
+
+func scrape(h http.Handler) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return rec
+}
+
+func TestStaleMetricsHandlerReplaysLastGoodExposition(t *testing.T) {
+	captureErrorLog(t)
+	g := newFlakyGatherer(t)
+	h := staleMetricsHandler(promhttp.HandlerFor(g, promhttp.HandlerOpts{}), "", nil, MetricsCacheConfig{ServeStale: true})
+
+	fresh := scrape(h)
+	if fresh.Code != http.StatusOK || !strings.Contains(fresh.Body.String(), "wifi_test_devices 3") ||
+		!strings.Contains(fresh.Body.String(), "telemetry_serving_stale_metrics 0\n") {
+		t.Fatalf("fresh scrape: %d %s", fresh.Code, fresh.Body)
+	}
+
+	g.fail(true)
+	stale := scrape(h)
+	body := stale.Body.String()
+	if stale.Code != http.StatusOK {
+		t.Fatalf("stale scrape: %d %s", stale.Code, body)
+	}
+	if !strings.Contains(body, "wifi_test_devices 3") {
+		t.Errorf("stale scrape does not replay the cached exposition:\n%s", body)
+	}
+	if !strings.Contains(body, "\ntelemetry_serving_stale_metrics 1\n") {
+		t.Errorf("stale scrape lacks the telemetry_serving_stale_metrics 1 trailer:\n%s", body)
+	}
+	if strings.Contains(body, "telemetry_serving_stale_metrics 0") {
+		t.Errorf("stale scrape replays the fresh trailer:\n%s", body)
+	}
+	if !strings.Contains(body, "telemetry_stale_metrics_timestamp_seconds ") {
+		t.Errorf("stale scrape lacks the exposition timestamp:\n%s", body)
+	}
+}
+
+func TestStaleMetricsHandlerPassesFailureWithoutCache(t *testing.T) {
+	captureErrorLog(t)
+	g := newFlakyGatherer(t)
+	g.fail(true)
+	h := staleMetricsHandler(promhttp.HandlerFor(g, promhttp.HandlerOpts{}), "", nil, MetricsCacheConfig{ServeStale: true})
+	if rec := scrape(h); rec.Code != http.StatusInternalServerError {
+		t.Errorf("got %d, want the gather failure passed through", rec.Code)
+	}
+}
+
+func TestStaleMetricsHandlerExpiresCache(t *testing.T) {
+	captureErrorLog(t)
+	g := newFlakyGatherer(t)
+	h := staleMetricsHandler(promhttp.HandlerFor(g, promhttp.HandlerOpts{}), "", nil, MetricsCacheConfig{ServeStale: true, MaxAge: time.Nanosecond})
+	scrape(h)
+	time.Sleep(time.Millisecond)
+	g.fail(true)
+	if rec := scrape(h); rec.Code != http.StatusInternalServerError {
+		t.Errorf("got %d, want the failure passed through once the cache is past max_age", rec.Code)
+	}
+}
+
+func TestStaleMetricsHandlerLogsOversizedExposition(t *testing.T) {
+	logged := captureErrorLog(t)
+	g := newFlakyGatherer(t)
+	h := staleMetricsHandler(promhttp.HandlerFor(g, promhttp.HandlerOpts{}), "", nil, MetricsCacheConfig{ServeStale: true, MaxBytes: 10})
+
+	// Nothing is cached yet, and the skip is still logged.
+	if rec := scrape(h); rec.Code != http.StatusOK {
+		t.Fatalf("scrape: %d", rec.Code)
+	}
+	lines := logged()
+	if len(lines) != 1 || !strings.Contains(lines[0], "exceeds http.metrics_cache.max_bytes (10)") {
+		t.Fatalf("logged %q, want one line about max_bytes", lines)
+	}
+
+	g.fail(true)
+	if rec := scrape(h); rec.Code != http.StatusInternalServerError {
+		t.Errorf("got %d, want the failure passed through, nothing was cached", rec.Code)
+	}
+}
+
+func TestStaleMetricsHandlerDisabled(t *testing.T) {
+	g := newFlakyGatherer(t)
+	inner := promhttp.HandlerFor(g, promhttp.HandlerOpts{})
+	h := staleMetricsHandler(inner, "", nil, MetricsCacheConfig{})
+	if rec := scrape(h); strings.Contains(rec.Body.String(), "telemetry_serving_stale_metrics") {
+		t.Errorf("serve_stale off still appends the trailer:\n%s", rec.Body)
+	}
+}
+
+func TestStaleMetricsHandlerSiteLabel(t *testing.T) {
+	captureErrorLog(t)
+	g := newFlakyGatherer(t)
+	site := prometheus.Labels{"site": `lab "b"`}
+	h := staleMetricsHandler(promhttp.HandlerFor(g, promhttp.HandlerOpts{}), "", site, MetricsCacheConfig{ServeStale: true})
+	fresh := scrape(h).Body.String()
+	g.fail(true)
+	stale := scrape(h).Body.String()
+	for _, tc := range []struct {
+		body, family string
+	}{
+		{fresh, "telemetry_serving_stale_metrics"},
+		{stale, "telemetry_serving_stale_metrics"},
+		{stale, "telemetry_stale_metrics_timestamp_seconds"},
+	} {
+		var p expfmt.TextParser
+		families, err := p.TextToMetricFamilies(strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatalf("%v:\n%s", err, tc.body)
+		}
+		mf := families[tc.family]
+		if mf == nil || len(mf.Metric) != 1 {
+			t.Fatalf("%s missing:\n%s", tc.family, tc.body)
+		}
+		labels := mf.Metric[0].GetLabel()
+		if len(labels) != 1 || labels[0].GetName() != "site" || labels[0].GetValue() != site["site"] {
+			t.Errorf("%s labels %v, want site=%q", tc.family, labels, site["site"])
+		}
+	}
+}
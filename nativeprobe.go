@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// Native probe modes, picked once from what this process is allowed to do.
+const (
+	probeModeICMP            = "icmp"              // raw socket: root or CAP_NET_RAW
+	probeModeICMPUnprivilege = "icmp_unprivileged" // ping socket: macOS, or Linux within net.ipv4.ping_group_range
+	probeModeTCP             = "tcp"               // connect probe, no privileges needed
+)
+
+// tcpProbePorts are tried in parallel by the TCP fallback; a refused
+// connection proves the host is up just as well as an accepted one.
+var tcpProbePorts = []string{"80", "443", "22", "445", "62078", "8080"}
+
+var (
+	probeModeOnce sync.Once
+	nativeMode    string
+	echoSeq       atomic.Uint32
+)
+
+func detectProbeMode() string {
+	probeModeOnce.Do(func() {
+		nativeMode = probeModeTCP
+		for _, candidate := range []struct{ mode, network string }{
+			{probeModeICMP, "ip4:icmp"},
+			{probeModeICMPUnprivilege, "udp4"},
+		} {
+			if conn, err := icmp.ListenPacket(candidate.network, "0.0.0.0"); err == nil {
+				conn.Close()
+				nativeMode = candidate.mode
+				break
+			}
+		}
+		log.Printf("Probing natively with %s", nativeMode)
+	})
+	return nativeMode
+}
+
+// probeHost checks one address: natively when scanning from this host, with
+// a ping command on a remote runner or when scan.ping_command is set.
+func (s *scanner) probeHost(ip, source string, cfg Config) (time.Duration, error) {
+	if _, ok := s.runner.(localRunner); !ok || cfg.Scan.PingCommand.enabled() {
+		return s.ping(ip, cfg)
+	}
+	timeout := cfg.Network.timeout()
+	if mode := detectProbeMode(); mode != probeModeTCP {
+		return s.icmpEcho(mode, ip, source, cfg.Scan.Interface, timeout)
+	}
+	return s.tcpProbe(ip, source, cfg.Scan.Interface, timeout)
+}
+
+// interfaceControl pins the sockets it is installed on to iface, as ping
+// -I does; a source address alone does not pick the egress interface on a
+// multi-homed host. It is nil without an interface.
+func interfaceControl(iface string) func(network, address string, c syscall.RawConn) error {
+	if iface == "" {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var bindErr error
+		if err := c.Control(func(fd uintptr) { bindErr = bindToInterface(fd, iface) }); err != nil {
+			return err
+		}
+		if bindErr != nil {
+			return &bindFailure{iface, bindErr}
+		}
+		return nil
+	}
+}
+
+// bindFailure is a socket that could not be pinned to its interface; the
+// probe fails with it rather than reporting the host down.
+type bindFailure struct {
+	iface string
+	err   error
+}
+
+func (e *bindFailure) Error() string { return fmt.Sprintf("bind to interface %s: %v", e.iface, e.err) }
+func (e *bindFailure) Unwrap() error { return e.err }
+
+// listenICMP opens the socket of an echo probe, sent from source and
+// pinned to iface when set.
+func listenICMP(mode, source, iface string) (net.PacketConn, error) {
+	network := "ip4:icmp"
+	if mode == probeModeICMPUnprivilege {
+		network = "udp4"
+	}
+	if source == "" {
+		source = "0.0.0.0"
+	}
+	switch {
+	case iface == "":
+		conn, err := icmp.ListenPacket(network, source)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	case mode == probeModeICMPUnprivilege:
+		// Ping sockets are not made by package net, so they get no
+		// Control hook.
+		return listenPingSocket(source, iface)
+	}
+	lc := net.ListenConfig{Control: interfaceControl(iface)}
+	return lc.ListenPacket(context.Background(), network, source)
+}
+
+func (s *scanner) icmpEcho(mode, ip, source, iface string, timeout time.Duration) (time.Duration, error) {
+	conn, err := listenICMP(mode, source, iface)
+	if err != nil {
+		return 0, classify(err)
+	}
+	defer conn.Close()
+
+	dstIP := net.ParseIP(ip)
+	var dst net.Addr = &net.IPAddr{IP: dstIP}
+	if mode == probeModeICMPUnprivilege {
+		dst = &net.UDPAddr{IP: dstIP}
+	}
+	// Ping sockets get their ID assigned by the kernel; raw sockets see
+	// every reply, so they also match on ours.
+	id := os.Getpid() & 0xffff
+	seq := int(echoSeq.Add(1) & 0xffff)
+	packet, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("telemetry-probe")},
+	}).Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	conn.SetDeadline(start.Add(timeout))
+	if _, err := conn.WriteTo(packet, dst); err != nil {
+		return 0, classify(err)
+	}
+	s.countSent(trafficICMP, 1, 20+len(packet))
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return 0, classified(ErrTimeout, fmt.Errorf("no echo reply within %s", timeout))
+			}
+			return 0, classify(err)
+		}
+		if peerIP(peer) != ip {
+			continue
+		}
+		msg, err := icmp.ParseMessage(ipv4.ICMPTypeEcho.Protocol(), buf[:n])
+		if err != nil || msg.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		echo, ok := msg.Body.(*icmp.Echo)
+		if !ok || echo.Seq != seq || mode == probeModeICMP && echo.ID != id {
+			continue
+		}
+		return time.Since(start), nil
+	}
+}
+
+func peerIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	return ""
+}
+
+// probeDialer is the dialer of the TCP probes: from source and pinned to
+// iface when they are set.
+func probeDialer(source, iface string, timeout time.Duration) *net.Dialer {
+	dialer := &net.Dialer{Timeout: timeout, Control: interfaceControl(iface)}
+	if source != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(source)}
+	}
+	return dialer
+}
+
+// tcpProbe connects to a few common ports at once and reports the host up
+// on the first accepted or refused connection.
+func (s *scanner) tcpProbe(ip, source, iface string, timeout time.Duration) (time.Duration, error) {
+	dialer := probeDialer(source, iface, timeout)
+	start := time.Now()
+	s.countSent(trafficTCP, len(tcpProbePorts), len(tcpProbePorts)*tcpSYNSize)
+	results := make(chan error, len(tcpProbePorts))
+	for _, port := range tcpProbePorts {
+		go func(port string) {
+			conn, err := dialer.Dial("tcp4", net.JoinHostPort(ip, port))
+			if err == nil {
+				conn.Close()
+			}
+			results <- err
+		}(port)
+	}
+	var bind *bindFailure
+	for range tcpProbePorts {
+		err := <-results
+		if err == nil || errors.Is(err, syscall.ECONNREFUSED) {
+			return time.Since(start), nil
+		}
+		if errors.As(err, &bind) {
+			return 0, classify(err)
+		}
+	}
+	return 0, classified(ErrTimeout, fmt.Errorf("no TCP answer on ports %v within %s", tcpProbePorts, timeout))
+}
+
+// probeSource is the address probes are sent from: scan.source_ip, or the
+// address scan.interface has in the scan range.
+func probeSource(cfg ScanConfig, r scanRange) string {
+	if cfg.SourceIP != "" || cfg.Interface == "" {
+		return cfg.SourceIP
+	}
+	ip, _, err := localAddress(cfg, r)
+	if err != nil {
+		debugf("probe source: %v", err)
+		return ""
+	}
+	return ip
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestProbeDialer(t *testing.T) {
+	for _, tc := range []struct {
+		name, source, iface string
+		control             bool
+	}{
+		{"defaults", "", "", false},
+		{"source only", "192.168.1.10", "", false},
+		{"interface", "", "eth1", true},
+		{"source and interface", "192.168.1.10", "eth1", true},
+	} {
+		d := probeDialer(tc.source, tc.iface, time.Second)
+		if (d.Control != nil) != tc.control {
+			t.Errorf("%s: control installed %v, want %v", tc.name, d.Control != nil, tc.control)
+		}
+		if got := d.LocalAddr != nil; got != (tc.source != "") {
+			t.Errorf("%s: local address %v", tc.name, d.LocalAddr)
+		}
+		if d.Timeout != time.Second {
+			t.Errorf("%s: timeout %s", tc.name, d.Timeout)
+		}
+	}
+	if interfaceControl("") != nil {
+		t.Error("a control function without an interface")
+	}
+}
+
+func TestTCPProbeBindFailure(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("probes are only pinned to an interface on Linux and macOS")
+	}
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	d := probeDialer("", "no-such-if0", time.Second)
+	conn, err := d.Dial("tcp4", net.JoinHostPort("127.0.0.1", port))
+	if err == nil {
+		conn.Close()
+		t.Fatal("dialed through an interface that does not exist")
+	}
+	var bind *bindFailure
+	if !errors.As(err, &bind) || bind.iface != "no-such-if0" {
+		t.Errorf("got %v, want a bind failure for no-such-if0", err)
+	}
+
+	s := newScanner("", 1)
+	if _, err := s.tcpProbe("127.0.0.1", "", "no-such-if0", time.Second); !errors.As(err, &bind) {
+		t.Errorf("probe through a missing interface: %v, want the bind failure rather than a timeout", err)
+	}
+}
+
+func TestTCPProbeBoundToLoopback(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("loopback is lo only on Linux")
+	}
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	conn, err := probeDialer("", "lo", time.Second).Dial("tcp4", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatalf("dial pinned to lo: %v", err)
+	}
+	conn.Close()
+}
+
+func TestListenICMPBound(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("loopback is lo only on Linux")
+	}
+	for _, mode := range []string{probeModeICMP, probeModeICMPUnprivilege} {
+		t.Run(mode, func(t *testing.T) {
+			conn, err := listenICMP(mode, "", "")
+			if err != nil {
+				t.Skipf("cannot open %s sockets here: %v", mode, err)
+			}
+			conn.Close()
+
+			var bind *bindFailure
+			if conn, err := listenICMP(mode, "", "no-such-if0"); !errors.As(err, &bind) {
+				if conn != nil {
+					conn.Close()
+				}
+				t.Errorf("missing interface: got %v, want a bind failure", err)
+			}
+			if _, err := newScanner("", 1).icmpEcho(mode, "127.0.0.1", "", "lo", time.Second); err != nil {
+				t.Errorf("echo pinned to lo: %v", err)
+			}
+		})
+	}
+}
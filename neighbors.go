@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+const unknownMAC = "unknown"
+
+// checkNeighborTable detects hosts answering pings while the neighbor
+// table is empty (typically a container without CAP_NET_ADMIN or access to
+// /proc/net/arp) and falls back to reporting the answering IPs with an
+// unknown MAC instead of an empty network.
+func (s *scanner) checkNeighborTable(table map[string]string, replied map[string]bool) map[string]string {
+	if len(table) > 0 {
+		s.m.NeighborTableUnavailable.Set(0)
+		return table
+	}
+	fallback := make(map[string]string)
+	for ip, ok := range replied {
+		if ok {
+			fallback[ip] = unknownMAC
+		}
+	}
+	if len(fallback) == 0 {
+		s.m.NeighborTableUnavailable.Set(0)
+		return table
+	}
+	s.m.NeighborTableUnavailable.Set(1)
+	s.logf("%d hosts answered probes but the neighbor table is empty; "+
+		"missing permission to read it (e.g. container without CAP_NET_ADMIN)? "+
+		"Reporting devices by IP only", len(fallback))
+	return fallback
+}
+
+// deviceKey identifies a device for the per-device caches: its MAC, or
+// its IP when the neighbor table could not be read.
+func deviceKey(ip, mac string) string {
+	if mac == unknownMAC {
+		return "ip:" + ip
+	}
+	return mac
+}
+
+const procNetARP = "/proc/net/arp"
+
+// neighbor is one complete neighbor table entry.
+type neighbor struct {
+	IP        string `json:"ip"`
+	MAC       string `json:"mac"`
+	Interface string `json:"interface"`
+}
+
+// neighborMACs maps the entries by IP; nil stays nil so callers can tell a
+// failed read from an empty table.
+func neighborMACs(entries []neighbor) map[string]string {
+	if entries == nil {
+		return nil
+	}
+	table := make(map[string]string, len(entries))
+	for _, n := range entries {
+		table[n.IP] = n.MAC
+	}
+	return table
+}
+
+// getNeighbors returns the IPv4 neighbor table and its raw text, or nil if
+// it could not be read; the failure is logged.
+func (s *scanner) getNeighbors() ([]neighbor, string) {
+	entries, raw, err := s.readNeighbors()
+	if err != nil {
+		s.logf("Error reading neighbor table: %v", err)
+	}
+	return entries, raw
+}
+
+// readNeighbors reads the IPv4 neighbor table and its raw text. Linux hosts
+// are read from /proc/net/arp, macOS and FreeBSD through sysctl when they
+// are this host, and everything else through `arp -an`; the choice follows
+// the runner's OS, which for a remote runner need not be ours.
+func (s *scanner) readNeighbors() ([]neighbor, string, error) {
+	if s.runner.GOOS() == "linux" {
+		var data []byte
+		var err error
+		if _, ok := s.runner.(localRunner); ok {
+			data, err = os.ReadFile(procNetARP)
+		} else {
+			data, err = s.runner.Output("cat", procNetARP)
+		}
+		if err != nil {
+			return nil, "", classify(err)
+		}
+		if header, _, _ := strings.Cut(string(data), "\n"); !strings.HasPrefix(header, "IP address") {
+			return nil, "", classified(ErrParse, fmt.Errorf("%s: unexpected header %q", procNetARP, header))
+		}
+		return parseProcNetARP(string(data)), string(data), nil
+	}
+
+	if _, ok := s.runner.(localRunner); ok {
+		entries, raw, err := sysctlNeighbors()
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return entries, raw, err
+		}
+	}
+
+	// -n skips the tool's own reverse lookups, which stall the scan when
+	// DNS is broken; names come from our resolver chain instead.
+	out, err := s.runner.Output("arp", "-an")
+	if err != nil {
+		return nil, "", fmt.Errorf("arp -an: %w", err)
+	}
+	return parseARPOutput(string(out)), string(out), nil
+}
+
+// parseProcNetARP parses /proc/net/arp:
+//
+//	IP address       HW type     Flags       HW address            Mask     Device
+//	192.168.1.5      0x1         0x2         aa:bb:cc:dd:ee:ff     *        wlan0
+//
+// Entries with flags 0x0 never got an ARP reply.
+func parseProcNetARP(data string) []neighbor {
+	entries := []neighbor{}
+	for i, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if i == 0 || len(fields) < 6 || fields[2] == "0x0" {
+			continue
+		}
+		if ip, mac, ok := neighborEntry(fields[0], fields[3]); ok {
+			entries = append(entries, neighbor{IP: ip, MAC: mac, Interface: fields[5]})
+		}
+	}
+	return entries
+}
+
+// parseARPOutput parses `arp -an` as printed by macOS, the BSDs and Linux
+// net-tools:
+//
+//	? (192.168.1.5) at 8:0:27:a:b:c on en0 ifscope [ethernet]
+//	? (192.168.1.6) at aa:bb:cc:dd:ee:ff [ether] on wlan0
+func parseARPOutput(out string) []neighbor {
+	entries := []neighbor{}
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.Fields(line)
+		if len(parts) < 4 || parts[2] != "at" {
+			continue
+		}
+		ip, mac, ok := neighborEntry(strings.Trim(parts[1], "()"), parts[3])
+		if !ok {
+			continue
+		}
+		n := neighbor{IP: ip, MAC: mac}
+		for i := 4; i+1 < len(parts); i++ {
+			if parts[i] == "on" {
+				n.Interface = parts[i+1]
+				break
+			}
+		}
+		entries = append(entries, n)
+	}
+	return entries
+}
+
+// neighborEntry validates one entry and normalizes the MAC to lower-case
+// two-digit octets; macOS drops leading zeros ("8:0:27:...").
+// Incomplete and all-zero entries are rejected: the device is not there.
+func neighborEntry(ipField, macField string) (string, string, bool) {
+	ip := net.ParseIP(ipField).To4()
+	if ip == nil {
+		return "", "", false
+	}
+	octets := strings.Split(strings.ToLower(macField), ":")
+	if len(octets) != 6 {
+		return "", "", false
+	}
+	for i, o := range octets {
+		if len(o) == 1 {
+			octets[i] = "0" + o
+		}
+	}
+	hw, err := net.ParseMAC(strings.Join(octets, ":"))
+	if err != nil || hw.String() == "00:00:00:00:00:00" {
+		return "", "", false
+	}
+	return ip.String(), hw.String(), true
+}
+
+// Neighbor table changes counted by network_neighbor_table_churn_total.
+const (
+	churnAdded    = "added"
+	churnRemoved  = "removed"
+	churnModified = "modified"
+)
+
+// trackNeighborChurn counts entries added, removed or moved to another MAC
+// per interface since the previous read. The first read and failed reads
+// only set (or keep) the baseline.
+func (s *scanner) trackNeighborChurn(entries []neighbor) {
+	if entries == nil {
+		return
+	}
+	current := make(map[[2]string]string, len(entries))
+	for _, n := range entries {
+		current[[2]string{n.Interface, n.IP}] = n.MAC
+	}
+	if s.neighborBaseline != nil {
+		for key, mac := range current {
+			switch prev, ok := s.neighborBaseline[key]; {
+			case !ok:
+				s.m.NeighborChurn.WithLabelValues(key[0], churnAdded).Inc()
+			case prev != mac:
+				s.m.NeighborChurn.WithLabelValues(key[0], churnModified).Inc()
+			}
+		}
+		for key := range s.neighborBaseline {
+			if _, ok := current[key]; !ok {
+				s.m.NeighborChurn.WithLabelValues(key[0], churnRemoved).Inc()
+			}
+		}
+	}
+	s.neighborBaseline = current
+}
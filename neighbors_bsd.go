@@ -0,0 +1,55 @@
+//go:build darwin || freebsd
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/route"
+)
+
+// sysctlNeighbors reads the ARP entries of the routing table through
+// sysctl (NET_RT_FLAGS with RTF_LLINFO), as arp(8) does itself. The raw
+// text comes back in `arp -an` form for the debug dump.
+func sysctlNeighbors() ([]neighbor, string, error) {
+	rib, err := route.FetchRIB(syscall.AF_INET, syscall.NET_RT_FLAGS, syscall.RTF_LLINFO)
+	if err != nil {
+		return nil, "", classify(err)
+	}
+	msgs, err := route.ParseRIB(syscall.NET_RT_FLAGS, rib)
+	if err != nil {
+		return nil, "", classified(ErrParse, fmt.Errorf("routing table: %w", err))
+	}
+	entries := []neighbor{}
+	var raw strings.Builder
+	for _, msg := range msgs {
+		rm, ok := msg.(*route.RouteMessage)
+		if !ok || len(rm.Addrs) <= syscall.RTAX_GATEWAY {
+			continue
+		}
+		dst, ok := rm.Addrs[syscall.RTAX_DST].(*route.Inet4Addr)
+		if !ok {
+			continue
+		}
+		link, ok := rm.Addrs[syscall.RTAX_GATEWAY].(*route.LinkAddr)
+		if !ok {
+			continue
+		}
+		ip, mac, ok := neighborEntry(net.IP(dst.IP[:]).String(), net.HardwareAddr(link.Addr).String())
+		if !ok {
+			continue
+		}
+		n := neighbor{IP: ip, MAC: mac, Interface: link.Name}
+		if n.Interface == "" {
+			if ifi, err := net.InterfaceByIndex(rm.Index); err == nil {
+				n.Interface = ifi.Name
+			}
+		}
+		entries = append(entries, n)
+		fmt.Fprintf(&raw, "? (%s) at %s on %s\n", n.IP, n.MAC, n.Interface)
+	}
+	return entries, raw.String(), nil
+}
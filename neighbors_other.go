@@ -0,0 +1,9 @@
+//go:build !darwin && !freebsd
+
+package main
+
+import "errors"
+
+func sysctlNeighbors() ([]neighbor, string, error) {
+	return nil, "", errors.ErrUnsupported
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseProcNetARP(t *testing.T) {
+	data := `IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.5      0x1         0x2         AA:BB:CC:DD:EE:FF     *        wlan0
+192.168.1.6      0x1         0x0         00:00:00:00:00:00     *        wlan0
+192.168.1.7      0x1         0x2         00:00:00:00:00:00     *        wlan0
+10.0.0.2         0x1         0x6         02:42:0a:00:00:02     *        docker0
+fe80::1          0x1         0x2         aa:bb:cc:dd:ee:01     *        wlan0
+192.168.1.8      0x1         0x2         aa:bb:cc
+`
+	want := []neighbor{
+		{IP: "192.168.1.5", MAC: "aa:bb:cc:dd:ee:ff", Interface: "wlan0"},
+		{IP: "10.0.0.2", MAC: "02:42:0a:00:00:02", Interface: "docker0"},
+	}
+	if got := parseProcNetARP(data); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := parseProcNetARP("IP address       HW type     Flags       HW address            Mask     Device\n"); got == nil || len(got) != 0 {
+		t.Errorf("empty table parsed as %#v, want an empty, non-nil list", got)
+	}
+}
+
+func TestParseARPOutput(t *testing.T) {
+	for _, tc := range []struct {
+		name, out string
+		want      []neighbor
+	}{
+		{"macOS", `? (192.168.1.1) at 8:0:27:a:b:c on en0 ifscope [ethernet]
+? (192.168.1.2) at (incomplete) on en0 ifscope [ethernet]
+? (224.0.0.251) at 1:0:5e:0:0:fb on en0 ifscope permanent [ethernet]
+`, []neighbor{
+			{IP: "192.168.1.1", MAC: "08:00:27:0a:0b:0c", Interface: "en0"},
+			{IP: "224.0.0.251", MAC: "01:00:5e:00:00:fb", Interface: "en0"},
+		}},
+		{"net-tools", `? (192.168.1.6) at aa:bb:cc:dd:ee:ff [ether] on wlan0
+? (192.168.1.9) at <incomplete> on wlan0
+`, []neighbor{{IP: "192.168.1.6", MAC: "aa:bb:cc:dd:ee:ff", Interface: "wlan0"}}},
+		{"FreeBSD", `? (10.0.0.1) at 00:0c:29:11:22:33 on em0 expires in 1187 seconds [ethernet]
+`, []neighbor{{IP: "10.0.0.1", MAC: "00:0c:29:11:22:33", Interface: "em0"}}},
+		{"no interface", `? (10.0.0.1) at 00:0c:29:11:22:33`, []neighbor{{IP: "10.0.0.1", MAC: "00:0c:29:11:22:33"}}},
+		{"no entries", "arp: no entries\n", []neighbor{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := parseARPOutput(tc.out); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNeighborEntry(t *testing.T) {
+	for _, tc := range []struct {
+		ip, mac         string
+		wantIP, wantMAC string
+		ok              bool
+	}{
+		{"192.168.1.5", "AA:BB:CC:DD:EE:FF", "192.168.1.5", "aa:bb:cc:dd:ee:ff", true},
+		{"192.168.1.5", "8:0:27:a:b:c", "192.168.1.5", "08:00:27:0a:0b:0c", true},
+		{"::ffff:192.168.1.5", "aa:bb:cc:dd:ee:ff", "192.168.1.5", "aa:bb:cc:dd:ee:ff", true},
+		{"fe80::1", "aa:bb:cc:dd:ee:ff", "", "", false},
+		{"192.168.1", "aa:bb:cc:dd:ee:ff", "", "", false},
+		{"192.168.1.5", "00:00:00:00:00:00", "", "", false},
+		{"192.168.1.5", "0:0:0:0:0:0", "", "", false},
+		{"192.168.1.5", "(incomplete)", "", "", false},
+		{"192.168.1.5", "aa:bb:cc:dd:ee", "", "", false},
+		{"192.168.1.5", "aa:bb:cc:dd:ee:gg", "", "", false},
+		{"192.168.1.5", "aa-bb-cc-dd-ee-ff", "", "", false},
+	} {
+		ip, mac, ok := neighborEntry(tc.ip, tc.mac)
+		if ip != tc.wantIP || mac != tc.wantMAC || ok != tc.ok {
+			t.Errorf("neighborEntry(%q, %q) = %q, %q, %v; want %q, %q, %v", tc.ip, tc.mac, ip, mac, ok, tc.wantIP, tc.wantMAC, tc.ok)
+		}
+	}
+}
+
+func TestNeighborMACs(t *testing.T) {
+	if neighborMACs(nil) != nil {
+		t.Error("a failed read must stay nil")
+	}
+	got := neighborMACs([]neighbor{{IP: "10.0.0.1", MAC: "aa:bb:cc:dd:ee:01"}, {IP: "10.0.0.2", MAC: "aa:bb:cc:dd:ee:02"}})
+	want := map[string]string{"10.0.0.1": "aa:bb:cc:dd:ee:01", "10.0.0.2": "aa:bb:cc:dd:ee:02"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := neighborMACs([]neighbor{}); got == nil || len(got) != 0 {
+		t.Errorf("empty table mapped to %#v, want an empty, non-nil map", got)
+	}
+}
+
+// fakeRunner answers commands from a table keyed by the command line, as
+// a remote linux host would.
+type fakeRunner map[string]string
+
+func (f fakeRunner) Output(name string, args ...string) ([]byte, error) {
+	cmd := strings.Join(append([]string{name}, args...), " ")
+	out, ok := f[cmd]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", cmd, ErrPermission)
+	}
+	return []byte(out), nil
+}
+
+func (f fakeRunner) Run(name string, args ...string) error {
+	_, err := f.Output(name, args...)
+	return err
+}
+
+func (fakeRunner) GOOS() string { return "linux" }
+
+func TestNeighborTableUnavailable(t *testing.T) {
+	const header = "IP address       HW type     Flags       HW address            Mask     Device\n"
+	replied := map[string]bool{"192.168.1.5": true, "192.168.1.6": true, "192.168.1.7": false}
+	for _, tc := range []struct {
+		name        string
+		runner      fakeRunner
+		want        map[string]string
+		unavailable float64
+		logged      bool
+	}{
+		{"healthy", fakeRunner{"cat " + procNetARP: header + "192.168.1.5      0x1         0x2         aa:bb:cc:dd:ee:ff     *        wlan0\n"},
+			map[string]string{"192.168.1.5": "aa:bb:cc:dd:ee:ff"}, 0, false},
+		{"empty table", fakeRunner{"cat " + procNetARP: header},
+			map[string]string{"192.168.1.5": unknownMAC, "192.168.1.6": unknownMAC}, 1, true},
+		{"unreadable table", fakeRunner{},
+			map[string]string{"192.168.1.5": unknownMAC, "192.168.1.6": unknownMAC}, 1, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logged := captureErrorLog(t)
+			reg := prometheus.NewRegistry()
+			s := newScanner("", 1)
+			s.m = NewMetrics(reg, "").forScanner(reg, s)
+			s.runner = tc.runner
+
+			entries, _, _ := s.readNeighbors()
+			got := s.checkNeighborTable(neighborMACs(entries), replied)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+			if v := testutil.ToFloat64(s.m.NeighborTableUnavailable); v != tc.unavailable {
+				t.Errorf("telemetry_neighbor_table_unavailable = %v, want %v", v, tc.unavailable)
+			}
+			explained := false
+			for _, line := range logged() {
+				explained = explained || strings.Contains(line, "CAP_NET_ADMIN")
+			}
+			if explained != tc.logged {
+				t.Errorf("logged the likely cause: %v, want %v (%q)", explained, tc.logged, logged())
+			}
+		})
+	}
+
+	// Nobody answering an empty table is a quiet network, not a failure.
+	reg := prometheus.NewRegistry()
+	s := newScanner("", 1)
+	s.m = NewMetrics(reg, "").forScanner(reg, s)
+	s.m.NeighborTableUnavailable.Set(1)
+	if got := s.checkNeighborTable(map[string]string{}, map[string]bool{"192.168.1.7": false}); len(got) != 0 {
+		t.Errorf("quiet network reported %v", got)
+	}
+	if v := testutil.ToFloat64(s.m.NeighborTableUnavailable); v != 0 {
+		t.Errorf("quiet network left telemetry_neighbor_table_unavailable at %v", v)
+	}
+	if deviceKey("192.168.1.5", unknownMAC) == deviceKey("192.168.1.6", unknownMAC) {
+		t.Error("IP-only devices share a cache key")
+	}
+}
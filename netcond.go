@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+type NetworkConfig struct {
+	// VPNInterfaces are interface name prefixes that mean a VPN carries
+	// the default route (default utun, tun, wg, ppp, ipsec).
+	VPNInterfaces []string `yaml:"vpn_interfaces"`
+	// CaptivePortalURL is fetched every scan and must answer 204; empty
+	// disables the check.
+	CaptivePortalURL string `yaml:"captive_portal_url"`
+	// SoftenOnVPN treats scans while a VPN is active as degraded: no
+	// device_left/joined events and no device-count anomaly tracking.
+	SoftenOnVPN bool `yaml:"soften_on_vpn"`
+	// CIDRs are the IPv4 prefixes scanned every cycle (default
+	// 192.168.1.0/24).
+	CIDRs []string `yaml:"cidrs"`
+	// Concurrency caps the probes in flight at once (default 64).
+	Concurrency int `yaml:"concurrency"`
+	// Timeout is how long a native probe waits for an answer (default 1s).
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c NetworkConfig) vpnInterfaces() []string {
+	if len(c.VPNInterfaces) == 0 {
+		return []string{"utun", "tun", "wg", "ppp", "ipsec"}
+	}
+	return c.VPNInterfaces
+}
+
+// ScanConditions records host network conditions that explain a partial
+// scan.
+type ScanConditions struct {
+	VPNActive     bool   `json:"vpn_active"`
+	VPNInterface  string `json:"vpn_interface,omitempty"`
+	CaptivePortal bool   `json:"captive_portal"`
+	// InternetUp is whether the captive portal check answered 204; nil
+	// when it is not configured.
+	InternetUp *bool `json:"internet_up,omitempty"`
+}
+
+func (c ScanConditions) names() []string {
+	var out []string
+	if c.VPNActive {
+		out = append(out, "vpn_active ("+c.VPNInterface+")")
+	}
+	if c.CaptivePortal {
+		out = append(out, "captive_portal")
+	}
+	return out
+}
+
+// defaultRouteInterfaces parses /proc/net/route for the interfaces of the
+// default route and of the 0.0.0.0/1 + 128.0.0.0/1 pair VPN clients use to
+// override it.
+func defaultRouteInterfaces(routes string) []string {
+	var out []string
+	for _, line := range strings.Split(routes, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 8 {
+			continue
+		}
+		if fields[1] == "00000000" || fields[1] == "00000080" && fields[7] == "00000080" {
+			out = append(out, fields[0])
+		}
+	}
+	return out
+}
+
+func parseDarwinDefaultInterface(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "interface:" {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+func (s *scanner) routeInterfaces() []string {
+	if s.runner.GOOS() == "darwin" {
+		out, err := s.runner.Output("route", "-n", "get", "default")
+		if err != nil {
+			return nil
+		}
+		if iface := parseDarwinDefaultInterface(string(out)); iface != "" {
+			return []string{iface}
+		}
+		return nil
+	}
+	out, err := s.runner.Output("cat", "/proc/net/route")
+	if err != nil {
+		return nil
+	}
+	return defaultRouteInterfaces(string(out))
+}
+
+// captivePortal reports whether the check URL answered anything but 204.
+// Redirects are not followed, since portals usually answer with one.
+func captivePortal(url string) (bool, error) {
+	client := &http.Client{
+		Timeout: 3 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode != http.StatusNoContent, nil
+}
+
+func (s *scanner) checkNetworkConditions(cfg NetworkConfig) ScanConditions {
+	var c ScanConditions
+	for _, iface := range s.routeInterfaces() {
+		for _, prefix := range cfg.vpnInterfaces() {
+			if strings.HasPrefix(iface, prefix) {
+				c.VPNActive = true
+				c.VPNInterface = iface
+			}
+		}
+	}
+	if cfg.CaptivePortalURL != "" {
+		portal, err := captivePortal(cfg.CaptivePortalURL)
+		if err != nil {
+			s.logf("Captive portal check failed: %v", err)
+		}
+		c.CaptivePortal = portal
+		up := err == nil && !portal
+		c.InternetUp = &up
+	}
+	vpn, portal := 0.0, 0.0
+	if c.VPNActive {
+		vpn = 1
+	}
+	if c.CaptivePortal {
+		portal = 1
+	}
+	s.m.VPNActive.Set(vpn)
+	s.m.CaptivePortal.Set(portal)
+	return c
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// OTLPConfig pushes the metrics /metrics serves to an OpenTelemetry
+// collector over OTLP/HTTP (JSON encoding), for hosts a Prometheus cannot
+// reach, such as laptops behind NAT. /metrics keeps working alongside. It
+// is off unless endpoint is set and takes effect on restart.
+type OTLPConfig struct {
+	// Endpoint is the collector's metrics URL, e.g.
+	// http://localhost:4318/v1/metrics.
+	Endpoint string `yaml:"endpoint"`
+	// Headers are added to every export request, e.g. for authentication.
+	Headers map[string]string `yaml:"headers"`
+	// Interval between pushes (default 60s).
+	Interval time.Duration `yaml:"interval"`
+	TLS      OTLPTLSConfig `yaml:"tls"`
+	// ServiceName is the service.name resource attribute (default
+	// telemetry-test).
+	ServiceName string `yaml:"service_name"`
+	// ResourceAttributes are added to host.name, os.type, service.name and
+	// service.version, e.g. deployment.environment.
+	ResourceAttributes map[string]string `yaml:"resource_attributes"`
+}
+
+// OTLPTLSConfig sets up TLS for an https endpoint.
+type OTLPTLSConfig struct {
+	// CAFile verifies the collector against these CAs instead of the
+	// system pool.
+	CAFile string `yaml:"ca_file"`
+	// CertFile and KeyFile are a client certificate, for collectors that
+	// require mutual TLS.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// InsecureSkipVerify accepts any server certificate.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+}
+
+func (c OTLPConfig) enabled() bool {
+	return c.Endpoint != ""
+}
+
+func (c OTLPConfig) interval() time.Duration {
+	if c.Interval <= 0 {
+		return 60 * time.Second
+	}
+	return c.Interval
+}
+
+func (c OTLPConfig) serviceName() string {
+	if c.ServiceName == "" {
+		return "telemetry-test"
+	}
+	return c.ServiceName
+}
+
+func (c OTLPConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("otlp.endpoint %q is not an absolute http(s) URL; only OTLP/HTTP is supported, not gRPC", c.Endpoint)
+	}
+	t := c.TLS
+	if (t.CAFile != "" || t.CertFile != "" || t.InsecureSkipVerify) && u.Scheme != "https" {
+		return fmt.Errorf("otlp.tls is set but otlp.endpoint %q is not https", c.Endpoint)
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("otlp.tls.cert_file and otlp.tls.key_file must be set together")
+	}
+	_, err = t.config()
+	return err
+}
+
+// config builds the client TLS config, nil without any settings.
+func (c OTLPTLSConfig) config() (*tls.Config, error) {
+	if c == (OTLPTLSConfig{}) {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("otlp.tls.ca_file: %v", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("otlp.tls.ca_file: no certificates in %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("otlp.tls: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// otlpExportTimeout bounds one export request.
+const otlpExportTimeout = 10 * time.Second
+
+// metricsPusher pushes a gatherer's metrics from its own goroutine.
+type metricsPusher struct {
+	cfg      OTLPConfig
+	m        *Metrics
+	g        prometheus.Gatherer
+	client   *http.Client
+	resource []otlpAttribute
+	// start is the start time of every cumulative series.
+	start time.Time
+}
+
+func newMetricsPusher(m *Metrics, cfg OTLPConfig, g prometheus.Gatherer) (*metricsPusher, error) {
+	tlsCfg, err := cfg.TLS.config()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+	hostname, _ := os.Hostname()
+	resource := []otlpAttribute{
+		attr("service.name", cfg.serviceName()),
+		attr("service.version", version),
+		attr("host.name", hostname),
+		attr("os.type", runtime.GOOS),
+	}
+	keys := make([]string, 0, len(cfg.ResourceAttributes))
+	for k := range cfg.ResourceAttributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		resource = append(resource, attr(k, cfg.ResourceAttributes[k]))
+	}
+	return &metricsPusher{
+		cfg:      cfg,
+		m:        m,
+		g:        g,
+		client:   &http.Client{Timeout: otlpExportTimeout, Transport: transport},
+		resource: resource,
+		start:    time.Now(),
+	}, nil
+}
+
+// otlpDouble is a double as the OTLP/JSON mapping writes it: NaN and the
+// infinities, which encoding/json refuses, become strings.
+type otlpDouble float64
+
+func (d otlpDouble) MarshalJSON() ([]byte, error) {
+	f := float64(d)
+	switch {
+	case math.IsNaN(f):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(f, 1):
+		return []byte(`"Infinity"`), nil
+	case math.IsInf(f, -1):
+		return []byte(`"-Infinity"`), nil
+	}
+	return json.Marshal(f)
+}
+
+// otlpMetrics converts gathered families to OTLP metrics, see
+// opentelemetry-proto's metrics.proto: counters become monotonic
+// cumulative sums named without _total, as the Prometheus compatibility
+// spec has it; gauges and untyped metrics become gauges; histograms keep
+// their buckets, made non-cumulative; summaries keep their quantiles.
+func otlpMetrics(mfs []*dto.MetricFamily, start, now time.Time) []map[string]interface{} {
+	startNano := strconv.FormatInt(start.UnixNano(), 10)
+	nowNano := strconv.FormatInt(now.UnixNano(), 10)
+	out := make([]map[string]interface{}, 0, len(mfs))
+	for _, mf := range mfs {
+		points := make([]map[string]interface{}, 0, len(mf.GetMetric()))
+		for _, m := range mf.GetMetric() {
+			p := map[string]interface{}{"timeUnixNano": nowNano}
+			if labels := m.GetLabel(); len(labels) > 0 {
+				attrs := make([]otlpAttribute, 0, len(labels))
+				for _, l := range labels {
+					attrs = append(attrs, attr(l.GetName(), l.GetValue()))
+				}
+				p["attributes"] = attrs
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				p["startTimeUnixNano"] = startNano
+				p["asDouble"] = otlpDouble(m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				p["asDouble"] = otlpDouble(m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				p["asDouble"] = otlpDouble(m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				var bounds []otlpDouble
+				var counts []string
+				var prev uint64
+				for _, b := range h.GetBucket() {
+					if math.IsInf(b.GetUpperBound(), 1) {
+						continue
+					}
+					bounds = append(bounds, otlpDouble(b.GetUpperBound()))
+					counts = append(counts, strconv.FormatUint(b.GetCumulativeCount()-prev, 10))
+					prev = b.GetCumulativeCount()
+				}
+				counts = append(counts, strconv.FormatUint(h.GetSampleCount()-prev, 10))
+				p["startTimeUnixNano"] = startNano
+				p["count"] = strconv.FormatUint(h.GetSampleCount(), 10)
+				p["sum"] = otlpDouble(h.GetSampleSum())
+				p["explicitBounds"] = bounds
+				p["bucketCounts"] = counts
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				quantiles := make([]map[string]interface{}, 0, len(s.GetQuantile()))
+				for _, q := range s.GetQuantile() {
+					quantiles = append(quantiles, map[string]interface{}{"quantile": otlpDouble(q.GetQuantile()), "value": otlpDouble(q.GetValue())})
+				}
+				p["startTimeUnixNano"] = startNano
+				p["count"] = strconv.FormatUint(s.GetSampleCount(), 10)
+				p["sum"] = otlpDouble(s.GetSampleSum())
+				p["quantileValues"] = quantiles
+			default:
+				continue
+			}
+			points = append(points, p)
+		}
+		if len(points) == 0 {
+			continue
+		}
+		metric := map[string]interface{}{"name": mf.GetName(), "description": mf.GetHelp()}
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			metric["name"] = strings.TrimSuffix(mf.GetName(), "_total")
+			metric["sum"] = map[string]interface{}{"dataPoints": points, "aggregationTemporality": 2, "isMonotonic": true}
+		case dto.MetricType_HISTOGRAM:
+			metric["histogram"] = map[string]interface{}{"dataPoints": points, "aggregationTemporality": 2}
+		case dto.MetricType_SUMMARY:
+			metric["summary"] = map[string]interface{}{"dataPoints": points}
+		default:
+			metric["gauge"] = map[string]interface{}{"dataPoints": points}
+		}
+		out = append(out, metric)
+	}
+	return out
+}
+
+func init() {
+	registerFeature("otlp", false)
+}
+
+func (p *metricsPusher) push(ctx context.Context) error {
+	mfs, err := p.g.Gather()
+	if err != nil && len(mfs) == 0 {
+		return err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceMetrics": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": p.resource},
+			"scopeMetrics": []interface{}{map[string]interface{}{
+				"scope":   map[string]string{"name": "telemetry-test", "version": version},
+				"metrics": otlpMetrics(mfs, p.start, time.Now()),
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "telemetry-test/"+version)
+	for k, v := range p.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// otlpPushLoop pushes every otlp.interval until ctx is done. A failed push
+// is not retried; the next one carries the cumulative values anyway.
+func otlpPushLoop(ctx context.Context, p *metricsPusher) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(p.cfg.interval()):
+		}
+		if err := p.push(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			p.m.OTLPExports.WithLabelValues("error").Inc()
+			errorLog.Printf("Error pushing metrics to %s: %v", p.cfg.Endpoint, err)
+			continue
+		}
+		p.m.OTLPExports.WithLabelValues("ok").Inc()
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestOTLPDoubleJSON(t *testing.T) {
+	for _, tc := range []struct {
+		f    float64
+		want string
+	}{
+		{1.5, `1.5`},
+		{0, `0`},
+		{-2, `-2`},
+		{math.NaN(), `"NaN"`},
+		{math.Inf(1), `"Infinity"`},
+		{math.Inf(-1), `"-Infinity"`},
+	} {
+		got, err := json.Marshal([]otlpDouble{otlpDouble(tc.f)})
+		if err != nil {
+			t.Errorf("%v: %v", tc.f, err)
+			continue
+		}
+		if string(got) != "["+tc.want+"]" {
+			t.Errorf("%v marshaled as %s, want [%s]", tc.f, got, tc.want)
+		}
+	}
+}
+
+// otlpJSON converts the families of reg and decodes the result again, as a
+// collector would see it.
+func otlpJSON(t *testing.T, reg *prometheus.Registry, start, now time.Time) map[string]map[string]interface{} {
+	t.Helper()
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(otlpMetrics(mfs, start, now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metrics []map[string]interface{}
+	if err := json.Unmarshal(data, &metrics); err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]map[string]interface{})
+	for _, m := range metrics {
+		byName[m["name"].(string)] = m
+	}
+	return byName
+}
+
+// dataPoint returns the only data point of the metric's field (sum, gauge,
+// histogram or summary).
+func dataPoint(t *testing.T, metric map[string]interface{}, field string) map[string]interface{} {
+	t.Helper()
+	data, ok := metric[field].(map[string]interface{})
+	if !ok {
+		t.Fatalf("%v has no %s", metric["name"], field)
+	}
+	points := data["dataPoints"].([]interface{})
+	if len(points) != 1 {
+		t.Fatalf("%v has %d data points, want 1", metric["name"], len(points))
+	}
+	return points[0].(map[string]interface{})
+}
+
+func TestOTLPMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	scans := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "wifi_scans_total", Help: "Scans."}, []string{"result"})
+	scans.WithLabelValues("ok").Add(3)
+	nan := prometheus.NewGauge(prometheus.GaugeOpts{Name: "wifi_nan", Help: "h"})
+	nan.Set(math.NaN())
+	inf := prometheus.NewGauge(prometheus.GaugeOpts{Name: "wifi_inf", Help: "h"})
+	inf.Set(math.Inf(-1))
+	rtt := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "wifi_rtt_seconds", Help: "h", Buckets: []float64{0.01, 0.1, 1}})
+	for _, v := range []float64{0.005, 0.005, 0.05, 0.5, 0.5, 0.5, 5} {
+		rtt.Observe(v)
+	}
+	summary := prometheus.NewSummary(prometheus.SummaryOpts{Name: "wifi_probe_seconds", Help: "h", Objectives: map[float64]float64{0.5: 0.05}})
+	summary.Observe(2)
+	reg.MustRegister(scans, nan, inf, rtt, summary)
+
+	start, now := time.Unix(100, 0), time.Unix(200, 5)
+	metrics := otlpJSON(t, reg, start, now)
+
+	t.Run("counter", func(t *testing.T) {
+		m, ok := metrics["wifi_scans"]
+		if !ok {
+			t.Fatalf("no wifi_scans in %v; _total must be dropped", keys(metrics))
+		}
+		if m["description"] != "Scans." {
+			t.Errorf("description %v", m["description"])
+		}
+		sum := m["sum"].(map[string]interface{})
+		if sum["isMonotonic"] != true || sum["aggregationTemporality"] != float64(2) {
+			t.Errorf("sum %v, want monotonic and cumulative", sum)
+		}
+		p := dataPoint(t, m, "sum")
+		if p["asDouble"] != float64(3) || p["startTimeUnixNano"] != "100000000000" || p["timeUnixNano"] != "200000000005" {
+			t.Errorf("point %v", p)
+		}
+		want := []interface{}{map[string]interface{}{"key": "result", "value": map[string]interface{}{"stringValue": "ok"}}}
+		if !reflect.DeepEqual(p["attributes"], want) {
+			t.Errorf("attributes %v, want %v", p["attributes"], want)
+		}
+	})
+
+	t.Run("non-finite gauges", func(t *testing.T) {
+		if p := dataPoint(t, metrics["wifi_nan"], "gauge"); p["asDouble"] != "NaN" {
+			t.Errorf("NaN written as %v", p["asDouble"])
+		}
+		if p := dataPoint(t, metrics["wifi_inf"], "gauge"); p["asDouble"] != "-Infinity" {
+			t.Errorf("-Inf written as %v", p["asDouble"])
+		}
+		if _, ok := dataPoint(t, metrics["wifi_nan"], "gauge")["startTimeUnixNano"]; ok {
+			t.Error("a gauge carries a start time")
+		}
+	})
+
+	t.Run("histogram", func(t *testing.T) {
+		p := dataPoint(t, metrics["wifi_rtt_seconds"], "histogram")
+		if !reflect.DeepEqual(p["explicitBounds"], []interface{}{0.01, 0.1, 1.0}) {
+			t.Errorf("bounds %v; the +Inf bucket is implied", p["explicitBounds"])
+		}
+		// Cumulative 2, 3, 6 of 7 observations become per bucket counts,
+		// with the last one above 1.
+		if want := []interface{}{"2", "1", "3", "1"}; !reflect.DeepEqual(p["bucketCounts"], want) {
+			t.Errorf("bucket counts %v, want %v", p["bucketCounts"], want)
+		}
+		if p["count"] != "7" || math.Abs(p["sum"].(float64)-6.56) > 1e-9 {
+			t.Errorf("count %v sum %v", p["count"], p["sum"])
+		}
+	})
+
+	t.Run("summary", func(t *testing.T) {
+		p := dataPoint(t, metrics["wifi_probe_seconds"], "summary")
+		want := []interface{}{map[string]interface{}{"quantile": 0.5, "value": 2.0}}
+		if !reflect.DeepEqual(p["quantileValues"], want) || p["count"] != "1" {
+			t.Errorf("point %v", p)
+		}
+	})
+}
+
+func TestOTLPMetricsEmptyHistogram(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewHistogram(prometheus.HistogramOpts{Name: "wifi_rtt_seconds", Help: "h", Buckets: []float64{1}}))
+	p := dataPoint(t, otlpJSON(t, reg, time.Unix(0, 0), time.Unix(1, 0))["wifi_rtt_seconds"], "histogram")
+	if want := []interface{}{"0", "0"}; !reflect.DeepEqual(p["bucketCounts"], want) || p["count"] != "0" {
+		t.Errorf("point %v", p)
+	}
+}
+
+func keys(m map[string]map[string]interface{}) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	return out
+}
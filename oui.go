@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ouiRegistryURL = "https://standards-oui.ieee.org/oui/oui.csv"
+	ouiCacheMagic  = "OUI1"
+)
+
+//go:embed data/oui_common.txt
+var embeddedOUI string
+
+// ouiTable maps 24-bit MAC prefixes to vendor names. Prefixes are sorted so
+// lookups are a binary search.
+type ouiTable struct {
+	prefixes []uint32
+	vendor   []uint32 // index into vendors, parallel to prefixes
+	vendors  []string
+}
+
+var ouiDB = mustParseEmbeddedOUI()
+
+func mustParseEmbeddedOUI() *ouiTable {
+	entries := make(map[uint32]string)
+	for _, line := range strings.Split(embeddedOUI, "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		p, err := strconv.ParseUint(parts[0], 16, 32)
+		if err != nil {
+			continue
+		}
+		entries[uint32(p)] = parts[1]
+	}
+	return newOUITable(entries)
+}
+
+func newOUITable(entries map[uint32]string) *ouiTable {
+	t := &ouiTable{}
+	vendorIdx := make(map[string]uint32)
+	for p := range entries {
+		t.prefixes = append(t.prefixes, p)
+	}
+	sort.Slice(t.prefixes, func(i, j int) bool { return t.prefixes[i] < t.prefixes[j] })
+	for _, p := range t.prefixes {
+		name := entries[p]
+		idx, ok := vendorIdx[name]
+		if !ok {
+			idx = uint32(len(t.vendors))
+			vendorIdx[name] = idx
+			t.vendors = append(t.vendors, name)
+		}
+		t.vendor = append(t.vendor, idx)
+	}
+	return t
+}
+
+func macPrefix(mac string) (uint32, bool) {
+	hex := strings.NewReplacer(":", "", "-", "", ".", "").Replace(mac)
+	if len(hex) < 6 {
+		return 0, false
+	}
+	p, err := strconv.ParseUint(hex[:6], 16, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(p), true
+}
+
+func (t *ouiTable) lookup(mac string) string {
+	p, ok := macPrefix(mac)
+	if !ok {
+		return ""
+	}
+	i := sort.Search(len(t.prefixes), func(i int) bool { return t.prefixes[i] >= p })
+	if i < len(t.prefixes) && t.prefixes[i] == p {
+		return t.vendors[t.vendor[i]]
+	}
+	return ""
+}
+
+// encode writes the compact cache format: magic, vendor strings, then
+// prefix entries as 3 bytes plus a uvarint vendor index, followed by a
+// SHA-256 of everything before it.
+func (t *ouiTable) encode() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(ouiCacheMagic)
+	buf.Write(binary.AppendUvarint(nil, uint64(len(t.vendors))))
+	for _, v := range t.vendors {
+		buf.Write(binary.AppendUvarint(nil, uint64(len(v))))
+		buf.WriteString(v)
+	}
+	buf.Write(binary.AppendUvarint(nil, uint64(len(t.prefixes))))
+	for i, p := range t.prefixes {
+		buf.Write([]byte{byte(p >> 16), byte(p >> 8), byte(p)})
+		buf.Write(binary.AppendUvarint(nil, uint64(t.vendor[i])))
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:])
+	return buf.Bytes()
+}
+
+var errCorruptOUICache = errors.New("corrupt OUI cache")
+
+func decodeOUITable(data []byte) (*ouiTable, error) {
+	if len(data) < len(ouiCacheMagic)+sha256.Size || string(data[:len(ouiCacheMagic)]) != ouiCacheMagic {
+		return nil, errCorruptOUICache
+	}
+	body, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if got := sha256.Sum256(body); !bytes.Equal(got[:], sum) {
+		return nil, fmt.Errorf("%w: checksum mismatch", errCorruptOUICache)
+	}
+
+	r := bytes.NewReader(body[len(ouiCacheMagic):])
+	readCount := func(limit int) (int, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(limit) {
+			return 0, errCorruptOUICache
+		}
+		return int(n), nil
+	}
+
+	t := &ouiTable{}
+	nVendors, err := readCount(r.Len())
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < nVendors; i++ {
+		n, err := readCount(r.Len())
+		if err != nil {
+			return nil, err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, errCorruptOUICache
+		}
+		t.vendors = append(t.vendors, string(name))
+	}
+	nPrefixes, err := readCount(r.Len())
+	if err != nil {
+		return nil, err
+	}
+	if nPrefixes > 0 && nVendors == 0 {
+		return nil, errCorruptOUICache
+	}
+	var last int64 = -1
+	for i := 0; i < nPrefixes; i++ {
+		var b [3]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, errCorruptOUICache
+		}
+		p := uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		if int64(p) <= last {
+			return nil, fmt.Errorf("%w: prefixes not sorted", errCorruptOUICache)
+		}
+		last = int64(p)
+		idx, err := readCount(nVendors - 1)
+		if err != nil {
+			return nil, err
+		}
+		t.prefixes = append(t.prefixes, p)
+		t.vendor = append(t.vendor, uint32(idx))
+	}
+	return t, nil
+}
+
+func ouiCachePath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "telemetry-test", "oui.bin"), nil
+}
+
+// loadOUICache replaces the embedded subset with the downloaded registry
+// when a valid cache file exists. Missing or corrupt caches keep the
+// embedded subset.
+func loadOUICache() {
+	path, err := ouiCachePath()
+	if err != nil {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	t, err := decodeOUITable(data)
+	if err != nil {
+		errorLog.Printf("Ignoring OUI cache %s: %v", path, err)
+		return
+	}
+	ouiDB = t
+}
+
+func parseIEEERegistry(r io.Reader) (map[uint32]string, error) {
+	cr := csv.NewReader(bufio.NewReader(r))
+	cr.FieldsPerRecord = -1
+	entries := make(map[uint32]string)
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) < 3 || rec[0] != "MA-L" {
+			continue // header and other registries
+		}
+		p, err := strconv.ParseUint(rec[1], 16, 32)
+		if err != nil || len(rec[1]) != 6 {
+			continue
+		}
+		entries[uint32(p)] = strings.TrimSpace(rec[2])
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("no MA-L entries in registry")
+	}
+	return entries, nil
+}
+
+// runOUIUpdate implements "telemetry-test oui update [url]".
+func runOUIUpdate(args []string) error {
+	url := ouiRegistryURL
+	if len(args) > 0 {
+		url = args[0]
+	}
+	client := &http.Client{Timeout: 2 * time.Minute}
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("failed to download OUI registry: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download OUI registry: %s", resp.Status)
+	}
+	entries, err := parseIEEERegistry(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to parse OUI registry: %v", err)
+	}
+
+	path, err := ouiCachePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, newOUITable(entries).encode(), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d OUI entries to %s\n", len(entries), path)
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOUITableLookup(t *testing.T) {
+	table := newOUITable(map[uint32]string{0x001C42: "Parallels", 0xF0189: "Apple", 0xACDE48: "Apple"})
+	for _, tc := range []struct {
+		mac, want string
+	}{
+		{"00:1c:42:aa:bb:cc", "Parallels"},
+		{"00-1C-42-AA-BB-CC", "Parallels"},
+		{"001c.42aa.bbcc", "Parallels"},
+		{"0f:01:89:00:00:01", "Apple"},
+		{"ac:de:48:00:11:22", "Apple"},
+		{"00:1c:43:aa:bb:cc", ""},
+		{"00:1c", ""},
+		{"zz:zz:zz:00:00:00", ""},
+		{unknownMAC, ""},
+	} {
+		if got := table.lookup(tc.mac); got != tc.want {
+			t.Errorf("lookup(%q) = %q, want %q", tc.mac, got, tc.want)
+		}
+	}
+	if len(table.vendors) != 2 {
+		t.Errorf("vendors %v, want each name stored once", table.vendors)
+	}
+}
+
+func TestEmbeddedOUI(t *testing.T) {
+	if len(ouiDB.prefixes) == 0 {
+		t.Fatal("embedded OUI subset is empty")
+	}
+	for i := 1; i < len(ouiDB.prefixes); i++ {
+		if ouiDB.prefixes[i-1] >= ouiDB.prefixes[i] {
+			t.Fatalf("prefixes not sorted at %d", i)
+		}
+	}
+}
+
+func TestOUICacheRoundTrip(t *testing.T) {
+	for _, entries := range []map[uint32]string{
+		{},
+		{0x000000: "Xerox"},
+		{0x001C42: "Parallels", 0xACDE48: "Apple", 0xFFFFFF: "Broadcast", 0x3C0754: "Apple"},
+	} {
+		table := newOUITable(entries)
+		got, err := decodeOUITable(table.encode())
+		if err != nil {
+			t.Fatalf("%v: %v", entries, err)
+		}
+		if len(got.prefixes) != len(table.prefixes) || (len(got.prefixes) > 0 && !reflect.DeepEqual(got, table)) {
+			t.Errorf("%v: decoded %+v, want %+v", entries, got, table)
+		}
+	}
+}
+
+func TestDecodeOUITableCorrupt(t *testing.T) {
+	valid := newOUITable(map[uint32]string{0x001C42: "Parallels", 0xACDE48: "Apple"}).encode()
+	flipped := append([]byte(nil), valid...)
+	flipped[len(ouiCacheMagic)+2] ^= 0xFF
+
+	// Well-formed checksums over broken bodies: unsorted prefixes and a
+	// vendor index out of range.
+	unsorted := &ouiTable{prefixes: []uint32{2, 1}, vendor: []uint32{0, 0}, vendors: []string{"a"}}
+	badIndex := &ouiTable{prefixes: []uint32{1}, vendor: []uint32{1}, vendors: []string{"a"}}
+	noVendors := &ouiTable{prefixes: []uint32{1}, vendor: []uint32{0}}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "corrupt OUI cache"},
+		{"magic", append([]byte("OUI0"), valid[4:]...), "corrupt OUI cache"},
+		{"truncated", valid[:len(valid)-1], "checksum mismatch"},
+		{"flipped", flipped, "checksum mismatch"},
+		{"unsorted", unsorted.encode(), "prefixes not sorted"},
+		{"vendor index", badIndex.encode(), "corrupt OUI cache"},
+		{"no vendors", noVendors.encode(), "corrupt OUI cache"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := decodeOUITable(tc.data)
+			if !errors.Is(err, errCorruptOUICache) || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseIEEERegistry(t *testing.T) {
+	csv := `Registry,Assignment,Organization Name,Organization Address
+MA-L,001C42,"Parallels, Inc.","9th Floor, Seattle"
+MA-L,ACDE48,"  Private  ",
+MA-M,ACDE481,Too Long,
+MA-L,XYZ123,Not Hex,
+MA-L,0A0B,Too Short,
+`
+	got, err := parseIEEERegistry(strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint32]string{0x001C42: "Parallels, Inc.", 0xACDE48: "Private"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := parseIEEERegistry(strings.NewReader("Registry,Assignment,Organization Name\n")); err == nil {
+		t.Error("a registry without MA-L entries was accepted")
+	}
+}
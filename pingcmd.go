@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PingCommandConfig replaces the probe with an external command, for
+// hosts where ping lives elsewhere, takes other flags, or fping is wanted.
+type PingCommandConfig struct {
+	// Path is the binary to run; empty keeps native probing (or the
+	// system ping on a remote host).
+	Path string `yaml:"path"`
+	// Args is the argument template. {ip}, {count}, {timeout_s} (whole
+	// seconds, rounded up) and {timeout_ms} are substituted per probe.
+	Args []string `yaml:"args"`
+	// Count is the value of {count} (default 1).
+	Count int `yaml:"count"`
+	// AliveExitCodes are the exit codes meaning the host answered
+	// (default [0]).
+	AliveExitCodes []int `yaml:"alive_exit_codes"`
+}
+
+var pingPlaceholder = regexp.MustCompile(`\{[a-z_]*\}`)
+
+func (c PingCommandConfig) enabled() bool {
+	return c.Path != ""
+}
+
+func (c PingCommandConfig) count() int {
+	if c.Count <= 0 {
+		return 1
+	}
+	return c.Count
+}
+
+func (c PingCommandConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	hasIP := false
+	for _, arg := range c.Args {
+		for _, ph := range pingPlaceholder.FindAllString(arg, -1) {
+			switch ph {
+			case "{ip}":
+				hasIP = true
+			case "{count}", "{timeout_s}", "{timeout_ms}":
+			default:
+				return fmt.Errorf("scan.ping_command.args: unknown placeholder %s", ph)
+			}
+		}
+	}
+	if !hasIP {
+		return fmt.Errorf("scan.ping_command.args must contain {ip}")
+	}
+	return nil
+}
+
+func (c PingCommandConfig) expand(ip string, timeout time.Duration) []string {
+	r := strings.NewReplacer(
+		"{ip}", ip,
+		"{count}", strconv.Itoa(c.count()),
+		"{timeout_s}", strconv.Itoa(int(math.Ceil(timeout.Seconds()))),
+		"{timeout_ms}", strconv.FormatInt(timeout.Milliseconds(), 10),
+	)
+	args := make([]string, len(c.Args))
+	for i, arg := range c.Args {
+		args[i] = r.Replace(arg)
+	}
+	return args
+}
+
+// exitResult maps the command's outcome to nil for an answering host.
+func (c PingCommandConfig) exitResult(err error) error {
+	code := 0
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return err // did not run at all
+		}
+		code = exitErr.ExitCode()
+	}
+	alive := c.AliveExitCodes
+	if len(alive) == 0 {
+		alive = []int{0}
+	}
+	for _, ok := range alive {
+		if code == ok {
+			return nil
+		}
+	}
+	return classified(ErrTimeout, fmt.Errorf("%s exited with status %d", c.Path, code))
+}
+
+// checkPingCommand dry-runs the configured command against localhost on
+// runner r, so a wrong path or template fails at startup rather than
+// reporting every device as down.
+func checkPingCommand(r commandRunner, c PingCommandConfig, timeout time.Duration) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	args := c.expand("127.0.0.1", timeout)
+	if err := c.exitResult(r.Run(c.Path, args...)); err != nil {
+		return fmt.Errorf("scan.ping_command: %s %s failed: %v", c.Path, strings.Join(args, " "), err)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PowerSaveConfig stretches the scan interval while the host runs on
+// battery below a charge level, and holds the enrichment workers until it
+// is back on AC or charged above the level again.
+type PowerSaveConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// BelowPercent is the battery charge under which scanning backs off
+	// (default 50).
+	BelowPercent float64 `yaml:"below_percent"`
+	// IntervalFactor multiplies the scan interval while backing off
+	// (default 4).
+	IntervalFactor float64 `yaml:"interval_factor"`
+}
+
+func (c PowerSaveConfig) belowPercent() float64 {
+	if c.BelowPercent <= 0 {
+		return 50
+	}
+	return c.BelowPercent
+}
+
+func (c PowerSaveConfig) intervalFactor() float64 {
+	if c.IntervalFactor <= 0 {
+		return 4
+	}
+	return c.IntervalFactor
+}
+
+func (c PowerSaveConfig) validate() error {
+	if c.BelowPercent > 100 {
+		return fmt.Errorf("power_save.below_percent must be at most 100, got %g", c.BelowPercent)
+	}
+	if c.IntervalFactor != 0 && c.IntervalFactor < 1 {
+		return fmt.Errorf("power_save.interval_factor must be at least 1, got %g", c.IntervalFactor)
+	}
+	return nil
+}
+
+// Power sources reported in telemetry_power_source.
+const (
+	powerAC      = "ac"
+	powerBattery = "battery"
+	powerUnknown = "unknown"
+)
+
+type powerState struct {
+	Source string
+	// Percent is the battery charge, or -1 without a battery.
+	Percent float64
+}
+
+var pmsetPercent = regexp.MustCompile(`(\d+)%`)
+
+// readPowerState reads the power source of this host, which is where the
+// scans run from even with a remote runner: pmset on macOS,
+// /sys/class/power_supply on Linux. Hosts without a battery are on AC.
+func readPowerState() (powerState, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		out, err := outputAccounted("pmset", "-g", "batt")
+		if err != nil {
+			return powerState{Source: powerUnknown, Percent: -1}, err
+		}
+		return parsePmset(string(out)), nil
+	case "linux":
+		return readPowerSupply("/sys/class/power_supply")
+	}
+	return powerState{Source: powerUnknown, Percent: -1}, nil
+}
+
+// parsePmset parses `pmset -g batt`, e.g.
+//
+//	Now drawing from 'Battery Power'
+//	 -InternalBattery-0 (id=4653155)	42%; discharging; 3:10 remaining present: true
+func parsePmset(out string) powerState {
+	s := powerState{Source: powerAC, Percent: -1}
+	if strings.Contains(out, "'Battery Power'") {
+		s.Source = powerBattery
+	}
+	if m := pmsetPercent.FindStringSubmatch(out); m != nil {
+		s.Percent, _ = strconv.ParseFloat(m[1], 64)
+	}
+	return s
+}
+
+func readSysfs(dir, name string) string {
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// readPowerSupply is on battery when a battery is discharging and no mains
+// or USB supply is online.
+func readPowerSupply(root string) (powerState, error) {
+	s := powerState{Source: powerAC, Percent: -1}
+	dirs, err := filepath.Glob(filepath.Join(root, "*"))
+	if err != nil {
+		return powerState{Source: powerUnknown, Percent: -1}, err
+	}
+	discharging, online := false, false
+	for _, dir := range dirs {
+		switch readSysfs(dir, "type") {
+		case "Battery":
+			if p, err := strconv.ParseFloat(readSysfs(dir, "capacity"), 64); err == nil && s.Percent < 0 {
+				s.Percent = p
+			}
+			discharging = discharging || readSysfs(dir, "status") == "Discharging"
+		case "Mains", "USB":
+			online = online || readSysfs(dir, "online") == "1"
+		}
+	}
+	if discharging && !online {
+		s.Source = powerBattery
+	}
+	return s, nil
+}
+
+// powerMu guards the power state, which every scanner updates at the
+// start of its scans.
+var (
+	powerMu         sync.Mutex
+	lastPowerSource string
+	powerSaving     bool
+	// scanPause is the pause before the next scan; the scan loops read it
+	// after every scan with currentScanPause.
+	scanPause = scanInterval
+)
+
+func currentScanPause() time.Duration {
+	powerMu.Lock()
+	defer powerMu.Unlock()
+	return scanPause
+}
+
+// updatePowerSave reads the power state at the start of a scan and sets
+// the pause before the next one: scanInterval, times interval_factor
+// while on battery below below_percent. The enrichment workers of every
+// scanner are held for as long as that lasts. Called by the scan loops.
+func updatePowerSave(m *Metrics, cfg PowerSaveConfig) {
+	powerMu.Lock()
+	defer powerMu.Unlock()
+	state, err := readPowerState()
+	if err != nil {
+		errorLog.Printf("Error reading the power state: %v", err)
+	}
+	for _, source := range []string{powerAC, powerBattery, powerUnknown} {
+		v := 0.0
+		if source == state.Source {
+			v = 1
+		}
+		m.PowerSource.WithLabelValues(source).Set(v)
+	}
+	m.BatteryPercent.Set(state.Percent)
+	if state.Source != lastPowerSource {
+		if lastPowerSource != "" {
+			emitEvent("power_source_changed", map[string]interface{}{
+				"from":            lastPowerSource,
+				"to":              state.Source,
+				"battery_percent": state.Percent,
+			})
+		}
+		lastPowerSource = state.Source
+	}
+
+	saving := cfg.Enabled && state.Source == powerBattery && state.Percent >= 0 && state.Percent < cfg.belowPercent()
+	scanPause = scanInterval
+	active := 0.0
+	if saving {
+		scanPause = time.Duration(float64(scanInterval) * cfg.intervalFactor())
+		active = 1
+	}
+	m.PowerSave.Set(active)
+	m.ScanEffectiveInterval.Set(scanPause.Seconds())
+	if saving != powerSaving {
+		if saving {
+			log.Printf("On battery at %g%% (below %g%%): scanning every %s and holding enrichment (power_save)",
+				state.Percent, cfg.belowPercent(), scanPause)
+		} else {
+			log.Printf("Leaving power save: scanning every %s again", scanPause)
+		}
+		emitEvent("power_save_changed", map[string]interface{}{
+			"active":           saving,
+			"battery_percent":  state.Percent,
+			"interval_seconds": scanPause.Seconds(),
+		})
+		powerSaving = saving
+	}
+	for _, s := range scanners {
+		s.enrichment.hold(saving)
+	}
+}
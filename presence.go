@@ -0,0 +1,165 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+const flapWindow = 24 * time.Hour
+
+func (c ScanConfig) offlineRetention() time.Duration {
+	if c.OfflineRetention <= 0 {
+		return 24 * time.Hour
+	}
+	return c.OfflineRetention
+}
+
+type presenceState struct {
+	online      bool
+	lastSeen    time.Time
+	transitions []time.Time // online/offline edges within flapWindow, oldest first
+	// last is the device as last seen; an absent device keeps exporting
+	// its labels (IP, hostname, type) from it.
+	last Device
+	// edges counts transitions into each state since the device was first
+	// seen, for wifi_device_transitions_total.
+	edges map[string]uint64
+}
+
+// PresenceRecord is a device in the presence registry. Absent devices stay
+// until scan.offline_retention has passed since they were last seen, by the
+// monotonic clock; LastSeen is only for display (see wallTime).
+type PresenceRecord struct {
+	Device   Device            `json:"device"`
+	Online   bool              `json:"online"`
+	LastSeen time.Time         `json:"last_seen"`
+	Edges    map[string]uint64 `json:"transitions"`
+}
+
+// Presence states of wifi_device_transitions_total.
+const (
+	presenceOnline  = "online"
+	presenceOffline = "offline"
+)
+
+func (s *scanner) addPresence(key string, p *presenceState) {
+	s.presence[key] = p
+	if d := p.last; d.Proxied {
+		keys := s.proxiedPresence[d.MAC]
+		if keys == nil {
+			keys = make(map[string]bool)
+			s.proxiedPresence[d.MAC] = keys
+		}
+		keys[key] = true
+	}
+}
+
+func (s *scanner) deletePresence(key string) {
+	p, ok := s.presence[key]
+	if !ok {
+		return
+	}
+	delete(s.presence, key)
+	if d := p.last; d.Proxied {
+		keys := s.proxiedPresence[d.MAC]
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(s.proxiedPresence, d.MAC)
+		}
+	}
+}
+
+func (p *presenceState) transition(now time.Time) {
+	p.online = !p.online
+	p.transitions = append(p.transitions, now)
+	if p.online {
+		p.edges[presenceOnline]++
+	} else {
+		p.edges[presenceOffline]++
+	}
+}
+
+// trim drops transitions older than the window. Each timestamp is appended
+// and removed once, so the cost is amortized O(1) per scan.
+func (p *presenceState) trim(now time.Time) {
+	i := 0
+	for i < len(p.transitions) && now.Sub(p.transitions[i]) > flapWindow {
+		i++
+	}
+	p.transitions = p.transitions[i:]
+}
+
+// updatePresence records sightings for this scan, observes the gap since
+// each device was last seen, fills in the per-device flap counts and
+// returns the registry, absent devices included, sorted by key.
+func (s *scanner) updatePresence(cfg ScanConfig, devices []Device, now time.Time) []PresenceRecord {
+	seen := make(map[string]bool, len(devices))
+	for i := range devices {
+		key := devices[i].key()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		s.dropOtherProxyMode(devices[i])
+
+		p, ok := s.presence[key]
+		if !ok {
+			p = &presenceState{online: true, last: devices[i], edges: map[string]uint64{presenceOnline: 0, presenceOffline: 0}}
+			s.addPresence(key, p)
+		} else {
+			s.m.SightingGap.Observe(now.Sub(p.lastSeen).Seconds())
+			if !p.online {
+				p.transition(now)
+			}
+		}
+		p.lastSeen = now
+		p.trim(now)
+		devices[i].Flaps24h = len(p.transitions)
+		p.last = devices[i]
+	}
+
+	for key, p := range s.presence {
+		if seen[key] {
+			continue
+		}
+		if p.online {
+			p.transition(now)
+		}
+		p.trim(now)
+		if now.Sub(p.lastSeen) > cfg.offlineRetention() {
+			s.deletePresence(key)
+		}
+	}
+
+	keys := make([]string, 0, len(s.presence))
+	for key := range s.presence {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	records := make([]PresenceRecord, 0, len(keys))
+	for _, key := range keys {
+		p := s.presence[key]
+		edges := make(map[string]uint64, len(p.edges))
+		for state, n := range p.edges {
+			edges[state] = n
+		}
+		records = append(records, PresenceRecord{Device: p.last, Online: p.online, LastSeen: wallTime(p.lastSeen, now), Edges: edges})
+	}
+	return records
+}
+
+// dropOtherProxyMode forgets the entries a device's MAC had in the other
+// proxy-ARP mode, so an AP starting or stopping to proxy does not leave
+// absent duplicates of the same devices behind.
+func (s *scanner) dropOtherProxyMode(d Device) {
+	if d.MAC == unknownMAC {
+		return
+	}
+	if !d.Proxied {
+		for key := range s.proxiedPresence[d.MAC] {
+			s.deletePresence(key)
+		}
+		return
+	}
+	s.deletePresence(d.MAC)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// presenceScanner is an unnamed scanner whose collectors are registered on
+// the returned registry.
+func presenceScanner(t *testing.T) (*scanner, *prometheus.Registry) {
+	t.Helper()
+	reg := prometheus.NewPedanticRegistry()
+	s := newScanner("", 1)
+	s.m = NewMetrics(reg, "").forScanner(reg, s)
+	return s, reg
+}
+
+// scanCycle runs the presence step of one scan that found devices at now,
+// publishes it and returns the per-device series as "name{labels}" ->
+// value, labels sorted by name as gathered.
+func scanCycle(t *testing.T, s *scanner, reg *prometheus.Registry, cfg ScanConfig, now time.Time, devices ...Device) map[string]float64 {
+	t.Helper()
+	presence := s.updatePresence(cfg, devices, now)
+	s.publishScan(&ScanSnapshot{Devices: devices, Presence: presence, TakenAt: now})
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := make(map[string]float64)
+	for _, mf := range mfs {
+		switch mf.GetName() {
+		case "wifi_connected_devices", "wifi_device_last_seen_timestamp_seconds", "wifi_device_transitions_total":
+		default:
+			continue
+		}
+		for _, m := range mf.Metric {
+			var labels []string
+			for _, l := range m.Label {
+				switch l.GetName() {
+				case "mac", "ip", "hostname", "state":
+					labels = append(labels, l.GetName()+"="+l.GetValue())
+				}
+			}
+			value := m.GetGauge().GetValue()
+			if m.Counter != nil {
+				value = m.GetCounter().GetValue()
+			}
+			series[mf.GetName()+"{"+strings.Join(labels, ",")+"}"] = value
+		}
+	}
+	return series
+}
+
+func TestPresenceCycles(t *testing.T) {
+	s, reg := presenceScanner(t)
+	cfg := ScanConfig{OfflineRetention: time.Hour}
+	t0 := time.Now()
+	tv := Device{IP: "192.168.1.10", MAC: "aa:bb:cc:00:00:01", HostnameLabel: "tv", DeviceType: "apple"}
+	moved := tv
+	moved.IP = "192.168.1.20"
+	lastSeen := func(at time.Time) float64 { return float64(wallTime(at, at).Unix()) }
+
+	for _, tc := range []struct {
+		name    string
+		at      time.Time
+		devices []Device
+		want    map[string]float64
+	}{
+		{"appears", t0, []Device{tv}, map[string]float64{
+			"wifi_connected_devices{hostname=tv,ip=192.168.1.10,mac=aa:bb:cc:00:00:01}":                  1,
+			"wifi_device_last_seen_timestamp_seconds{hostname=tv,ip=192.168.1.10,mac=aa:bb:cc:00:00:01}": lastSeen(t0),
+			"wifi_device_transitions_total{mac=aa:bb:cc:00:00:01,state=online}":                          0,
+			"wifi_device_transitions_total{mac=aa:bb:cc:00:00:01,state=offline}":                         0,
+		}},
+		// An absent device keeps its labels and goes to 0.
+		{"disappears", t0.Add(30 * time.Second), nil, map[string]float64{
+			"wifi_connected_devices{hostname=tv,ip=192.168.1.10,mac=aa:bb:cc:00:00:01}":                  0,
+			"wifi_device_last_seen_timestamp_seconds{hostname=tv,ip=192.168.1.10,mac=aa:bb:cc:00:00:01}": lastSeen(t0),
+			"wifi_device_transitions_total{mac=aa:bb:cc:00:00:01,state=online}":                          0,
+			"wifi_device_transitions_total{mac=aa:bb:cc:00:00:01,state=offline}":                         1,
+		}},
+		{"stays away", t0.Add(time.Minute), nil, map[string]float64{
+			"wifi_connected_devices{hostname=tv,ip=192.168.1.10,mac=aa:bb:cc:00:00:01}":                  0,
+			"wifi_device_last_seen_timestamp_seconds{hostname=tv,ip=192.168.1.10,mac=aa:bb:cc:00:00:01}": lastSeen(t0),
+			"wifi_device_transitions_total{mac=aa:bb:cc:00:00:01,state=online}":                          0,
+			"wifi_device_transitions_total{mac=aa:bb:cc:00:00:01,state=offline}":                         1,
+		}},
+		// A new DHCP lease moves the one series instead of adding one.
+		{"reappears with a new IP", t0.Add(2 * time.Minute), []Device{moved}, map[string]float64{
+			"wifi_connected_devices{hostname=tv,ip=192.168.1.20,mac=aa:bb:cc:00:00:01}":                  1,
+			"wifi_device_last_seen_timestamp_seconds{hostname=tv,ip=192.168.1.20,mac=aa:bb:cc:00:00:01}": lastSeen(t0.Add(2 * time.Minute)),
+			"wifi_device_transitions_total{mac=aa:bb:cc:00:00:01,state=online}":                          1,
+			"wifi_device_transitions_total{mac=aa:bb:cc:00:00:01,state=offline}":                         1,
+		}},
+		{"leaves again", t0.Add(3 * time.Minute), nil, map[string]float64{
+			"wifi_connected_devices{hostname=tv,ip=192.168.1.20,mac=aa:bb:cc:00:00:01}":                  0,
+			"wifi_device_last_seen_timestamp_seconds{hostname=tv,ip=192.168.1.20,mac=aa:bb:cc:00:00:01}": lastSeen(t0.Add(2 * time.Minute)),
+			"wifi_device_transitions_total{mac=aa:bb:cc:00:00:01,state=online}":                          1,
+			"wifi_device_transitions_total{mac=aa:bb:cc:00:00:01,state=offline}":                         2,
+		}},
+		{"evicted after offline_retention", t0.Add(2*time.Minute + time.Hour + time.Second), nil, map[string]float64{}},
+	} {
+		got := scanCycle(t, s, reg, cfg, tc.at, tc.devices...)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s:\ngot  %v\nwant %v", tc.name, got, tc.want)
+		}
+	}
+	if len(s.presence) != 0 {
+		t.Errorf("registry keeps %d entries after eviction", len(s.presence))
+	}
+}
+
+func TestPresenceFlaps(t *testing.T) {
+	s, _ := presenceScanner(t)
+	cfg := ScanConfig{}
+	t0 := time.Now()
+	d := Device{IP: "192.168.1.10", MAC: "aa:bb:cc:00:00:01"}
+	for i := range 4 {
+		at := t0.Add(time.Duration(i) * time.Hour)
+		if i%2 == 0 {
+			s.updatePresence(cfg, []Device{d}, at)
+		} else {
+			s.updatePresence(cfg, nil, at)
+		}
+	}
+	// Back online for the fourth edge; a day later they have all aged out.
+	devices := []Device{d}
+	s.updatePresence(cfg, devices, t0.Add(4*time.Hour))
+	if devices[0].Flaps24h != 4 {
+		t.Errorf("flaps %d, want 4", devices[0].Flaps24h)
+	}
+	devices = []Device{d}
+	s.updatePresence(cfg, devices, t0.Add(4*time.Hour+flapWindow+time.Minute))
+	if devices[0].Flaps24h != 0 {
+		t.Errorf("flaps %d a day later, want 0", devices[0].Flaps24h)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ScanConfig struct {
+	// Interface and SourceIP pin the probes to one interface/address on
+	// multi-homed hosts so the ARP cache of the target network populates.
+	Interface string `yaml:"interface"`
+	SourceIP  string `yaml:"source_ip"`
+	// Interfaces scans several networks, each through its own interface
+	// (e.g. VLAN subinterfaces), instead of network.cidrs.
+	Interfaces []ScanInterface `yaml:"interfaces"`
+	// AutoFollowInterface scans the interface's own subnets while the
+	// configured range matches none of them (see
+	// telemetry_config_subnet_mismatch).
+	AutoFollowInterface bool `yaml:"auto_follow_interface"`
+	// ChunkSize limits how many addresses are probed per cycle; 0 probes
+	// the whole range every time.
+	ChunkSize int `yaml:"chunk_size"`
+	// MaxPacketsPerCycle stops probing further addresses once a scan has
+	// sent this many packets (see telemetry_scan_packets_sent_total); the
+	// addresses left out count as unprobed in the scan stats. Name lookups
+	// of the devices found afterwards are not held back. 0 disables the
+	// budget.
+	MaxPacketsPerCycle int `yaml:"max_packets_per_cycle"`
+	// MaxTrackedDevices caps the devices exported as individual series;
+	// unknown randomized-MAC devices beyond it are counted in
+	// wifi_guest_devices_total instead. 0 disables the cap.
+	MaxTrackedDevices int `yaml:"max_tracked_devices"`
+	// Probe is "unicast" (ping every address, the default) or "broadcast"
+	// (one broadcast ping plus mDNS/SSDP queries, then read the neighbor
+	// table after BroadcastSettle). ProbeFallback "unicast" pings the
+	// addresses the broadcast phase did not find.
+	Probe           string        `yaml:"probe"`
+	ProbeFallback   string        `yaml:"probe_fallback"`
+	BroadcastSettle time.Duration `yaml:"broadcast_settle"`
+	// BlockStartup holds the HTTP listener back until the first scan has
+	// finished, for at most StartupTimeout (default 60s).
+	BlockStartup   bool          `yaml:"block_startup"`
+	StartupTimeout time.Duration `yaml:"startup_timeout"`
+	// OfflineRetention is how long an absent device keeps its series, at
+	// value 0, before it is forgotten (default 24h).
+	OfflineRetention time.Duration `yaml:"offline_retention"`
+	// ProxyARPThreshold is how many IPs one MAC may answer for before they
+	// are tracked as separate proxied devices (default 2).
+	ProxyARPThreshold int `yaml:"proxy_arp_threshold"`
+	// PingCommand probes with an external command instead.
+	PingCommand PingCommandConfig `yaml:"ping_command"`
+}
+
+func (c ScanConfig) startupTimeout() time.Duration {
+	if c.StartupTimeout <= 0 {
+		return 60 * time.Second
+	}
+	return c.StartupTimeout
+}
+
+const (
+	stateOnline  = "online"
+	stateDormant = "dormant"
+)
+
+var deviceStates = []string{stateOnline, stateDormant}
+
+// deviceState classifies a device from its probe results. A fresh ARP entry
+// without an ICMP reply is a sleeping device (e.g. behind a Bonjour sleep
+// proxy) rather than an absent one.
+func deviceState(p ProbeResult) string {
+	if p.ARPSeen && p.ICMPProbed && !p.ICMPReplied {
+		return stateDormant
+	}
+	return stateOnline
+}
+
+func pingArgs(ip string, cfg ScanConfig, goos string) []string {
+	args := []string{"-c", "1", "-W", "1"}
+	switch goos {
+	case "darwin":
+		if cfg.Interface != "" {
+			args = append(args, "-b", cfg.Interface) // IP_BOUND_IF
+		}
+		if cfg.SourceIP != "" {
+			args = append(args, "-S", cfg.SourceIP)
+		}
+	default:
+		// -I accepts either an interface name (SO_BINDTODEVICE) or an address.
+		if cfg.Interface != "" {
+			args = append(args, "-I", cfg.Interface)
+		} else if cfg.SourceIP != "" {
+			args = append(args, "-I", cfg.SourceIP)
+		}
+	}
+	return append(args, ip)
+}
+
+// pingError classifies a failed system ping: exit status 1 on Linux, 2 on
+// macOS and the BSDs, means no reply came back.
+func pingError(err error, goos string) error {
+	noReply := 2
+	if goos == "linux" {
+		noReply = 1
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == noReply {
+		return classified(ErrTimeout, err)
+	}
+	return err
+}
+
+// parsePingRTT extracts the "time=1.23 ms" of a ping reply line.
+func parsePingRTT(out string) time.Duration {
+	i := strings.Index(out, "time=")
+	if i < 0 {
+		return 0
+	}
+	field := out[i+len("time="):]
+	if end := strings.IndexAny(field, " m\n"); end >= 0 {
+		field = field[:end]
+	}
+	ms, err := strconv.ParseFloat(field, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// validateProbeSource checks that the configured source interface/address
+// actually sits in the scanned range.
+func validateProbeSource(cfg ScanConfig, r scanRange) error {
+	if cfg.SourceIP != "" {
+		ip := net.ParseIP(cfg.SourceIP)
+		if ip == nil {
+			return fmt.Errorf("scan.source_ip %q is not a valid IP address", cfg.SourceIP)
+		}
+		if !r.contains(ip) {
+			return fmt.Errorf("scan.source_ip %s is not in scan range %s", cfg.SourceIP, r)
+		}
+	}
+
+	if cfg.Interface == "" {
+		return nil
+	}
+	iface, err := net.InterfaceByName(cfg.Interface)
+	if err != nil {
+		return fmt.Errorf("scan.interface %s: %v", cfg.Interface, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return fmt.Errorf("scan.interface %s: failed to list addresses: %v", cfg.Interface, err)
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if cfg.SourceIP != "" && !ipNet.IP.Equal(net.ParseIP(cfg.SourceIP)) {
+			continue
+		}
+		if r.contains(ipNet.IP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("scan.interface %s has no address in scan range %s", cfg.Interface, r)
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// bindToInterface pins an IPv4 socket to iface with IP_BOUND_IF, so its
+// packets leave through iface whatever the routing table prefers.
+func bindToInterface(fd uintptr, iface string) error {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_BOUND_IF, ifi.Index)
+}
@@ -0,0 +1,9 @@
+package main
+
+import "syscall"
+
+// bindToInterface pins a socket to iface with SO_BINDTODEVICE, so its
+// packets leave through iface whatever the routing table prefers.
+func bindToInterface(fd uintptr, iface string) error {
+	return syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+}
@@ -0,0 +1,23 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"net"
+
+	"golang.org/x/net/icmp"
+)
+
+// bindToInterface does nothing here: there is no per-socket interface
+// option to set, so probes are only bound to the interface's address.
+func bindToInterface(fd uintptr, iface string) error {
+	return nil
+}
+
+func listenPingSocket(source, iface string) (net.PacketConn, error) {
+	conn, err := icmp.ListenPacket("udp4", source)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,45 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// ipStripHdr makes darwin's ICMP datagram sockets return the message
+// without the IPv4 header, as on Linux.
+const ipStripHdr = 0x17
+
+// listenPingSocket opens an unprivileged ICMP datagram socket bound to
+// source and pinned to iface. It is what icmp.ListenPacket("udp4", ...)
+// does, with the interface set before the socket is bound.
+func listenPingSocket(source, iface string) (net.PacketConn, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_ICMP)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if runtime.GOOS == "darwin" {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, ipStripHdr, 1); err != nil {
+			syscall.Close(fd)
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if err := bindToInterface(uintptr(fd), iface); err != nil {
+		syscall.Close(fd)
+		return nil, &bindFailure{iface, err}
+	}
+	sa := &syscall.SockaddrInet4{}
+	if ip := net.ParseIP(source).To4(); ip != nil {
+		copy(sa.Addr[:], ip)
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	f := os.NewFile(uintptr(fd), "icmp datagram socket")
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
@@ -0,0 +1,64 @@
+package main
+
+import "sort"
+
+func (c ScanConfig) proxyARPThreshold() int {
+	if c.ProxyARPThreshold <= 0 {
+		return 2
+	}
+	return c.ProxyARPThreshold
+}
+
+// proxiedKey identifies one of several devices behind a proxy-ARP MAC.
+func proxiedKey(ip, mac string) string {
+	return mac + "@" + ip
+}
+
+// key is the device's key for the per-device caches and the presence
+// registry: its MAC, or MAC and IP while that MAC is proxied.
+func (d Device) key() string {
+	if d.Proxied {
+		return proxiedKey(d.IP, d.MAC)
+	}
+	return deviceKey(d.IP, d.MAC)
+}
+
+// proxiedMACs returns the MACs answering for more IPs than
+// scan.proxy_arp_threshold (typically a mesh AP proxying ARP for its
+// wireless clients), or forced either way by proxy_arp on their devices:
+// entry. Every IP of such a MAC is tracked as a device of its own.
+func (s *scanner) proxiedMACs(cfg Config, table map[string]string) map[string]bool {
+	ips := make(map[string][]string)
+	for ip, mac := range table {
+		if mac != unknownMAC {
+			ips[mac] = append(ips[mac], ip)
+		}
+	}
+	proxied := make(map[string]bool)
+	for mac, list := range ips {
+		on := len(list) > cfg.Scan.proxyARPThreshold()
+		if dc, ok := cfg.deviceConfig(mac); ok && dc.ProxyARP != nil {
+			on = *dc.ProxyARP
+		}
+		if on {
+			proxied[mac] = true
+		}
+		if on != s.proxyARP[mac] {
+			sort.Strings(list)
+			s.emitEvent("proxy_arp_changed", map[string]interface{}{
+				"mac":     mac,
+				"proxied": on,
+				"ips":     list,
+			})
+		}
+	}
+	for mac := range s.proxyARP {
+		if _, ok := ips[mac]; !ok {
+			delete(s.proxyARP, mac)
+		}
+	}
+	for mac := range ips {
+		s.proxyARP[mac] = proxied[mac]
+	}
+	return proxied
+}
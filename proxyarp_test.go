@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+const apMAC = "aa:bb:cc:00:00:0a"
+
+// proxyScan runs the proxy-ARP detection and presence steps of one scan
+// over table, as scanAndUpdateMetrics does, and returns the presence keys.
+func proxyScan(s *scanner, cfg Config, table map[string]string, now time.Time) []string {
+	proxied := s.proxiedMACs(cfg, table)
+	var devices []Device
+	for ip, mac := range table {
+		devices = append(devices, Device{IP: ip, MAC: mac, Proxied: proxied[mac]})
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].IP < devices[j].IP })
+	var keys []string
+	for _, rec := range s.updatePresence(cfg.Scan, devices, now) {
+		keys = append(keys, rec.Device.key())
+	}
+	return keys
+}
+
+// proxyEvents returns the proxied flag of every proxy_arp_changed event
+// after seq, by MAC.
+func proxyEvents(seq uint64) map[string]bool {
+	events, _ := recentEvents(seq)
+	out := make(map[string]bool)
+	for _, ev := range events {
+		if ev.Type == "proxy_arp_changed" {
+			out[ev.Fields["mac"].(string)] = ev.Fields["proxied"].(bool)
+		}
+	}
+	return out
+}
+
+func TestProxiedMACs(t *testing.T) {
+	on, off := true, false
+	table := map[string]string{
+		"192.168.1.2": apMAC, "192.168.1.3": apMAC, "192.168.1.4": apMAC,
+		"192.168.1.5": "aa:bb:cc:00:00:01", "192.168.1.6": "aa:bb:cc:00:00:01",
+		"192.168.1.7": "aa:bb:cc:00:00:02",
+		"192.168.1.8": unknownMAC, "192.168.1.9": unknownMAC, "192.168.1.10": unknownMAC,
+	}
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+		want map[string]bool
+	}{
+		{"default threshold", Config{}, map[string]bool{apMAC: true}},
+		{"higher threshold", Config{Scan: ScanConfig{ProxyARPThreshold: 3}}, map[string]bool{}},
+		{"lower threshold", Config{Scan: ScanConfig{ProxyARPThreshold: 1}}, map[string]bool{apMAC: true, "aa:bb:cc:00:00:01": true}},
+		{"forced off", Config{Devices: []DeviceConfig{{MAC: "AA:BB:CC:00:00:0A", ProxyARP: &off}}}, map[string]bool{}},
+		{"forced on", Config{Devices: []DeviceConfig{{MAC: "aa:bb:cc:00:00:02", ProxyARP: &on}}}, map[string]bool{apMAC: true, "aa:bb:cc:00:00:02": true}},
+	} {
+		s := newScanner("", 1)
+		if got := s.proxiedMACs(tc.cfg, table); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestProxyARPTransitions(t *testing.T) {
+	s, _ := presenceScanner(t)
+	cfg := Config{}
+	t0 := time.Now()
+	alone := map[string]string{"192.168.1.2": apMAC, "192.168.1.7": "aa:bb:cc:00:00:02"}
+	proxying := map[string]string{"192.168.1.2": apMAC, "192.168.1.3": apMAC, "192.168.1.4": apMAC, "192.168.1.7": "aa:bb:cc:00:00:02"}
+
+	for _, tc := range []struct {
+		name   string
+		table  map[string]string
+		want   []string
+		events map[string]bool
+	}{
+		{"one IP per MAC", alone, []string{"aa:bb:cc:00:00:02", apMAC}, map[string]bool{}},
+		// The AP's own entry goes; each IP behind it is a device.
+		{"starts proxying", proxying, []string{"aa:bb:cc:00:00:02", apMAC + "@192.168.1.2", apMAC + "@192.168.1.3", apMAC + "@192.168.1.4"}, map[string]bool{apMAC: true}},
+		{"keeps proxying", proxying, []string{"aa:bb:cc:00:00:02", apMAC + "@192.168.1.2", apMAC + "@192.168.1.3", apMAC + "@192.168.1.4"}, map[string]bool{}},
+		// No absent proxied duplicates are left behind.
+		{"stops proxying", alone, []string{"aa:bb:cc:00:00:02", apMAC}, map[string]bool{apMAC: false}},
+	} {
+		_, seq := recentEvents(0)
+		got := proxyScan(s, cfg, tc.table, t0)
+		sort.Strings(got)
+		sort.Strings(tc.want)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: presence %v, want %v", tc.name, got, tc.want)
+		}
+		if events := proxyEvents(seq); !reflect.DeepEqual(events, tc.events) {
+			t.Errorf("%s: proxy_arp_changed %v, want %v", tc.name, events, tc.events)
+		}
+		t0 = t0.Add(30 * time.Second)
+	}
+	if len(s.proxiedPresence) != 0 {
+		t.Errorf("proxied index keeps %v", s.proxiedPresence)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RegistryConfig sets the device inventory: every device ever seen, with
+// when it was first and last seen, also for devices long gone from the
+// presence registry.
+type RegistryConfig struct {
+	// StateFile keeps the inventory in a JSON file across restarts, so
+	// first-seen times, the cohorts and wifi_devices_discovered_total
+	// survive them. Empty keeps it in memory only.
+	StateFile string `yaml:"state_file"`
+	// Retention forgets devices not seen for this long (default 90 days);
+	// one that comes back counts as discovered again.
+	Retention time.Duration `yaml:"retention"`
+}
+
+func (c RegistryConfig) retention() time.Duration {
+	if c.Retention <= 0 {
+		return 90 * 24 * time.Hour
+	}
+	return c.Retention
+}
+
+// KnownDevice is a device in the inventory, as the state file keeps it.
+type KnownDevice struct {
+	MAC        string    `json:"mac"`
+	IP         string    `json:"ip"`
+	Hostname   string    `json:"hostname"`
+	DeviceType string    `json:"device_type"`
+	Vendor     string    `json:"vendor,omitempty"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	// Sightings counts the scans that saw the device.
+	Sightings uint64 `json:"sightings"`
+}
+
+// inventoryDevice is a device as /api/v1/inventory serves it.
+type inventoryDevice struct {
+	KnownDevice
+	// Online is whether the last scan saw the device.
+	Online bool `json:"online"`
+}
+
+// registryState is the state file's content, at registryStateVersion;
+// older files are migrated when read (see registryMigrations).
+type registryState struct {
+	Version int           `json:"version"`
+	Devices []KnownDevice `json:"devices"`
+}
+
+// deviceRegistry is a scanner's inventory.
+type deviceRegistry struct {
+	// cfg is the registry config the scanner started with; prunes from
+	// the API write its state file.
+	cfg RegistryConfig
+	// mu guards devices and pruned: the scan loop updates the inventory,
+	// and prunes from the API delete from it.
+	mu sync.Mutex
+	// devices is keyed by MAC; devices without one (IP-only) are left
+	// out, their address is no identity.
+	devices map[string]*KnownDevice
+	// pruned are the MACs pruned since the last scan, whose first-seen
+	// times the scan loop forgets.
+	pruned []string
+
+	last atomic.Pointer[[]inventoryDevice]
+}
+
+// loadRegistry reads the state file into the inventory and seeds the
+// first-seen times and cohorts from it. A missing file is an empty
+// inventory; an older one is backed up and rewritten at the current
+// version first.
+func (s *scanner) loadRegistry(cfg RegistryConfig) error {
+	s.registry.cfg = cfg
+	if cfg.StateFile == "" {
+		return nil
+	}
+	state, from, err := readRegistryState(cfg.StateFile)
+	if err != nil {
+		return err
+	}
+	if from < registryStateVersion {
+		backup, err := backupRegistryState(cfg.StateFile, from)
+		if err != nil {
+			return err
+		}
+		if err := saveRegistry(cfg.StateFile, state.Devices); err != nil {
+			return err
+		}
+		log.Printf("Migrated %s from version %d to %d; the old file is %s", cfg.StateFile, from, registryStateVersion, backup)
+	}
+	sort.Slice(state.Devices, func(i, j int) bool { return state.Devices[i].FirstSeen.Before(state.Devices[j].FirstSeen) })
+	for i := range state.Devices {
+		d := state.Devices[i]
+		s.registry.devices[d.MAC] = &d
+		s.firstSeen[d.MAC] = d.FirstSeen
+		s.cohorts.noteFirstSeen(d.MAC, d.FirstSeen)
+	}
+	return nil
+}
+
+// updateRegistry records the devices of a scan, forgets those past
+// registry.retention, writes the state file and publishes the inventory.
+// Called by the scan loop after the scan is published.
+func (s *scanner) updateRegistry(cfg RegistryConfig, devices []Device, now time.Time) {
+	r := &s.registry
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	online := make(map[string]bool, len(devices))
+	for _, d := range devices {
+		if d.MAC == unknownMAC || d.Proxied || online[d.MAC] {
+			continue
+		}
+		online[d.MAC] = true
+		k, ok := r.devices[d.MAC]
+		if !ok {
+			k = &KnownDevice{MAC: d.MAC, FirstSeen: d.FirstSeen}
+			r.devices[d.MAC] = k
+		}
+		k.IP, k.DeviceType, k.Vendor = d.IP, d.DeviceType, d.Vendor
+		if d.Hostname != "" {
+			k.Hostname = d.Hostname
+		}
+		k.LastSeen = now
+		k.Sightings++
+	}
+	for mac, k := range r.devices {
+		if !online[mac] && now.Sub(k.LastSeen) > cfg.retention() {
+			delete(r.devices, mac)
+			delete(s.firstSeen, mac)
+		}
+	}
+	// A pruned device seen again keeps its first-seen time and cohort.
+	gone := make(map[string]bool)
+	back := make(map[string]time.Time)
+	for _, mac := range r.pruned {
+		if !online[mac] {
+			delete(s.firstSeen, mac)
+			gone[mac] = true
+		} else if at, ok := s.firstSeen[mac]; ok {
+			back[mac] = at
+		}
+	}
+	if len(gone) > 0 {
+		s.forgetCohorts(gone)
+	}
+	if len(back) > 0 {
+		s.rejoinCohorts(back)
+	}
+	r.pruned = nil
+	r.publish(cfg, online)
+}
+
+// publish publishes the inventory and writes the state file. The caller
+// holds r.mu.
+func (r *deviceRegistry) publish(cfg RegistryConfig, online map[string]bool) {
+	devices := make([]KnownDevice, 0, len(r.devices))
+	for _, k := range r.devices {
+		devices = append(devices, *k)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].MAC < devices[j].MAC })
+	list := make([]inventoryDevice, len(devices))
+	for i, d := range devices {
+		list[i] = inventoryDevice{KnownDevice: d, Online: online[d.MAC]}
+	}
+	r.last.Store(&list)
+
+	if cfg.StateFile != "" {
+		if err := saveRegistry(cfg.StateFile, devices); err != nil {
+			errorLog.Printf("Error writing device registry: %v", err)
+		}
+	}
+}
+
+// saveRegistry replaces the state file, through a temporary file so a
+// crash never leaves a truncated one behind.
+func saveRegistry(path string, devices []KnownDevice) error {
+	data, err := json.MarshalIndent(registryState{Version: registryStateVersion, Devices: devices}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// inventoryHandler serves GET /api/v1/inventory.
+func inventoryHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := scannerFor(w, r)
+	if !ok {
+		return
+	}
+	list := s.registry.last.Load()
+	if list == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no scan yet"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"devices": *list})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// registryMigrations upgrade the state file one version at a time:
+// registryMigrations[i] turns version i+1 into version i+2. They work on
+// the decoded JSON rather than on registryState, so an old migration keeps
+// meaning what it did when KnownDevice changes later. Append only.
+var registryMigrations = []func(state map[string]interface{}) error{
+	// 1 to 2: online was written with every device, but it only means
+	// something in the served inventory.
+	func(state map[string]interface{}) error {
+		devices, _ := state["devices"].([]interface{})
+		for i, d := range devices {
+			device, ok := d.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("device %d is not an object", i)
+			}
+			delete(device, "online")
+		}
+		return nil
+	},
+}
+
+// registryStateVersion is the state file version this binary writes.
+var registryStateVersion = len(registryMigrations) + 1
+
+// readRegistryState reads a state file, migrated to registryStateVersion
+// in memory. from is the version the file had; a missing file is an empty
+// inventory at the current version. Every migration has to succeed, or
+// nothing is returned; a file from a newer binary is refused.
+func readRegistryState(path string) (state registryState, from int, err error) {
+	state = registryState{Version: registryStateVersion, Devices: []KnownDevice{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, registryStateVersion, nil
+	}
+	if err != nil {
+		return state, 0, err
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return state, 0, fmt.Errorf("%s: %v", path, err)
+	}
+	version, ok := raw["version"].(float64)
+	from = int(version)
+	switch {
+	case !ok || from < 1 || float64(from) != version:
+		return state, 0, fmt.Errorf("%s: no valid version; is it a device registry state file?", path)
+	case from > registryStateVersion:
+		return state, from, fmt.Errorf("%s is version %d, written by a newer exporter; this one reads up to version %d", path, from, registryStateVersion)
+	}
+	for v := from; v < registryStateVersion; v++ {
+		if err := registryMigrations[v-1](raw); err != nil {
+			return state, from, fmt.Errorf("%s: migrating version %d to %d: %v", path, v, v+1, err)
+		}
+		raw["version"] = v + 1
+	}
+	if data, err = json.Marshal(raw); err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil {
+		return state, from, fmt.Errorf("%s: %v", path, err)
+	}
+	return state, from, nil
+}
+
+// backupRegistryState copies a state file of version from next to it
+// before it is overwritten at the current version, and returns the copy's
+// path.
+func backupRegistryState(path string, from int) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	backup := fmt.Sprintf("%s.v%d.bak", path, from)
+	if err := os.WriteFile(backup, data, 0o644); err != nil {
+		return "", fmt.Errorf("backing up %s before migrating it: %v", path, err)
+	}
+	return backup, nil
+}
+
+// runStoreCommand is `store info`: the version and device counts of
+// registry.state_file, without changing it.
+func runStoreCommand(args []string) int {
+	fs := flag.NewFlagSet("store info", flag.ContinueOnError)
+	scannerName := fs.String("scanner", "", "read this scanner's state file (required with scanners:)")
+	if len(args) == 0 || args[0] != "info" || fs.Parse(args[1:]) != nil || fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: store info [-scanner NAME]")
+		return 2
+	}
+	cfg, err := loadScannerConfig(*scannerName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "store info:", err)
+		return 1
+	}
+	path := cfg.Registry.StateFile
+	if path == "" {
+		fmt.Fprintf(os.Stderr, "store info: registry.state_file is not set in %s\n", cfgPath)
+		return 1
+	}
+	if _, err := os.Stat(path); err != nil {
+		fmt.Fprintln(os.Stderr, "store info:", err)
+		return 1
+	}
+	state, from, err := readRegistryState(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "store info:", err)
+		return 1
+	}
+	fmt.Printf("state file: %s\n", path)
+	if from < registryStateVersion {
+		fmt.Printf("version:    %d (migrated to %d when the exporter starts)\n", from, registryStateVersion)
+	} else {
+		fmt.Printf("version:    %d\n", from)
+	}
+	byType := make(map[string]int)
+	for _, d := range state.Devices {
+		byType[d.DeviceType]++
+	}
+	types := make([]string, 0, len(byType))
+	for t := range byType {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	counts := make([]string, len(types))
+	for i, t := range types {
+		counts[i] = fmt.Sprintf("%s %d", t, byType[t])
+	}
+	fmt.Printf("devices:    %d", len(state.Devices))
+	if len(counts) > 0 {
+		fmt.Printf(" (%s)", strings.Join(counts, ", "))
+	}
+	fmt.Println()
+	return 0
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// registryV1 is a state file as version 1 wrote it, online included.
+const registryV1 = `{
+  "version": 1,
+  "devices": [
+    {"mac": "aa:bb:cc:00:00:01", "ip": "192.168.1.10", "hostname": "tv", "device_type": "apple", "vendor": "Apple",
+     "first_seen": "2024-01-02T03:04:05Z", "last_seen": "2024-02-01T00:00:00Z", "sightings": 12, "online": true},
+    {"mac": "aa:bb:cc:00:00:02", "ip": "192.168.1.11", "hostname": "", "device_type": "unknown",
+     "first_seen": "2024-01-03T00:00:00Z", "last_seen": "2024-01-03T00:00:00Z", "sightings": 1, "online": false}
+  ]
+}`
+
+func writeState(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "registry.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadRegistryStateMigratesV1(t *testing.T) {
+	state, from, err := readRegistryState(writeState(t, registryV1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 1 || state.Version != registryStateVersion {
+		t.Fatalf("from %d version %d, want 1 and %d", from, state.Version, registryStateVersion)
+	}
+	want := []KnownDevice{
+		{MAC: "aa:bb:cc:00:00:01", IP: "192.168.1.10", Hostname: "tv", DeviceType: "apple", Vendor: "Apple",
+			FirstSeen: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), LastSeen: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), Sightings: 12},
+		{MAC: "aa:bb:cc:00:00:02", IP: "192.168.1.11", DeviceType: "unknown",
+			FirstSeen: time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC), LastSeen: time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC), Sightings: 1},
+	}
+	if len(state.Devices) != len(want) {
+		t.Fatalf("got %d devices, want %d", len(state.Devices), len(want))
+	}
+	for i := range want {
+		got := state.Devices[i]
+		if got.MAC != want[i].MAC || got.IP != want[i].IP || got.Hostname != want[i].Hostname ||
+			got.DeviceType != want[i].DeviceType || got.Vendor != want[i].Vendor || got.Sightings != want[i].Sightings ||
+			!got.FirstSeen.Equal(want[i].FirstSeen) || !got.LastSeen.Equal(want[i].LastSeen) {
+			t.Errorf("device %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+}
+
+// registryV2 is registryV1 as version 2 writes it.
+const registryV2 = `{
+  "version": 2,
+  "devices": [
+    {"mac": "aa:bb:cc:00:00:01", "ip": "192.168.1.10", "hostname": "tv", "device_type": "apple", "vendor": "Apple",
+     "first_seen": "2024-01-02T03:04:05Z", "last_seen": "2024-02-01T00:00:00Z", "sightings": 12},
+    {"mac": "aa:bb:cc:00:00:02", "ip": "192.168.1.11", "hostname": "", "device_type": "unknown",
+     "first_seen": "2024-01-03T00:00:00Z", "last_seen": "2024-01-03T00:00:00Z", "sightings": 1}
+  ]
+}`
+
+// registryFixtures holds the same inventory at every version; a new
+// migration needs a fixture for its version here.
+var registryFixtures = map[int]string{1: registryV1, 2: registryV2}
+
+// TestRegistryMigrationPaths reads the fixture of every version, which must
+// all end up as the same current state, and saves it, which must read back
+// without another migration.
+func TestRegistryMigrationPaths(t *testing.T) {
+	current, _, err := readRegistryState(writeState(t, registryFixtures[registryStateVersion]))
+	if err != nil {
+		t.Fatalf("no usable fixture for the current version %d: %v", registryStateVersion, err)
+	}
+	for v := 1; v <= registryStateVersion; v++ {
+		fixture, ok := registryFixtures[v]
+		if !ok {
+			t.Errorf("no fixture for version %d", v)
+			continue
+		}
+		state, from, err := readRegistryState(writeState(t, fixture))
+		if err != nil {
+			t.Errorf("version %d: %v", v, err)
+			continue
+		}
+		if from != v {
+			t.Errorf("version %d fixture read as version %d", v, from)
+		}
+		if !reflect.DeepEqual(state, current) {
+			t.Errorf("version %d migrated to %+v, want %+v", v, state, current)
+		}
+		path := filepath.Join(t.TempDir(), "registry.json")
+		if err := saveRegistry(path, state.Devices); err != nil {
+			t.Fatal(err)
+		}
+		if again, from, err := readRegistryState(path); err != nil || from != registryStateVersion || !reflect.DeepEqual(again, current) {
+			t.Errorf("version %d saved and read back as version %d: %+v, %v", v, from, again, err)
+		}
+	}
+}
+
+func TestReadRegistryStateRefuses(t *testing.T) {
+	for _, tc := range []struct {
+		name, content, want string
+	}{
+		{"newer", `{"version": 99, "devices": []}`, "written by a newer exporter"},
+		{"no version", `{"devices": []}`, "no valid version"},
+		{"zero version", `{"version": 0, "devices": []}`, "no valid version"},
+		{"fractional version", `{"version": 1.5, "devices": []}`, "no valid version"},
+		{"not json", `devices`, "invalid character"},
+		{"bad device", `{"version": 1, "devices": ["aa:bb"]}`, "device 0 is not an object"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := readRegistryState(writeState(t, tc.content))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestReadRegistryStateMissingFile(t *testing.T) {
+	state, from, err := readRegistryState(filepath.Join(t.TempDir(), "none.json"))
+	if err != nil || from != registryStateVersion || len(state.Devices) != 0 {
+		t.Errorf("got %+v, %d, %v; want an empty current state", state, from, err)
+	}
+}
+
+func TestBackupRegistryState(t *testing.T) {
+	path := writeState(t, registryV1)
+	backup, err := backupRegistryState(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backup != path+".v1.bak" {
+		t.Errorf("backup is %s", backup)
+	}
+	if data, err := os.ReadFile(backup); err != nil || string(data) != registryV1 {
+		t.Errorf("backup differs from the original (%v)", err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+func nameOrigin(source string) string {
+	if source == sourceARP {
+		return "os"
+	}
+	return "resolver"
+}
+
+type ResolutionConfig struct {
+	Enabled *bool `yaml:"enabled"`
+	// Stages toggles individual resolution stages (dns, mdns, netbios,
+	// versions, and arp for the system resolver's reverse lookup of the
+	// neighbor table entries, as `arp -a` prints them). Stages not
+	// listed are on, except arp which is opt-in.
+	Stages map[string]bool `yaml:"stages"`
+	// StaleAfter is how long a cached hostname is trusted once lookups stop.
+	StaleAfter time.Duration `yaml:"stale_after"`
+	// Timeout bounds each network lookup.
+	Timeout time.Duration `yaml:"timeout"`
+	// HostnameLabelSource picks which source feeds the hostname label:
+	// mdns, dns, netbios, arp or best (first available in that order), or
+	// ssh for what managed devices report themselves (devices[].ssh).
+	HostnameLabelSource string `yaml:"hostname_label_source"`
+	// VersionMetric exports wifi_device_version_info with the reported
+	// firmware/OS version per device.
+	VersionMetric bool `yaml:"version_metric"`
+}
+
+func (c ResolutionConfig) stageEnabled(stage string) bool {
+	if c.Enabled != nil && !*c.Enabled {
+		return false
+	}
+	enabled, ok := c.Stages[stage]
+	if !ok {
+		return stage != sourceARP
+	}
+	return enabled
+}
+
+func (c ResolutionConfig) staleAfter() time.Duration {
+	if c.StaleAfter <= 0 {
+		return 10 * time.Minute
+	}
+	return c.StaleAfter
+}
+
+func (c ResolutionConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return time.Second
+	}
+	return c.Timeout
+}
+
+type NameRecord struct {
+	Name       string    `json:"name"`
+	ResolvedAt time.Time `json:"resolved_at"`
+}
+
+// resolveNames runs every enabled stage for ip concurrently and returns
+// the names found, the error of every failed stage, and the first error if
+// nothing resolved at all.
+func (s *scanner) resolveNames(ip string, cfg ResolutionConfig) (map[string]string, map[string]error, error) {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		names    = make(map[string]string)
+		errs     = make(map[string]error)
+		firstErr error
+	)
+	for _, source := range nameSources {
+		if !cfg.stageEnabled(source) || s.enrichment.deferred(source) {
+			continue
+		}
+		wg.Add(1)
+		go func(source string) {
+			defer wg.Done()
+			name, err := nameResolvers[source](s, ip, cfg.timeout())
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[source] = err
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			names[source] = name
+		}(source)
+	}
+	wg.Wait()
+	if len(names) > 0 {
+		return names, errs, nil
+	}
+	return names, errs, firstErr
+}
+
+func pickName(records map[string]NameRecord, source string) (NameRecord, bool) {
+	if source != "" && source != "best" {
+		rec, ok := records[source]
+		return rec, ok
+	}
+	for _, s := range nameSources {
+		if rec, ok := records[s]; ok {
+			return rec, true
+		}
+	}
+	return NameRecord{}, false
+}
+
+type nameResult struct {
+	names   map[string]string
+	errs    map[string]error // per stage
+	err     error
+	version VersionRecord
+}
+
+// resolveConcurrency bounds the addresses resolved at once, shared by
+// every scanner.
+const resolveConcurrency = 32
+
+// resolveAll resolves every IP of the ARP table with bounded concurrency.
+func (s *scanner) resolveAll(table map[string]string, cfg ResolutionConfig) map[string]nameResult {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		sem     = make(chan struct{}, scannerShare(resolveConcurrency, len(scanners)))
+		results = make(map[string]nameResult, len(table))
+	)
+	for ip := range table {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(ip string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			names, errs, err := s.resolveNames(ip, cfg)
+			for source := range names {
+				s.m.HostnameOrigins.WithLabelValues(nameOrigin(source)).Inc()
+			}
+			var version VersionRecord
+			if cfg.stageEnabled(stageVersions) && !s.enrichment.deferred(stageVersions) {
+				version, _ = s.lookupVersion(ip, names, cfg.timeout())
+			}
+			mu.Lock()
+			results[ip] = nameResult{names: names, errs: errs, err: err, version: version}
+			mu.Unlock()
+		}(ip)
+	}
+	wg.Wait()
+	return results
+}
+
+// hostnameFor merges freshly resolved names into the per-MAC records and
+// picks the hostname label, falling back to the last known names when
+// resolution is disabled or fails. stale reports whether the returned name
+// is older than the configured TTL.
+func (s *scanner) hostnameFor(mac string, res nameResult, cfg ResolutionConfig, now time.Time) (hostname string, stale bool, err error) {
+	records := s.deviceNames[mac]
+	if records == nil {
+		records = make(map[string]NameRecord)
+		s.deviceNames[mac] = records
+	}
+	for source, name := range res.names {
+		records[source] = NameRecord{Name: name, ResolvedAt: now}
+	}
+
+	rec, ok := pickName(records, cfg.HostnameLabelSource)
+	if !ok {
+		return "<unknown>", false, res.err
+	}
+	ttl := cfg.staleAfter()
+	for _, source := range []string{sourceNetBIOS, sourceSSH} {
+		if r, ok := records[source]; ok && r == rec {
+			ttl = s.enrichment.staleAfter(source, ttl)
+		}
+	}
+	return rec.Name, now.Sub(rec.ResolvedAt) > ttl, res.err
+}
+
+// deviceNameSet returns a copy of the names known for mac, safe to hand to
+// snapshot readers.
+func (s *scanner) deviceNameSet(mac string) map[string]NameRecord {
+	out := make(map[string]NameRecord, len(s.deviceNames[mac]))
+	for k, v := range s.deviceNames[mac] {
+		out[k] = v
+	}
+	return out
+}
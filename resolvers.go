@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Name sources, in the order "best" prefers them.
+const (
+	sourceMDNS    = "mdns"
+	sourceDNS     = "dns"
+	sourceNetBIOS = "netbios"
+	sourceARP     = "arp"
+)
+
+var nameSources = []string{sourceMDNS, sourceDNS, sourceNetBIOS, sourceARP}
+
+func (s *scanner) lookupDNS(ip string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if rev, err := reverseName(net.ParseIP(ip)); err == nil {
+		// One PTR question with an EDNS record, to the first nameserver;
+		// retries and further servers are not seen from here.
+		s.countSent(trafficDNS, 1, udpOverhead+12+len(rev)+1+4+11)
+	}
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if err != nil {
+		return "", err
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("no PTR record for %s", ip)
+	}
+	return strings.TrimSuffix(names[0], "."), nil
+}
+
+func reverseName(ip net.IP) (string, error) {
+	v4 := ip.To4()
+	if v4 == nil {
+		return "", fmt.Errorf("%s is not an IPv4 address", ip)
+	}
+	return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", v4[3], v4[2], v4[1], v4[0]), nil
+}
+
+// mdnsQuery sends a legacy unicast mDNS query straight to the device.
+func (s *scanner) mdnsQuery(ip, qname string, qtype dnsmessage.Type, timeout time.Duration) (*dnsmessage.Message, error) {
+	name, err := dnsmessage.NewName(qname)
+	if err != nil {
+		return nil, err
+	}
+	id := uint16(rand.Intn(1 << 16))
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("udp4", net.JoinHostPort(ip, "5353"), timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+	s.countSent(trafficMDNS, 1, udpOverhead+len(packet))
+
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(buf[:n]); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// lookupMDNS asks the device for the PTR of its own address, which it
+// answers with its .local name.
+func (s *scanner) lookupMDNS(ip string, timeout time.Duration) (string, error) {
+	rev, err := reverseName(net.ParseIP(ip))
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.mdnsQuery(ip, rev, dnsmessage.TypePTR, timeout)
+	if err != nil {
+		return "", err
+	}
+	for _, ans := range resp.Answers {
+		if ptr, ok := ans.Body.(*dnsmessage.PTRResource); ok {
+			return strings.TrimSuffix(ptr.PTR.String(), "."), nil
+		}
+	}
+	return "", fmt.Errorf("no mDNS PTR answer from %s", ip)
+}
+
+// netbiosStatusRequest builds an NBSTAT query for the wildcard name "*".
+func netbiosStatusRequest(id uint16) []byte {
+	packet := make([]byte, 12, 50)
+	binary.BigEndian.PutUint16(packet[0:], id)
+	binary.BigEndian.PutUint16(packet[4:], 1) // QDCOUNT
+
+	name := make([]byte, 16)
+	name[0] = '*'
+	packet = append(packet, 0x20)
+	for _, b := range name {
+		packet = append(packet, 'A'+(b>>4), 'A'+(b&0x0f))
+	}
+	packet = append(packet, 0x00)
+	packet = append(packet, 0x00, 0x21) // NBSTAT
+	packet = append(packet, 0x00, 0x01) // IN
+	return packet
+}
+
+func parseNetbiosStatus(resp []byte) (string, error) {
+	if len(resp) < 12 {
+		return "", fmt.Errorf("short NetBIOS response")
+	}
+	off := 12
+	for off < len(resp) && resp[off] != 0 {
+		off += int(resp[off]) + 1
+	}
+	off++                // terminating zero
+	off += 2 + 2 + 4 + 2 // type, class, ttl, rdlength
+	if off >= len(resp) {
+		return "", fmt.Errorf("truncated NetBIOS response")
+	}
+	count := int(resp[off])
+	off++
+	for i := 0; i < count && off+18 <= len(resp); i++ {
+		entry := resp[off : off+18]
+		off += 18
+		suffix := entry[15]
+		flags := binary.BigEndian.Uint16(entry[16:])
+		if suffix == 0x00 && flags&0x8000 == 0 {
+			return strings.TrimRight(string(entry[:15]), " \x00"), nil
+		}
+	}
+	return "", fmt.Errorf("no NetBIOS workstation name")
+}
+
+func (s *scanner) lookupNetBIOS(ip string, timeout time.Duration) (string, error) {
+	conn, err := net.DialTimeout("udp4", net.JoinHostPort(ip, "137"), timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	packet := netbiosStatusRequest(uint16(rand.Intn(1 << 16)))
+	if _, err := conn.Write(packet); err != nil {
+		return "", err
+	}
+	s.countSent(trafficNetBIOS, 1, udpOverhead+len(packet))
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return parseNetbiosStatus(buf[:n])
+}
+
+func (s *scanner) lookupARPName(ip string, timeout time.Duration) (string, error) {
+	name, err := s.resolveHostname(ip, timeout)
+	if err != nil {
+		return "", err
+	}
+	if name == "<unknown>" {
+		return "", fmt.Errorf("no hostname for %s in ARP table", ip)
+	}
+	return name, nil
+}
+
+var nameResolvers = map[string]func(s *scanner, ip string, timeout time.Duration) (string, error){
+	sourceMDNS:    (*scanner).lookupMDNS,
+	sourceDNS:     (*scanner).lookupDNS,
+	sourceNetBIOS: (*scanner).lookupNetBIOS,
+	sourceARP:     (*scanner).lookupARPName,
+}
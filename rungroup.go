@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Restart policies for a component that fails.
+const (
+	restartExit   = "exit"   // stop every component and exit non-zero
+	restartAlways = "always" // restart the component with backoff
+)
+
+type RestartPolicy struct {
+	Restart    string        `yaml:"restart"`
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+func (p RestartPolicy) withDefaults() RestartPolicy {
+	if p.Restart == "" {
+		p.Restart = restartExit
+	}
+	if p.Backoff <= 0 {
+		p.Backoff = time.Second
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = time.Minute
+	}
+	return p
+}
+
+var componentNames = []string{"server", "scanner", "system", "uplink", "enrichment", "dhcp", "event_log", "user_metrics", "tracing", "firewall", "otlp", "host_metrics"}
+
+func validateComponents(policies map[string]RestartPolicy) error {
+	for name, p := range policies {
+		if !slices.Contains(componentNames, name) {
+			return fmt.Errorf("unknown component %q in components (have %s)", name, strings.Join(componentNames, ", "))
+		}
+		switch p.Restart {
+		case "", restartExit, restartAlways:
+		default:
+			return fmt.Errorf("components.%s.restart must be %q or %q, got %q", name, restartExit, restartAlways, p.Restart)
+		}
+	}
+	return nil
+}
+
+// component is a long-running part of the exporter. run blocks until ctx
+// is cancelled, returning nil, or until the component fails.
+type component struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// componentError names the component a fatal error came from.
+type componentError struct {
+	component string
+	err       error
+}
+
+func (e *componentError) Error() string { return e.component + ": " + e.err.Error() }
+func (e *componentError) Unwrap() error { return e.err }
+
+var errComponentExited = errors.New("exited unexpectedly")
+
+// runOnce runs a component, turning a panic into an error and an early
+// return into errComponentExited.
+func runOnce(ctx context.Context, c component) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Component %s panicked: %v\n%s", c.name, r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	err = c.run(ctx)
+	if err == nil && ctx.Err() == nil {
+		err = errComponentExited
+	}
+	return err
+}
+
+// supervise runs c until ctx is cancelled, restarting it according to its
+// policy. It returns the error that should stop the group, if any.
+func supervise(ctx context.Context, m *Metrics, c component, policy RestartPolicy) error {
+	backoff := policy.Backoff
+	for {
+		started := time.Now()
+		err := runOnce(ctx, c)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if policy.Restart != restartAlways {
+			return &componentError{c.name, err}
+		}
+		// A component that stayed up for a while starts over with the
+		// shortest backoff.
+		if time.Since(started) > policy.MaxBackoff {
+			backoff = policy.Backoff
+		}
+		m.ComponentRestarts.WithLabelValues(c.name).Inc()
+		errorLog.Printf("Component %s failed, restarting in %s: %v", c.name, backoff, err)
+		emitEvent("component_restarting", map[string]interface{}{
+			"component": c.name,
+			"error":     err.Error(),
+			"backoff":   backoff.Seconds(),
+		})
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, policy.MaxBackoff)
+	}
+}
+
+// runComponents runs every component under a shared context. The first
+// fatal failure cancels the others; runComponents waits for all of them
+// and returns that failure, or nil once ctx is cancelled. A scanner's
+// components (scanner:home) follow the policy of their kind (scanner).
+func runComponents(ctx context.Context, m *Metrics, policies map[string]RestartPolicy, components []component) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	for _, c := range components {
+		wg.Add(1)
+		go func(c component) {
+			defer wg.Done()
+			kind, _, _ := strings.Cut(c.name, ":")
+			if err := supervise(ctx, m, c, policies[kind].withDefaults()); err != nil {
+				once.Do(func() {
+					firstErr = err
+					log.Printf("Component %v; stopping", err)
+					cancel()
+				})
+			}
+		}(c)
+	}
+	wg.Wait()
+	return firstErr
+}
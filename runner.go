@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// commandRunner executes the probe and neighbor-table commands, either on
+// this host or on a remote one.
+type commandRunner interface {
+	Output(name string, args ...string) ([]byte, error)
+	Run(name string, args ...string) error
+	// GOOS is the operating system the commands run on.
+	GOOS() string
+}
+
+type localRunner struct{}
+
+func (localRunner) Output(name string, args ...string) ([]byte, error) {
+	return outputAccounted(name, args...)
+}
+
+func (localRunner) Run(name string, args ...string) error {
+	return runAccounted(name, args...)
+}
+
+func (localRunner) GOOS() string { return runtime.GOOS }
+
+type RemoteConfig struct {
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"`
+	User string `yaml:"user"`
+	// KeyFile is the private key used for authentication; password auth is
+	// never attempted.
+	KeyFile string `yaml:"key_file"`
+	// KnownHostsFile pins the remote host key; unknown or changed keys are
+	// rejected.
+	KnownHostsFile string        `yaml:"known_hosts_file"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	// OS of the remote host, used to pick ping flags (default linux).
+	OS string `yaml:"os"`
+}
+
+// sshRunner runs commands over the system ssh client. A control master
+// socket keeps one connection open across scans; ssh transparently
+// re-establishes it when it drops.
+type sshRunner struct {
+	cfg         RemoteConfig
+	controlPath string
+}
+
+func newSSHRunner(cfg RemoteConfig) (*sshRunner, error) {
+	if cfg.Host == "" {
+		return nil, fmt.Errorf("remote.host is required")
+	}
+	if cfg.KeyFile == "" || cfg.KnownHostsFile == "" {
+		return nil, fmt.Errorf("remote.key_file and remote.known_hosts_file are required")
+	}
+	if _, err := exec.LookPath("ssh"); err != nil {
+		return nil, fmt.Errorf("ssh client not found: %v", err)
+	}
+	return &sshRunner{
+		cfg:         cfg,
+		controlPath: filepath.Join(os.TempDir(), "telemetry-ssh-%r@%h:%p"),
+	}, nil
+}
+
+func (s *sshRunner) sshArgs(name string, args []string) []string {
+	timeout := s.cfg.ConnectTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	sshArgs := []string{
+		"-i", s.cfg.KeyFile,
+		"-o", "BatchMode=yes",
+		"-o", "PasswordAuthentication=no",
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", "UserKnownHostsFile=" + s.cfg.KnownHostsFile,
+		"-o", fmt.Sprintf("ConnectTimeout=%d", int(timeout.Seconds())),
+		"-o", "ServerAliveInterval=15",
+		"-o", "ControlMaster=auto",
+		"-o", "ControlPath=" + s.controlPath,
+		"-o", "ControlPersist=5m",
+	}
+	if s.cfg.Port != 0 {
+		sshArgs = append(sshArgs, "-p", fmt.Sprint(s.cfg.Port))
+	}
+	target := s.cfg.Host
+	if s.cfg.User != "" {
+		target = s.cfg.User + "@" + s.cfg.Host
+	}
+
+	quoted := []string{shellQuote(name)}
+	for _, a := range args {
+		quoted = append(quoted, shellQuote(a))
+	}
+	return append(sshArgs, target, "--", strings.Join(quoted, " "))
+}
+
+// Only the local ssh client is accounted; the remote command's own usage
+// is not visible from here.
+func (s *sshRunner) Output(name string, args ...string) ([]byte, error) {
+	out, err := outputAccounted("ssh", s.sshArgs(name, args)...)
+	return out, sshError(err)
+}
+
+func (s *sshRunner) Run(name string, args ...string) error {
+	return sshError(runAccounted("ssh", s.sshArgs(name, args)...))
+}
+
+// sshError classifies exit status 255, with which ssh reports that it could
+// not connect or log in, as opposed to the remote command failing. Rejected
+// keys are already ErrPermission from their stderr.
+func sshError(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 255 {
+		return classified(ErrUnavailable, err)
+	}
+	return err
+}
+
+func (s *sshRunner) GOOS() string {
+	if s.cfg.OS == "" {
+		return "linux"
+	}
+	return s.cfg.OS
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func init() {
+	registerFeature("remote_runner", false)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// Error classes of the scan backends (native probes, ping commands, the
+// ssh runner, neighbor table reads). Backends wrap their failures in one
+// of them, so callers can tell a transient network problem from a
+// misconfiguration with errors.Is; the underlying error stays reachable
+// with errors.As.
+var (
+	// ErrPermission: not allowed to open a socket, run a command or log
+	// in. Needs fixing on the host; retrying does not help.
+	ErrPermission = errors.New("permission denied")
+	// ErrTimeout: no answer in time. Expected for addresses nobody is on.
+	ErrTimeout = errors.New("timeout")
+	// ErrUnavailable: the backend itself is missing or unreachable, e.g.
+	// the command is not installed or the ssh host is down.
+	ErrUnavailable = errors.New("unavailable")
+	// ErrParse: the backend answered with output we could not read.
+	ErrParse = errors.New("unparsable output")
+)
+
+// Classes counted in telemetry_scan_errors_total.
+const (
+	errClassPermission  = "permission"
+	errClassTimeout     = "timeout"
+	errClassUnavailable = "unavailable"
+	errClassParse       = "parse"
+	errClassOther       = "other"
+)
+
+var errorClasses = []struct {
+	err   error
+	class string
+}{
+	{ErrPermission, errClassPermission},
+	{ErrTimeout, errClassTimeout},
+	{ErrUnavailable, errClassUnavailable},
+	{ErrParse, errClassParse},
+}
+
+// scanError tags err with its class without changing the message.
+type scanError struct {
+	class error
+	err   error
+}
+
+func (e *scanError) Error() string   { return e.err.Error() }
+func (e *scanError) Unwrap() []error { return []error{e.class, e.err} }
+
+// classified wraps err in class, unless err is nil or already classified.
+func classified(class, err error) error {
+	if err == nil || errorClass(err) != errClassOther {
+		return err
+	}
+	return &scanError{class, err}
+}
+
+// errorClass returns the class label of err, "other" when unclassified.
+func errorClass(err error) string {
+	for _, c := range errorClasses {
+		if errors.Is(err, c.err) {
+			return c.class
+		}
+	}
+	return errClassOther
+}
+
+// classify infers the class of a socket or command error from the error
+// itself; errors it cannot place are returned unchanged.
+func classify(err error) error {
+	var netErr net.Error
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, os.ErrPermission), errors.Is(err, syscall.EPERM):
+		return classified(ErrPermission, err)
+	// On the local network EHOSTUNREACH means ARP got no answer: nobody is
+	// on that address, just like a missing reply.
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout(),
+		errors.Is(err, syscall.EHOSTUNREACH):
+		return classified(ErrTimeout, err)
+	case errors.Is(err, exec.ErrNotFound), errors.Is(err, os.ErrNotExist),
+		errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EADDRNOTAVAIL):
+		return classified(ErrUnavailable, err)
+	case errors.As(err, &exitErr) && permissionMessage(string(exitErr.Stderr)):
+		return classified(ErrPermission, err)
+	}
+	return err
+}
+
+// permissionMessage reports whether a command's stderr says it was not
+// allowed to do something: ping without a raw socket, ssh rejecting the
+// key, a file it could not read.
+func permissionMessage(stderr string) bool {
+	stderr = strings.ToLower(stderr)
+	for _, s := range []string{"permission denied", "not permitted", "host key verification failed"} {
+		if strings.Contains(stderr, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// countScanError counts a backend failure in telemetry_scan_errors_total.
+func countScanError(m *Metrics, err error) {
+	if err != nil {
+		m.ScanErrors.WithLabelValues(errorClass(err)).Inc()
+	}
+}
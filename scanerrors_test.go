@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// exitError runs a shell that writes stderr and exits with code, and
+// returns the *exec.ExitError as Output reports it.
+func exitError(t *testing.T, code int, stderr string) error {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	_, err := exec.Command("sh", "-c", fmt.Sprintf("printf '%%s' '%s' >&2; exit %d", stderr, code)).Output()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("got %v, want an exit error", err)
+	}
+	return err
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassify(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		err   error
+		class string
+	}{
+		{"socket permission", &os.SyscallError{Syscall: "socket", Err: syscall.EPERM}, errClassPermission},
+		{"file permission", &os.PathError{Op: "open", Path: procNetARP, Err: syscall.EACCES}, errClassPermission},
+		{"deadline", fmt.Errorf("probe: %w", context.DeadlineExceeded), errClassTimeout},
+		{"net timeout", &os.SyscallError{Syscall: "read", Err: timeoutError{}}, errClassTimeout},
+		{"host unreachable", &os.SyscallError{Syscall: "connect", Err: syscall.EHOSTUNREACH}, errClassTimeout},
+		{"command missing", &exec.Error{Name: "arp", Err: exec.ErrNotFound}, errClassUnavailable},
+		{"file missing", &os.PathError{Op: "open", Path: procNetARP, Err: syscall.ENOENT}, errClassUnavailable},
+		{"network unreachable", &os.SyscallError{Syscall: "connect", Err: syscall.ENETUNREACH}, errClassUnavailable},
+		{"address gone", &os.SyscallError{Syscall: "bind", Err: syscall.EADDRNOTAVAIL}, errClassUnavailable},
+		{"ping without raw socket", exitError(t, 2, "ping: socket: Operation not permitted"), errClassPermission},
+		{"ssh key rejected", exitError(t, 255, "user@pi: Permission denied (publickey)."), errClassPermission},
+		{"host key changed", exitError(t, 255, "Host key verification failed."), errClassPermission},
+		{"plain exit", exitError(t, 1, ""), errClassOther},
+		{"unknown", errors.New("something else"), errClassOther},
+	} {
+		err := classify(tc.err)
+		if got := errorClass(err); got != tc.class {
+			t.Errorf("%s: %v classified as %s, want %s", tc.name, tc.err, got, tc.class)
+		}
+		if !errors.Is(err, tc.err) || err.Error() != tc.err.Error() {
+			t.Errorf("%s: classification changed the error to %v", tc.name, err)
+		}
+	}
+	if classify(nil) != nil || classified(ErrTimeout, nil) != nil {
+		t.Error("nil is classified")
+	}
+}
+
+func TestClassifiedKeepsFirstClass(t *testing.T) {
+	err := classified(ErrPermission, errors.New("denied"))
+	if again := classified(ErrUnavailable, err); errorClass(again) != errClassPermission {
+		t.Errorf("reclassified as %s", errorClass(again))
+	}
+	wrapped := fmt.Errorf("arp -an: %w", err)
+	if !errors.Is(wrapped, ErrPermission) || errors.Is(wrapped, ErrUnavailable) {
+		t.Errorf("%v lost its class through wrapping", wrapped)
+	}
+}
+
+func TestBackendErrorClasses(t *testing.T) {
+	deadline, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-deadline.Done()
+	for _, tc := range []struct {
+		name  string
+		err   error
+		class string
+	}{
+		// ping exits 1 on Linux and 2 elsewhere when nobody answered.
+		{"ping no reply, linux", pingError(exitError(t, 1, ""), "linux"), errClassTimeout},
+		{"ping no reply, darwin", pingError(exitError(t, 2, ""), "darwin"), errClassTimeout},
+		{"ping error, linux", pingError(exitError(t, 2, "ping: unknown host"), "linux"), errClassOther},
+		{"ping_command dead", PingCommandConfig{Path: "fping"}.exitResult(exitError(t, 1, "")), errClassTimeout},
+		{"ping_command not run", PingCommandConfig{Path: "fping"}.exitResult(classify(&exec.Error{Name: "fping", Err: exec.ErrNotFound})), errClassUnavailable},
+		{"command killed", commandError(deadline, exitError(t, 137, "")), errClassTimeout},
+		{"command missing", commandError(context.Background(), &exec.Error{Name: "arp", Err: exec.ErrNotFound}), errClassUnavailable},
+		{"ssh cannot connect", sshError(commandError(context.Background(), exitError(t, 255, "ssh: connect to host pi port 22: Connection refused"))), errClassUnavailable},
+		{"ssh key rejected", sshError(commandError(context.Background(), exitError(t, 255, "Permission denied (publickey)."))), errClassPermission},
+		{"ssh remote command failed", sshError(commandError(context.Background(), exitError(t, 1, ""))), errClassOther},
+	} {
+		if got := errorClass(tc.err); got != tc.class {
+			t.Errorf("%s: %v classified as %s, want %s", tc.name, tc.err, got, tc.class)
+		}
+	}
+	if err := (PingCommandConfig{Path: "fping", AliveExitCodes: []int{0, 1}}).exitResult(exitError(t, 1, "")); err != nil {
+		t.Errorf("alive exit code reported as %v", err)
+	}
+
+	s := newScanner("", 1)
+	s.runner = fakeRunner{"cat " + procNetARP: "garbage\n"}
+	if _, _, err := s.readNeighbors(); errorClass(err) != errClassParse {
+		t.Errorf("unknown neighbor table format: %v classified as %s", err, errorClass(err))
+	}
+}
+
+func TestCountScanError(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	s := newScanner("", 1)
+	s.m = NewMetrics(reg, "").forScanner(reg, s)
+	countScanError(s.m, nil)
+	countScanError(s.m, classified(ErrTimeout, errors.New("no reply")))
+	countScanError(s.m, classified(ErrTimeout, errors.New("no reply")))
+	countScanError(s.m, errors.New("odd"))
+	for class, want := range map[string]float64{errClassTimeout: 2, errClassOther: 1, errClassPermission: 0} {
+		if got := testutil.ToFloat64(s.m.ScanErrors.WithLabelValues(class)); got != want {
+			t.Errorf("telemetry_scan_errors_total{class=%q} = %v, want %v", class, got, want)
+		}
+	}
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ScannerConfig is one entry of scanners:. Every key but name is merged
+// over the rest of the file, as a later config document would be, to give
+// the scanner's own config: its networks, runner, devices, registry and
+// everything else that belongs to one scan pipeline.
+type ScannerConfig struct {
+	Name string `yaml:"name"`
+	node *yaml.Node
+}
+
+func (c *ScannerConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.AliasNode && value.Alias != nil {
+		value = value.Alias
+	}
+	if value.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: a scanners entry must be a mapping", value.Line)
+	}
+	var head struct {
+		Name string `yaml:"name"`
+	}
+	if err := value.Decode(&head); err != nil {
+		return err
+	}
+	c.Name, c.node = head.Name, value
+	return nil
+}
+
+// MarshalYAML writes the entry as it was configured.
+func (c ScannerConfig) MarshalYAML() (interface{}, error) {
+	if c.node == nil {
+		return map[string]string{"name": c.Name}, nil
+	}
+	return c.node, nil
+}
+
+// redacted copies the entry with the ssh credentials of its devices
+// replaced, like Config.redacted does for the top-level devices.
+func (c ScannerConfig) redacted() ScannerConfig {
+	if c.node == nil {
+		return c
+	}
+	c.node = copyNode(c.node)
+	expandAliases(c.node)
+	for _, key := range []string{"devices", "devices+"} {
+		i := mappingIndex(c.node, key)
+		if i < 0 || c.node.Content[i+1].Kind != yaml.SequenceNode {
+			continue
+		}
+		for _, d := range c.node.Content[i+1].Content {
+			j := mappingIndex(d, "ssh")
+			if d.Kind != yaml.MappingNode || j < 0 {
+				continue
+			}
+			ssh := d.Content[j+1]
+			for _, secret := range []string{"user", "key_file", "known_hosts_file"} {
+				if k := mappingIndex(ssh, secret); k >= 0 && ssh.Content[k+1].Value != "" {
+					ssh.Content[k+1] = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "<redacted>"}
+				}
+			}
+		}
+	}
+	return c
+}
+
+// processWideKeys are the top-level keys that configure the process rather
+// than a scan pipeline; a scanners entry cannot set them.
+var processWideKeys = []string{
+	"http", "log", "metrics", "admin", "components", "debug", "event_log", "user_metrics",
+	"host_metrics", "tracing", "otlp", "cpu", "uplink", "power_save", "scanners",
+}
+
+var scannerNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// scannerNames lists the configured scanners, or the single unnamed one a
+// file without scanners: runs.
+func (c Config) scannerNames() []string {
+	if len(c.Scanners) == 0 {
+		return []string{""}
+	}
+	names := make([]string, len(c.Scanners))
+	for i, s := range c.Scanners {
+		names[i] = s.Name
+	}
+	return names
+}
+
+// scannerConfig returns the effective config of the named scanner: its
+// entry merged over the file without the scanners: list, decoded with
+// decode. The unnamed scanner's config is c itself.
+func (c Config) scannerConfig(name string, decode func([]byte) (Config, error)) (Config, error) {
+	if name == "" && len(c.Scanners) == 0 {
+		return c, nil
+	}
+	var entry *ScannerConfig
+	for i := range c.Scanners {
+		if c.Scanners[i].Name == name {
+			entry = &c.Scanners[i]
+			break
+		}
+	}
+	if entry == nil {
+		return Config{}, fmt.Errorf("no scanner %q in scanners", name)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(c.source, &doc); err != nil {
+		return Config{}, err
+	}
+	base := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if len(doc.Content) > 0 && doc.Content[0].Kind == yaml.MappingNode {
+		base = doc.Content[0]
+	}
+	expandAliases(base)
+	if i := mappingIndex(base, "scanners"); i >= 0 {
+		base.Content = append(base.Content[:i:i], base.Content[i+2:]...)
+	}
+	overlay := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if entry.node != nil {
+		node := copyNode(entry.node)
+		expandAliases(node)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value != "name" {
+				overlay.Content = append(overlay.Content, node.Content[i], node.Content[i+1])
+			}
+		}
+	}
+	if err := mergeMapping(base, overlay, "scanners."+name+"."); err != nil {
+		return Config{}, err
+	}
+	data, err := yaml.Marshal(base)
+	if err != nil {
+		return Config{}, err
+	}
+	return decode(data)
+}
+
+// loadScannerConfig reads the effective config of the named scanner, for
+// the commands working on one scanner's state. The name may only be empty
+// when the file has no scanners: list.
+func loadScannerConfig(name string) (Config, error) {
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		return cfg, err
+	}
+	if name == "" && len(cfg.Scanners) > 0 {
+		return cfg, fmt.Errorf("%s lists scanners; pick one with -scanner (%s)", cfgPath, strings.Join(cfg.scannerNames(), ", "))
+	}
+	return cfg.scannerConfig(name, parseConfig)
+}
+
+// validateScanners checks the scanners: list: names, keys only the whole
+// process can set, and the effective config of every scanner.
+func validateScanners(cfg Config) []error {
+	var errs []error
+	seen := make(map[string]bool)
+	for i, s := range cfg.Scanners {
+		switch {
+		case s.Name == "":
+			errs = append(errs, fmt.Errorf("scanners[%d]: name is required", i))
+			continue
+		case !scannerNamePattern.MatchString(s.Name):
+			errs = append(errs, fmt.Errorf("scanners[%d]: name %q may only use letters, digits, _ and -", i, s.Name))
+			continue
+		case seen[s.Name]:
+			errs = append(errs, fmt.Errorf("scanners[%d]: duplicate scanner %q", i, s.Name))
+			continue
+		}
+		seen[s.Name] = true
+		if s.node == nil {
+			continue
+		}
+		for j := 0; j+1 < len(s.node.Content); j += 2 {
+			key := strings.TrimSuffix(s.node.Content[j].Value, "+")
+			for _, global := range processWideKeys {
+				if key == global {
+					errs = append(errs, fmt.Errorf("scanner %s: %s is process-wide and cannot be set per scanner", s.Name, key))
+				}
+			}
+			if network := s.node.Content[j+1]; key == "network" && network.Kind == yaml.MappingNode && mappingIndex(network, "concurrency") >= 0 {
+				errs = append(errs, fmt.Errorf("scanner %s: network.concurrency is shared by all scanners and cannot be set per scanner", s.Name))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	stateFiles := make(map[string]string)
+	sniffing := ""
+	for _, s := range cfg.Scanners {
+		eff, err := cfg.scannerConfig(s.Name, decodeConfigStrict)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("scanner %s: %w", s.Name, err))
+			continue
+		}
+		for _, err := range validateConfig(eff) {
+			errs = append(errs, fmt.Errorf("scanner %s: %w", s.Name, err))
+		}
+		if path := eff.Registry.StateFile; path != "" {
+			if other, ok := stateFiles[path]; ok {
+				errs = append(errs, fmt.Errorf("scanners %s and %s share registry.state_file %s", other, s.Name, path))
+			}
+			stateFiles[path] = s.Name
+		}
+		if eff.DHCP.Sniff {
+			if sniffing != "" {
+				errs = append(errs, fmt.Errorf("scanners %s and %s both set dhcp.sniff; only one scanner can listen for DHCP", sniffing, s.Name))
+			}
+			sniffing = s.Name
+		}
+	}
+	return errs
+}
+
+// scanner is one scan pipeline: its schedule, runner, the state its scans
+// carry over, its last snapshot and its metrics. There is one per
+// scanners: entry, or a single unnamed one. The state is only touched by
+// the scanner's own scan loop unless a field says otherwise.
+type scanner struct {
+	name string
+	m    *Metrics
+	// runner runs the probe and neighbor-table commands of this scanner.
+	runner commandRunner
+	// workers is this scanner's share of network.concurrency.
+	workers int
+	// enrichment is nil unless enrichment.enabled was set at startup.
+	enrichment *enrichScheduler
+	sent       *trafficCounter
+
+	// requests asks the scan loop for an extra scan between periodic
+	// ones; requests made while one is pending are merged.
+	requests chan string
+	// running is held for the whole of a scan, so a scan started while
+	// another one is still running (e.g. by a scanner restarted after a
+	// panic) is skipped instead of doubling the probe goroutines and
+	// subprocesses.
+	running  sync.Mutex
+	schedule scanSchedule
+	// scanID is the ID of this scanner's scan in progress, or of its last
+	// one.
+	scanID atomic.Uint64
+
+	// Snapshots are read by the HTTP handlers and collectors.
+	lastScan     atomic.Pointer[ScanSnapshot]
+	lastScanDump atomic.Pointer[scanDump]
+
+	// lastARPTable holds the previous scan's entries; those addresses are
+	// probed every cycle regardless of chunking.
+	lastARPTable  map[string]string
+	eventBaseline *ScanSnapshot
+	chunks        *chunkScheduler
+	joins         *dhcpJoins
+
+	firstSeen      map[string]time.Time
+	deviceNames    map[string]map[string]NameRecord
+	deviceVersions map[string]VersionRecord
+	deviceHostInfo map[string]HostInfo
+	// deviceErrorLog is keyed by device key, then category.
+	deviceErrorLog map[string]map[string]*errorRing
+	hostnameLabels map[string]*hostnameLabelState
+
+	// presence is keyed by deviceKey, so a device whose IP changes keeps
+	// its entry; readers get the records published in the scan snapshot.
+	presence map[string]*presenceState
+	// proxiedPresence indexes the proxied entries of presence by MAC, so a
+	// MAC leaving proxy-ARP mode drops them without walking the registry.
+	proxiedPresence map[string]map[string]bool
+	// proxyARP remembers which MACs were proxied in the last scan so mode
+	// changes are reported once.
+	proxyARP map[string]bool
+
+	// knownInfrastructure remembers every infrastructure device seen so
+	// it is reported as down once it disappears.
+	knownInfrastructure map[string]string
+	// ipViolations holds the IPs a device was last seen at while off its
+	// expected_ip, and pinnedDevices the expected_ip of every pinned MAC.
+	ipViolations  map[string]string
+	pinnedDevices map[string]string
+	// sloStreaks counts consecutive breaching scans per MAC.
+	sloStreaks map[string]int
+	// staticInPool remembers flagged MACs so static_ip_in_pool fires once
+	// per device.
+	staticInPool map[string]bool
+	// subnetMismatches holds, by setting (network.cidrs or
+	// scan.interfaces[i].cidrs), the mismatch last warned about, so each
+	// is logged once and its end is noticed.
+	subnetMismatches map[string]string
+	// neighborBaseline is the last neighbor table read successfully,
+	// keyed by interface and IP.
+	neighborBaseline map[[2]string]string
+	selfAddress      selfAddressState
+	deviceTrend      deviceTrendState
+	scanShrink       scanShrinkState
+
+	cohorts    cohortState
+	registry   deviceRegistry
+	timeseries countSeries
+	history    scanHistory
+}
+
+// scanners are the scan pipelines the process runs, in config order. Set
+// once at startup.
+var scanners []*scanner
+
+func newScanner(name string, workers int) *scanner {
+	return &scanner{
+		name:                name,
+		runner:              localRunner{},
+		workers:             workers,
+		sent:                newTrafficCounter(),
+		requests:            make(chan string, 1),
+		chunks:              newChunkScheduler(),
+		joins:               newDHCPJoins(),
+		firstSeen:           make(map[string]time.Time),
+		deviceNames:         make(map[string]map[string]NameRecord),
+		deviceVersions:      make(map[string]VersionRecord),
+		deviceHostInfo:      make(map[string]HostInfo),
+		deviceErrorLog:      make(map[string]map[string]*errorRing),
+		hostnameLabels:      make(map[string]*hostnameLabelState),
+		presence:            make(map[string]*presenceState),
+		proxiedPresence:     make(map[string]map[string]bool),
+		proxyARP:            make(map[string]bool),
+		knownInfrastructure: make(map[string]string),
+		ipViolations:        make(map[string]string),
+		pinnedDevices:       make(map[string]string),
+		sloStreaks:          make(map[string]int),
+		staticInPool:        make(map[string]bool),
+		subnetMismatches:    make(map[string]string),
+		registry:            deviceRegistry{devices: make(map[string]*KnownDevice)},
+	}
+}
+
+// scannerShare splits a process-wide budget fairly between n scanners,
+// leaving every one at least one.
+func scannerShare(total, n int) int {
+	if n <= 1 {
+		return total
+	}
+	return max(1, total/n)
+}
+
+// loadConfig reads this scanner's effective config; the unnamed scanner
+// reads the whole file.
+func (s *scanner) loadConfig() (Config, error) {
+	cfg, err := loadConfig(cfgPath)
+	if err != nil || s.name == "" {
+		return cfg, err
+	}
+	return cfg.scannerConfig(s.name, parseConfig)
+}
+
+// component names a component of this scanner, e.g. scanner:home; the
+// restart policy is that of the component without the suffix.
+func (s *scanner) component(kind string) string {
+	if s.name == "" {
+		return kind
+	}
+	return kind + ":" + s.name
+}
+
+// emitEvent emits an event of this scanner, naming it in the scanner
+// field when there are several.
+func (s *scanner) emitEvent(eventType string, fields map[string]interface{}) {
+	if s.name != "" {
+		if fields == nil {
+			fields = make(map[string]interface{})
+		}
+		fields["scanner"] = s.name
+	}
+	logEvent(Event{ScanID: s.scanID.Load(), Type: eventType, Time: time.Now(), Fields: fields})
+}
+
+// logf prints an error line prefixed with the scanner's name, so the
+// deduplicated log keeps the lines of different scanners apart.
+func (s *scanner) logf(format string, args ...interface{}) {
+	errorLog.Printf(s.prefix(format), args...)
+}
+
+// printf logs an informational line prefixed like logf.
+func (s *scanner) printf(format string, args ...interface{}) {
+	log.Printf(s.prefix(format), args...)
+}
+
+func (s *scanner) prefix(format string) string {
+	if s.name == "" {
+		return format
+	}
+	return "Scanner " + s.name + ": " + format
+}
+
+// setup checks the scanner's effective config at startup and picks its
+// runner; an error is a config the exporter cannot start with.
+func (s *scanner) setup(cfg Config) error {
+	networks, err := parseScanNetworks(cfg)
+	if err != nil {
+		return err
+	}
+	for _, n := range networks {
+		if n.Interface != "" {
+			s.printf("Scanning %s (%d addresses) on %s%s", n.Range, len(n.Range.addresses()), n.Interface, vlanSuffix(n.VLAN))
+		} else {
+			s.printf("Scanning %s (%d addresses)", n.Range, len(n.Range.addresses()))
+		}
+	}
+	if cfg.Remote != nil {
+		r, err := newSSHRunner(*cfg.Remote)
+		if err != nil {
+			return err
+		}
+		s.runner = r
+		registerFeature("remote_runner", true)
+		s.printf("Running probes on remote host %s over SSH", cfg.Remote.Host)
+	} else if err := validateScanNetworks(networks); err != nil {
+		// The source interface can only be checked when probing locally.
+		return err
+	} else if !cfg.Scan.PingCommand.enabled() {
+		detectProbeMode()
+	}
+	if cfg.Scan.PingCommand.enabled() {
+		if err := checkPingCommand(s.runner, cfg.Scan.PingCommand, cfg.Network.timeout()); err != nil {
+			return err
+		}
+		s.printf("Probing with %s", cfg.Scan.PingCommand.Path)
+	}
+	if err := validateDHCPSniff(cfg); err != nil {
+		return err
+	}
+	if err := cfg.Anomaly.validate(); err != nil {
+		return err
+	}
+	if errs := validateDeviceSSH(cfg.Devices); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+func (s *scanner) requestScan(cause string) {
+	select {
+	case s.requests <- cause:
+	default:
+	}
+}
+
+func (s *scanner) publishScan(snap *ScanSnapshot) {
+	s.lastScan.Store(snap)
+}
+
+func (s *scanner) currentScan() *ScanSnapshot {
+	return s.lastScan.Load()
+}
+
+// findScanner returns the scanner called name, or the first one for an
+// empty name.
+func findScanner(name string) (*scanner, bool) {
+	for _, s := range scanners {
+		if name == "" || s.name == name {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// scannerFor returns the scanner a request is about: the one ?scanner=
+// names, or the first. An unknown name is answered with 404 here.
+func scannerFor(w http.ResponseWriter, r *http.Request) (*scanner, bool) {
+	name := r.URL.Query().Get("scanner")
+	s, ok := findScanner(name)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("no scanner %q", name)})
+	}
+	return s, ok
+}
+
+// scannerHealth is the state of one scanner as GET /api/v1/scanners
+// reports it.
+type scannerHealth struct {
+	Name string `json:"name"`
+	// Running is set while a scan is in progress.
+	Running      bool       `json:"running"`
+	LastScanID   uint64     `json:"last_scan_id,omitempty"`
+	LastScanAt   *time.Time `json:"last_scan_at,omitempty"`
+	DurationSecs float64    `json:"last_scan_duration_seconds,omitempty"`
+	Devices      int        `json:"devices"`
+	// Stale is set when no scan was published for three intervals.
+	Stale   bool   `json:"stale"`
+	Runner  string `json:"runner"`
+	Workers int    `json:"workers"`
+}
+
+func (s *scanner) health(now time.Time) scannerHealth {
+	h := scannerHealth{Name: s.name, Runner: "local", Workers: s.workers, Stale: true}
+	if _, ok := s.runner.(localRunner); !ok {
+		h.Runner = "ssh"
+	}
+	if s.running.TryLock() {
+		s.running.Unlock()
+	} else {
+		h.Running = true
+	}
+	if scan := s.currentScan(); scan != nil {
+		taken := scan.TakenAt
+		h.LastScanID, h.LastScanAt = scan.Stats.ID, &taken
+		h.DurationSecs = scan.Stats.Duration.Seconds()
+		h.Devices = len(scan.Devices)
+		h.Stale = now.Sub(scan.TakenAt) > 3*currentScanPause()
+	}
+	return h
+}
+
+// scannersHandler serves GET /api/v1/scanners: the health of every
+// scanner, so one stuck pipeline shows next to the working ones.
+func scannersHandler(w http.ResponseWriter, r *http.Request) {
+	out := make([]scannerHealth, 0, len(scanners))
+	now := time.Now()
+	for _, s := range scanners {
+		out = append(out, s.health(now))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
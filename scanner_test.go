@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const scannersConfig = `
+network:
+  cidrs: ["192.168.1.0/24"]
+  timeout: 2s
+devices:
+  - mac: aa:bb:cc:dd:ee:01
+    name: nas
+x-lab-network: &lab
+  cidrs: ["10.0.0.0/24"]
+scanners:
+  - name: home
+    devices+:
+      - mac: aa:bb:cc:dd:ee:02
+        name: tv
+  - name: lab
+    network: *lab
+    devices:
+      - mac: aa:bb:cc:dd:ee:03
+        name: switch
+`
+
+func TestScannerConfig(t *testing.T) {
+	cfg, err := parseConfig([]byte(scannersConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.scannerNames(); !reflect.DeepEqual(got, []string{"home", "lab"}) {
+		t.Errorf("scanner names %v", got)
+	}
+	for _, tc := range []struct {
+		name    string
+		cidrs   []string
+		devices []string
+	}{
+		{"home", []string{"192.168.1.0/24"}, []string{"nas", "tv"}},
+		{"lab", []string{"10.0.0.0/24"}, []string{"switch"}},
+	} {
+		eff, err := cfg.scannerConfig(tc.name, parseConfig)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		var devices []string
+		for _, d := range eff.Devices {
+			devices = append(devices, d.Name)
+		}
+		if !reflect.DeepEqual(eff.Network.CIDRs, tc.cidrs) || !reflect.DeepEqual(devices, tc.devices) {
+			t.Errorf("%s: cidrs %v devices %v, want %v %v", tc.name, eff.Network.CIDRs, devices, tc.cidrs, tc.devices)
+		}
+		if eff.Network.Timeout != cfg.Network.Timeout {
+			t.Errorf("%s: network.timeout %v was not inherited", tc.name, eff.Network.Timeout)
+		}
+		if eff.Scanners != nil {
+			t.Errorf("%s: the effective config keeps scanners: %v", tc.name, eff.Scanners)
+		}
+	}
+	if _, err := cfg.scannerConfig("office", parseConfig); err == nil || !strings.Contains(err.Error(), `no scanner "office"`) {
+		t.Errorf("unknown scanner: %v", err)
+	}
+
+	var single Config
+	if eff, err := single.scannerConfig("", parseConfig); err != nil || !reflect.DeepEqual(single.scannerNames(), []string{""}) || eff.source != nil {
+		t.Errorf("a file without scanners: %v, names %v", err, single.scannerNames())
+	}
+}
+
+func TestValidateScanners(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		scanners string
+		want     string
+	}{
+		{"valid", "  - name: home\n  - name: lab\n    network:\n      cidrs: [10.0.0.0/24]\n", ""},
+		{"no name", "  - network:\n      cidrs: [10.0.0.0/24]\n", "scanners[0]: name is required"},
+		{"bad name", "  - name: my lab\n", `scanners[0]: name "my lab" may only use`},
+		{"duplicate", "  - name: home\n  - name: home\n", `scanners[1]: duplicate scanner "home"`},
+		{"process-wide key", "  - name: home\n    http:\n      port: 9101\n", "scanner home: http is process-wide"},
+		{"appended process-wide key", "  - name: home\n    components+: []\n", "scanner home: components is process-wide"},
+		{"concurrency", "  - name: home\n    network:\n      concurrency: 8\n", "scanner home: network.concurrency is shared"},
+		{"unknown key", "  - name: home\n    netwrok: {}\n", "scanner home: "},
+		{"shared state file", "  - name: home\n    registry:\n      state_file: a.json\n  - name: lab\n    registry:\n      state_file: a.json\n",
+			"scanners home and lab share registry.state_file a.json"},
+		{"two sniffers", "  - name: home\n    dhcp:\n      sniff: true\n  - name: lab\n    dhcp:\n      sniff: true\n",
+			"scanners home and lab both set dhcp.sniff"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := parseConfig([]byte("network:\n  cidrs: [192.168.1.0/24]\nscanners:\n" + tc.scanners))
+			if err != nil {
+				t.Fatal(err)
+			}
+			errs := validateScanners(cfg)
+			if tc.want == "" {
+				if len(errs) > 0 {
+					t.Errorf("got %v, want no errors", errs)
+				}
+				return
+			}
+			for _, err := range errs {
+				if strings.Contains(err.Error(), tc.want) {
+					return
+				}
+			}
+			t.Errorf("got %v, want an error containing %q", errs, tc.want)
+		})
+	}
+}
+
+func TestScannerShare(t *testing.T) {
+	for _, tc := range []struct{ total, n, want int }{
+		{64, 0, 64},
+		{64, 1, 64},
+		{64, 2, 32},
+		{64, 3, 21},
+		{2, 3, 1},
+	} {
+		if got := scannerShare(tc.total, tc.n); got != tc.want {
+			t.Errorf("scannerShare(%d, %d) = %d, want %d", tc.total, tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestScannersHandler(t *testing.T) {
+	prev := scanners
+	home, lab := newScanner("home", 32), newScanner("lab", 32)
+	scanners = []*scanner{home, lab}
+	t.Cleanup(func() { scanners = prev })
+	home.publishScan(&ScanSnapshot{Devices: []Device{{MAC: "aa:bb:cc:dd:ee:01"}}})
+
+	rec := httptest.NewRecorder()
+	scannersHandler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/scanners", nil))
+	var got []scannerHealth
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Name != "home" || got[0].Devices != 1 || got[1].Name != "lab" || !got[1].Stale || got[1].LastScanAt != nil {
+		t.Errorf("got %+v", got)
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  *scanner
+	}{
+		{"", home},
+		{"?scanner=lab", lab},
+		{"?scanner=office", nil},
+	} {
+		rec := httptest.NewRecorder()
+		s, ok := scannerFor(rec, httptest.NewRequest(http.MethodGet, "/api/v1/devices"+tc.query, nil))
+		if tc.want == nil {
+			if ok || rec.Code != http.StatusNotFound {
+				t.Errorf("%q: got %v and %d, want 404", tc.query, ok, rec.Code)
+			}
+		} else if !ok || s != tc.want {
+			t.Errorf("%q: got scanner %v, want %s", tc.query, s, tc.want.name)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCIDR = "192.168.1.0/24"
+	// maxScanAddresses bounds the configured range (a /20).
+	maxScanAddresses = 4096
+)
+
+func (c NetworkConfig) concurrency() int {
+	if c.Concurrency <= 0 {
+		return 64
+	}
+	return c.Concurrency
+}
+
+func (c NetworkConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return time.Second
+	}
+	return c.Timeout
+}
+
+// scanRange is the set of IPv4 prefixes from network.cidrs.
+type scanRange []netip.Prefix
+
+func parseScanRange(cidrs []string) (scanRange, error) {
+	if len(cidrs) == 0 {
+		cidrs = []string{defaultCIDR}
+	}
+	var r scanRange
+	total := 0
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("network.cidrs: %v", err)
+		}
+		if !prefix.Addr().Is4() {
+			return nil, fmt.Errorf("network.cidrs: %s is not an IPv4 prefix", cidr)
+		}
+		total += 1 << (32 - prefix.Bits())
+		if total > maxScanAddresses {
+			return nil, fmt.Errorf("network.cidrs covers more than %d addresses", maxScanAddresses)
+		}
+		r = append(r, prefix.Masked())
+	}
+	return r, nil
+}
+
+func (r scanRange) String() string {
+	parts := make([]string, len(r))
+	for i, p := range r {
+		parts[i] = p.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (r scanRange) contains(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip.To4())
+	if !ok {
+		return false
+	}
+	for _, p := range r {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// addresses lists the host addresses of every prefix, skipping the network
+// and broadcast address of prefixes that have them (shorter than /31).
+func (r scanRange) addresses() []string {
+	var out []string
+	seen := make(map[netip.Addr]bool)
+	for _, p := range r {
+		first, last := p.Addr(), lastAddr(p)
+		if p.Bits() < 31 {
+			first, last = first.Next(), last.Prev()
+		}
+		for a := first; a.IsValid() && a.Compare(last) <= 0; a = a.Next() {
+			if !seen[a] {
+				seen[a] = true
+				out = append(out, a.String())
+			}
+		}
+	}
+	return out
+}
+
+// broadcasts returns the directed broadcast address of every prefix that
+// has one.
+func (r scanRange) broadcasts() []string {
+	var out []string
+	for _, p := range r {
+		if p.Bits() < 31 {
+			out = append(out, lastAddr(p).String())
+		}
+	}
+	return out
+}
+
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().As4()
+	for i := p.Bits(); i < 32; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	return netip.AddrFrom4(b)
+}
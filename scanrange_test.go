@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestScanRangeAddresses(t *testing.T) {
+	for _, tc := range []struct {
+		cidrs      []string
+		want       []string
+		broadcasts []string
+	}{
+		{[]string{"192.168.1.0/30"}, []string{"192.168.1.1", "192.168.1.2"}, []string{"192.168.1.3"}},
+		{[]string{"192.168.1.5/30"}, []string{"192.168.1.5", "192.168.1.6"}, []string{"192.168.1.7"}},
+		{[]string{"10.0.0.0/31"}, []string{"10.0.0.0", "10.0.0.1"}, nil},
+		{[]string{"10.0.0.7/32"}, []string{"10.0.0.7"}, nil},
+		{[]string{"10.0.0.0/30", " 10.0.0.2/32 "}, []string{"10.0.0.1", "10.0.0.2"}, []string{"10.0.0.3"}},
+	} {
+		r, err := parseScanRange(tc.cidrs)
+		if err != nil {
+			t.Errorf("%v: %v", tc.cidrs, err)
+			continue
+		}
+		if got := r.addresses(); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: addresses %v, want %v", tc.cidrs, got, tc.want)
+		}
+		if got := r.broadcasts(); !reflect.DeepEqual(got, tc.broadcasts) {
+			t.Errorf("%v: broadcasts %v, want %v", tc.cidrs, got, tc.broadcasts)
+		}
+	}
+
+	r, err := parseScanRange(nil)
+	if err != nil || r.String() != defaultCIDR || len(r.addresses()) != 254 {
+		t.Errorf("default range %v (%v), %d addresses", r, err, len(r.addresses()))
+	}
+	if r, err := parseScanRange([]string{"10.0.0.0/20"}); err != nil || len(r.addresses()) != maxScanAddresses-2 {
+		t.Errorf("a /20 is allowed: %v", err)
+	}
+}
+
+func TestParseScanRangeErrors(t *testing.T) {
+	for _, tc := range []struct {
+		cidrs []string
+		want  string
+	}{
+		{[]string{"192.168.1.0"}, "network.cidrs: "},
+		{[]string{"192.168.1.0/33"}, "network.cidrs: "},
+		{[]string{"fd00::/120"}, "fd00::/120 is not an IPv4 prefix"},
+		{[]string{"2001:db8::/32"}, "is not an IPv4 prefix"},
+		{[]string{"10.0.0.0/19"}, "covers more than 4096 addresses"},
+		{[]string{"10.0.0.0/20", "10.1.0.0/32"}, "covers more than 4096 addresses"},
+	} {
+		_, err := parseScanRange(tc.cidrs)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%v: got %v, want an error containing %q", tc.cidrs, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// scanResultVersion is the schema_version of the scan result document
+// written by `scan -output` and served at /api/v1/scans/latest/full.
+//
+// The document is meant to be archived and diffed between days, so within
+// a version:
+//   - fields are only ever added, never renamed, removed or retyped;
+//   - fields appear in the order declared below, maps are sorted by key and
+//     devices by IP, then MAC;
+//   - times are UTC;
+//   - values that change from scan to scan without the network changing
+//     (round-trip times, probe details, flaps, errors, the scan duration,
+//     when a name was resolved, first_seen, which is per process) are left
+//     out unless volatile fields are requested.
+//
+// Anything else changing between two documents is a change on the network
+// or in the devices: config.
+const scanResultVersion = 1
+
+type scanResult struct {
+	SchemaVersion   int                `json:"schema_version" yaml:"schema_version"`
+	ExporterVersion string             `json:"exporter_version" yaml:"exporter_version"`
+	Scan            scanResultMeta     `json:"scan" yaml:"scan"`
+	Stats           scanResultStats    `json:"stats" yaml:"stats"`
+	Devices         []scanResultDevice `json:"devices" yaml:"devices"`
+}
+
+type scanResultMeta struct {
+	ID        uint64    `json:"id" yaml:"id"`
+	Cause     string    `json:"cause" yaml:"cause"`
+	StartedAt time.Time `json:"started_at" yaml:"started_at"`
+	Gateway   string    `json:"gateway,omitempty" yaml:"gateway,omitempty"`
+	// Volatile.
+	DurationSeconds float64 `json:"duration_seconds,omitempty" yaml:"duration_seconds,omitempty"`
+}
+
+type scanResultStats struct {
+	Devices        int            `json:"devices" yaml:"devices"`
+	Online         int            `json:"online" yaml:"online"`
+	Dormant        int            `json:"dormant" yaml:"dormant"`
+	Infrastructure int            `json:"infrastructure" yaml:"infrastructure"`
+	ByType         map[string]int `json:"by_type" yaml:"by_type"`
+}
+
+type scanResultDevice struct {
+	IP             string   `json:"ip" yaml:"ip"`
+	MAC            string   `json:"mac" yaml:"mac"`
+	Hostname       string   `json:"hostname" yaml:"hostname"`
+	Name           string   `json:"name" yaml:"name"`
+	Vendor         string   `json:"vendor" yaml:"vendor"`
+	DeviceType     string   `json:"device_type" yaml:"device_type"`
+	Infrastructure bool     `json:"infrastructure" yaml:"infrastructure"`
+	State          string   `json:"state" yaml:"state"`
+	Guest          bool     `json:"guest,omitempty" yaml:"guest,omitempty"`
+	Proxied        bool     `json:"proxied,omitempty" yaml:"proxied,omitempty"`
+	StaticInPool   bool     `json:"static_in_pool,omitempty" yaml:"static_in_pool,omitempty"`
+	VLAN           string   `json:"vlan,omitempty" yaml:"vlan,omitempty"`
+	Owner          string   `json:"owner,omitempty" yaml:"owner,omitempty"`
+	Location       string   `json:"location,omitempty" yaml:"location,omitempty"`
+	Tags           []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Groups         []string `json:"groups,omitempty" yaml:"groups,omitempty"`
+	// Names are the resolved names by source.
+	Names   map[string]string `json:"names,omitempty" yaml:"names,omitempty"`
+	Version string            `json:"version,omitempty" yaml:"version,omitempty"`
+
+	// Volatile.
+	RTTMs         float64                  `json:"rtt_ms,omitempty" yaml:"rtt_ms,omitempty"`
+	ARPSeen       bool                     `json:"arp_seen,omitempty" yaml:"arp_seen,omitempty"`
+	ICMPReplied   bool                     `json:"icmp_replied,omitempty" yaml:"icmp_replied,omitempty"`
+	HostnameStale bool                     `json:"hostname_stale,omitempty" yaml:"hostname_stale,omitempty"`
+	FirstSeen     *time.Time               `json:"first_seen,omitempty" yaml:"first_seen,omitempty"`
+	Flaps24h      int                      `json:"flaps_24h,omitempty" yaml:"flaps_24h,omitempty"`
+	Errors        map[string][]ErrorRecord `json:"errors,omitempty" yaml:"errors,omitempty"`
+}
+
+// newScanResult builds the document for a scan, with the volatile fields
+// only when asked for.
+func newScanResult(scan *ScanSnapshot, volatile bool) scanResult {
+	res := scanResult{
+		SchemaVersion:   scanResultVersion,
+		ExporterVersion: version,
+		Scan: scanResultMeta{
+			ID:        scan.Stats.ID,
+			Cause:     scan.Stats.Cause,
+			StartedAt: scan.Stats.StartedAt.UTC().Truncate(time.Second),
+			Gateway:   scan.Gateway,
+		},
+		Stats:   scanResultStats{ByType: make(map[string]int)},
+		Devices: make([]scanResultDevice, 0, len(scan.Devices)),
+	}
+	if volatile {
+		res.Scan.StartedAt = scan.Stats.StartedAt.UTC()
+		res.Scan.DurationSeconds = scan.Stats.Duration.Seconds()
+	}
+	for _, d := range scan.Devices {
+		res.Stats.Devices++
+		res.Stats.ByType[d.DeviceType]++
+		switch d.State {
+		case stateOnline:
+			res.Stats.Online++
+		case stateDormant:
+			res.Stats.Dormant++
+		}
+		if d.Infrastructure {
+			res.Stats.Infrastructure++
+		}
+		rd := scanResultDevice{
+			IP:             d.IP,
+			MAC:            d.MAC,
+			Hostname:       d.Hostname,
+			Name:           d.Name,
+			Vendor:         d.Vendor,
+			DeviceType:     d.DeviceType,
+			Infrastructure: d.Infrastructure,
+			State:          d.State,
+			Guest:          d.Guest,
+			Proxied:        d.Proxied,
+			StaticInPool:   d.StaticInPool,
+			VLAN:           d.VLAN,
+			Owner:          d.Owner,
+			Location:       d.Location,
+			Tags:           d.Tags,
+			Groups:         d.Groups,
+		}
+		if len(d.Names) > 0 {
+			rd.Names = make(map[string]string, len(d.Names))
+			for source, rec := range d.Names {
+				rd.Names[source] = rec.Name
+			}
+		}
+		if d.Version != nil {
+			rd.Version = d.Version.Version
+		}
+		if volatile {
+			firstSeen := d.FirstSeen.UTC()
+			rd.RTTMs = float64(d.Probe.RTT) / float64(time.Millisecond)
+			rd.ARPSeen, rd.ICMPReplied = d.Probe.ARPSeen, d.Probe.ICMPReplied
+			rd.HostnameStale = d.HostnameStale
+			rd.FirstSeen = &firstSeen
+			rd.Flaps24h = d.Flaps24h
+			rd.Errors = d.Errors
+		}
+		res.Devices = append(res.Devices, rd)
+	}
+	sort.Slice(res.Devices, func(i, j int) bool {
+		a, b := res.Devices[i], res.Devices[j]
+		if a.IP != b.IP {
+			ai, aerr := netip.ParseAddr(a.IP)
+			bi, berr := netip.ParseAddr(b.IP)
+			if aerr == nil && berr == nil {
+				return ai.Less(bi)
+			}
+			return a.IP < b.IP
+		}
+		return a.MAC < b.MAC
+	})
+	return res
+}
+
+// encodeScanResult renders the document as "json" or "yaml".
+func encodeScanResult(res scanResult, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	if format == "json" {
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		err := enc.Encode(res)
+		return buf.Bytes(), err
+	}
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(res); err != nil {
+		return nil, err
+	}
+	enc.Close()
+	return buf.Bytes(), nil
+}
+
+// scanResultHandler serves GET /api/v1/scans/latest/full: the latest scan
+// as a scan result document, JSON unless format=yaml, with volatile=true
+// adding the volatile fields.
+func scanResultHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := scannerFor(w, r)
+	if !ok {
+		return
+	}
+	scan := s.currentScan()
+	if scan == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no scan has finished yet"})
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "yaml" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format must be json or yaml"})
+		return
+	}
+	data, err := encodeScanResult(newScanResult(scan, r.URL.Query().Get("volatile") == "true"), format)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if format == "yaml" {
+		w.Header().Set("Content-Type", "application/yaml")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Write(data)
+}
+
+type scanOnceOptions struct {
+	output   string
+	format   string
+	volatile bool
+	scanner  string
+}
+
+// parseScanOnceArgs parses `scan -output FILE` or `--once --output FILE`,
+// both running a single scan that is written to FILE ("-" for stdout).
+func parseScanOnceArgs(args []string) (scanOnceOptions, error) {
+	if len(args) > 0 && args[0] == "scan" {
+		args = args[1:]
+	}
+	var opts scanOnceOptions
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	fs.Bool("once", true, "scan once and exit (always the case here)")
+	fs.StringVar(&opts.output, "output", "", "file to write the scan result to, - for stdout")
+	fs.StringVar(&opts.format, "format", "", "json or yaml (default: from the file extension, yaml for stdout)")
+	fs.BoolVar(&opts.volatile, "volatile", false, "include fields that change between scans (RTT, probe details, errors)")
+	fs.StringVar(&opts.scanner, "scanner", "", "scanner to run with scanners: (default: the first)")
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	if opts.output == "" {
+		return opts, fmt.Errorf("scan: -output is required")
+	}
+	if opts.format == "" {
+		opts.format = "yaml"
+		if strings.EqualFold(filepath.Ext(opts.output), ".json") {
+			opts.format = "json"
+		}
+	}
+	if opts.format != "json" && opts.format != "yaml" {
+		return opts, fmt.Errorf("scan: -format must be json or yaml, got %q", opts.format)
+	}
+	return opts, nil
+}
+
+// runScanOnce runs one scan and writes its result document, returning the
+// process exit code.
+func runScanOnce(opts scanOnceOptions) int {
+	s, ok := findScanner(opts.scanner)
+	if !ok {
+		errorLog.Printf("No scanner %q in scanners", opts.scanner)
+		return 2
+	}
+	s.scanAndUpdateMetrics(scanCauseOnce)
+	scan := s.currentScan()
+	if scan == nil {
+		errorLog.Printf("The scan produced no result")
+		return 1
+	}
+	data, err := encodeScanResult(newScanResult(scan, opts.volatile), opts.format)
+	if err != nil {
+		errorLog.Printf("Error encoding the scan result: %v", err)
+		return 1
+	}
+	if opts.output == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = os.WriteFile(opts.output, data, 0o644)
+	}
+	if err != nil {
+		errorLog.Printf("Error writing the scan result: %v", err)
+		return 1
+	}
+	if opts.output != "-" {
+		log.Printf("Wrote %d devices to %s", len(scan.Devices), opts.output)
+	}
+	return 0
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// resultScan is a scan with devices out of order and every field the
+// document carries, volatile ones included.
+func resultScan(rtt time.Duration, flaps int) *ScanSnapshot {
+	at := time.Date(2024, 3, 1, 2, 0, 0, 123456789, time.FixedZone("CET", 3600))
+	return &ScanSnapshot{
+		Stats:   ScanStats{ID: 42, Cause: scanCauseOnce, StartedAt: at, Duration: 3*time.Second + rtt},
+		Gateway: "192.168.1.1",
+		TakenAt: at,
+		Devices: []Device{
+			{IP: "192.168.1.10", MAC: "aa:bb:cc:00:00:10", Hostname: "tv.lan", DeviceType: "tv", Vendor: "LG", State: stateDormant,
+				Names:     map[string]NameRecord{"mdns": {Name: "tv.local", ResolvedAt: at}, "dns": {Name: "tv.lan", ResolvedAt: at}},
+				Probe:     ProbeResult{ARPSeen: true, RTT: rtt},
+				FirstSeen: at.Add(-time.Hour), Flaps24h: flaps},
+			{IP: "192.168.1.2", MAC: "aa:bb:cc:00:00:02", Hostname: "nas.lan", Name: "nas", DeviceType: "server", State: stateOnline,
+				Owner: "ops", Location: "closet", Tags: []string{"backup", "storage"}, Groups: []string{"servers"},
+				Version:   &VersionRecord{Version: "7.2", Source: "ssh", ReportedAt: at},
+				Probe:     ProbeResult{ARPSeen: true, ICMPProbed: true, ICMPReplied: true, RTT: 2 * rtt},
+				FirstSeen: at.Add(-2 * time.Hour), Flaps24h: flaps,
+				Errors: map[string][]ErrorRecord{errResolution: {{Message: "timeout", Time: at}}}},
+			{IP: "192.168.1.1", MAC: "aa:bb:cc:00:00:01", Hostname: "router.lan", DeviceType: "router", State: stateOnline,
+				Infrastructure: true, VLAN: "10", Probe: ProbeResult{ICMPReplied: true, RTT: rtt}, FirstSeen: at.Add(-3 * time.Hour)},
+			{IP: "192.168.1.2", MAC: "aa:bb:cc:00:00:00", DeviceType: "unknown", State: stateOnline, Proxied: true, Guest: true},
+		},
+	}
+}
+
+func TestScanResultGolden(t *testing.T) {
+	prev := version
+	version = "1.2.3"
+	t.Cleanup(func() { version = prev })
+
+	for _, tc := range []struct {
+		file     string
+		format   string
+		volatile bool
+	}{
+		{"scan_result.yaml", "yaml", false},
+		{"scan_result.json", "json", false},
+		{"scan_result_volatile.json", "json", true},
+	} {
+		data, err := encodeScanResult(newScanResult(resultScan(1500*time.Microsecond, 2), tc.volatile), tc.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		golden(t, tc.file, data)
+	}
+}
+
+func TestScanResultIgnoresVolatileChanges(t *testing.T) {
+	a := newScanResult(resultScan(time.Millisecond, 0), false)
+	b := newScanResult(resultScan(20*time.Millisecond, 5), false)
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("RTT, flaps and duration changed the document:\n%+v\n%+v", a, b)
+	}
+	if v := newScanResult(resultScan(20*time.Millisecond, 5), true); v.Devices[0].RTTMs != 20 || v.Scan.DurationSeconds == 0 {
+		t.Errorf("volatile fields missing: %+v", v.Devices[0])
+	}
+
+	var ips []string
+	for _, d := range a.Devices {
+		ips = append(ips, d.IP+" "+d.MAC)
+	}
+	want := []string{"192.168.1.1 aa:bb:cc:00:00:01", "192.168.1.2 aa:bb:cc:00:00:00", "192.168.1.2 aa:bb:cc:00:00:02", "192.168.1.10 aa:bb:cc:00:00:10"}
+	if !reflect.DeepEqual(ips, want) {
+		t.Errorf("devices in order %v, want %v", ips, want)
+	}
+}
+
+func TestScanResultHandler(t *testing.T) {
+	s := withScanner(t)
+	get := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		scanResultHandler(rec, httptest.NewRequest("GET", "/api/v1/scans/latest/full"+query, nil))
+		return rec
+	}
+	if rec := get(""); rec.Code != 503 {
+		t.Errorf("before the first scan: status %d", rec.Code)
+	}
+	s.publishScan(resultScan(time.Millisecond, 0))
+	for _, tc := range []struct {
+		query, contentType string
+		code               int
+	}{
+		{"", "application/json", 200},
+		{"?format=yaml", "application/yaml", 200},
+		{"?format=json&volatile=true", "application/json", 200},
+		{"?format=xml", "application/json", 400},
+	} {
+		rec := get(tc.query)
+		if rec.Code != tc.code || rec.Header().Get("Content-Type") != tc.contentType {
+			t.Errorf("%q: status %d, %s; want %d, %s", tc.query, rec.Code, rec.Header().Get("Content-Type"), tc.code, tc.contentType)
+		}
+	}
+}
+
+func TestParseScanOnceArgs(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want scanOnceOptions
+		err  bool
+	}{
+		{[]string{"scan", "-output", "scan.yaml"}, scanOnceOptions{output: "scan.yaml", format: "yaml"}, false},
+		{[]string{"--once", "--output", "scan.JSON"}, scanOnceOptions{output: "scan.JSON", format: "json"}, false},
+		{[]string{"scan", "-output", "-", "-volatile", "-scanner", "lab"}, scanOnceOptions{output: "-", format: "yaml", volatile: true, scanner: "lab"}, false},
+		{[]string{"scan", "-output", "scan.txt", "-format", "json"}, scanOnceOptions{output: "scan.txt", format: "json"}, false},
+		{[]string{"scan"}, scanOnceOptions{}, true},
+		{[]string{"scan", "-output", "scan.xml", "-format", "xml"}, scanOnceOptions{}, true},
+	} {
+		got, err := parseScanOnceArgs(tc.args)
+		if (err != nil) != tc.err || (!tc.err && got != tc.want) {
+			t.Errorf("%v: got %+v, %v; want %+v", tc.args, got, err, tc.want)
+		}
+	}
+}
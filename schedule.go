@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// scanInterval is the pause between the end of one scan and the start of
+// the next.
+const scanInterval = 30 * time.Second
+
+// Scan causes counted in telemetry_scans_total. A dhcp scan only probes
+// the addresses joining devices requested (dhcp.sniff); a once scan is the
+// single scan of `scan -output`.
+const (
+	scanCausePeriodic = "periodic"
+	scanCauseDHCP     = "dhcp"
+	scanCauseOnce     = "once"
+)
+
+// overdueScans is how many consecutive intervals above twice the intended
+// pause (scanPause) are tolerated before a warning is logged.
+const overdueScans = 3
+
+// scanSchedule tracks the time between scan starts. Only touched by the
+// scan loop.
+type scanSchedule struct {
+	lastStart time.Time
+	overdue   int
+}
+
+// record observes the interval since the previous scan started and warns
+// once per streak of intervals longer than twice the pause waited before
+// this scan; it runs before updatePowerSave changes scanPause.
+func (s *scanSchedule) record(m *Metrics, cause string, start time.Time) {
+	m.ScansTriggered.WithLabelValues(cause).Inc()
+	defer func() { s.lastStart = start }()
+	if s.lastStart.IsZero() {
+		return
+	}
+	noteClockStep(m, s.lastStart, start)
+	interval := start.Sub(s.lastStart)
+	m.ScanIntervalHistogram.Observe(interval.Seconds())
+	m.ScanInterval.Observe(interval.Seconds())
+	pause := currentScanPause()
+	if interval <= 2*pause {
+		s.overdue = 0
+		return
+	}
+	s.overdue++
+	if s.overdue == overdueScans {
+		log.Printf("Warning: the last %d scans started more than %s apart (latest %s); scans are taking too long or the host is overloaded",
+			overdueScans, 2*pause, interval.Truncate(time.Second))
+	}
+}
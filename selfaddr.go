@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// localAddress returns this host's address and MAC on the scanned network,
+// honouring scan.interface and scan.source_ip.
+func localAddress(cfg ScanConfig, r scanRange) (string, string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", "", err
+	}
+	for _, iface := range ifaces {
+		if cfg.Interface != "" && iface.Name != cfg.Interface {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || !r.contains(ipNet.IP) {
+				continue
+			}
+			if cfg.SourceIP != "" && !ipNet.IP.Equal(net.ParseIP(cfg.SourceIP)) {
+				continue
+			}
+			return ipNet.IP.String(), strings.ToLower(iface.HardwareAddr.String()), nil
+		}
+	}
+	return "", "", fmt.Errorf("no local address in scan range %s", r)
+}
+
+// selfAddressState tracks our own address across scans.
+type selfAddressState struct {
+	ip       string
+	conflict string // MAC currently claiming our IP, if any
+}
+
+// checkSelfAddress detects another device answering ARP for our own IP and
+// our address changing between cycles (e.g. a new DHCP lease).
+func (s *scanner) checkSelfAddress(cfg ScanConfig, r scanRange, arpTable map[string]string) {
+	// With a remote s.runner the scanned network is not ours.
+	if _, ok := s.runner.(localRunner); !ok {
+		return
+	}
+	ip, mac, err := localAddress(cfg, r)
+	if err != nil {
+		debugf("self address: %v", err)
+		return
+	}
+
+	if s.selfAddress.ip != "" && s.selfAddress.ip != ip {
+		s.m.SelfIPChanges.Inc()
+		s.emitEvent("self_ip_changed", map[string]interface{}{
+			"previous": s.selfAddress.ip,
+			"ip":       ip,
+		})
+		s.selfAddress.conflict = ""
+	}
+	s.selfAddress.ip = ip
+
+	foreign, ok := arpTable[ip]
+	if !ok || foreign == unknownMAC || strings.EqualFold(foreign, mac) {
+		s.m.SelfIPConflict.Set(0)
+		s.selfAddress.conflict = ""
+		return
+	}
+	s.m.SelfIPConflict.Set(1)
+	if s.selfAddress.conflict != foreign {
+		s.selfAddress.conflict = foreign
+		s.emitEvent("self_ip_conflict", map[string]interface{}{
+			"ip":     ip,
+			"mac":    foreign,
+			"vendor": ouiDB.lookup(foreign),
+		})
+	}
+}
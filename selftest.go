@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// SentinelConfig describes a device that should always be discoverable,
+// typically the router. Expectations left empty are not checked.
+type SentinelConfig struct {
+	Name string `yaml:"name"`
+	MAC  string `yaml:"mac"`
+	IP   string `yaml:"ip"`
+	// ExpectResolved requires a hostname from the resolver chain.
+	ExpectResolved bool          `yaml:"expect_resolved"`
+	ExpectType     string        `yaml:"expect_type"`
+	MaxRTT         time.Duration `yaml:"max_rtt"`
+}
+
+type SelfTestConfig struct {
+	Sentinels []SentinelConfig `yaml:"sentinels"`
+}
+
+// Self-test failure reasons, in the order they are checked.
+const (
+	selftestNotFound    = "not_found"
+	selftestNotResolved = "not_resolved"
+	selftestWrongType   = "wrong_type"
+	selftestNoReply     = "no_reply"
+	selftestSlow        = "rtt_exceeded"
+)
+
+func (s SentinelConfig) label() string {
+	switch {
+	case s.Name != "":
+		return s.Name
+	case s.MAC != "":
+		return strings.ToLower(s.MAC)
+	}
+	return s.IP
+}
+
+// checkSentinel returns the first failed expectation, or "" if the
+// sentinel passed.
+func checkSentinel(s SentinelConfig, devices []Device) string {
+	var dev *Device
+	for i, d := range devices {
+		if (s.MAC != "" && strings.EqualFold(d.MAC, s.MAC)) || (s.MAC == "" && d.IP == s.IP) {
+			dev = &devices[i]
+			break
+		}
+	}
+	switch {
+	case dev == nil:
+		return selftestNotFound
+	case s.ExpectResolved && dev.Hostname == "<unknown>":
+		return selftestNotResolved
+	case s.ExpectType != "" && dev.DeviceType != s.ExpectType:
+		return selftestWrongType
+	case s.MaxRTT > 0 && !dev.Probe.ICMPReplied:
+		return selftestNoReply
+	case s.MaxRTT > 0 && dev.Probe.RTT > s.MaxRTT:
+		return selftestSlow
+	}
+	return ""
+}
+
+// runSelfTest checks every sentinel against the finished scan and exports
+// telemetry_selftest_ok{sentinel,reason}.
+func runSelfTest(m *Metrics, cfg SelfTestConfig, devices []Device) {
+	m.SelfTestOK.Reset()
+	for _, s := range cfg.Sentinels {
+		reason := checkSentinel(s, devices)
+		ok := 1.0
+		if reason != "" {
+			ok = 0
+			errorLog.Printf("Self-test sentinel %s failed: %s", s.label(), reason)
+		}
+		m.SelfTestOK.WithLabelValues(s.label(), reason).Set(ok)
+	}
+}
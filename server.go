@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+type HTTPConfig struct {
+	// RequestTimeout bounds every handler; requests exceeding it get a 503.
+	RequestTimeout time.Duration   `yaml:"request_timeout"`
+	WebSocket      WebSocketConfig `yaml:"websocket"`
+	Events         EventsConfig    `yaml:"events"`
+	Ingest         IngestConfig    `yaml:"ingest"`
+	// MetricsCache serves the last good /metrics exposition when
+	// gathering fails.
+	MetricsCache MetricsCacheConfig `yaml:"metrics_cache"`
+}
+
+func (c HTTPConfig) requestTimeout() time.Duration {
+	if c.RequestTimeout <= 0 {
+		return 10 * time.Second
+	}
+	return c.RequestTimeout
+}
+
+// withTimeout cancels the request context after the configured timeout and
+// answers 503 if the handler has not finished by then.
+func withTimeout(h http.Handler, cfg HTTPConfig) http.Handler {
+	return http.TimeoutHandler(h, cfg.requestTimeout(), "request timed out\n")
+}
+
+// requestCancelled reports whether r was cancelled by withTimeout or by a
+// client that went away. The response is decided by then, so slow handlers
+// check it between steps and before writing state instead of finishing in
+// the background.
+func requestCancelled(r *http.Request) bool {
+	return r.Context().Err() != nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestWithTimeoutCancelsHandler(t *testing.T) {
+	done := make(chan error, 1)
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			done <- r.Context().Err()
+		case <-time.After(5 * time.Second):
+			done <- nil
+			w.Write([]byte("finished"))
+		}
+	})
+	srv := httptest.NewServer(withTimeout(slow, HTTPConfig{RequestTimeout: 50 * time.Millisecond}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got %s, want 503", resp.Status)
+	}
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("handler ended with %v, want its context cancelled at the deadline", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("the handler kept running after the timeout")
+	}
+}
+
+func TestCancelledBundleWritesNothing(t *testing.T) {
+	withScanner(t)
+	dir := t.TempDir()
+	bundleMu.Lock()
+	lastBundle = time.Time{}
+	bundleMu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequestWithContext(ctx, http.MethodPost, "/api/v1/debug/bundle", nil)
+	if !requestCancelled(r) {
+		t.Fatal("a cancelled request is not reported as such")
+	}
+	rec := httptest.NewRecorder()
+	bundleHandler(DebugConfig{BundleDir: dir}, prometheus.NewRegistry())(rec, r)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 || rec.Body.Len() != 0 {
+		t.Errorf("a cancelled bundle request wrote %d files and %q", len(entries), rec.Body)
+	}
+	if _, err := collectBundle(ctx, time.Now(), prometheus.NewRegistry()); err != context.Canceled {
+		t.Errorf("collectBundle on a cancelled context: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+type RTTSLOConfig struct {
+	// EventAfter is how many consecutive breaching scans fire an
+	// rtt_slo_breached event (default 3).
+	EventAfter int `yaml:"event_after"`
+}
+
+func (c RTTSLOConfig) eventAfter() int {
+	if c.EventAfter <= 0 {
+		return 3
+	}
+	return c.EventAfter
+}
+
+// rttSLO returns the RTT objective for a device: the per-device setting
+// wins over the one on its device type rule.
+func (c Config) rttSLO(mac, deviceType string) (time.Duration, bool) {
+	if d, ok := c.deviceConfig(mac); ok && d.RTTSLOMs > 0 {
+		return time.Duration(d.RTTSLOMs * float64(time.Millisecond)), true
+	}
+	for _, rule := range c.DeviceTypes {
+		if rule.Type == deviceType && rule.RTTSLOMs > 0 {
+			return time.Duration(rule.RTTSLOMs * float64(time.Millisecond)), true
+		}
+	}
+	return 0, false
+}
+
+// checkRTTSLOs compares every device's RTT with its objective. Devices
+// without an objective are skipped, and so are scans without an RTT sample
+// (no reply), which neither breach nor end a streak.
+func (s *scanner) checkRTTSLOs(cfg Config, devices []Device) {
+	for _, d := range devices {
+		if d.MAC == unknownMAC {
+			continue
+		}
+		mac := strings.ToLower(d.MAC)
+		slo, ok := cfg.rttSLO(mac, d.DeviceType)
+		if !ok {
+			s.m.RTTSLOBreach.DeleteLabelValues(mac)
+			delete(s.sloStreaks, mac)
+			continue
+		}
+		rtt := d.Probe.RTT
+		if !d.Probe.ICMPReplied || rtt == 0 {
+			continue
+		}
+		if rtt <= slo {
+			s.m.RTTSLOBreach.WithLabelValues(mac).Set(0)
+			if s.sloStreaks[mac] >= cfg.RTTSLO.eventAfter() {
+				s.emitEvent("rtt_slo_recovered", map[string]interface{}{"device": d, "rtt_ms": millis(rtt), "slo_ms": millis(slo)})
+			}
+			s.sloStreaks[mac] = 0
+			continue
+		}
+		s.m.RTTSLOBreaches.WithLabelValues(mac).Inc()
+		s.m.RTTSLOBreach.WithLabelValues(mac).Set(1)
+		s.sloStreaks[mac]++
+		if s.sloStreaks[mac] == cfg.RTTSLO.eventAfter() {
+			s.emitEvent("rtt_slo_breached", map[string]interface{}{
+				"device":      d,
+				"rtt_ms":      millis(rtt),
+				"slo_ms":      millis(slo),
+				"consecutive": s.sloStreaks[mac],
+			})
+		}
+	}
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+type Device struct {
+	IP         string `json:"ip"`
+	MAC        string `json:"mac"`
+	Hostname   string `json:"hostname"`
+	Name       string `json:"name"`
+	Vendor     string `json:"vendor"`
+	DeviceType string `json:"device_type"`
+	// Infrastructure devices (gateway, switches, APs) are not clients.
+	Infrastructure bool          `json:"infrastructure"`
+	Display        DisplayConfig `json:"display"`
+	HostnameStale  bool          `json:"hostname_stale"`
+	// HostnameLabel is the hostname exported as a label; it only follows
+	// Hostname once a new name is confirmed (labels.hostname_confirm_scans).
+	HostnameLabel string `json:"hostname_label"`
+	// HostnameUnstable is set while HostnameLabel is frozen because the
+	// device changes names too often (labels.hostname_max_changes_per_hour).
+	HostnameUnstable bool `json:"hostname_unstable"`
+	// Names holds every resolved name by source (mdns, dns, netbios, arp).
+	Names map[string]NameRecord `json:"names"`
+	// Version is the last firmware/OS version the device reported over
+	// SSDP or mDNS, if any.
+	Version *VersionRecord `json:"version,omitempty"`
+	// HostInfo is what the device last reported about itself over SSH
+	// (devices[].ssh).
+	HostInfo  *HostInfo   `json:"host_info,omitempty"`
+	State     string      `json:"state"`
+	Probe     ProbeResult `json:"probe"`
+	FirstSeen time.Time   `json:"first_seen"`
+	// Flaps24h counts online/offline transitions in the last 24 hours.
+	Flaps24h int `json:"flaps_24h"`
+	// Errors holds the last errors per category (probe, resolution,
+	// classification, ssh); a category is cleared once it succeeds again.
+	Errors map[string][]ErrorRecord `json:"errors,omitempty"`
+	// ObservedInScan is the ID of the scan this device record comes from.
+	ObservedInScan uint64 `json:"observed_in_scan"`
+	// Guest devices are collapsed into wifi_guest_devices_total instead of
+	// getting their own series (scan.max_tracked_devices).
+	Guest bool `json:"guest"`
+	// Lease is the device's DHCP lease, when dhcp.leases_file is set.
+	Lease *Lease `json:"lease,omitempty"`
+	// StaticInPool marks a device inside the DHCP pool without a lease.
+	StaticInPool bool `json:"static_in_pool"`
+	// Tags come from the device's devices: entry; Groups are the groups:
+	// it belongs to in this scan.
+	Tags []string `json:"tags,omitempty"`
+	// Owner and Location also come from the devices: entry.
+	Owner    string `json:"owner,omitempty"`
+	Location string `json:"location,omitempty"`
+	// Proxied marks one of several IPs answered by the same MAC (proxy
+	// ARP), tracked as a device of its own; see scan.proxy_arp_threshold.
+	Proxied bool     `json:"proxied"`
+	Groups  []string `json:"groups,omitempty"`
+	// VLAN is the vlan of the scan interface the device was seen on.
+	VLAN string `json:"vlan,omitempty"`
+	// DHCP is the device's last sniffed DHCP fingerprint (dhcp.sniff).
+	DHCP *DHCPFingerprint `json:"dhcp,omitempty"`
+}
+
+// ProbeResult records what each probe phase saw for a device in one scan.
+type ProbeResult struct {
+	ARPSeen     bool `json:"arp_seen"`
+	ICMPProbed  bool `json:"icmp_probed"`
+	ICMPReplied bool `json:"icmp_replied"`
+	// RTT is the echo round-trip time, 0 without a reply.
+	RTT time.Duration `json:"rtt,omitempty"`
+}
+
+type ScanStats struct {
+	// ID increases by one per scan since the process started, across
+	// scanners; Cause is what triggered it and Scanner the scanners:
+	// entry that ran it.
+	ID        uint64        `json:"scan_id"`
+	Cause     string        `json:"cause"`
+	Scanner   string        `json:"scanner,omitempty"`
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+	Probed    int           `json:"probed"`
+	// Unprobed counts the targets left out because the scan ran out of
+	// scan.max_packets_per_cycle, which BudgetExhausted reports.
+	Unprobed        int          `json:"unprobed,omitempty"`
+	BudgetExhausted bool         `json:"budget_exhausted,omitempty"`
+	Stages          []StageStats `json:"stages"`
+	// Traffic is what the scan sent, per probe kind.
+	Traffic map[string]TrafficStats `json:"traffic,omitempty"`
+	// Phases counts the devices each probe phase (broadcast, unicast)
+	// found first.
+	Phases map[string]int `json:"phases"`
+	// Conditions are host network conditions seen during the scan.
+	Conditions ScanConditions `json:"conditions"`
+	// TraceID is the scan's trace when tracing is on.
+	TraceID string `json:"trace_id,omitempty"`
+
+	trace *scanTrace
+}
+
+type ScanSnapshot struct {
+	Devices        []Device               `json:"devices"`
+	Infrastructure []InfrastructureStatus `json:"infrastructure"`
+	Stats          ScanStats              `json:"stats"`
+	// Aggregates summarize RTT and loss per vendor and device type.
+	Aggregates Aggregates `json:"aggregates"`
+	// Groups is the presence of every configured device group.
+	Groups map[string]GroupStatus `json:"groups"`
+	// Presence is the device registry, including recently absent devices.
+	Presence []PresenceRecord `json:"presence"`
+	// Gateway is the host's default gateway during the scan.
+	Gateway string    `json:"gateway"`
+	TakenAt time.Time `json:"taken_at"`
+	// VersionMetric mirrors resolution.version_metric for the collector.
+	VersionMetric bool `json:"-"`
+	// Labels sanitizes free-form label values; the API keeps raw values.
+	Labels labelPolicy `json:"-"`
+	// Views are the configured metric views, rendered by viewCollector.
+	Views []metricView `json:"-"`
+}
+
+type SystemSnapshot struct {
+	CPUPercent float64 `json:"cpu_percent"`
+	// CPUCorePercent is the usage of every logical CPU, by CPU number.
+	CPUCorePercent []float64 `json:"cpu_core_percent,omitempty"`
+	MemoryPercent  float64   `json:"memory_percent"`
+	MemoryTotal    uint64    `json:"memory_total_bytes"`
+	MemoryUsed     uint64    `json:"memory_used_bytes"`
+	TakenAt        time.Time `json:"taken_at"`
+}
+
+// Snapshots are immutable once published: writers build a fresh value and
+// swap the pointer, readers never modify what they load. Scan snapshots
+// are kept per scanner.
+var lastSystemInfo atomic.Pointer[SystemSnapshot]
+
+func publishSystem(s SystemSnapshot) {
+	lastSystemInfo.Store(&s)
+}
+
+func currentSystem() SystemSnapshot {
+	if s := lastSystemInfo.Load(); s != nil {
+		return *s
+	}
+	return SystemSnapshot{}
+}
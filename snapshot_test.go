@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// consistentScan builds scan n: n devices, scan ID n and a group of n
+// members, so a reader that mixes two scans sees counts that disagree.
+func consistentScan(n int) *ScanSnapshot {
+	snap := &ScanSnapshot{
+		Stats:   ScanStats{ID: uint64(n)},
+		Groups:  map[string]GroupStatus{"all": {Members: n, Online: n, AnyOnline: n > 0}},
+		TakenAt: time.Unix(int64(n), 0),
+	}
+	for i := range n {
+		snap.Devices = append(snap.Devices, Device{
+			IP:         fmt.Sprintf("10.0.%d.%d", i/250, i%250+1),
+			MAC:        fmt.Sprintf("aa:bb:cc:00:%02x:%02x", i/256, i%256),
+			DeviceType: "unknown",
+		})
+	}
+	return snap
+}
+
+// TestSnapshotReadersRace runs the collector, the devices API and the
+// status page against publication; run it under -race. Every reader must
+// see one whole scan, and none may change what it read.
+func TestSnapshotReadersRace(t *testing.T) {
+	s := withScanner(t)
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(newDeviceCollector("", s))
+
+	const scans = 200
+	published := make([]*ScanSnapshot, scans)
+	for i := range published {
+		published[i] = consistentScan(i % 20)
+	}
+	s.publishScan(published[0])
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failures []string
+	fail := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		failures = append(failures, fmt.Sprintf(format, args...))
+	}
+	reader := func(read func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					read()
+				}
+			}
+		}()
+	}
+
+	reader(func() {
+		mfs, err := reg.Gather()
+		if err != nil {
+			fail("gather: %v", err)
+			return
+		}
+		devices, members := 0, -1.0
+		for _, mf := range mfs {
+			switch mf.GetName() {
+			case "wifi_connected_devices":
+				devices = len(mf.Metric)
+			case "wifi_group_devices":
+				members = mf.Metric[0].GetGauge().GetValue()
+			}
+		}
+		if float64(devices) != members {
+			fail("scrape saw %d devices and a group of %v", devices, members)
+		}
+	})
+	reader(func() {
+		rec := httptest.NewRecorder()
+		devicesHandler(rec, httptest.NewRequest("GET", "/api/v1/devices", nil))
+		var got []Device
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			fail("devices API: %v", err)
+		}
+	})
+	reader(func() {
+		v := buildStatusView(s.currentScan(), currentSystem(), time.Now())
+		if uint64(v.Devices) != v.ScanID {
+			fail("status page saw scan %d with %d devices", v.ScanID, v.Devices)
+		}
+	})
+
+	for _, snap := range published {
+		s.publishScan(snap)
+		time.Sleep(100 * time.Microsecond)
+	}
+	close(stop)
+	wg.Wait()
+	for _, f := range failures {
+		t.Error(f)
+	}
+
+	for i, snap := range published {
+		if want := consistentScan(i % 20); !reflect.DeepEqual(snap, want) {
+			t.Errorf("scan %d was modified after publication", i)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// eventCursor reads the resume position from Last-Event-ID or ?after_seq=.
+func eventCursor(r *http.Request) (*uint64, error) {
+	raw := r.Header.Get("Last-Event-ID")
+	if q := r.URL.Query().Get("after_seq"); q != "" {
+		raw = q
+	}
+	if raw == "" {
+		return nil, nil
+	}
+	seq, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid event cursor %q", raw)
+	}
+	return &seq, nil
+}
+
+// eventsHandler serves GET /api/v1/events: the buffered events after
+// ?after_seq= (all buffered events without it).
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	after, err := eventCursor(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	var cursor uint64
+	if after != nil {
+		cursor = *after
+	}
+	events, latest := recentEvents(cursor)
+	if events == nil {
+		events = []Event{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"events":     events,
+		"latest_seq": latest,
+	})
+}
+
+func writeSSE(w http.ResponseWriter, ev Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return nil // skip what cannot be encoded
+	}
+	if ev.Seq != 0 {
+		fmt.Fprintf(w, "id: %d\n", ev.Seq)
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+	return err
+}
+
+// eventStreamHandler serves GET /api/v1/events/stream as server-sent
+// events, replaying the buffer after Last-Event-ID on reconnect.
+func eventStreamHandler(cfg WebSocketConfig) http.HandlerFunc {
+	cfg = cfg.withDefaults()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.originAllowed(r) {
+			http.Error(w, "cross-origin request rejected", http.StatusForbidden)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		after, err := eventCursor(r)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		filter := parseTypeFilter(r)
+
+		events, replay, cancel := subscribeAfter(cfg.SendBuffer, after)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		for _, ev := range replay {
+			if filter == nil || filter[ev.Type] || ev.Type == "resync_required" {
+				if err := writeSSE(w, ev); err != nil {
+					return
+				}
+			}
+		}
+		flusher.Flush()
+
+		ticker := time.NewTicker(cfg.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+			case ev, ok := <-events:
+				if !ok {
+					// Too slow; the client reconnects with Last-Event-ID.
+					return
+				}
+				if filter != nil && !filter[ev.Type] {
+					continue
+				}
+				if err := writeSSE(w, ev); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sourceSSH is the enricher asking managed devices (devices[].ssh) about
+// themselves, and the name source of the hostname they report.
+const sourceSSH = "ssh"
+
+// errSSH is the device error category of failed SSH enrichment.
+const errSSH = "ssh"
+
+// HostInfo is what a managed device reports about itself over SSH.
+type HostInfo struct {
+	Hostname  string    `json:"hostname"`
+	OS        string    `json:"os"`
+	Kernel    string    `json:"kernel"`
+	BootTime  time.Time `json:"boot_time"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// hostInfoScript prints the hostname, OS, kernel release and either the
+// uptime (Linux) or the boot time (macOS, BSD).
+const hostInfoScript = "hostname; uname -s; uname -r; cat /proc/uptime 2>/dev/null || sysctl -n kern.boottime"
+
+// lookupHostInfo runs hostInfoScript on a managed device through the ssh
+// runner, at the device's IP unless the ssh entry names a host.
+func lookupHostInfo(ip string, cfg RemoteConfig, now time.Time) (HostInfo, error) {
+	if cfg.Host == "" {
+		cfg.Host = ip
+	}
+	r, err := newSSHRunner(cfg)
+	if err != nil {
+		return HostInfo{}, err
+	}
+	out, err := r.Output("sh", "-c", hostInfoScript)
+	if err != nil {
+		return HostInfo{}, scrubSSHError(err, cfg)
+	}
+	return parseHostInfo(string(out), now)
+}
+
+// parseHostInfo parses the output of hostInfoScript, e.g. on Linux
+//
+//	nas
+//	Linux
+//	6.1.0-18-amd64
+//	350735.12 1382537.55
+//
+// and on macOS, where the last line is kern.boottime:
+//
+//	{ sec = 1712044800, usec = 0 } Tue Apr  2 10:00:00 2024
+func parseHostInfo(out string, now time.Time) (HostInfo, error) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) < 4 {
+		return HostInfo{}, classified(ErrParse, fmt.Errorf("host info: expected 4 lines, got %d", len(lines)))
+	}
+	info := HostInfo{
+		Hostname:  strings.TrimSpace(lines[0]),
+		OS:        strings.TrimSpace(lines[1]),
+		Kernel:    strings.TrimSpace(lines[2]),
+		CheckedAt: now,
+	}
+	last := strings.TrimSpace(lines[3])
+	if _, rest, ok := strings.Cut(last, "sec = "); ok {
+		sec, err := strconv.ParseInt(strings.TrimRight(strings.Fields(rest)[0], ","), 10, 64)
+		if err != nil {
+			return HostInfo{}, classified(ErrParse, fmt.Errorf("host info: boot time %q: %v", last, err))
+		}
+		info.BootTime = time.Unix(sec, 0)
+	} else if fields := strings.Fields(last); len(fields) > 0 {
+		uptime, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return HostInfo{}, classified(ErrParse, fmt.Errorf("host info: uptime %q: %v", last, err))
+		}
+		info.BootTime = now.Add(-time.Duration(uptime * float64(time.Second))).Truncate(time.Second)
+	}
+	return info, nil
+}
+
+// scrubSSHError adds the first line of ssh's stderr to err, with the key
+// and known hosts paths and the user name taken out, since the error ends
+// up in the device's error history and the API.
+func scrubSSHError(err error, cfg RemoteConfig) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	msg, _, _ := strings.Cut(strings.TrimSpace(string(exitErr.Stderr)), "\n")
+	if msg == "" {
+		return err
+	}
+	for _, secret := range []string{cfg.KeyFile, cfg.KnownHostsFile, cfg.User} {
+		if secret != "" {
+			msg = strings.ReplaceAll(msg, secret, "<redacted>")
+		}
+	}
+	return fmt.Errorf("%w: %s", err, msg)
+}
+
+// enrichBackoff is how long a device is left alone after n failed
+// attempts in a row: 5 minutes, doubling up to a day.
+func enrichBackoff(n int) time.Duration {
+	d := 5 * time.Minute
+	for i := 1; i < n && d < 24*time.Hour; i++ {
+		d *= 2
+	}
+	return min(d, 24*time.Hour)
+}
+
+// validateDeviceSSH checks the ssh entries of devices:.
+func validateDeviceSSH(devices []DeviceConfig) []error {
+	var errs []error
+	for i, d := range devices {
+		if d.SSH != nil && (d.SSH.KeyFile == "" || d.SSH.KnownHostsFile == "") {
+			errs = append(errs, fmt.Errorf("devices[%d].ssh: key_file and known_hosts_file are required", i))
+		}
+	}
+	return errs
+}
+
+func init() {
+	registerFeature("ssh_enrichment", false)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Scan pipeline stages, in execution order.
+const (
+	stageProbe          = "probe"
+	stageNeighborRead   = "neighbor_read"
+	stageResolution     = "resolution"
+	stageClassification = "classification"
+	stagePublish        = "publish"
+)
+
+type StageStats struct {
+	Stage    string        `json:"stage"`
+	Duration time.Duration `json:"duration"`
+	Items    int           `json:"items"`
+	Errors   int           `json:"errors"`
+}
+
+func (s *ScanStats) recordStage(m *Metrics, stage string, start time.Time, items, errors int) {
+	d := time.Since(start)
+	s.Stages = append(s.Stages, StageStats{Stage: stage, Duration: d, Items: items, Errors: errors})
+	m.ScanStageDuration.WithLabelValues(stage).Observe(d.Seconds())
+	s.trace.stage(stage, start, start.Add(d), items, errors)
+}
+
+// scanID is the ID of the scan in progress, or of the last one, of any
+// scanner. Events carry it so they can be matched with /api/v1/scans and
+// the metrics; a scanner's own events carry its own scan instead.
+var scanID atomic.Uint64
+
+func nextScanID() uint64 {
+	return scanID.Add(1)
+}
+
+const scanHistorySize = 50
+
+// scanHistory keeps a scanner's last scanHistorySize scans for
+// /api/v1/scans.
+type scanHistory struct {
+	mu    sync.Mutex
+	scans []ScanStats
+}
+
+func (h *scanHistory) record(s ScanStats) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.scans = append(h.scans, s)
+	if len(h.scans) > scanHistorySize {
+		h.scans = h.scans[len(h.scans)-scanHistorySize:]
+	}
+}
+
+// recent returns the recorded scans, newest first.
+func (h *scanHistory) recent() []ScanStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make([]ScanStats, 0, len(h.scans))
+	for i := len(h.scans) - 1; i >= 0; i-- {
+		out = append(out, h.scans[i])
+	}
+	return out
+}
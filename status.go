@@ -0,0 +1,172 @@
+package main
+
+import (
+	htmltemplate "html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var startTime = time.Now()
+
+type typeCount struct {
+	Type  string
+	Count int
+}
+
+type statusView struct {
+	Uptime       time.Duration
+	LastScan     time.Time
+	ScanID       uint64
+	ScanDuration time.Duration
+	Stages       []StageStats
+	Devices      int
+	ByType       []typeCount
+	RecentJoins  []Device
+	TopFlappers  []Device
+	System       SystemSnapshot
+	Conditions   []string
+	// Sparkline plots devices online over the last 24 hours (HTML only).
+	Sparkline htmltemplate.HTML
+}
+
+func buildStatusView(scan *ScanSnapshot, sys SystemSnapshot, now time.Time) statusView {
+	v := statusView{
+		Uptime: now.Sub(startTime).Truncate(time.Second),
+		System: sys,
+	}
+	if scan == nil {
+		return v
+	}
+	v.LastScan = scan.TakenAt
+	v.ScanID = scan.Stats.ID
+	v.ScanDuration = scan.Stats.Duration.Truncate(time.Millisecond)
+	v.Stages = scan.Stats.Stages
+	v.Conditions = scan.Stats.Conditions.names()
+	v.Devices = len(scan.Devices)
+
+	counts := make(map[string]int)
+	for _, d := range scan.Devices {
+		counts[d.DeviceType]++
+	}
+	for t, c := range counts {
+		v.ByType = append(v.ByType, typeCount{Type: t, Count: c})
+	}
+	sort.Slice(v.ByType, func(i, j int) bool { return v.ByType[i].Type < v.ByType[j].Type })
+
+	recent := append([]Device(nil), scan.Devices...)
+	sort.Slice(recent, func(i, j int) bool { return recent[i].FirstSeen.After(recent[j].FirstSeen) })
+	if len(recent) > 5 {
+		recent = recent[:5]
+	}
+	v.RecentJoins = recent
+
+	var flappers []Device
+	for _, d := range scan.Devices {
+		if d.Flaps24h > 0 {
+			flappers = append(flappers, d)
+		}
+	}
+	sort.Slice(flappers, func(i, j int) bool { return flappers[i].Flaps24h > flappers[j].Flaps24h })
+	if len(flappers) > 5 {
+		flappers = flappers[:5]
+	}
+	v.TopFlappers = flappers
+	return v
+}
+
+const statusText = `uptime:        {{.Uptime}}
+{{- if .LastScan.IsZero}}
+last scan:     pending
+{{- else}}
+last scan:     #{{.ScanID}} {{.LastScan.Format "2006-01-02 15:04:05"}} ({{.ScanDuration}})
+{{- range .Stages}}
+  {{printf "%-15s" .Stage}} {{printf "%10s" (ms .Duration)}} {{printf "%5d" .Items}} items {{.Errors}} errors
+{{- end}}
+{{- end}}
+devices:       {{.Devices}}
+{{- range .ByType}}
+  {{printf "%-12s" .Type}} {{.Count}}
+{{- end}}
+recently joined:
+{{- range .RecentJoins}}
+  {{printf "%-15s" .IP}} {{.MAC}} {{.Hostname}} ({{.DeviceType}}, {{.Display.Category}}) since {{.FirstSeen.Format "2006-01-02 15:04"}}
+{{- end}}
+top flappers (24h):
+{{- range .TopFlappers}}
+  {{printf "%-15s" .IP}} {{.MAC}} {{.Hostname}} {{.Flaps24h}} transitions
+{{- end}}
+cpu:           {{printf "%.1f" .System.CPUPercent}}%
+memory:        {{printf "%.1f" .System.MemoryPercent}}% of {{.System.MemoryTotal}} bytes
+conditions:    {{if .Conditions}}{{join .Conditions ", "}}{{else}}none{{end}}
+`
+
+const statusHTML = `<!DOCTYPE html>
+<html><head><title>telemetry status</title></head><body>
+<h1>Status</h1>
+<table>
+<tr><th align="left">Uptime</th><td>{{.Uptime}}</td></tr>
+<tr><th align="left">Last scan</th><td>{{if .LastScan.IsZero}}pending{{else}}#{{.ScanID}} {{.LastScan.Format "2006-01-02 15:04:05"}} ({{.ScanDuration}}){{end}}</td></tr>
+{{- range .Stages}}
+<tr><td>{{.Stage}}</td><td>{{ms .Duration}}, {{.Items}} items, {{.Errors}} errors</td></tr>
+{{- end}}
+<tr><th align="left">Devices</th><td>{{.Devices}}</td></tr>
+{{- if .Sparkline}}
+<tr><th align="left">Online (24h)</th><td>{{.Sparkline}}</td></tr>
+{{- end}}
+{{- range .ByType}}
+<tr><td>{{.Type}}</td><td>{{.Count}}</td></tr>
+{{- end}}
+<tr><th align="left">CPU</th><td>{{printf "%.1f" .System.CPUPercent}}%</td></tr>
+<tr><th align="left">Memory</th><td>{{printf "%.1f" .System.MemoryPercent}}% of {{.System.MemoryTotal}} bytes</td></tr>
+<tr><th align="left">Conditions</th><td>{{if .Conditions}}{{join .Conditions ", "}}{{else}}none{{end}}</td></tr>
+</table>
+<h2>Recently joined</h2>
+<table>
+{{- range .RecentJoins}}
+<tr><td title="{{.Display.Icon}}" style="color:{{.Display.Color}}">&#9679;</td><td>{{.IP}}</td><td>{{.MAC}}</td><td>{{.Hostname}}</td><td>{{.DeviceType}} ({{.Display.Category}})</td><td>{{.FirstSeen.Format "2006-01-02 15:04"}}</td></tr>
+{{- end}}
+</table>
+<h2>Top flappers (24h)</h2>
+<table>
+{{- range .TopFlappers}}
+<tr><td>{{.IP}}</td><td>{{.MAC}}</td><td>{{.Hostname}}</td><td>{{.Flaps24h}}</td></tr>
+{{- end}}
+</table>
+</body></html>
+`
+
+var (
+	statusFuncs    = map[string]interface{}{"join": strings.Join, "ms": formatMillis}
+	statusTextTmpl = template.Must(template.New("status").Funcs(statusFuncs).Parse(statusText))
+	statusHTMLTmpl = htmltemplate.Must(htmltemplate.New("status").Funcs(statusFuncs).Parse(statusHTML))
+)
+
+func formatMillis(d time.Duration) string {
+	return d.Truncate(100 * time.Microsecond).String()
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := scannerFor(w, r)
+	if !ok {
+		return
+	}
+	view := buildStatusView(s.currentScan(), currentSystem(), time.Now())
+
+	var err error
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		if points, resolution, err := s.timeseries.series("devices_online", 24*time.Hour, time.Now()); err == nil {
+			view.Sparkline = sparklineSVG(points, resolution, 24*time.Hour, time.Now())
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = statusHTMLTmpl.Execute(w, view)
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		err = statusTextTmpl.Execute(w, view)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// actualSubnets returns the IPv4 subnets of the interface a network is
+// scanned through: scan.interface, or else the interface holding the
+// default gateway.
+func actualSubnets(n scanNetwork, gateway string) (string, []string, error) {
+	if n.Interface != "" {
+		cidrs, err := interfaceCIDRs(n.Interface)
+		return n.Interface, cidrs, err
+	}
+	gw := net.ParseIP(gateway)
+	if gw == nil {
+		return "", nil, fmt.Errorf("no default gateway")
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.Contains(gw) {
+				cidrs, err := interfaceCIDRs(iface.Name)
+				return iface.Name, cidrs, err
+			}
+		}
+	}
+	return "", nil, fmt.Errorf("no interface on the gateway's subnet")
+}
+
+func overlapsAny(r scanRange, cidrs []string) bool {
+	for _, cidr := range cidrs {
+		q, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			continue
+		}
+		for _, p := range r {
+			if p.Overlaps(q) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkSubnets compares every network's configured range with the subnets
+// of its interface, e.g. after a new router started handing out another
+// subnet. A network that overlaps none of them is reported in
+// telemetry_config_subnet_mismatch and, with scan.auto_follow_interface,
+// scanned on the interface's subnets instead for this scan. Networks
+// whose interface subnets are unknown are left alone.
+func (s *scanner) checkSubnets(cfg Config, networks []scanNetwork, gateway string) []scanNetwork {
+	// With a remote s.runner the scanned network is not ours.
+	if _, ok := s.runner.(localRunner); !ok {
+		return networks
+	}
+	s.m.SubnetMismatch.Reset()
+	out := append([]scanNetwork(nil), networks...)
+	for i, n := range networks {
+		iface, cidrs, err := actualSubnets(n, gateway)
+		if err != nil {
+			debugf("subnet check for %s: %v", n.Range, err)
+			continue
+		}
+		setting := "network.cidrs"
+		if len(cfg.Scan.Interfaces) > 0 {
+			setting = fmt.Sprintf("scan.interfaces[%d].cidrs", i)
+		}
+		configured, actual := n.Range.String(), strings.Join(cidrs, ", ")
+		if overlapsAny(n.Range, cidrs) {
+			s.m.SubnetMismatch.WithLabelValues(configured, actual).Set(0)
+			if _, ok := s.subnetMismatches[setting]; ok {
+				s.printf("Scan range %s matches %s again", configured, iface)
+				delete(s.subnetMismatches, setting)
+			}
+			continue
+		}
+		s.m.SubnetMismatch.WithLabelValues(configured, actual).Set(1)
+		if key := configured + " -> " + actual; s.subnetMismatches[setting] != key {
+			s.subnetMismatches[setting] = key
+			quoted := make([]string, len(cidrs))
+			for j, cidr := range cidrs {
+				quoted[j] = fmt.Sprintf("%q", cidr)
+			}
+			effect := "no devices will be found"
+			if n.Scan.AutoFollowInterface {
+				effect = "scanning the interface's subnets instead (scan.auto_follow_interface)"
+			}
+			s.printf("WARNING: the scan range %s does not match %s, which is on %s; %s. Set %s: [%s]",
+				configured, iface, actual, effect, setting, strings.Join(quoted, ", "))
+			s.emitEvent("config_subnet_mismatch", map[string]interface{}{
+				"configured": configured,
+				"actual":     actual,
+				"interface":  iface,
+			})
+		}
+		if !n.Scan.AutoFollowInterface {
+			continue
+		}
+		r, err := parseScanRange(cidrs)
+		if err != nil {
+			s.logf("Not following %s (scan.auto_follow_interface): %v", iface, err)
+			continue
+		}
+		debugf("scanning %s instead of %s (scan.auto_follow_interface)", r, configured)
+		out[i].Range = r
+	}
+	return out
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// commandTimeout bounds every spawned command: one still running after a
+// whole scan interval is hung, and is killed instead of holding its
+// goroutines and pipes into the next scans. Tests shorten it.
+var commandTimeout = scanInterval
+
+// commandWaitDelay is how long a command's pipes stay open after it exited
+// or was killed, for children that inherited them.
+const commandWaitDelay = time.Second
+
+type subprocessUsage struct {
+	cpuSeconds float64
+	maxRSS     int64
+	timeouts   int
+}
+
+// subprocessStats accumulates the resource usage of every command the
+// runners spawn, by command name.
+var subprocessStats = struct {
+	mu    sync.Mutex
+	usage map[string]*subprocessUsage
+}{usage: make(map[string]*subprocessUsage)}
+
+// accountSubprocess records the CPU time and peak RSS of a finished
+// command, and whether it was killed for running past commandTimeout. It
+// is a no-op if the command never started.
+func accountSubprocess(name string, cmd *exec.Cmd, timedOut bool) {
+	state := cmd.ProcessState
+	if state == nil {
+		return
+	}
+	cpu := (state.UserTime() + state.SystemTime()).Seconds()
+	rss := maxRSSBytes(state)
+
+	subprocessStats.mu.Lock()
+	defer subprocessStats.mu.Unlock()
+	u := subprocessStats.usage[name]
+	if u == nil {
+		u = &subprocessUsage{}
+		subprocessStats.usage[name] = u
+	}
+	u.cpuSeconds += cpu
+	if rss > u.maxRSS {
+		u.maxRSS = rss
+	}
+	if timedOut {
+		u.timeouts++
+	}
+}
+
+// startCommand builds a command bounded by commandTimeout. Run and Output
+// close its pipes once it exits or is killed, even when a child keeps
+// them open, so no exec path can leak descriptors.
+func startCommand(name string, args []string) (*exec.Cmd, context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.WaitDelay = commandWaitDelay
+	return cmd, ctx, cancel
+}
+
+func runAccounted(name string, args ...string) error {
+	cmd, ctx, cancel := startCommand(name, args)
+	defer cancel()
+	err := cmd.Run()
+	accountSubprocess(name, cmd, ctx.Err() == context.DeadlineExceeded)
+	return commandError(ctx, waitResult(err))
+}
+
+func outputAccounted(name string, args ...string) ([]byte, error) {
+	cmd, ctx, cancel := startCommand(name, args)
+	defer cancel()
+	out, err := cmd.Output()
+	accountSubprocess(name, cmd, ctx.Err() == context.DeadlineExceeded)
+	return out, commandError(ctx, waitResult(err))
+}
+
+// waitResult treats a command that succeeded but left a child holding its
+// pipes as successful; commandWaitDelay already closed them.
+func waitResult(err error) error {
+	if errors.Is(err, exec.ErrWaitDelay) {
+		return nil
+	}
+	return err
+}
+
+// commandError classifies a failed command: killed at commandTimeout, not
+// installed, or refused by its own permission checks.
+func commandError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return classified(ErrTimeout, err)
+	}
+	return classify(err)
+}
+
+type subprocessCollector struct {
+	cpuSeconds *prometheus.Desc
+	maxRSS     *prometheus.Desc
+	timeouts   *prometheus.Desc
+}
+
+func newSubprocessCollector(namespace string) *subprocessCollector {
+	return &subprocessCollector{
+		cpuSeconds: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "telemetry_subprocess_cpu_seconds_total"),
+			"User and system CPU time spent in spawned subprocesses",
+			[]string{"command"}, nil,
+		),
+		maxRSS: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "telemetry_subprocess_max_rss_bytes"),
+			"Peak resident set size of any spawned subprocess",
+			[]string{"command"}, nil,
+		),
+		timeouts: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "telemetry_subprocess_timeouts_total"),
+			"Subprocesses killed for running longer than a scan interval",
+			[]string{"command"}, nil,
+		),
+	}
+}
+
+func (c *subprocessCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.cpuSeconds
+	ch <- c.maxRSS
+	ch <- c.timeouts
+}
+
+func (c *subprocessCollector) Collect(ch chan<- prometheus.Metric) {
+	subprocessStats.mu.Lock()
+	defer subprocessStats.mu.Unlock()
+	for name, u := range subprocessStats.usage {
+		ch <- prometheus.MustNewConstMetric(c.cpuSeconds, prometheus.CounterValue, u.cpuSeconds, name)
+		ch <- prometheus.MustNewConstMetric(c.maxRSS, prometheus.GaugeValue, float64(u.maxRSS), name)
+		ch <- prometheus.MustNewConstMetric(c.timeouts, prometheus.CounterValue, float64(u.timeouts), name)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// settledGoroutines waits for goroutines still winding down to exit and
+// returns how many are left once the count stops at or below want.
+func settledGoroutines(want int) int {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n := runtime.NumGoroutine()
+		if n <= want || time.Now().After(deadline) {
+			return n
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHungCommandIsKilled(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("no sleep command")
+	}
+	prev := commandTimeout
+	commandTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { commandTimeout = prev })
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		run  func(name string, args ...string) error
+	}{
+		{"run", []string{"sleep", "10"}, runAccounted},
+		{"output", []string{"sleep", "10"}, func(name string, args ...string) error {
+			_, err := outputAccounted(name, args...)
+			return err
+		}},
+		// The shell is killed, but the sleep it started keeps the output
+		// pipe open until commandWaitDelay closes it.
+		{"output held by a child", []string{"sh", "-c", "sleep 10 & sleep 10"}, func(name string, args ...string) error {
+			_, err := outputAccounted(name, args...)
+			return err
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := exec.LookPath(tc.args[0]); err != nil {
+				t.Skipf("no %s command", tc.args[0])
+			}
+			before := runtime.NumGoroutine()
+			start := time.Now()
+			err := tc.run(tc.args[0], tc.args[1:]...)
+			if elapsed := time.Since(start); elapsed > commandTimeout+commandWaitDelay+2*time.Second {
+				t.Errorf("returned after %s", elapsed)
+			}
+			if !errors.Is(err, ErrTimeout) || errorClass(err) != errClassTimeout {
+				t.Errorf("got %v (class %s), want a timeout", err, errorClass(err))
+			}
+			if n := settledGoroutines(before); n > before {
+				t.Errorf("%d goroutines after the command, %d before", n, before)
+			}
+		})
+	}
+
+	subprocessStats.mu.Lock()
+	defer subprocessStats.mu.Unlock()
+	if u := subprocessStats.usage["sleep"]; u == nil || u.timeouts < 2 {
+		t.Errorf("sleep usage %+v, want 2 timeouts", u)
+	}
+}
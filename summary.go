@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// networkSummary answers "is everything fine" for a single-panel
+// overview. It is served at /api/v1/summary and as the network_summary_*
+// gauges, both from buildNetworkSummary.
+type networkSummary struct {
+	DevicesOnline  int  `json:"devices_online"`
+	DevicesUnknown int  `json:"devices_unknown"`
+	GatewayUp      bool `json:"gateway_up"`
+	// InternetUp is null without network.captive_portal_url to check it.
+	InternetUp         *bool    `json:"internet_up"`
+	LastScanAgeSeconds float64  `json:"last_scan_age_seconds"`
+	ConditionFiring    bool     `json:"condition_firing"`
+	Conditions         []string `json:"conditions"`
+}
+
+func buildNetworkSummary(scan *ScanSnapshot, now time.Time) networkSummary {
+	s := networkSummary{Conditions: []string{}}
+	if scan == nil {
+		return s
+	}
+	for _, d := range scan.Devices {
+		if d.State == stateOnline {
+			s.DevicesOnline++
+		}
+		if d.DeviceType == "unknown" {
+			s.DevicesUnknown++
+		}
+		if scan.Gateway != "" && d.IP == scan.Gateway && d.State == stateOnline {
+			s.GatewayUp = true
+		}
+	}
+	s.InternetUp = scan.Stats.Conditions.InternetUp
+	s.LastScanAgeSeconds = now.Sub(scan.TakenAt).Seconds()
+	s.Conditions = append(s.Conditions, scan.Stats.Conditions.names()...)
+	s.ConditionFiring = len(s.Conditions) > 0
+	return s
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// summaryGauges maps the summary to its gauges; a gauge whose value is
+// unknown is left out.
+var summaryGauges = []struct {
+	name, help string
+	value      func(networkSummary) (float64, bool)
+}{
+	{"devices_online", "Devices online in the last scan", func(s networkSummary) (float64, bool) {
+		return float64(s.DevicesOnline), true
+	}},
+	{"devices_unknown", "Devices of unknown type in the last scan", func(s networkSummary) (float64, bool) {
+		return float64(s.DevicesUnknown), true
+	}},
+	{"gateway_up", "1 if the default gateway was online in the last scan", func(s networkSummary) (float64, bool) {
+		return boolValue(s.GatewayUp), true
+	}},
+	{"internet_up", "1 if network.captive_portal_url answered 204 in the last scan", func(s networkSummary) (float64, bool) {
+		if s.InternetUp == nil {
+			return 0, false
+		}
+		return boolValue(*s.InternetUp), true
+	}},
+	{"last_scan_age_seconds", "Seconds since the last scan finished", func(s networkSummary) (float64, bool) {
+		return s.LastScanAgeSeconds, true
+	}},
+	{"condition_firing", "1 if any network condition (VPN, captive portal) is active", func(s networkSummary) (float64, bool) {
+		return boolValue(s.ConditionFiring), true
+	}},
+}
+
+type summaryCollector struct {
+	descs []*prometheus.Desc
+	s     *scanner
+}
+
+func newSummaryCollector(namespace string, s *scanner) *summaryCollector {
+	c := &summaryCollector{s: s}
+	for _, g := range summaryGauges {
+		c.descs = append(c.descs, prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "network_summary_"+g.name), g.help, nil, nil))
+	}
+	return c
+}
+
+func (c *summaryCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range c.descs {
+		ch <- d
+	}
+}
+
+func (c *summaryCollector) Collect(ch chan<- prometheus.Metric) {
+	scan := c.s.currentScan()
+	if scan == nil {
+		return
+	}
+	summary := buildNetworkSummary(scan, time.Now())
+	for i, g := range summaryGauges {
+		if v, ok := g.value(summary); ok {
+			ch <- prometheus.MustNewConstMetric(c.descs[i], prometheus.GaugeValue, v)
+		}
+	}
+}
+
+// summaryHandler serves GET /api/v1/summary.
+func summaryHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := scannerFor(w, r)
+	if !ok {
+		return
+	}
+	scan := s.currentScan()
+	if scan == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no scan yet"})
+		return
+	}
+	writeJSON(w, http.StatusOK, buildNetworkSummary(scan, time.Now()))
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TimeseriesConfig sizes the in-memory history of device counts behind
+// /api/v1/stats/timeseries and the /status sparkline. It holds at most
+// retention/resolution buckets (capped at maxTimeseriesBuckets), each a
+// few dozen bytes plus one counter per device type: about 100 KiB with
+// the defaults and ten device types. The history is lost on restart.
+type TimeseriesConfig struct {
+	// Resolution is the bucket width (default 5m); scans falling into the
+	// same bucket are averaged.
+	Resolution time.Duration `yaml:"resolution"`
+	// Retention is how far back buckets are kept (default 24h).
+	Retention time.Duration `yaml:"retention"`
+}
+
+const maxTimeseriesBuckets = 4032 // two weeks at 5m
+
+func (c TimeseriesConfig) resolution() time.Duration {
+	if c.Resolution <= 0 {
+		return 5 * time.Minute
+	}
+	return c.Resolution
+}
+
+func (c TimeseriesConfig) retention() time.Duration {
+	if c.Retention <= 0 {
+		return 24 * time.Hour
+	}
+	return c.Retention
+}
+
+// countBucket sums the counts of every scan in [Start, Start+resolution).
+// Start is a wall time for display; retention and windows go by lastScan,
+// which keeps the monotonic reading, so a clock step neither drops buckets
+// early nor keeps them too long. After a step backwards Start repeats
+// earlier times; buckets stay in scan order.
+type countBucket struct {
+	Start    time.Time
+	lastScan time.Time
+	Scans    int
+	Total    int
+	Online   int
+	ByType   map[string]int
+}
+
+type timeseriesPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+	Scans int       `json:"scans"`
+}
+
+// countSeries is a scanner's device counts over time.
+type countSeries struct {
+	mu         sync.Mutex
+	buckets    []countBucket
+	resolution time.Duration
+}
+
+// record adds a scan to its bucket. Buckets exist only for periods that
+// had a scan, so gaps and irregular intervals show up as missing points
+// rather than zeros.
+func (c *countSeries) record(cfg TimeseriesConfig, devices []Device, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resolution = cfg.resolution()
+	start := at.Truncate(c.resolution)
+	if n := len(c.buckets); n == 0 || !c.buckets[n-1].Start.Equal(start) {
+		c.buckets = append(c.buckets, countBucket{Start: start, ByType: make(map[string]int)})
+	}
+	b := &c.buckets[len(c.buckets)-1]
+	b.lastScan = at
+	b.Scans++
+	b.Total += len(devices)
+	for _, d := range devices {
+		if d.State == stateOnline {
+			b.Online++
+		}
+		b.ByType[d.DeviceType]++
+	}
+
+	cutoff := at.Add(-cfg.retention())
+	drop := 0
+	for drop < len(c.buckets) && c.buckets[drop].lastScan.Before(cutoff) {
+		drop++
+	}
+	drop = max(drop, len(c.buckets)-maxTimeseriesBuckets)
+	c.buckets = append([]countBucket(nil), c.buckets[drop:]...)
+}
+
+// timeseriesValue picks metric out of a bucket, averaged per scan:
+// devices_total, devices_online or type:<device type>.
+func timeseriesValue(b countBucket, metric string) (float64, error) {
+	var sum int
+	switch {
+	case metric == "devices_total":
+		sum = b.Total
+	case metric == "devices_online":
+		sum = b.Online
+	case strings.HasPrefix(metric, "type:"):
+		sum = b.ByType[strings.TrimPrefix(metric, "type:")]
+	default:
+		return 0, fmt.Errorf("unknown metric %q (have devices_total, devices_online, type:<device type>)", metric)
+	}
+	return float64(sum) / float64(b.Scans), nil
+}
+
+// series returns the points of metric within window, along with the
+// bucket width they were recorded at.
+func (c *countSeries) series(metric string, window time.Duration, now time.Time) ([]timeseriesPoint, time.Duration, error) {
+	if _, err := timeseriesValue(countBucket{Scans: 1}, metric); err != nil {
+		return nil, 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	points := []timeseriesPoint{}
+	for _, b := range c.buckets {
+		if b.lastScan.Before(now.Add(-window)) {
+			continue
+		}
+		v, _ := timeseriesValue(b, metric)
+		points = append(points, timeseriesPoint{Time: b.Start, Value: v, Scans: b.Scans})
+	}
+	return points, c.resolution, nil
+}
+
+// timeseriesHandler serves GET /api/v1/stats/timeseries?metric=&window=.
+func timeseriesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	metric := q.Get("metric")
+	if metric == "" {
+		metric = "devices_online"
+	}
+	window := 24 * time.Hour
+	if s := q.Get("window"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid window %q", s)})
+			return
+		}
+		window = d
+	}
+	s, ok := scannerFor(w, r)
+	if !ok {
+		return
+	}
+	points, _, err := s.timeseries.series(metric, window, time.Now())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"metric": metric,
+		"window": window.String(),
+		"points": points,
+	})
+}
+
+// sparklineSVG draws points over the window ending at now as an inline
+// SVG polyline. The line breaks where more than two buckets or scan
+// intervals passed without a scan, whichever is longer.
+func sparklineSVG(points []timeseriesPoint, resolution, window time.Duration, now time.Time) htmltemplate.HTML {
+	const width, height = 240.0, 40.0
+	if len(points) == 0 {
+		return ""
+	}
+	peak := 1.0
+	for _, p := range points {
+		peak = max(peak, p.Value)
+	}
+	start := now.Add(-window)
+	maxGap := 2 * max(resolution, scanInterval)
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%.0f" height="%.0f" viewBox="0 0 %.0f %.0f">`, width, height, width, height)
+	var line []string
+	flush := func() {
+		if len(line) == 1 {
+			line = append(line, line[0])
+		}
+		if len(line) > 0 {
+			fmt.Fprintf(&b, `<polyline fill="none" stroke="#1976d2" stroke-width="1.5" points="%s"/>`, strings.Join(line, " "))
+		}
+		line = nil
+	}
+	for i, p := range points {
+		if i > 0 && p.Time.Sub(points[i-1].Time) > maxGap {
+			flush()
+		}
+		x := width * p.Time.Sub(start).Seconds() / window.Seconds()
+		y := height - 1 - (height-2)*p.Value/peak
+		line = append(line, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	flush()
+	fmt.Fprintf(&b, `<title>devices online, last %s (peak %.0f)</title></svg>`, window, peak)
+	return htmltemplate.HTML(b.String())
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TracingConfig exports one trace per scan over OTLP/HTTP (JSON encoding)
+// to an OpenTelemetry collector: a root span for the scan, a child span
+// per pipeline stage and, for a sample of addresses, a span per device
+// probe. The trace ID is attached as an exemplar to
+// telemetry_scan_duration_seconds when scraped as OpenMetrics. It is off
+// unless endpoint is set and takes effect on restart.
+type TracingConfig struct {
+	// Endpoint is the collector's traces URL, e.g.
+	// http://localhost:4318/v1/traces.
+	Endpoint string `yaml:"endpoint"`
+	// Headers are added to every export request, e.g. for authentication.
+	Headers map[string]string `yaml:"headers"`
+	// ServiceName is the service.name resource attribute (default
+	// telemetry-test).
+	ServiceName string `yaml:"service_name"`
+	// DeviceSampleRatio is the share of probed addresses that get a span
+	// of their own (default 0.1, at most 1).
+	DeviceSampleRatio float64 `yaml:"device_sample_ratio"`
+}
+
+func (c TracingConfig) enabled() bool {
+	return c.Endpoint != ""
+}
+
+func (c TracingConfig) serviceName() string {
+	if c.ServiceName == "" {
+		return "telemetry-test"
+	}
+	return c.ServiceName
+}
+
+func (c TracingConfig) deviceSampleRatio() float64 {
+	if c.DeviceSampleRatio <= 0 {
+		return 0.1
+	}
+	return c.DeviceSampleRatio
+}
+
+func (c TracingConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("tracing.endpoint %q is not an absolute http(s) URL", c.Endpoint)
+	}
+	if c.DeviceSampleRatio > 1 {
+		return fmt.Errorf("tracing.device_sample_ratio must be at most 1, got %g", c.DeviceSampleRatio)
+	}
+	return nil
+}
+
+// traceQueueSize bounds the scans waiting to be exported; a slow or
+// unreachable collector drops traces rather than holding scans.
+const traceQueueSize = 8
+
+// traceExportTimeout bounds one export request.
+const traceExportTimeout = 10 * time.Second
+
+// traceExporter posts finished scan traces from its own goroutine.
+type traceExporter struct {
+	cfg    TracingConfig
+	m      *Metrics
+	client *http.Client
+	queue  chan []otlpSpan
+}
+
+// tracer is nil unless tracing.endpoint was set at startup; every tracing
+// call is then a no-op on a nil *scanTrace.
+var tracer *traceExporter
+
+func newTraceExporter(m *Metrics, cfg TracingConfig) *traceExporter {
+	return &traceExporter{
+		cfg:    cfg,
+		m:      m,
+		client: &http.Client{Timeout: traceExportTimeout},
+		queue:  make(chan []otlpSpan, traceQueueSize),
+	}
+}
+
+// OTLP/JSON span, see opentelemetry-proto's trace.proto. IDs are hex and
+// 64-bit integers are strings, as the JSON mapping requires.
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2 is STATUS_CODE_ERROR
+	Message string `json:"message,omitempty"`
+}
+
+const otlpSpanKindInternal = 1
+
+func attr(key string, v interface{}) otlpAttribute {
+	switch v := v.(type) {
+	case int:
+		return otlpAttribute{key, map[string]interface{}{"intValue": strconv.Itoa(v)}}
+	case uint64:
+		return otlpAttribute{key, map[string]interface{}{"intValue": strconv.FormatUint(v, 10)}}
+	case bool:
+		return otlpAttribute{key, map[string]interface{}{"boolValue": v}}
+	default:
+		return otlpAttribute{key, map[string]interface{}{"stringValue": fmt.Sprint(v)}}
+	}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func newSpanID() string {
+	var id [8]byte
+	binary.BigEndian.PutUint64(id[:], rand.Uint64()|1)
+	return hex.EncodeToString(id[:])
+}
+
+// scanTrace collects the spans of one scan. Stage spans are created when
+// the stage is recorded; their IDs are handed out earlier to the device
+// spans started within them. Device spans come from the probe workers,
+// hence the mutex.
+type scanTrace struct {
+	traceID string
+	rootID  string
+	start   time.Time
+	ratio   float64
+
+	mu       sync.Mutex
+	stageIDs map[string]string
+	spans    []otlpSpan
+}
+
+// startScanTrace begins the trace of a scan, or returns nil when tracing
+// is off.
+func startScanTrace(start time.Time) *scanTrace {
+	if tracer == nil {
+		return nil
+	}
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], rand.Uint64())
+	binary.BigEndian.PutUint64(id[8:], rand.Uint64()|1)
+	return &scanTrace{
+		traceID:  hex.EncodeToString(id[:]),
+		rootID:   newSpanID(),
+		start:    start,
+		ratio:    tracer.cfg.deviceSampleRatio(),
+		stageIDs: make(map[string]string),
+	}
+}
+
+// ID is the trace ID, or "" for a nil trace.
+func (t *scanTrace) ID() string {
+	if t == nil {
+		return ""
+	}
+	return t.traceID
+}
+
+func (t *scanTrace) stageID(stage string) string {
+	id, ok := t.stageIDs[stage]
+	if !ok {
+		id = newSpanID()
+		t.stageIDs[stage] = id
+	}
+	return id
+}
+
+func (t *scanTrace) stage(stage string, start, end time.Time, items, errors int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spans = append(t.spans, otlpSpan{
+		TraceID:      t.traceID,
+		SpanID:       t.stageID(stage),
+		ParentSpanID: t.rootID,
+		Name:         "scan." + stage,
+		Kind:         otlpSpanKindInternal,
+		Start:        unixNano(start),
+		End:          unixNano(end),
+		Attributes:   []otlpAttribute{attr("scan.stage.items", items), attr("scan.stage.errors", errors)},
+	})
+}
+
+// device records a sampled span for one address within a stage.
+func (t *scanTrace) device(stage, ip string, start time.Time, err error) {
+	if t == nil || rand.Float64() >= t.ratio {
+		return
+	}
+	end := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := otlpSpan{
+		TraceID:      t.traceID,
+		SpanID:       newSpanID(),
+		ParentSpanID: t.stageID(stage),
+		Name:         stage + " " + ip,
+		Kind:         otlpSpanKindInternal,
+		Start:        unixNano(start),
+		End:          unixNano(end),
+		Attributes:   []otlpAttribute{attr("net.peer.ip", ip)},
+	}
+	if err != nil {
+		s.Status = &otlpStatus{Code: 2, Message: err.Error()}
+	}
+	t.spans = append(t.spans, s)
+}
+
+// finish adds the root span and queues the trace for export.
+func (t *scanTrace) finish(stats ScanStats, devices int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	spans := append(t.spans, otlpSpan{
+		TraceID: t.traceID,
+		SpanID:  t.rootID,
+		Name:    "scan",
+		Kind:    otlpSpanKindInternal,
+		Start:   unixNano(t.start),
+		End:     unixNano(t.start.Add(stats.Duration)),
+		Attributes: []otlpAttribute{
+			attr("scan.id", stats.ID),
+			attr("scan.cause", stats.Cause),
+			attr("scan.probed", stats.Probed),
+			attr("scan.devices", devices),
+		},
+	})
+	t.spans = nil
+	t.mu.Unlock()
+	select {
+	case tracer.queue <- spans:
+	default:
+		tracer.m.TracesDropped.Inc()
+		errorLog.Printf("Dropping scan trace: %d traces are already waiting for export", traceQueueSize)
+	}
+}
+
+func (e *traceExporter) export(ctx context.Context, spans []otlpSpan) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{attr("service.name", e.cfg.serviceName()), attr("service.version", version)},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "telemetry-test", "version": version},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "telemetry-test/"+version)
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// traceExportLoop exports queued traces until ctx is done. A failed export
+// drops that trace; scans are not retried.
+func traceExportLoop(ctx context.Context, e *traceExporter) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case spans := <-e.queue:
+			if err := e.export(ctx, spans); err != nil && ctx.Err() == nil {
+				e.m.TracesDropped.Inc()
+				errorLog.Printf("Error exporting scan trace to %s: %v", e.cfg.Endpoint, err)
+			}
+		}
+	}
+}
+
+func init() {
+	registerFeature("tracing", false)
+}
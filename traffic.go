@@ -0,0 +1,171 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Probe kinds counted in telemetry_scan_packets_sent_total.
+const (
+	trafficICMP    = "icmp"
+	trafficARP     = "arp"
+	trafficTCP     = "tcp"
+	trafficMDNS    = "mdns"
+	trafficSSDP    = "ssdp"
+	trafficNetBIOS = "netbios"
+	trafficDNS     = "dns"
+)
+
+// Approximate sizes, IP header included, of what the probes put on the
+// wire, for the ones whose packets we do not build ourselves.
+const (
+	udpOverhead    = 28 // IPv4 and UDP headers
+	pingEchoSize   = 84 // system ping: 56 data bytes
+	tcpSYNSize     = 60 // SYN with the usual options
+	arpRequestSize = 28 // ARP payload; there is no IP header
+	// arpRetries is how often the kernel asks for an address nobody
+	// answers for (Linux mcast_solicit, and macOS alike).
+	arpRetries = 3
+)
+
+// TrafficStats counts packets and approximate bytes sent.
+type TrafficStats struct {
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// trafficCounter is everything a scanner's probes and lookups have sent
+// since startup, by probe kind. It counts what the exporter asks to send,
+// plus the ARP requests the kernel makes for it; retransmissions and
+// replies to the responses are not counted.
+type trafficCounter struct {
+	mu     sync.Mutex
+	byKind map[string]TrafficStats
+}
+
+func newTrafficCounter() *trafficCounter {
+	return &trafficCounter{byKind: make(map[string]TrafficStats)}
+}
+
+func (c *trafficCounter) count(kind string, packets, bytes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.byKind[kind]
+	t.Packets += uint64(packets)
+	t.Bytes += uint64(bytes)
+	c.byKind[kind] = t
+}
+
+func (c *trafficCounter) snapshot() map[string]TrafficStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]TrafficStats, len(c.byKind))
+	for kind, t := range c.byKind {
+		out[kind] = t
+	}
+	return out
+}
+
+func (s *scanner) countSent(kind string, packets, bytes int) {
+	s.sent.count(kind, packets, bytes)
+}
+
+// countARP counts the ARP requests probing ip caused: none when it was
+// already in the neighbor table, one when it answered, arpRetries when it
+// did not.
+func (s *scanner) countARP(ip string, known map[string]string, answered bool) {
+	if _, ok := known[ip]; ok {
+		return
+	}
+	n := arpRetries
+	if answered {
+		n = 1
+	}
+	s.countSent(trafficARP, n, n*arpRequestSize)
+}
+
+// trafficSince returns what was sent since the snapshot start, leaving out
+// kinds that sent nothing.
+func (s *scanner) trafficSince(start map[string]TrafficStats) map[string]TrafficStats {
+	out := make(map[string]TrafficStats)
+	for kind, t := range s.sent.snapshot() {
+		d := TrafficStats{Packets: t.Packets - start[kind].Packets, Bytes: t.Bytes - start[kind].Bytes}
+		if d.Packets > 0 {
+			out[kind] = d
+		}
+	}
+	return out
+}
+
+func (s *scanner) packetsSince(start map[string]TrafficStats) uint64 {
+	var n uint64
+	for _, t := range s.trafficSince(start) {
+		n += t.Packets
+	}
+	return n
+}
+
+// probeCost is the most packets probing ip can send with probeHost,
+// counting the ARP requests for an address not in the neighbor table.
+func (s *scanner) probeCost(ip string, cfg Config, known map[string]string) int {
+	n := 1
+	if pc := cfg.Scan.PingCommand; pc.enabled() {
+		n = pc.count()
+	} else if _, ok := s.runner.(localRunner); ok && detectProbeMode() == probeModeTCP {
+		n = len(tcpProbePorts)
+	}
+	if _, ok := known[ip]; !ok {
+		n += arpRetries
+	}
+	return n
+}
+
+// knownFirst orders targets for a scan with a packet budget: the addresses
+// in the neighbor table go first, so running out of budget leaves unseen
+// parts of the range unprobed rather than the devices already tracked.
+func knownFirst(targets []string, known map[string]string) []string {
+	out := make([]string, 0, len(targets))
+	var rest []string
+	for _, ip := range targets {
+		if _, ok := known[ip]; ok {
+			out = append(out, ip)
+		} else {
+			rest = append(rest, ip)
+		}
+	}
+	return append(out, rest...)
+}
+
+type trafficCollector struct {
+	s              *scanner
+	packets, bytes *prometheus.Desc
+}
+
+func newTrafficCollector(namespace string, s *scanner) *trafficCollector {
+	return &trafficCollector{
+		s: s,
+		packets: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "telemetry_scan_packets_sent_total"),
+			"Packets sent by scan probes and lookups, including the ARP requests they cause",
+			[]string{"probe"}, nil,
+		),
+		bytes: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "telemetry_scan_bytes_sent_total"),
+			"Approximate bytes sent by scan probes and lookups, IP headers included",
+			[]string{"probe"}, nil,
+		),
+	}
+}
+
+func (c *trafficCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.packets
+	ch <- c.bytes
+}
+
+func (c *trafficCollector) Collect(ch chan<- prometheus.Metric) {
+	for kind, t := range c.s.sent.snapshot() {
+		ch <- prometheus.MustNewConstMetric(c.packets, prometheus.CounterValue, float64(t.Packets), kind)
+		ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.CounterValue, float64(t.Bytes), kind)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// UplinkConfig sends a compact summary of this site to a central endpoint.
+// It ships data off the host, so it stays off unless url is set.
+type UplinkConfig struct {
+	// URL receives the summaries; it must be https unless it is loopback.
+	URL string `yaml:"url"`
+	// Site names this exporter at the endpoint and is added as a site
+	// label to the exporter's own metrics.
+	Site string `yaml:"site"`
+	// Token is the per-site secret the payload is signed with
+	// (HMAC-SHA256). It is never sent itself.
+	Token string `yaml:"token"`
+	// Interval between reports (default 5m).
+	Interval time.Duration `yaml:"interval"`
+	// IncludeMACs adds every device's MAC, IP and type to the summary;
+	// by default only counts and infrastructure names leave the host.
+	IncludeMACs bool `yaml:"include_macs"`
+	// MaxPayloadBytes caps the JSON body (default 64 KiB). The device list
+	// is dropped first; a summary still above the cap is not sent.
+	MaxPayloadBytes int `yaml:"max_payload_bytes"`
+}
+
+func (c UplinkConfig) enabled() bool {
+	return c.URL != ""
+}
+
+func (c UplinkConfig) interval() time.Duration {
+	if c.Interval <= 0 {
+		return 5 * time.Minute
+	}
+	return c.Interval
+}
+
+func (c UplinkConfig) maxPayloadBytes() int {
+	if c.MaxPayloadBytes <= 0 {
+		return 64 << 10
+	}
+	return c.MaxPayloadBytes
+}
+
+func (c UplinkConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("uplink.url %q is not an absolute URL", c.URL)
+	}
+	if u.Scheme != "https" {
+		ip := net.ParseIP(u.Hostname())
+		if u.Scheme != "http" || (u.Hostname() != "localhost" && (ip == nil || !ip.IsLoopback())) {
+			return fmt.Errorf("uplink.url must use https (plain http only to loopback)")
+		}
+	}
+	if !agentHostPattern.MatchString(c.Site) {
+		return fmt.Errorf("uplink.site %q must be 1-63 letters, digits, '.', '_' or '-'", c.Site)
+	}
+	if c.Token == "" {
+		return fmt.Errorf("uplink.token is required with uplink.url")
+	}
+	return nil
+}
+
+type uplinkInfrastructure struct {
+	Name string `json:"name"`
+	MAC  string `json:"mac,omitempty"`
+	Up   bool   `json:"up"`
+}
+
+type uplinkDevice struct {
+	MAC        string `json:"mac"`
+	IP         string `json:"ip"`
+	DeviceType string `json:"device_type"`
+	State      string `json:"state"`
+}
+
+type uplinkReport struct {
+	Site string `json:"site"`
+	// Scanner names the scanner with scanners:; each sends its own report.
+	Scanner        string                 `json:"scanner,omitempty"`
+	Version        string                 `json:"version"`
+	SentAt         time.Time              `json:"sent_at"`
+	ScanID         uint64                 `json:"scan_id"`
+	ScanTakenAt    time.Time              `json:"scan_taken_at"`
+	Devices        int                    `json:"devices"`
+	DevicesByType  map[string]int         `json:"devices_by_type"`
+	Infrastructure []uplinkInfrastructure `json:"infrastructure"`
+	Conditions     []string               `json:"conditions"`
+	DeviceList     []uplinkDevice         `json:"device_list,omitempty"`
+	// Truncated is set when the device list was dropped to fit the cap.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+func buildUplinkReport(cfg UplinkConfig, scan *ScanSnapshot, now time.Time) uplinkReport {
+	r := uplinkReport{
+		Site:           cfg.Site,
+		Scanner:        scan.Stats.Scanner,
+		Version:        version,
+		SentAt:         now,
+		ScanID:         scan.Stats.ID,
+		ScanTakenAt:    scan.TakenAt,
+		Devices:        len(scan.Devices),
+		DevicesByType:  make(map[string]int),
+		Infrastructure: []uplinkInfrastructure{},
+		Conditions:     append([]string{}, scan.Stats.Conditions.names()...),
+	}
+	for _, d := range scan.Devices {
+		r.DevicesByType[d.DeviceType]++
+		if cfg.IncludeMACs {
+			r.DeviceList = append(r.DeviceList, uplinkDevice{MAC: d.MAC, IP: d.IP, DeviceType: d.DeviceType, State: d.State})
+		}
+	}
+	sort.Slice(r.DeviceList, func(i, j int) bool { return r.DeviceList[i].MAC < r.DeviceList[j].MAC })
+	for _, infra := range scan.Infrastructure {
+		entry := uplinkInfrastructure{Name: infra.Name, Up: infra.Up}
+		if cfg.IncludeMACs {
+			entry.MAC = infra.MAC
+		}
+		r.Infrastructure = append(r.Infrastructure, entry)
+	}
+	return r
+}
+
+// encodeUplinkReport marshals r within the payload cap.
+func encodeUplinkReport(cfg UplinkConfig, r uplinkReport) ([]byte, error) {
+	body, err := json.Marshal(r)
+	if err != nil || len(body) <= cfg.maxPayloadBytes() {
+		return body, err
+	}
+	if r.DeviceList != nil {
+		r.DeviceList, r.Truncated = nil, true
+		if body, err = json.Marshal(r); err != nil || len(body) <= cfg.maxPayloadBytes() {
+			return body, err
+		}
+	}
+	return nil, fmt.Errorf("summary of %d bytes exceeds uplink.max_payload_bytes %d", len(body), cfg.maxPayloadBytes())
+}
+
+// signUplink returns the signature over the timestamp and body, so a
+// captured report cannot be replayed with a different time.
+func signUplink(token, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// errUplinkRejected is a 4xx answer other than 429; retrying will not help.
+type errUplinkRejected struct{ status string }
+
+func (e errUplinkRejected) Error() string { return "uplink answered " + e.status }
+
+func postUplink(ctx context.Context, client *http.Client, cfg UplinkConfig, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Telemetry-Site", cfg.Site)
+	req.Header.Set("X-Telemetry-Timestamp", timestamp)
+	req.Header.Set("X-Telemetry-Signature", signUplink(cfg.Token, timestamp, body))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests:
+		return errUplinkRejected{resp.Status}
+	}
+	return fmt.Errorf("uplink answered %s", resp.Status)
+}
+
+// sendUplink posts body, retrying transient failures with exponential
+// backoff for at most half an interval.
+func sendUplink(ctx context.Context, client *http.Client, cfg UplinkConfig, body []byte) error {
+	deadline := time.Now().Add(cfg.interval() / 2)
+	backoff := 2 * time.Second
+	for {
+		err := postUplink(ctx, client, cfg, body)
+		if _, rejected := err.(errUplinkRejected); err == nil || rejected || time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		debugf("uplink: %v; retrying in %s", err, backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// uplinkLoop reports the latest scan of every scanner every interval until
+// ctx is done. Failures are counted and logged; they never stop the
+// exporter.
+func uplinkLoop(ctx context.Context, m *Metrics, cfg UplinkConfig) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(cfg.interval()):
+		}
+		for _, s := range scanners {
+			scan := s.currentScan()
+			if scan == nil {
+				continue
+			}
+			body, err := encodeUplinkReport(cfg, buildUplinkReport(cfg, scan, time.Now()))
+			if err != nil {
+				m.UplinkReports.WithLabelValues("oversize").Inc()
+				s.logf("Not sending uplink report: %v", err)
+				continue
+			}
+			if err := sendUplink(ctx, client, cfg, body); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				m.UplinkReports.WithLabelValues("error").Inc()
+				s.logf("Error sending uplink report: %v", err)
+				continue
+			}
+			m.UplinkReports.WithLabelValues("ok").Inc()
+			m.UplinkLastSuccess.SetToCurrentTime()
+		}
+	}
+}
+
+func init() {
+	registerFeature("uplink", false)
+}
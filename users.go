@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"os/user"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// UserMetricsConfig breaks CPU and memory down by the account running the
+// processes, for machines several people share. Enumerating processes is
+// cheap with native process info (macOS builds with cgo, Linux /proc);
+// without cgo, macOS spawns ps per process, so keep the interval long.
+// It only takes effect on restart.
+type UserMetricsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// TopN is how many users get their own series (default 5); the rest
+	// are summed into user="other".
+	TopN int `yaml:"top_n"`
+	// Interval between samples (default 30s).
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (c UserMetricsConfig) topN() int {
+	if c.TopN <= 0 {
+		return 5
+	}
+	return c.TopN
+}
+
+func (c UserMetricsConfig) interval() time.Duration {
+	if c.Interval <= 0 {
+		return 30 * time.Second
+	}
+	return c.Interval
+}
+
+const otherUsers = "other"
+
+type userUsage struct {
+	User string
+	// CPUPercent is the share of the whole machine (all cores), like
+	// macbook_cpu_usage_percent; -1 on the first sample.
+	CPUPercent  float64
+	MemoryBytes uint64
+}
+
+// UserSnapshot is one sample of per-user usage. Unreadable counts the
+// processes whose owner, CPU time or memory could not be read, typically
+// other users' processes when not running as root; their usage is
+// missing from Users.
+type UserSnapshot struct {
+	Users      []userUsage
+	Unreadable int
+	TakenAt    time.Time
+}
+
+var lastUserUsage atomic.Pointer[UserSnapshot]
+
+// userSampler keeps the previous CPU time of every process so each
+// sample reports usage over the interval. Only touched by the user
+// metrics loop.
+type userSampler struct {
+	prevCPU  map[int32]float64
+	prevAt   time.Time
+	names    map[int32]string // uid -> username
+	ncpu     int
+	topN     int
+	hasDelta bool
+}
+
+func newUserSampler(cfg UserMetricsConfig) *userSampler {
+	return &userSampler{prevCPU: make(map[int32]float64), names: make(map[int32]string), ncpu: runtime.NumCPU(), topN: cfg.topN()}
+}
+
+func (s *userSampler) username(uid int32) string {
+	if name, ok := s.names[uid]; ok {
+		return name
+	}
+	name := strconv.Itoa(int(uid))
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+	s.names[uid] = name
+	return name
+}
+
+func (s *userSampler) sample(now time.Time) (UserSnapshot, error) {
+	procs, err := process.Processes()
+	if err != nil {
+		return UserSnapshot{}, err
+	}
+	snap := UserSnapshot{TakenAt: now}
+	cpuSeconds := make(map[string]float64)
+	memory := make(map[string]uint64)
+	curCPU := make(map[int32]float64, len(procs))
+	for _, p := range procs {
+		uids, err := p.Uids()
+		if err != nil || len(uids) == 0 {
+			snap.Unreadable++
+			continue
+		}
+		name := s.username(uids[0])
+		times, terr := p.Times()
+		mem, merr := p.MemoryInfo()
+		if terr != nil || merr != nil {
+			snap.Unreadable++
+			continue
+		}
+		memory[name] += mem.RSS
+		cpu := times.User + times.System
+		curCPU[p.Pid] = cpu
+		// A new pid (or a reused one) ran entirely since the last sample.
+		prev, ok := s.prevCPU[p.Pid]
+		if !ok || prev > cpu {
+			prev = 0
+		}
+		cpuSeconds[name] += cpu - prev
+	}
+	elapsed := now.Sub(s.prevAt).Seconds()
+	withCPU := s.hasDelta && elapsed > 0
+	s.prevCPU, s.prevAt, s.hasDelta = curCPU, now, true
+
+	for name, rss := range memory {
+		u := userUsage{User: name, CPUPercent: -1, MemoryBytes: rss}
+		if withCPU {
+			u.CPUPercent = 100 * cpuSeconds[name] / (elapsed * float64(s.ncpu))
+		}
+		snap.Users = append(snap.Users, u)
+	}
+	snap.Users = topUsers(snap.Users, s.topN)
+	return snap, nil
+}
+
+// topUsers keeps the n users using the most CPU (memory on the first
+// sample) and sums the others into user="other".
+func topUsers(users []userUsage, n int) []userUsage {
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].CPUPercent != users[j].CPUPercent {
+			return users[i].CPUPercent > users[j].CPUPercent
+		}
+		if users[i].MemoryBytes != users[j].MemoryBytes {
+			return users[i].MemoryBytes > users[j].MemoryBytes
+		}
+		return users[i].User < users[j].User
+	})
+	if len(users) <= n {
+		return users
+	}
+	// CPU is either known for every user of a sample or for none.
+	other := userUsage{User: otherUsers, CPUPercent: min(users[n].CPUPercent, 0)}
+	for _, u := range users[n:] {
+		other.MemoryBytes += u.MemoryBytes
+		if u.CPUPercent > 0 {
+			other.CPUPercent += u.CPUPercent
+		}
+	}
+	return append(users[:n:n], other)
+}
+
+// userMetricsLoop samples per-user usage every interval until ctx is done.
+// A failed sample keeps the previous one published.
+func userMetricsLoop(ctx context.Context, cfg UserMetricsConfig) error {
+	s := newUserSampler(cfg)
+	for {
+		if snap, err := s.sample(time.Now()); err != nil {
+			errorLog.Printf("Error sampling per-user usage: %v", err)
+		} else {
+			lastUserUsage.Store(&snap)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(cfg.interval()):
+		}
+	}
+}
+
+type userCollector struct {
+	cpuPercent, memoryBytes, unreadable *prometheus.Desc
+}
+
+func newUserCollector(namespace string) *userCollector {
+	return &userCollector{
+		cpuPercent: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "macbook_user_cpu_percent"),
+			"CPU used by the processes of a user over the last interval, in percent of the whole machine (0-100)", []string{"user"}, nil),
+		memoryBytes: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "macbook_user_memory_bytes"),
+			"Resident memory of the processes of a user", []string{"user"}, nil),
+		unreadable: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "macbook_user_processes_unreadable"),
+			"Processes left out of the per-user breakdown because they could not be read (e.g. other users' without root); the per-user values undercount when above 0", nil, nil),
+	}
+}
+
+func (c *userCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.cpuPercent
+	ch <- c.memoryBytes
+	ch <- c.unreadable
+}
+
+func (c *userCollector) Collect(ch chan<- prometheus.Metric) {
+	snap := lastUserUsage.Load()
+	if snap == nil {
+		return
+	}
+	for _, u := range snap.Users {
+		if u.CPUPercent >= 0 {
+			ch <- prometheus.MustNewConstMetric(c.cpuPercent, prometheus.GaugeValue, u.CPUPercent, u.User)
+		}
+		ch <- prometheus.MustNewConstMetric(c.memoryBytes, prometheus.GaugeValue, float64(u.MemoryBytes), u.User)
+	}
+	ch <- prometheus.MustNewConstMetric(c.unreadable, prometheus.GaugeValue, float64(snap.Unreadable))
+}
+
+func init() {
+	registerFeature("user_metrics", false)
+}
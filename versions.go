@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stageVersions is the resolution stage that collects firmware/OS version
+// strings; it can be turned off like the name stages.
+const stageVersions = "versions"
+
+// Version sources.
+const (
+	versionSSDP = "ssdp"
+	versionMDNS = "mdns"
+)
+
+type VersionRecord struct {
+	Version    string    `json:"version"`
+	Source     string    `json:"source"`
+	ReportedAt time.Time `json:"reported_at"`
+}
+
+// normalizeVersion collapses whitespace and strips quotes so the same
+// firmware always yields the same string.
+func normalizeVersion(s string) string {
+	return strings.Join(strings.Fields(strings.Trim(s, "\" ")), " ")
+}
+
+// parseSSDPServer picks the product token out of an SSDP SERVER header
+// ("OS/version UPnP/1.0 product/version"), falling back to the OS token.
+// Some stacks separate the tokens with commas so products may contain
+// spaces.
+func parseSSDPServer(server string) (string, bool) {
+	tokens := strings.Fields(server)
+	if strings.Contains(server, ",") {
+		tokens = strings.Split(server, ",")
+	}
+	var product, os string
+	for _, tok := range tokens {
+		tok = strings.TrimSpace(tok)
+		if !strings.Contains(tok, "/") {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(strings.ToUpper(tok), "UPNP/"):
+		case os == "":
+			os = tok
+		default:
+			product = tok
+		}
+	}
+	if product != "" {
+		return normalizeVersion(product), true
+	}
+	if os != "" {
+		return normalizeVersion(os), true
+	}
+	return "", false
+}
+
+// lookupSSDPVersion sends a unicast M-SEARCH to the device and reads the
+// SERVER header of its answer.
+func (s *scanner) lookupSSDPVersion(ip string, timeout time.Duration) (string, error) {
+	conn, err := net.DialTimeout("udp4", net.JoinHostPort(ip, "1900"), timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	req := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + net.JoinHostPort(ip, "1900") + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"ST: upnp:rootdevice\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return "", err
+	}
+	s.countSent(trafficSSDP, 1, udpOverhead+len(req))
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(string(buf[:n]))), nil)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if v, ok := parseSSDPServer(resp.Header.Get("Server")); ok {
+		return v, nil
+	}
+	return "", fmt.Errorf("no SSDP SERVER header from %s", ip)
+}
+
+// txtVersionKeys are the TXT keys that carry a version, in preference
+// order.
+var txtVersionKeys = []string{"fwvers", "fw", "firmware", "swvers", "vers", "version", "osxvers"}
+
+func parseTXTVersion(txt []string) (string, bool) {
+	values := make(map[string]string, len(txt))
+	for _, kv := range txt {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			values[strings.ToLower(k)] = v
+		}
+	}
+	for _, k := range txtVersionKeys {
+		if v := normalizeVersion(values[k]); v != "" {
+			if k == "osxvers" {
+				return "macOS/" + v, true // Darwin major version
+			}
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// lookupMDNSVersion reads the _device-info TXT record of an mDNS host
+// (name as resolved by the mdns stage, e.g. "living-room.local").
+func (s *scanner) lookupMDNSVersion(ip, mdnsName string, timeout time.Duration) (string, error) {
+	host := strings.TrimSuffix(strings.TrimSuffix(mdnsName, "."), ".local")
+	resp, err := s.mdnsQuery(ip, host+"._device-info._tcp.local.", dnsmessage.TypeTXT, timeout)
+	if err != nil {
+		return "", err
+	}
+	for _, ans := range append(resp.Answers, resp.Additionals...) {
+		if txt, ok := ans.Body.(*dnsmessage.TXTResource); ok {
+			if v, ok := parseTXTVersion(txt.TXT); ok {
+				return v, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no version in mDNS TXT from %s", ip)
+}
+
+// lookupVersion tries SSDP first, then the mDNS device-info record when
+// the device has an mDNS name.
+func (s *scanner) lookupVersion(ip string, names map[string]string, timeout time.Duration) (VersionRecord, bool) {
+	now := time.Now()
+	if v, err := s.lookupSSDPVersion(ip, timeout); err == nil {
+		return VersionRecord{Version: v, Source: versionSSDP, ReportedAt: now}, true
+	}
+	if name, ok := names[sourceMDNS]; ok {
+		if v, err := s.lookupMDNSVersion(ip, name, timeout); err == nil {
+			return VersionRecord{Version: v, Source: versionMDNS, ReportedAt: now}, true
+		}
+	}
+	return VersionRecord{}, false
+}
+
+// versionFor records a freshly reported version and returns the last one
+// known for the device key.
+func (s *scanner) versionFor(key string, res nameResult) VersionRecord {
+	if res.version.Version != "" {
+		s.deviceVersions[key] = res.version
+	}
+	return s.deviceVersions[key]
+}
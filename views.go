@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ViewConfig defines an extra device metric family for one consumer: the
+// devices matching Types, grouped by Labels, each series counting the
+// devices in its group. A view with ip or mac among its labels is
+// effectively one series per device.
+type ViewConfig struct {
+	Name string `yaml:"name"`
+	// Metric defaults to wifi_devices_<name>_view.
+	Metric string   `yaml:"metric"`
+	Labels []string `yaml:"labels"`
+	// Types limits the view to these device types; "infrastructure"
+	// matches infrastructure devices of any type.
+	Types []string `yaml:"types"`
+}
+
+// viewLabels are the device fields a view can use as labels.
+var viewLabels = map[string]func(Device) string{
+	"ip":          func(d Device) string { return d.IP },
+	"mac":         func(d Device) string { return d.MAC },
+	"hostname":    func(d Device) string { return d.HostnameLabel },
+	"name":        func(d Device) string { return d.Name },
+	"vendor":      func(d Device) string { return d.Vendor },
+	"device_type": func(d Device) string { return d.DeviceType },
+	"category":    func(d Device) string { return d.Display.Category },
+	"state":       func(d Device) string { return d.State },
+	"infrastructure": func(d Device) string {
+		return strconv.FormatBool(d.Infrastructure)
+	},
+}
+
+// freeformLabels go through the label policy.
+var freeformLabels = map[string]bool{"hostname": true, "name": true, "vendor": true}
+
+// builtinMetrics are the device metric names a view may not claim.
+var builtinMetrics = map[string]bool{
+	"wifi_connected_devices":    true,
+	"wifi_device_state":         true,
+	"wifi_guest_devices_total":  true,
+	"wifi_device_version_info":  true,
+	"network_infrastructure_up": true,
+}
+
+var metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+type metricView struct {
+	desc   *prometheus.Desc
+	labels []string
+	types  map[string]bool
+}
+
+func (v metricView) matches(d Device) bool {
+	if len(v.types) == 0 {
+		return true
+	}
+	return v.types[d.DeviceType] || (d.Infrastructure && v.types["infrastructure"])
+}
+
+// compileViews validates the configured views. Invalid views are skipped
+// and reported; the valid ones are still returned.
+func compileViews(namespace string, cfgs []ViewConfig) ([]metricView, []error) {
+	var (
+		views  []metricView
+		errs   []error
+		claims = make(map[string]string)
+	)
+	for i, vc := range cfgs {
+		metric := vc.Metric
+		if metric == "" {
+			metric = "wifi_devices_" + vc.Name + "_view"
+		}
+		if vc.Name == "" {
+			errs = append(errs, fmt.Errorf("views[%d]: name is required", i))
+			continue
+		}
+		if !metricNamePattern.MatchString(metric) {
+			errs = append(errs, fmt.Errorf("view %s: %q is not a valid metric name", vc.Name, metric))
+			continue
+		}
+		if builtinMetrics[metric] {
+			errs = append(errs, fmt.Errorf("view %s: metric %s is built in", vc.Name, metric))
+			continue
+		}
+		if other, ok := claims[metric]; ok {
+			errs = append(errs, fmt.Errorf("view %s: metric %s already claimed by view %s", vc.Name, metric, other))
+			continue
+		}
+		var bad error
+		seen := make(map[string]bool, len(vc.Labels))
+		for _, l := range vc.Labels {
+			if _, ok := viewLabels[l]; !ok {
+				bad = fmt.Errorf("view %s: unknown label %q", vc.Name, l)
+			} else if seen[l] {
+				bad = fmt.Errorf("view %s: duplicate label %q", vc.Name, l)
+			}
+			seen[l] = true
+		}
+		if bad != nil {
+			errs = append(errs, bad)
+			continue
+		}
+		claims[metric] = vc.Name
+		types := make(map[string]bool, len(vc.Types))
+		for _, t := range vc.Types {
+			types[t] = true
+		}
+		views = append(views, metricView{
+			desc:   prometheus.NewDesc(prometheus.BuildFQName(namespace, "", metric), "Devices in the "+vc.Name+" view", vc.Labels, nil),
+			labels: vc.Labels,
+			types:  types,
+		})
+	}
+	return views, errs
+}
+
+// viewCollector renders the configured views from the published snapshot.
+// Views follow the config, so it is an unchecked collector and describes
+// nothing up front.
+type viewCollector struct {
+	s *scanner
+}
+
+func (viewCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (c viewCollector) Collect(ch chan<- prometheus.Metric) {
+	scan := c.s.currentScan()
+	if scan == nil {
+		return
+	}
+	for _, v := range scan.Views {
+		counts := make(map[string]int)
+		values := make(map[string][]string)
+		for _, d := range scan.Devices {
+			if d.Guest || !v.matches(d) {
+				continue
+			}
+			lv := make([]string, len(v.labels))
+			for i, l := range v.labels {
+				lv[i] = viewLabels[l](d)
+				if freeformLabels[l] {
+					lv[i] = scan.Labels.value(lv[i])
+				}
+			}
+			key := fmt.Sprintf("%q", lv)
+			counts[key]++
+			values[key] = lv
+		}
+		for key, n := range counts {
+			ch <- prometheus.MustNewConstMetric(v.desc, prometheus.GaugeValue, float64(n), values[key]...)
+		}
+	}
+}
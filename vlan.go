@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ScanInterface is one network to scan from its own interface, typically
+// a tagged VLAN subinterface trunked to this host (en0.10, eth0.20).
+type ScanInterface struct {
+	Name string `yaml:"name"`
+	// VLAN is the vlan label of the devices found here. It defaults to the
+	// ID in the interface name: the part after the last '.', or after a
+	// "vlan" prefix (vlan30).
+	VLAN string `yaml:"vlan"`
+	// CIDRs defaults to the interface's own IPv4 subnets.
+	CIDRs    []string `yaml:"cidrs"`
+	SourceIP string   `yaml:"source_ip"`
+}
+
+// scanNetwork is a range probed through one interface. Scan is the scan
+// config with the interface and source address of this network.
+type scanNetwork struct {
+	Interface string
+	VLAN      string
+	Range     scanRange
+	Scan      ScanConfig
+}
+
+// parseVLAN extracts the VLAN ID from a subinterface name, or "".
+func parseVLAN(iface string) string {
+	id := ""
+	if i := strings.LastIndexByte(iface, '.'); i >= 0 {
+		id = iface[i+1:]
+	} else if strings.HasPrefix(iface, "vlan") {
+		id = strings.TrimPrefix(iface, "vlan")
+	}
+	if id == "" || strings.Trim(id, "0123456789") != "" {
+		return ""
+	}
+	return id
+}
+
+// interfaceCIDRs lists the IPv4 subnets configured on iface.
+func interfaceCIDRs(name string) ([]string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses: %v", err)
+	}
+	var cidrs []string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(ipNet.String()); err == nil {
+			cidrs = append(cidrs, prefix.Masked().String())
+		}
+	}
+	if len(cidrs) == 0 {
+		return nil, fmt.Errorf("no IPv4 address")
+	}
+	return cidrs, nil
+}
+
+// parseScanNetworks returns the networks to scan: every scan.interfaces
+// entry, or network.cidrs through scan.interface when there are none.
+// The networks together are capped like a single range.
+func parseScanNetworks(c Config) ([]scanNetwork, error) {
+	if len(c.Scan.Interfaces) == 0 {
+		r, err := parseScanRange(c.Network.CIDRs)
+		if err != nil {
+			return nil, err
+		}
+		return []scanNetwork{{Interface: c.Scan.Interface, VLAN: parseVLAN(c.Scan.Interface), Range: r, Scan: c.Scan}}, nil
+	}
+	var (
+		networks []scanNetwork
+		total    int
+		names    = make(map[string]bool)
+	)
+	for i, si := range c.Scan.Interfaces {
+		if si.Name == "" {
+			return nil, fmt.Errorf("scan.interfaces[%d]: name is required", i)
+		}
+		if names[si.Name] {
+			return nil, fmt.Errorf("scan.interfaces: %s is listed twice", si.Name)
+		}
+		names[si.Name] = true
+		cidrs := si.CIDRs
+		if len(cidrs) == 0 {
+			if c.Remote != nil {
+				return nil, fmt.Errorf("scan.interfaces[%d]: cidrs is required when probing remotely", i)
+			}
+			var err error
+			if cidrs, err = interfaceCIDRs(si.Name); err != nil {
+				return nil, fmt.Errorf("scan.interfaces[%d] %s: %v", i, si.Name, err)
+			}
+		}
+		r, err := parseScanRange(cidrs)
+		if err != nil {
+			return nil, fmt.Errorf("scan.interfaces[%d] %s: %v", i, si.Name, err)
+		}
+		if total += len(r.addresses()); total > maxScanAddresses {
+			return nil, fmt.Errorf("scan.interfaces cover more than %d addresses", maxScanAddresses)
+		}
+		vlan := si.VLAN
+		if vlan == "" {
+			vlan = parseVLAN(si.Name)
+		}
+		scan := c.Scan
+		scan.Interface, scan.SourceIP = si.Name, si.SourceIP
+		networks = append(networks, scanNetwork{Interface: si.Name, VLAN: vlan, Range: r, Scan: scan})
+	}
+	return networks, nil
+}
+
+// scanNetworks returns the configured networks, or the default range if
+// the settings are invalid.
+func (c Config) scanNetworks() []scanNetwork {
+	networks, err := parseScanNetworks(c)
+	if err != nil {
+		errorLog.Printf("Invalid scan networks, using %s: %v", defaultCIDR, err)
+		r, _ := parseScanRange(nil)
+		return []scanNetwork{{Range: r, Scan: c.Scan}}
+	}
+	return networks
+}
+
+// validateScanNetworks checks that every network's interface exists and
+// has an address in its range.
+func validateScanNetworks(networks []scanNetwork) error {
+	for _, n := range networks {
+		if err := validateProbeSource(n.Scan, n.Range); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func vlanSuffix(vlan string) string {
+	if vlan == "" {
+		return ""
+	}
+	return " (vlan " + vlan + ")"
+}
+
+// combinedRange is the union of the networks' ranges.
+func combinedRange(networks []scanNetwork) scanRange {
+	var r scanRange
+	for _, n := range networks {
+		r = append(r, n.Range...)
+	}
+	return r
+}
+
+// networkFor returns the index of the network ip is probed through.
+// Overlapping ranges resolve to the network the neighbor entry came in
+// on, when iface is known, and otherwise to the first one listed.
+func networkFor(networks []scanNetwork, ip, iface string) int {
+	found := -1
+	parsed := net.ParseIP(ip)
+	for i, n := range networks {
+		if !n.Range.contains(parsed) {
+			continue
+		}
+		if iface != "" && n.Interface == iface {
+			return i
+		}
+		if found < 0 {
+			found = i
+		}
+	}
+	return found
+}
+
+// neighborVLANs maps every neighbor IP to the VLAN of its network.
+func neighborVLANs(networks []scanNetwork, entries []neighbor) map[string]string {
+	vlans := make(map[string]string)
+	for _, e := range entries {
+		if i := networkFor(networks, e.IP, e.Interface); i >= 0 && networks[i].VLAN != "" {
+			vlans[e.IP] = networks[i].VLAN
+		}
+	}
+	return vlans
+}
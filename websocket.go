@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+)
+
+type WebSocketConfig struct {
+	MaxConnections int `yaml:"max_connections"`
+	// SendBuffer is the number of queued events per client; clients that
+	// fall further behind are disconnected.
+	SendBuffer   int           `yaml:"send_buffer"`
+	PingInterval time.Duration `yaml:"ping_interval"`
+	// AllowedOrigins are the origins (e.g. https://grafana.lan:3000) whose
+	// pages may open the WebSocket and SSE streams besides the exporter's
+	// own; other browser pages are rejected, so a site a LAN user visits
+	// cannot read the device stream.
+	AllowedOrigins []string `yaml:"allowed_origins"`
+}
+
+func (c WebSocketConfig) withDefaults() WebSocketConfig {
+	if c.MaxConnections <= 0 {
+		c.MaxConnections = 16
+	}
+	if c.SendBuffer <= 0 {
+		c.SendBuffer = 64
+	}
+	if c.PingInterval <= 0 {
+		c.PingInterval = 30 * time.Second
+	}
+	return c
+}
+
+// originAllowed reports whether a stream may be served to the page the
+// request came from: no Origin (curl, scripts), the exporter's own or one
+// of AllowedOrigins.
+func (c WebSocketConfig) originAllowed(r *http.Request) bool {
+	if sameOrigin(r) {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	for _, allowed := range c.AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+var wsConnections atomic.Int64
+
+// errWebSocketVersion is a handshake for a protocol version other than
+// 13, answered with 426 and the version this server speaks.
+var errWebSocketVersion = errors.New("unsupported Sec-WebSocket-Version, want 13")
+
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	mu   sync.Mutex // serializes writes
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126, byte(n>>8), byte(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(payload); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// readFrame reads one client frame. Client frames are always masked;
+// control payloads are small, so anything above 4 KiB is rejected.
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.rw, head[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if !masked {
+		return 0, nil, errors.New("unmasked client frame")
+	}
+	if length > 4096 {
+		return 0, nil, errors.New("client frame too large")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		return nil, errors.New("not a websocket upgrade request")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errWebSocketVersion
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection does not support hijacking")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	accept := base64.StdEncoding.EncodeToString(sum[:])
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, rw: rw}, nil
+}
+
+func parseTypeFilter(r *http.Request) map[string]bool {
+	raw := r.URL.Query().Get("types")
+	if raw == "" {
+		return nil
+	}
+	filter := make(map[string]bool)
+	for _, t := range strings.Split(raw, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			filter[t] = true
+		}
+	}
+	return filter
+}
+
+// websocketHandler serves GET /api/v1/ws: an initial snapshot message
+// followed by the live event stream, optionally filtered with ?types=. The
+// snapshot holds the devices of the scanner ?scanner= names, or the first;
+// the stream carries the events of all of them.
+func websocketHandler(cfg WebSocketConfig) http.HandlerFunc {
+	cfg = cfg.withDefaults()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if wsConnections.Add(1) > int64(cfg.MaxConnections) {
+			wsConnections.Add(-1)
+			http.Error(w, "too many websocket connections", http.StatusServiceUnavailable)
+			return
+		}
+		defer wsConnections.Add(-1)
+
+		if !cfg.originAllowed(r) {
+			http.Error(w, "cross-origin request rejected", http.StatusForbidden)
+			return
+		}
+		s, ok := scannerFor(w, r)
+		if !ok {
+			return
+		}
+		filter := parseTypeFilter(r)
+		ws, err := upgradeWebSocket(w, r)
+		if errors.Is(err, errWebSocketVersion) {
+			// RFC 6455 section 4.2.2: name the versions this server speaks.
+			w.Header().Set("Sec-WebSocket-Version", "13")
+			http.Error(w, err.Error(), http.StatusUpgradeRequired)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer ws.conn.Close()
+
+		events, cancel := subscribe(cfg.SendBuffer)
+		defer cancel()
+
+		devices := []Device{}
+		if scan := s.currentScan(); scan != nil {
+			devices = scan.Devices
+		}
+		snapshot, _ := json.Marshal(Event{Type: "snapshot", Time: time.Now(), Fields: map[string]interface{}{"devices": devices}})
+		if err := ws.writeFrame(wsOpText, snapshot); err != nil {
+			return
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				ws.conn.SetReadDeadline(time.Now().Add(2 * cfg.PingInterval))
+				opcode, payload, err := ws.readFrame()
+				if err != nil {
+					return
+				}
+				switch opcode {
+				case wsOpClose:
+					ws.writeFrame(wsOpClose, nil)
+					return
+				case wsOpPing:
+					ws.writeFrame(wsOpPong, payload)
+				}
+			}
+		}()
+
+		ticker := time.NewTicker(cfg.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := ws.writeFrame(wsOpPing, nil); err != nil {
+					return
+				}
+			case ev, ok := <-events:
+				if !ok {
+					// Too slow to keep up; the client should reconnect.
+					ws.writeFrame(wsOpClose, []byte{0x03, 0xF0})
+					return
+				}
+				if filter != nil && !filter[ev.Type] {
+					continue
+				}
+				data, err := json.Marshal(ev)
+				if err != nil {
+					continue
+				}
+				if err := ws.writeFrame(wsOpText, data); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientFrame encodes a frame as a client sends it: final, masked with
+// mask unless it is nil.
+func clientFrame(opcode byte, payload []byte, mask []byte) []byte {
+	frame := []byte{0x80 | opcode}
+	bit := byte(0)
+	if mask != nil {
+		bit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, bit|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, bit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, bit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if mask == nil {
+		return append(frame, payload...)
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// readServerFrame decodes an unmasked server frame.
+func readServerFrame(t *testing.T, r io.Reader) (byte, []byte) {
+	t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	if head[0]&0x80 == 0 {
+		t.Fatal("server frame is not final")
+	}
+	if head[1]&0x80 != 0 {
+		t.Fatal("server frame is masked")
+	}
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(r, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return head[0] & 0x0F, payload
+}
+
+func TestWriteFrame(t *testing.T) {
+	for _, n := range []int{0, 1, 125, 126, 0xFFFF, 0x10000} {
+		server, client := net.Pipe()
+		ws := &wsConn{conn: server, rw: bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server))}
+		payload := bytes.Repeat([]byte{'x'}, n)
+		errc := make(chan error, 1)
+		go func() { errc <- ws.writeFrame(wsOpText, payload) }()
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		opcode, got := readServerFrame(t, client)
+		if err := <-errc; err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if opcode != wsOpText || !bytes.Equal(got, payload) {
+			t.Errorf("%d bytes: got opcode %#x and %d bytes", n, opcode, len(got))
+		}
+		server.Close()
+		client.Close()
+	}
+}
+
+func TestWriteFrameHeader(t *testing.T) {
+	for _, tc := range []struct {
+		n    int
+		want []byte
+	}{
+		{5, []byte{0x89, 5}},
+		{126, []byte{0x89, 126, 0, 126}},
+		{0x10000, []byte{0x89, 127, 0, 0, 0, 0, 0, 1, 0, 0}},
+	} {
+		server, client := net.Pipe()
+		ws := &wsConn{conn: server, rw: bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server))}
+		go ws.writeFrame(wsOpPing, make([]byte, tc.n))
+		got := make([]byte, len(tc.want))
+		if _, err := io.ReadFull(client, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("%d bytes: header %x, want %x", tc.n, got, tc.want)
+		}
+		server.Close()
+		client.Close()
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	mask := []byte{0x37, 0xFA, 0x21, 0x3D}
+	for _, tc := range []struct {
+		name    string
+		frame   []byte
+		opcode  byte
+		payload string
+		err     string
+	}{
+		// RFC 6455 section 5.7: a masked "Hello".
+		{"rfc example", []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}, wsOpText, "Hello", ""},
+		{"ping", clientFrame(wsOpPing, []byte("are you there"), mask), wsOpPing, "are you there", ""},
+		{"empty close", clientFrame(wsOpClose, nil, mask), wsOpClose, "", ""},
+		{"16-bit length", clientFrame(wsOpText, bytes.Repeat([]byte{'a'}, 300), mask), wsOpText, strings.Repeat("a", 300), ""},
+		{"unmasked", clientFrame(wsOpText, []byte("hi"), nil), 0, "", "unmasked client frame"},
+		{"too large", clientFrame(wsOpText, make([]byte, 4097), mask), 0, "", "client frame too large"},
+		{"64-bit length", clientFrame(wsOpText, make([]byte, 0x10000), mask), 0, "", "client frame too large"},
+		{"truncated header", []byte{0x81}, 0, "", "EOF"},
+		{"truncated mask", []byte{0x81, 0x85, 0x37}, 0, "", "EOF"},
+		{"truncated payload", clientFrame(wsOpText, []byte("Hello"), mask)[:8], 0, "", "EOF"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ws := &wsConn{rw: bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(tc.frame)), nil)}
+			opcode, payload, err := ws.readFrame()
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("got %v, want an error containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil || opcode != tc.opcode || string(payload) != tc.payload {
+				t.Errorf("got %#x %q %v, want %#x %q", opcode, payload, err, tc.opcode, tc.payload)
+			}
+		})
+	}
+}
+
+func TestParseTypeFilter(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  map[string]bool
+	}{
+		{"", nil},
+		{"types=device_joined", map[string]bool{"device_joined": true}},
+		{"types=device_joined,%20device_left%20,,", map[string]bool{"device_joined": true, "device_left": true}},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/ws?"+tc.query, nil)
+		got := parseTypeFilter(r)
+		if len(got) != len(tc.want) || (tc.want == nil) != (got == nil) {
+			t.Errorf("%q: got %v, want %v", tc.query, got, tc.want)
+			continue
+		}
+		for k := range tc.want {
+			if !got[k] {
+				t.Errorf("%q: got %v, want %v", tc.query, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestWebSocketHandler(t *testing.T) {
+	withScanner(t)
+	srv := httptest.NewServer(websocketHandler(WebSocketConfig{PingInterval: time.Minute}))
+	defer srv.Close()
+
+	t.Run("plain request", func(t *testing.T) {
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("got %s, want 400", resp.Status)
+		}
+	})
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: exporter\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got %s, want 101", resp.Status)
+	}
+	// The accept key of the sample nonce in RFC 6455 section 1.3.
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept %q", got)
+	}
+
+	opcode, payload := readServerFrame(t, br)
+	var snapshot Event
+	if err := json.Unmarshal(payload, &snapshot); opcode != wsOpText || err != nil || snapshot.Type != "snapshot" {
+		t.Fatalf("first frame %#x %s (%v), want the snapshot", opcode, payload, err)
+	}
+
+	mask := []byte{1, 2, 3, 4}
+	conn.Write(clientFrame(wsOpPing, []byte("p1"), mask))
+	if opcode, payload := readServerFrame(t, br); opcode != wsOpPong || string(payload) != "p1" {
+		t.Errorf("ping answered with %#x %q, want a pong echoing p1", opcode, payload)
+	}
+	conn.Write(clientFrame(wsOpClose, nil, mask))
+	if opcode, _ := readServerFrame(t, br); opcode != wsOpClose {
+		t.Errorf("close answered with %#x", opcode)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("connection still open after the close handshake (%v)", err)
+	}
+}
+
+func TestStreamHandshakeRejects(t *testing.T) {
+	withScanner(t)
+	cfg := WebSocketConfig{PingInterval: time.Minute, AllowedOrigins: []string{"https://grafana.lan:3000/"}}
+	upgrade := map[string]string{
+		"Upgrade": "websocket", "Connection": "Upgrade",
+		"Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ==", "Sec-WebSocket-Version": "13",
+	}
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+		headers map[string]string
+		want    int
+	}{
+		{"ws from another site", websocketHandler(cfg), map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+		{"ws with a bad origin", websocketHandler(cfg), map[string]string{"Origin": "::"}, http.StatusForbidden},
+		{"ws without a version", websocketHandler(cfg), map[string]string{"Sec-WebSocket-Version": ""}, http.StatusUpgradeRequired},
+		{"ws with version 8", websocketHandler(cfg), map[string]string{"Sec-WebSocket-Version": "8"}, http.StatusUpgradeRequired},
+		{"sse from another site", eventStreamHandler(cfg), map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://exporter:2112/api/v1/ws", nil)
+			for k, v := range upgrade {
+				r.Header.Set(k, v)
+			}
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			tc.handler(rec, r)
+			if rec.Code != tc.want {
+				t.Errorf("got %d, want %d", rec.Code, tc.want)
+			}
+			if tc.want == http.StatusUpgradeRequired && rec.Header().Get("Sec-WebSocket-Version") != "13" {
+				t.Errorf("426 without Sec-WebSocket-Version: 13 (%v)", rec.Header())
+			}
+		})
+	}
+}
+
+func TestOriginAllowed(t *testing.T) {
+	cfg := WebSocketConfig{AllowedOrigins: []string{"https://grafana.lan:3000/"}}
+	for _, tc := range []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://exporter:2112", true},
+		{"https://grafana.lan:3000", true},
+		{"HTTPS://GRAFANA.LAN:3000", true},
+		{"https://grafana.lan", false},
+		{"http://exporter.evil.example", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://exporter:2112/api/v1/ws", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if got := cfg.originAllowed(r); got != tc.want {
+			t.Errorf("origin %q: got %v, want %v", tc.origin, got, tc.want)
+		}
+	}
+}